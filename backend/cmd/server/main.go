@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"docStream/backend/internal/auth"
@@ -47,7 +50,14 @@ func main() {
 	docService := document.NewService(repo)
 	authService := auth.NewService(repo)
 
-	hub := realtime.NewHub(docService)
+	hubConfig := realtime.Config{}
+	if redisAddr := os.Getenv("REDIS_ADDR"); redisAddr != "" {
+		broker := realtime.NewRedisBroker(redisAddr)
+		defer broker.Close()
+		hubConfig.Broker = broker
+		log.Printf("Realtime fan-out through Redis at %s\n", redisAddr)
+	}
+	hub := realtime.NewHub(docService, hubConfig)
 	api := httpapi.New(docService, authService)
 
 	mux := http.NewServeMux()
@@ -55,10 +65,13 @@ func main() {
 		fmt.Fprint(w, "DocStream Backend is Running with Postgres!")
 	})
 	mux.Handle("/api/", http.StripPrefix("/api", api))
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Add token validation for WS
-		hub.ServeWS(w, r)
-	})
+	mux.HandleFunc("/ws", hub.ServeWS)
+	mux.HandleFunc("/ws/multi", hub.ServeMultiplexed)
+	mux.HandleFunc("/ws/tenant", hub.ServeTenant)
+	// Fallback for clients whose proxies strip websocket upgrades.
+	mux.HandleFunc("/sse", hub.ServeSSE)
+	mux.HandleFunc("/poll", hub.ServePoll)
+	mux.HandleFunc("/send", hub.ServeSend)
 
 	port := getEnv("PORT", "8080")
 	server := &http.Server{
@@ -68,10 +81,29 @@ func main() {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Stop on SIGINT/SIGTERM: finish in-flight requests, then close rooms so
+	// queued edits are applied before the process exits.
+	stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-stopCtx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP shutdown: %v\n", err)
+		}
+		if err := hub.Close(shutdownCtx); err != nil {
+			log.Printf("Realtime shutdown: %v\n", err)
+		}
+	}()
+
 	log.Printf("Server started on port %s\n", port)
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal("Server failed to start: ", err)
 	}
+	<-shutdownDone
 }
 
 func getEnv(key, fallback string) string {
@@ -91,7 +123,7 @@ func withCORS(next http.Handler) http.Handler {
 		// The API's ServeHTTP handles its own OPTIONS, so we can skip this for /api
 		// or just set them here generally.
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		
 		if r.Method == http.MethodOptions {
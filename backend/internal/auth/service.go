@@ -15,6 +15,15 @@ import (
 var secret = os.Getenv("SECRET_KEY")
 var SecretKey = []byte(secret) // In prod, read from env
 
+// ErrInvalidToken is returned when a bearer token is missing, malformed or expired.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims is the identity carried by a login token.
+type Claims struct {
+	UserID string
+	Email  string
+}
+
 type Service struct {
 	repo document.Repository
 }
@@ -68,3 +77,24 @@ func (s *Service) Login(ctx context.Context, email, password string) (string, st
 	signed, err := token.SignedString(SecretKey)
 	return signed, user.ID, err
 }
+
+// ParseToken validates a token issued by Login and returns its claims.
+func ParseToken(tokenString string) (Claims, error) {
+	if tokenString == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return SecretKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return Claims{}, ErrInvalidToken
+	}
+	userID, _ := claims["sub"].(string)
+	if userID == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	email, _ := claims["email"].(string)
+	return Claims{UserID: userID, Email: email}, nil
+}
+
@@ -0,0 +1,53 @@
+package document
+
+import "time"
+
+// rank orders access levels so they can be compared.
+func (l AccessLevel) rank() int {
+	switch l {
+	case AccessView:
+		return 1
+	case AccessComment:
+		return 2
+	case AccessEdit:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// Allows reports whether l grants at least the access of want.
+func (l AccessLevel) Allows(want AccessLevel) bool {
+	return l.rank() > 0 && l.rank() >= want.rank()
+}
+
+// AccessFor resolves a user's access to the document. Owners always edit;
+// everyone else needs an explicit permission.
+func (d Document) AccessFor(userID string) (AccessLevel, bool) {
+	if userID != "" && userID == d.OwnerID {
+		return AccessEdit, true
+	}
+	level, ok := d.Permissions[userID]
+	if !ok || level.rank() == 0 {
+		return "", false
+	}
+	return level, true
+}
+
+// AccessForLink resolves the access granted by a share link token, ignoring
+// expired links.
+func (d Document) AccessForLink(token string, now time.Time) (AccessLevel, bool) {
+	if token == "" {
+		return "", false
+	}
+	for _, link := range d.ShareLinks {
+		if link.Token != token {
+			continue
+		}
+		if link.ExpiresAt != nil && now.After(*link.ExpiresAt) {
+			return "", false
+		}
+		return link.Level, link.Level.rank() > 0
+	}
+	return "", false
+}
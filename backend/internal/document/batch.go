@@ -0,0 +1,275 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// MaxBatchOperations caps the edits one batch may carry.
+const MaxBatchOperations = 1000
+
+// Reasons a batch cannot be merged, reported in BatchConflict.Reason.
+const (
+	// ConflictHistoryUnavailable means the log no longer reaches back to the
+	// batch's base version, so there is nothing to rebase it over.
+	ConflictHistoryUnavailable = "history_unavailable"
+	// ConflictOverlap means some edits change text that concurrent
+	// operations changed too; see BatchConflict.Overlaps.
+	ConflictOverlap = "overlap"
+)
+
+// BatchOperation is one edit of a batch: a text delta against the document
+// as the previous edit left it, the first one against the batch's base.
+type BatchOperation struct {
+	Delta string `json:"delta"`
+	// Seq numbers the edit within the sender's session, as in
+	// ApplyOperationInput.
+	Seq int64 `json:"seq,omitempty"`
+}
+
+// ApplyBatchInput is a run of edits made without a connection to the
+// server, all built on BaseVersion.
+type ApplyBatchInput struct {
+	TenantID    string
+	DocumentID  string
+	UserID      string
+	BaseVersion int64
+	Operations  []BatchOperation
+	Lamport     int64
+	Session     string
+	// Force merges edits that overlap concurrent changes instead of
+	// reporting a conflict.
+	Force bool
+}
+
+// BatchResult lists what a batch committed, oldest first.
+type BatchResult struct {
+	Document   Document
+	Operations []Operation
+	// Versions holds the snapshot each operation produced, or the zero
+	// value; it runs parallel to Operations.
+	Versions []DocumentVersion
+	// Acknowledged counts leading edits the log already held under the
+	// sender's session, say from before a dropped connection. They are not
+	// applied again.
+	Acknowledged int
+}
+
+// BatchConflict explains why a batch was not merged. Nothing in the batch
+// is committed.
+type BatchConflict struct {
+	Reason      string         `json:"reason"`
+	BaseVersion int64          `json:"baseVersion"`
+	HeadVersion int64          `json:"headVersion"`
+	Overlaps    []BatchOverlap `json:"overlaps,omitempty"`
+}
+
+// BatchOverlap pairs an edit with a concurrent operation that changed the
+// same text.
+type BatchOverlap struct {
+	Index   int    `json:"index"`   // position in ApplyBatchInput.Operations
+	Version int64  `json:"version"` // the concurrent operation
+	UserID  string `json:"userId"`
+}
+
+func (c *BatchConflict) Error() string {
+	return fmt.Sprintf("%v: %s between versions %d and %d", ErrBatchConflict, c.Reason, c.BaseVersion, c.HeadVersion)
+}
+
+func (c *BatchConflict) Unwrap() error { return ErrBatchConflict }
+
+// ApplyBatch rebases a batch of edits onto the head and commits them one
+// operation each. It returns a *BatchConflict when the batch cannot be
+// merged automatically. Should a commit fail partway, the result lists the
+// operations committed before it.
+func (s *Service) ApplyBatch(ctx context.Context, in ApplyBatchInput) (BatchResult, error) {
+	if n := len(in.Operations); n == 0 || n > MaxBatchOperations {
+		return BatchResult{}, fmt.Errorf("%w: %d operations, want 1 to %d", ErrInvalidBatch, n, MaxBatchOperations)
+	}
+	if in.BaseVersion <= 0 {
+		return BatchResult{}, fmt.Errorf("%w: base version is required", ErrInvalidBatch)
+	}
+	doc, err := s.repo.GetDocument(ctx, in.TenantID, in.DocumentID)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	if in.BaseVersion > doc.Version {
+		return BatchResult{}, fmt.Errorf("%w: base %d, head %d", ErrBaseVersionAhead, in.BaseVersion, doc.Version)
+	}
+
+	edits := make([]TextOperation, len(in.Operations))
+	for i, b := range in.Operations {
+		if edits[i], err = ParseDelta(b.Delta); err != nil {
+			return BatchResult{}, fmt.Errorf("%w: operation %d: %v", ErrInvalidDelta, i, err)
+		}
+	}
+	history, err := s.OperationsSince(ctx, in.TenantID, in.DocumentID, in.BaseVersion, 0)
+	if err != nil && !errors.Is(err, ErrHistoryUnavailable) {
+		return BatchResult{}, err
+	}
+	if err != nil || int64(len(history)) != doc.Version-in.BaseVersion {
+		return BatchResult{}, &BatchConflict{Reason: ConflictHistoryUnavailable, BaseVersion: in.BaseVersion, HeadVersion: doc.Version}
+	}
+
+	pending, acked, overlaps, err := rebaseBatch(in, edits, history)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	if len(overlaps) > 0 && !in.Force {
+		return BatchResult{}, &BatchConflict{Reason: ConflictOverlap, BaseVersion: in.BaseVersion, HeadVersion: doc.Version, Overlaps: overlaps}
+	}
+
+	result := BatchResult{Document: doc, Acknowledged: acked}
+	for i := 0; i < len(pending); i++ {
+		base := doc.Version
+		apply := ApplyOperationInput{
+			TenantID:    in.TenantID,
+			DocumentID:  in.DocumentID,
+			UserID:      in.UserID,
+			BaseVersion: base,
+			Lamport:     in.Lamport,
+			Session:     in.Session,
+			Seq:         in.Operations[acked+i].Seq,
+		}
+		// As with undo, CRDT documents take the edit as text and derive
+		// their own ops from it once it is rebased onto the head.
+		if doc.Engine == EngineCRDT {
+			apply.edit = &pending[i]
+		} else {
+			apply.Delta = pending[i].String()
+		}
+		var op Operation
+		var version DocumentVersion
+		if doc, op, version, err = s.ApplyOperation(ctx, apply); err != nil {
+			return result, fmt.Errorf("apply batch operation %d: %w", acked+i, err)
+		}
+		result.Document = doc
+		result.Operations = append(result.Operations, op)
+		result.Versions = append(result.Versions, version)
+
+		// The edit was rebased over anything another writer committed
+		// meanwhile; the rest of the batch follows it over the same.
+		if op.Version > base+1 && i+1 < len(pending) {
+			history, err := s.OperationsSince(ctx, in.TenantID, in.DocumentID, base, int(op.Version-base-1))
+			if err == nil && int64(len(history)) != op.Version-base-1 {
+				err = ErrHistoryUnavailable
+			}
+			if err == nil {
+				err = rebaseEdits(pending[i:], history)
+			}
+			if err != nil {
+				return result, fmt.Errorf("rebase batch operation %d: %w", acked+i+1, err)
+			}
+		}
+	}
+	return result, nil
+}
+
+// rebaseEdits transforms a run of edits, each following the one before,
+// past history in log order.
+func rebaseEdits(edits []TextOperation, history []Operation) error {
+	for _, h := range history {
+		concurrent, err := h.TextEffect()
+		if err != nil {
+			return fmt.Errorf("operation %s: %w", h.ID, err)
+		}
+		for i := range edits {
+			if concurrent, edits[i], err = Transform(concurrent, edits[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebaseBatch transforms edits past the operations committed since their
+// base, in log order. An operation from the sender's own session carrying the
+// next edit's seq is that edit, committed earlier; it is dropped rather than
+// rebased, and acked counts how many were. Edits touching text a concurrent
+// operation also changed are listed in overlaps.
+func rebaseBatch(in ApplyBatchInput, edits []TextOperation, history []Operation) (pending []TextOperation, acked int, overlaps []BatchOverlap, err error) {
+	pending = edits
+	for _, h := range history {
+		if len(pending) > 0 && in.Session != "" && h.UserID == in.UserID && h.Session == in.Session && h.Seq > 0 && h.Seq == in.Operations[acked].Seq {
+			pending = pending[1:]
+			acked++
+			continue
+		}
+		concurrent, err := h.TextEffect()
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("operation %s: %w", h.ID, err)
+		}
+		for i := range pending {
+			if changesSameText(concurrent, pending[i]) {
+				overlaps = append(overlaps, BatchOverlap{Index: acked + i, Version: h.Version, UserID: h.UserID})
+			}
+			if concurrent, pending[i], err = Transform(concurrent, pending[i]); err != nil {
+				return nil, 0, nil, fmt.Errorf("rebase operation %d over %s: %w", acked+i, h.ID, err)
+			}
+		}
+	}
+	return pending, acked, overlaps, nil
+}
+
+// deletedSpan is a run of text an operation deletes, [start, end) in the
+// document before it. replaced is set when the operation also inserts at or
+// inside the run.
+type deletedSpan struct {
+	start, end int
+	replaced   bool
+}
+
+// changesSameText reports whether a and b, made against the same document,
+// conflict: one inserts strictly inside text the other deletes, or both
+// delete overlapping text and at least one writes something in its place.
+// Deleting the same text twice or typing at the same spot merges cleanly.
+func changesSameText(a, b TextOperation) bool {
+	aDeleted, aInserts := editSpans(a)
+	bDeleted, bInserts := editSpans(b)
+	for _, d := range aDeleted {
+		for _, p := range bInserts {
+			if d.start < p && p < d.end {
+				return true
+			}
+		}
+		for _, e := range bDeleted {
+			if max(d.start, e.start) < min(d.end, e.end) && (d.replaced || e.replaced) {
+				return true
+			}
+		}
+	}
+	for _, d := range bDeleted {
+		for _, p := range aInserts {
+			if d.start < p && p < d.end {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// editSpans lists what o deletes and where it inserts, in positions of the
+// document before it.
+func editSpans(o TextOperation) (deleted []deletedSpan, inserts []int) {
+	pos := 0
+	for _, c := range o.Ops {
+		switch {
+		case c.Retain > 0:
+			pos += c.Retain
+		case c.Delete > 0:
+			deleted = append(deleted, deletedSpan{start: pos, end: pos + c.Delete})
+			pos += c.Delete
+		case c.Insert != "":
+			inserts = append(inserts, pos)
+		}
+	}
+	for i := range deleted {
+		for _, p := range inserts {
+			if deleted[i].start <= p && p <= deleted[i].end {
+				deleted[i].replaced = true
+			}
+		}
+	}
+	return deleted, inserts
+}
@@ -0,0 +1,143 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// hookedRepository runs beforeCommit once, just ahead of the next
+// CommitOperation, to slip in another writer's change.
+type hookedRepository struct {
+	*InMemoryRepository
+	beforeCommit func()
+}
+
+func (r *hookedRepository) CommitOperation(ctx context.Context, doc Document, op Operation) error {
+	if hook := r.beforeCommit; hook != nil {
+		r.beforeCommit = nil
+		hook()
+	}
+	return r.InMemoryRepository.CommitOperation(ctx, doc, op)
+}
+
+func TestApplyBatch(t *testing.T) {
+	for _, engine := range []string{EngineOT, EngineCRDT} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := context.Background()
+			setup := func(t *testing.T) (*Service, *hookedRepository, Document) {
+				repo := &hookedRepository{InMemoryRepository: NewInMemoryRepository()}
+				svc := NewService(repo)
+				doc, err := svc.CreateDocument(ctx, "t", "u", "x", "hello world", engine)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return svc, repo, doc
+			}
+			// peer replaces the head, which every engine accepts.
+			peer := func(t *testing.T, svc *Service, doc Document, content string) {
+				t.Helper()
+				if _, _, _, err := svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "peer", NewContent: content}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			batch := func(doc Document, base int64, deltas ...string) ApplyBatchInput {
+				in := ApplyBatchInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", BaseVersion: base, Session: "s"}
+				for i, d := range deltas {
+					in.Operations = append(in.Operations, BatchOperation{Delta: d, Seq: int64(i + 1)})
+				}
+				return in
+			}
+			content := func(t *testing.T, svc *Service, doc Document) string {
+				t.Helper()
+				got, err := svc.GetDocument(ctx, "t", doc.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return got.Content
+			}
+
+			t.Run("rebases over concurrent operations", func(t *testing.T) {
+				svc, _, doc := setup(t)
+				peer(t, svc, doc, "Hello world")
+				res, err := svc.ApplyBatch(ctx, batch(doc, doc.Version, `[11,"!"]`, `[12,"?"]`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res.Operations) != 2 || res.Document.Version != doc.Version+3 {
+					t.Fatalf("committed %d operations up to version %d", len(res.Operations), res.Document.Version)
+				}
+				if got := content(t, svc, doc); got != "Hello world!?" {
+					t.Fatalf("content = %q", got)
+				}
+			})
+
+			t.Run("keeps edits committed while it applies", func(t *testing.T) {
+				svc, repo, doc := setup(t)
+				repo.beforeCommit = func() { peer(t, svc, doc, ">hello world") }
+				if _, err := svc.ApplyBatch(ctx, batch(doc, doc.Version, `[11,"!"]`, `[12,"?"]`)); err != nil {
+					t.Fatal(err)
+				}
+				if got := content(t, svc, doc); got != ">hello world!?" {
+					t.Fatalf("content = %q", got)
+				}
+			})
+
+			t.Run("skips operations already committed", func(t *testing.T) {
+				svc, _, doc := setup(t)
+				if _, _, _, err := svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", NewContent: "hello world!", Session: "s", Seq: 1}); err != nil {
+					t.Fatal(err)
+				}
+				res, err := svc.ApplyBatch(ctx, batch(doc, doc.Version, `[11,"!"]`, `[12,"?"]`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Acknowledged != 1 || len(res.Operations) != 1 {
+					t.Fatalf("acknowledged %d, committed %d", res.Acknowledged, len(res.Operations))
+				}
+				if got := content(t, svc, doc); got != "hello world!?" {
+					t.Fatalf("content = %q", got)
+				}
+			})
+
+			t.Run("reports overlapping edits", func(t *testing.T) {
+				svc, _, doc := setup(t)
+				peer(t, svc, doc, "hello ")
+				in := batch(doc, doc.Version, `[6,-3,"WOR",2]`)
+				_, err := svc.ApplyBatch(ctx, in)
+				var conflict *BatchConflict
+				if !errors.As(err, &conflict) || conflict.Reason != ConflictOverlap {
+					t.Fatalf("err = %v, want an overlap conflict", err)
+				}
+				if len(conflict.Overlaps) != 1 || conflict.Overlaps[0].Index != 0 || conflict.Overlaps[0].UserID != "peer" {
+					t.Fatalf("overlaps = %+v", conflict.Overlaps)
+				}
+				if got := content(t, svc, doc); got != "hello " {
+					t.Fatalf("conflicting batch changed the document: %q", got)
+				}
+
+				in.Force = true
+				if _, err := svc.ApplyBatch(ctx, in); err != nil {
+					t.Fatal(err)
+				}
+				if got := content(t, svc, doc); got != "hello WOR" {
+					t.Fatalf("forced content = %q", got)
+				}
+			})
+
+			t.Run("reports operations committed before a failure", func(t *testing.T) {
+				svc, _, doc := setup(t)
+				res, err := svc.ApplyBatch(ctx, batch(doc, doc.Version, `[11,"!"]`, `[3,"?"]`))
+				if err == nil {
+					t.Fatal("batch with a malformed second operation succeeded")
+				}
+				if len(res.Operations) != 1 || res.Document.Version != doc.Version+1 {
+					t.Fatalf("result lists %d operations at version %d", len(res.Operations), res.Document.Version)
+				}
+				if got := content(t, svc, doc); got != "hello world!" {
+					t.Fatalf("content = %q", got)
+				}
+			})
+		})
+	}
+}
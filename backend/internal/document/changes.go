@@ -0,0 +1,55 @@
+package document
+
+// ChangeKind names a change made to a document outside its edit stream.
+type ChangeKind string
+
+const (
+	// ChangePermission: a user's access level was set or revoked.
+	ChangePermission ChangeKind = "permission"
+	// ChangeShareLink: a share link was created.
+	ChangeShareLink ChangeKind = "share_link"
+	// ChangeReverted: the content was restored from history.
+	ChangeReverted ChangeKind = "reverted"
+	// ChangeTitle: the document was renamed.
+	ChangeTitle ChangeKind = "title"
+	// ChangeCreated: the document was created.
+	ChangeCreated ChangeKind = "created"
+	// ChangeDeleted: the document and its history were deleted.
+	ChangeDeleted ChangeKind = "deleted"
+)
+
+// Change describes a stored change that open editing sessions should hear
+// about. It travels between instances as JSON.
+type Change struct {
+	Kind       ChangeKind  `json:"kind"`
+	TenantID   string      `json:"tenantId"`
+	DocumentID string      `json:"documentId"`
+	UserID     string      `json:"userId,omitempty"`    // who made the change, when known
+	SubjectID  string      `json:"subjectId,omitempty"` // permission: whose access changed
+	Level      AccessLevel `json:"level,omitempty"`     // permission, share_link: the level granted; empty when revoked
+	Title      string      `json:"title,omitempty"`     // title: the new title
+	Version    int64       `json:"version"`             // document version after the change
+	Operation  *Operation  `json:"operation,omitempty"` // reverted: the operation logged for the revert
+
+	// Document is the document after the change, or as it was before it
+	// for ChangeDeleted. It is not sent to other instances.
+	Document *Document `json:"-"`
+}
+
+// OnChange registers fn to be called after every Change. fn runs on the
+// goroutine that made the change, after it was stored, so it should hand
+// the change off rather than do slow work.
+func (s *Service) OnChange(fn func(Change)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+func (s *Service) emit(change Change) {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, fn := range listeners {
+		fn(change)
+	}
+}
@@ -0,0 +1,51 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+// Checksum returns a short hash of content that clients compare with their
+// own copy to notice drift: FNV-1a (32-bit) over the UTF-8 bytes, as eight
+// hex digits.
+func Checksum(content string) string {
+	h := fnv.New32a()
+	_, _ = io.WriteString(h, content)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// ChecksumAt returns the checksum of a document's content as of version, or
+// "" when that version can no longer be reconstructed.
+func (s *Service) ChecksumAt(ctx context.Context, tenantID, documentID string, version int64) (string, error) {
+	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case version > doc.Version:
+		return "", fmt.Errorf("%w: version %d, head %d", ErrBaseVersionAhead, version, doc.Version)
+	case version == doc.Version:
+		return Checksum(doc.Content), nil
+	}
+
+	// Operations logged before checksums were recorded have none; rebuild
+	// the content for those.
+	ops, err := s.repo.ListOperations(ctx, tenantID, documentID, version-1, 1)
+	if err != nil {
+		return "", fmt.Errorf("list operations: %w", err)
+	}
+	if len(ops) == 1 && ops[0].Version == version && ops[0].Checksum != "" {
+		return ops[0].Checksum, nil
+	}
+	v, err := s.VersionAt(ctx, tenantID, documentID, version)
+	if errors.Is(err, ErrHistoryUnavailable) || errors.Is(err, ErrVersionNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return Checksum(v.Content), nil
+}
@@ -0,0 +1,83 @@
+package document
+
+import "fmt"
+
+// Ordering: Version is the server-assigned position of an operation in a
+// document's log and the order every replay uses. Lamport timestamps are
+// assigned here too; a client's clock only ever pushes the document's
+// forward. Each editing session numbers its operations with Seq so the
+// server can drop retransmissions and refuse an operation whose predecessor
+// from the same session never arrived. Session IDs are chosen by clients, so
+// clocks are kept per user and session; one user cannot touch another's.
+
+// clockRetention is how many versions a session may go without editing
+// before its clock is forgotten.
+const clockRetention = 10000
+
+// SessionClock is the last operation accepted from one editing session.
+type SessionClock struct {
+	Seq     int64 `json:"seq"`
+	Version int64 `json:"version"` // document version that operation produced
+}
+
+// checkCausality refuses operations built on state the server has not
+// produced: a base version or Lamport timestamp beyond any it has issued,
+// or a session sequence that skips one of the session's own operations. It
+// holds for every engine, whether or not the engine uses the base.
+func checkCausality(doc Document, in ApplyOperationInput) error {
+	if in.BaseVersion > doc.Version {
+		return fmt.Errorf("%w: base %d, head %d", ErrBaseVersionAhead, in.BaseVersion, doc.Version)
+	}
+	if in.Lamport > doc.Lamport+1 {
+		return fmt.Errorf("%w: lamport %d, document clock %d", ErrCausalBaseUnseen, in.Lamport, doc.Lamport)
+	}
+	if in.Session == "" || in.Seq <= 0 {
+		return nil
+	}
+	last, ok := doc.Clocks[sessionKey(in.UserID, in.Session)]
+	if !ok {
+		// First operation seen from this session, or one forgotten after
+		// clockRetention versions; either way there is nothing to compare.
+		return nil
+	}
+	if in.Seq <= last.Seq {
+		return fmt.Errorf("%w: session %s already sent %d", ErrDuplicateOperation, in.Session, last.Seq)
+	}
+	if in.Seq > last.Seq+1 {
+		return fmt.Errorf("%w: session %s sent %d after %d", ErrCausalBaseUnseen, in.Session, in.Seq, last.Seq)
+	}
+	return nil
+}
+
+// advanceClocks stamps op with the next Lamport time and records the
+// sender's sequence on doc. op.Version must already be set.
+func advanceClocks(doc *Document, op *Operation, in ApplyOperationInput) {
+	doc.Lamport = max(doc.Lamport, in.Lamport) + 1
+	op.Lamport = doc.Lamport
+	if in.Session == "" || in.Seq <= 0 {
+		return
+	}
+	op.Session, op.Seq = in.Session, in.Seq
+
+	// Copy before writing; the repository may share the map with readers.
+	clocks := make(map[string]SessionClock, len(doc.Clocks)+1)
+	for session, clock := range doc.Clocks {
+		if op.Version-clock.Version <= clockRetention {
+			clocks[session] = clock
+		}
+	}
+	clocks[sessionKey(in.UserID, in.Session)] = SessionClock{Seq: in.Seq, Version: op.Version}
+	doc.Clocks = clocks
+}
+
+// SessionSeq returns the last sequence number accepted from userID's
+// session, or 0.
+func (d Document) SessionSeq(userID, session string) int64 {
+	return d.Clocks[sessionKey(userID, session)].Seq
+}
+
+// sessionKey names a session's entry in Document.Clocks. User IDs are
+// generated hex, so the separator cannot be forged.
+func sessionKey(userID, session string) string {
+	return userID + "/" + session
+}
@@ -0,0 +1,158 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestSessionSequence(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(NewInMemoryRepository())
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "", EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(userID, session string, seq int64, content string) error {
+		_, _, _, err := svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: userID, NewContent: content, Session: session, Seq: seq})
+		return err
+	}
+
+	if err := apply("u", "s", 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply("u", "s", 2, "ab"); err != nil {
+		t.Fatal(err)
+	}
+	// A retransmission is dropped, not applied twice.
+	for _, seq := range []int64{1, 2} {
+		if err := apply("u", "s", seq, "abX"); !errors.Is(err, ErrDuplicateOperation) {
+			t.Fatalf("seq %d again: err = %v, want ErrDuplicateOperation", seq, err)
+		}
+	}
+	// Skipping a sequence number means an operation went missing.
+	if err := apply("u", "s", 4, "abX"); !errors.Is(err, ErrCausalBaseUnseen) {
+		t.Fatalf("seq gap: err = %v, want ErrCausalBaseUnseen", err)
+	}
+	// Another user's session of the same name has its own clock.
+	if err := apply("v", "s", 1, "abv"); err != nil {
+		t.Fatalf("other user's first operation: %v", err)
+	}
+	if err := apply("u", "s", 3, "abvc"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := svc.GetDocument(ctx, "t", doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "abvc" || got.Version != doc.Version+4 {
+		t.Fatalf("document is %q at %d; refused operations were applied", got.Content, got.Version)
+	}
+	if got.SessionSeq("u", "s") != 3 || got.SessionSeq("v", "s") != 1 || got.SessionSeq("w", "s") != 0 {
+		t.Fatalf("session clocks = %v", got.Clocks)
+	}
+}
+
+func TestLamportClock(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(NewInMemoryRepository())
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "", EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(in ApplyOperationInput) (Operation, error) {
+		in.TenantID, in.DocumentID = "t", doc.ID
+		_, op, _, err := svc.ApplyOperation(ctx, in)
+		return op, err
+	}
+
+	// Two clients that saw the same time both get later, distinct ones.
+	seen := doc.Lamport
+	a, err := apply(ApplyOperationInput{UserID: "a", Delta: `["a"]`, BaseVersion: doc.Version, Lamport: seen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := apply(ApplyOperationInput{UserID: "b", Delta: `["b"]`, BaseVersion: doc.Version, Lamport: seen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Lamport <= seen || b.Lamport <= a.Lamport {
+		t.Fatalf("concurrent operations stamped %d and %d after %d", a.Lamport, b.Lamport, seen)
+	}
+
+	// A client clock one ahead pushes the document's forward; further
+	// ahead names a time the server never issued.
+	c, err := apply(ApplyOperationInput{UserID: "c", NewContent: "abc", Lamport: b.Lamport + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Lamport != b.Lamport+2 {
+		t.Fatalf("lamport %d after a client clock of %d", c.Lamport, b.Lamport+1)
+	}
+	if _, err := apply(ApplyOperationInput{UserID: "c", NewContent: "abcd", Lamport: c.Lamport + 2}); !errors.Is(err, ErrCausalBaseUnseen) {
+		t.Fatalf("lamport from the future: err = %v, want ErrCausalBaseUnseen", err)
+	}
+	if _, err := apply(ApplyOperationInput{UserID: "c", Delta: `[3,"d"]`, BaseVersion: c.Version + 1}); !errors.Is(err, ErrBaseVersionAhead) {
+		t.Fatalf("base ahead of the head: err = %v, want ErrBaseVersionAhead", err)
+	}
+}
+
+// TestConcurrentClocks commits operations from many goroutines against the
+// same base; the log comes out with Lamport times in version order.
+func TestConcurrentClocks(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(NewInMemoryRepository())
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "", EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "w", Delta: `["x"]`, BaseVersion: doc.Version, Lamport: doc.Lamport})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	applied := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			applied++
+		case errors.Is(err, ErrVersionConflict):
+			// Out of commit attempts under contention; not applied.
+		default:
+			t.Fatal(err)
+		}
+	}
+
+	ops, err := svc.OperationsSince(ctx, "t", doc.ID, doc.Version, writers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != applied || applied == 0 {
+		t.Fatalf("%d operations logged, %d applied", len(ops), applied)
+	}
+	last := doc.Lamport
+	for _, op := range ops {
+		if op.Lamport <= last {
+			t.Fatalf("version %d has lamport %d after %d", op.Version, op.Lamport, last)
+		}
+		last = op.Lamport
+	}
+	got, err := svc.GetDocument(ctx, "t", doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Lamport != last || len(got.Content) != applied {
+		t.Fatalf("document clock %d, content %q; want %d and %d characters", got.Lamport, got.Content, last, applied)
+	}
+}
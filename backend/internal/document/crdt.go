@@ -0,0 +1,508 @@
+package document
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// serverSite identifies characters the server writes on a client's behalf,
+// for example during reverts or whole-content replacements.
+const serverSite = "server"
+
+// CharID identifies one character of a CRDT document. Seq is a Lamport
+// counter: a site must pick a Seq greater than any it has observed.
+type CharID struct {
+	Site string `json:"site"`
+	Seq  int64  `json:"seq"`
+}
+
+// after reports whether id sorts ahead of other among siblings.
+func (id CharID) after(other CharID) bool {
+	if id.Seq != other.Seq {
+		return id.Seq > other.Seq
+	}
+	return id.Site > other.Site
+}
+
+// CRDTOp is one insert or delete in a CRDT delta.
+type CRDTOp struct {
+	Kind   string  `json:"kind"` // insert | delete
+	ID     CharID  `json:"id"`
+	Origin *CharID `json:"origin,omitempty"` // insert: left neighbour at creation, nil for the start
+	Value  string  `json:"value,omitempty"`  // insert: a single character
+}
+
+// CRDTDelta is the payload stored in Operation.Delta for CRDT documents.
+type CRDTDelta struct {
+	Ops []CRDTOp `json:"ops"`
+}
+
+// CRDTElement is a character in the replicated sequence. Deleted characters
+// stay behind as tombstones so later inserts can still find their origin.
+type CRDTElement struct {
+	ID      CharID `json:"id"`
+	Value   string `json:"value"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// CRDTState is the full replicated sequence, sent to clients on join.
+type CRDTState struct {
+	Elements []CRDTElement `json:"elements"`
+}
+
+// RGA is a replicated growable array of characters. Replicas that integrate
+// the same set of operations converge regardless of delivery order, as long
+// as every insert arrives after its origin.
+//
+// Characters are kept in a linked list indexed by ID, so an insert costs its
+// origin lookup plus the concurrent siblings it skips, however long the text.
+type RGA struct {
+	head   rgaNode // sentinel before the first character
+	nodes  map[CharID]*rgaNode
+	maxSeq int64
+}
+
+type rgaNode struct {
+	CRDTElement
+	next *rgaNode
+}
+
+// rgaUndo reverses one change Integrate made.
+type rgaUndo struct {
+	node   *rgaNode
+	prev   *rgaNode // insert: the node it was linked after; nil for a delete
+	maxSeq int64    // maxSeq before the change
+}
+
+func NewRGA() *RGA {
+	return &RGA{nodes: make(map[CharID]*rgaNode)}
+}
+
+// rgaFromState rebuilds a replica from a sequence returned by State.
+func rgaFromState(state CRDTState) (*RGA, error) {
+	g := NewRGA()
+	tail := &g.head
+	for _, e := range state.Elements {
+		if _, dup := g.nodes[e.ID]; dup {
+			return nil, fmt.Errorf("%w: state repeats character %s/%d", ErrInvalidDelta, e.ID.Site, e.ID.Seq)
+		}
+		tail.next = &rgaNode{CRDTElement: e}
+		tail = tail.next
+		g.nodes[e.ID] = tail
+		g.maxSeq = max(g.maxSeq, e.ID.Seq)
+	}
+	return g, nil
+}
+
+// Integrate applies a single operation. Re-delivered inserts and deletes are
+// ignored so clients can safely resend offline work.
+func (g *RGA) Integrate(op CRDTOp) error {
+	_, err := g.integrate(op)
+	return err
+}
+
+// integrateAll applies ops in order and returns how to undo them. If one is
+// rejected the ones before it are undone and g is left as it was.
+func (g *RGA) integrateAll(ops []CRDTOp) ([]rgaUndo, error) {
+	var undo []rgaUndo
+	for _, op := range ops {
+		u, err := g.integrate(op)
+		if err != nil {
+			g.rollback(undo)
+			return nil, err
+		}
+		if u.node != nil {
+			undo = append(undo, u)
+		}
+	}
+	return undo, nil
+}
+
+// rollback reverses changes recorded by integrateAll, newest first.
+func (g *RGA) rollback(undo []rgaUndo) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		if u.prev == nil {
+			u.node.Deleted = false
+		} else {
+			u.prev.next = u.node.next
+			delete(g.nodes, u.node.ID)
+		}
+		g.maxSeq = u.maxSeq
+	}
+}
+
+// integrate applies op and returns how to undo it; the undo has no node
+// when op changed nothing.
+func (g *RGA) integrate(op CRDTOp) (rgaUndo, error) {
+	switch op.Kind {
+	case "insert":
+		return g.insert(op)
+	case "delete":
+		n, ok := g.nodes[op.ID]
+		if !ok {
+			return rgaUndo{}, fmt.Errorf("%w: delete of unknown character %s/%d", ErrInvalidDelta, op.ID.Site, op.ID.Seq)
+		}
+		if n.Deleted {
+			return rgaUndo{}, nil
+		}
+		n.Deleted = true
+		return rgaUndo{node: n, maxSeq: g.maxSeq}, nil
+	default:
+		return rgaUndo{}, fmt.Errorf("%w: unknown crdt op %q", ErrInvalidDelta, op.Kind)
+	}
+}
+
+func (g *RGA) insert(op CRDTOp) (rgaUndo, error) {
+	if _, dup := g.nodes[op.ID]; dup {
+		return rgaUndo{}, nil
+	}
+	if op.ID.Seq <= 0 || op.ID.Site == "" {
+		return rgaUndo{}, fmt.Errorf("%w: insert needs a site and positive seq", ErrInvalidDelta)
+	}
+	if len([]rune(op.Value)) != 1 {
+		return rgaUndo{}, fmt.Errorf("%w: insert must carry exactly one character", ErrInvalidDelta)
+	}
+
+	prev := &g.head
+	if op.Origin != nil {
+		n, ok := g.nodes[*op.Origin]
+		if !ok {
+			return rgaUndo{}, fmt.Errorf("%w: insert after unknown character %s/%d", ErrInvalidDelta, op.Origin.Site, op.Origin.Seq)
+		}
+		if op.ID.Seq <= op.Origin.Seq {
+			return rgaUndo{}, fmt.Errorf("%w: insert seq %d must exceed origin seq %d", ErrInvalidDelta, op.ID.Seq, op.Origin.Seq)
+		}
+		prev = n
+	}
+	// Skip concurrent siblings (and their subtrees) that sort ahead of us.
+	for prev.next != nil && prev.next.ID.after(op.ID) {
+		prev = prev.next
+	}
+
+	n := &rgaNode{CRDTElement: CRDTElement{ID: op.ID, Value: op.Value}, next: prev.next}
+	prev.next = n
+	g.nodes[op.ID] = n
+	undo := rgaUndo{node: n, prev: prev, maxSeq: g.maxSeq}
+	g.maxSeq = max(g.maxSeq, op.ID.Seq)
+	return undo, nil
+}
+
+// Content materializes the visible text.
+func (g *RGA) Content() string {
+	var b strings.Builder
+	for n := g.head.next; n != nil; n = n.next {
+		if !n.Deleted {
+			b.WriteString(n.Value)
+		}
+	}
+	return b.String()
+}
+
+// State returns a copy of the sequence including tombstones.
+func (g *RGA) State() CRDTState {
+	elements := make([]CRDTElement, 0, len(g.nodes))
+	for n := g.head.next; n != nil; n = n.next {
+		elements = append(elements, n.CRDTElement)
+	}
+	return CRDTState{Elements: elements}
+}
+
+// Replace returns the operations that turn the visible text into content,
+// attributed to site.
+func (g *RGA) Replace(site, content string) []CRDTOp {
+	var ops []CRDTOp
+	diff := Diff(g.Content(), content)
+
+	visible := make([]CharID, 0, len(g.nodes))
+	for n := g.head.next; n != nil; n = n.next {
+		if !n.Deleted {
+			visible = append(visible, n.ID)
+		}
+	}
+
+	seq := g.maxSeq
+	cursor := 0 // position in visible text
+	var left *CharID
+	for _, c := range diff.Ops {
+		switch {
+		case c.Retain > 0:
+			cursor += c.Retain
+			id := visible[cursor-1]
+			left = &id
+		case c.Delete > 0:
+			for _, id := range visible[cursor : cursor+c.Delete] {
+				ops = append(ops, CRDTOp{Kind: "delete", ID: id})
+			}
+			cursor += c.Delete
+		case c.Insert != "":
+			for _, r := range c.Insert {
+				seq++
+				op := CRDTOp{Kind: "insert", ID: CharID{Site: site, Seq: seq}, Origin: left, Value: string(r)}
+				ops = append(ops, op)
+				id := op.ID
+				left = &id
+			}
+		}
+	}
+	return ops
+}
+
+// ParseCRDTDelta decodes a CRDT delta.
+func ParseCRDTDelta(delta string) (CRDTDelta, error) {
+	var d CRDTDelta
+	if err := json.Unmarshal([]byte(delta), &d); err != nil {
+		return CRDTDelta{}, fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	return d, nil
+}
+
+func encodeCRDTDelta(ops []CRDTOp) string {
+	b, _ := json.Marshal(CRDTDelta{Ops: ops})
+	return string(b)
+}
+
+// CRDTSite is the site the server stamps on inserts from a user's editing
+// session. It cannot be forged: user IDs never contain the separator, and
+// serverSite has none.
+func CRDTSite(userID, session string) string {
+	return sessionKey(userID, session)
+}
+
+// stampSite attributes the inserts in ops to site whatever the client sent,
+// renaming references to characters created earlier in the same delta.
+func stampSite(ops []CRDTOp, site string) []CRDTOp {
+	renamed := make(map[CharID]CharID)
+	stamped := make([]CRDTOp, len(ops))
+	for i, op := range ops {
+		if op.Origin != nil {
+			if id, ok := renamed[*op.Origin]; ok {
+				op.Origin = &id
+			}
+		}
+		switch op.Kind {
+		case "insert":
+			id := CharID{Site: site, Seq: op.ID.Seq}
+			renamed[op.ID] = id
+			op.ID = id
+		case "delete":
+			if id, ok := renamed[op.ID]; ok {
+				op.ID = id
+			}
+		}
+		stamped[i] = op
+	}
+	return stamped
+}
+
+// crdtEngine keeps CRDT documents as RGAs, caught up from the operation log
+// and rebuilt from the nearest checkpointed snapshot when not cached.
+// Clients integrate deltas locally, so no server-side transform is needed.
+type crdtEngine struct {
+	repo Repository
+
+	mu     sync.Mutex
+	states map[string]*crdtDoc
+}
+
+type crdtDoc struct {
+	rga     *RGA
+	version int64
+	// speculative is set while version is the one the last integrate will
+	// commit as; undo takes the replica back if it does not.
+	speculative bool
+	undo        []rgaUndo
+}
+
+func newCRDTEngine(repo Repository) *crdtEngine {
+	return &crdtEngine{repo: repo, states: make(map[string]*crdtDoc)}
+}
+
+func (e *crdtEngine) Name() string { return EngineCRDT }
+
+func (e *crdtEngine) Seed(_ context.Context, doc Document) (string, error) {
+	return encodeCRDTDelta(NewRGA().Replace(serverSite, doc.Content)), nil
+}
+
+func (e *crdtEngine) Apply(ctx context.Context, doc Document, delta string, _ int64, site string) (EngineResult, error) {
+	d, err := ParseCRDTDelta(delta)
+	if err != nil {
+		return EngineResult{}, err
+	}
+	ops := stampSite(d.Ops, site)
+	return e.integrate(ctx, doc, func(*RGA) []CRDTOp { return ops })
+}
+
+func (e *crdtEngine) Replace(ctx context.Context, doc Document, content string) (EngineResult, error) {
+	return e.integrate(ctx, doc, func(g *RGA) []CRDTOp { return g.Replace(serverSite, content) })
+}
+
+func (e *crdtEngine) State(ctx context.Context, doc Document) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	st, err := e.load(ctx, doc)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(st.rga.State())
+	return string(b), err
+}
+
+// Checkpoint returns the cached replica's state if it is at doc's version.
+func (e *crdtEngine) Checkpoint(doc Document) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	st, ok := e.states[e.key(doc)]
+	if !ok || st.version != doc.Version {
+		return "", false
+	}
+	b, err := json.Marshal(st.rga.State())
+	return string(b), err == nil
+}
+
+// integrate applies ops to the cached replica in place, keeping what it
+// takes to undo them until the next operation shows they committed. A
+// rejected delta is undone at once; a failed commit is undone by Abort.
+func (e *crdtEngine) integrate(ctx context.Context, doc Document, build func(*RGA) []CRDTOp) (EngineResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	st, err := e.load(ctx, doc)
+	if err != nil {
+		return EngineResult{}, err
+	}
+	ops := build(st.rga)
+	undo, err := st.rga.integrateAll(ops)
+	if err != nil {
+		return EngineResult{}, err
+	}
+	st.version, st.speculative, st.undo = doc.Version+1, true, undo
+
+	content := st.rga.Content()
+	return EngineResult{
+		Content: content,
+		Delta:   encodeCRDTDelta(ops),
+		Effect:  Diff(doc.Content, content).String(),
+	}, nil
+}
+
+// load returns the replica for doc at its current version. A cached replica
+// that is behind replays only the operations it missed; one that is ahead
+// undoes the last integrate if it can and is rebuilt otherwise. Callers hold
+// e.mu.
+func (e *crdtEngine) load(ctx context.Context, doc Document) (*crdtDoc, error) {
+	key := e.key(doc)
+	st, ok := e.states[key]
+	if ok && st.speculative && st.version == doc.Version+1 {
+		// The last integrate has not committed, or doc was read before it
+		// did; either way doc is what it was built on.
+		st.rga.rollback(st.undo)
+		st.version = doc.Version
+	}
+	if !ok || st.version > doc.Version {
+		var err error
+		if st, err = e.rebuild(ctx, doc); err != nil {
+			return nil, err
+		}
+		e.states[key] = st
+	}
+	if st.version == doc.Version {
+		st.speculative, st.undo = false, nil
+		return st, nil
+	}
+
+	ops, err := e.repo.ListOperations(ctx, doc.TenantID, doc.ID, st.version, int(doc.Version-st.version))
+	if err != nil {
+		return nil, err
+	}
+	st.speculative, st.undo = false, nil
+	for _, op := range ops {
+		if err := replayCRDT(st.rga, op, st.version+1); err != nil {
+			delete(e.states, key)
+			return nil, err
+		}
+		st.version++
+	}
+	if st.version != doc.Version {
+		delete(e.states, key)
+		return nil, fmt.Errorf("%w: log ends at version %d, document is at %d", ErrHistoryUnavailable, st.version, doc.Version)
+	}
+	return st, nil
+}
+
+// rebuild starts a replica for doc from the nearest snapshot that stored the
+// engine state, or from nothing. Snapshots are best effort, so one whose
+// state does not decode is passed over.
+func (e *crdtEngine) rebuild(ctx context.Context, doc Document) (*crdtDoc, error) {
+	v, err := e.repo.NearestVersion(ctx, doc.TenantID, doc.ID, doc.Version)
+	if errors.Is(err, ErrVersionNotFound) {
+		return &crdtDoc{rga: NewRGA()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v.engineState == "" {
+		return &crdtDoc{rga: NewRGA()}, nil
+	}
+	var state CRDTState
+	if err := json.Unmarshal([]byte(v.engineState), &state); err != nil {
+		return &crdtDoc{rga: NewRGA()}, nil
+	}
+	g, err := rgaFromState(state)
+	if err != nil {
+		return &crdtDoc{rga: NewRGA()}, nil
+	}
+	return &crdtDoc{rga: g, version: v.Sequence}, nil
+}
+
+// replayCRDT integrates a logged operation, which must be version.
+func replayCRDT(g *RGA, op Operation, version int64) error {
+	if op.Version != version {
+		return fmt.Errorf("%w: missing version %d", ErrHistoryUnavailable, version)
+	}
+	d, err := ParseCRDTDelta(op.Delta)
+	if err != nil {
+		return fmt.Errorf("operation %s: %w", op.ID, err)
+	}
+	for _, c := range d.Ops {
+		if err := g.Integrate(c); err != nil {
+			return fmt.Errorf("operation %s: %w", op.ID, err)
+		}
+	}
+	return nil
+}
+
+// Abort undoes the integrate that was to commit as version. If the replica
+// has moved on since, it is dropped instead.
+func (e *crdtEngine) Abort(tenantID, documentID string, version int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := tenantID + ":" + documentID
+	st, ok := e.states[key]
+	switch {
+	case !ok || st.version < version:
+	case st.speculative && st.version == version:
+		st.rga.rollback(st.undo)
+		st.version, st.speculative, st.undo = version-1, false, nil
+	default:
+		delete(e.states, key)
+	}
+}
+
+// Forget drops the cached replica; the next use rebuilds it.
+func (e *crdtEngine) Forget(tenantID, documentID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.states, tenantID+":"+documentID)
+}
+
+func (e *crdtEngine) key(doc Document) string {
+	return doc.TenantID + ":" + doc.ID
+}
@@ -0,0 +1,453 @@
+package document
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestRGAIntegrate(t *testing.T) {
+	a1 := CharID{Site: "a", Seq: 1}
+	b2 := CharID{Site: "b", Seq: 2}
+	insert := func(id CharID, origin *CharID, value string) CRDTOp {
+		return CRDTOp{Kind: "insert", ID: id, Origin: origin, Value: value}
+	}
+
+	tests := []struct {
+		name    string
+		ops     []CRDTOp
+		want    string
+		wantErr error
+	}{
+		{
+			name: "insert after origin",
+			ops:  []CRDTOp{insert(a1, nil, "x"), insert(b2, &a1, "y")},
+			want: "xy",
+		},
+		{
+			name: "concurrent inserts at the start order by seq then site",
+			ops:  []CRDTOp{insert(a1, nil, "x"), insert(CharID{Site: "b", Seq: 1}, nil, "y")},
+			want: "yx",
+		},
+		{
+			name: "duplicate insert is ignored",
+			ops:  []CRDTOp{insert(a1, nil, "x"), insert(a1, nil, "x")},
+			want: "x",
+		},
+		{
+			name: "delete leaves a tombstone later inserts can anchor to",
+			ops:  []CRDTOp{insert(a1, nil, "x"), {Kind: "delete", ID: a1}, insert(b2, &a1, "y")},
+			want: "y",
+		},
+		{
+			name: "repeated delete is ignored",
+			ops:  []CRDTOp{insert(a1, nil, "x"), {Kind: "delete", ID: a1}, {Kind: "delete", ID: a1}},
+			want: "",
+		},
+		{
+			name:    "delete of unknown character",
+			ops:     []CRDTOp{{Kind: "delete", ID: a1}},
+			wantErr: ErrInvalidDelta,
+		},
+		{
+			name:    "insert after unknown origin",
+			ops:     []CRDTOp{insert(b2, &a1, "y")},
+			wantErr: ErrInvalidDelta,
+		},
+		{
+			name:    "insert seq not past its origin",
+			ops:     []CRDTOp{insert(b2, nil, "x"), insert(a1, &b2, "y")},
+			wantErr: ErrInvalidDelta,
+		},
+		{
+			name:    "insert of several characters",
+			ops:     []CRDTOp{insert(a1, nil, "xy")},
+			wantErr: ErrInvalidDelta,
+		},
+		{
+			name:    "insert without a site",
+			ops:     []CRDTOp{insert(CharID{Seq: 1}, nil, "x")},
+			wantErr: ErrInvalidDelta,
+		},
+		{
+			name:    "unknown kind",
+			ops:     []CRDTOp{{Kind: "move", ID: a1}},
+			wantErr: ErrInvalidDelta,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewRGA()
+			var err error
+			for _, op := range tt.ops {
+				if err = g.Integrate(op); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && g.Content() != tt.want {
+				t.Errorf("content = %q, want %q", g.Content(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRGAReplace(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+	}{
+		{"from empty", "", "hello"},
+		{"to empty", "hello", ""},
+		{"insert in the middle", "helo", "hello"},
+		{"delete in the middle", "hello", "hllo"},
+		{"replace a word", "hello world", "hello there"},
+		{"multi-byte characters", "héllo", "hé🎉llo"},
+		{"unchanged", "same", "same"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewRGA()
+			for _, op := range g.Replace("a", tt.before) {
+				if err := g.Integrate(op); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, op := range g.Replace("b", tt.after) {
+				if err := g.Integrate(op); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if g.Content() != tt.after {
+				t.Errorf("content = %q, want %q", g.Content(), tt.after)
+			}
+		})
+	}
+}
+
+// TestRGAConverges has several replicas edit concurrently and exchange
+// operations in random order; once everything is delivered they must agree.
+func TestRGAConverges(t *testing.T) {
+	tests := []struct {
+		name  string
+		seed  int64
+		sites int
+		steps int
+	}{
+		{"two sites", 1, 2, 40},
+		{"three sites", 2, 3, 60},
+		{"five sites", 3, 5, 80},
+		{"long run", 4, 3, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(tt.seed))
+			for round := 0; round < 50; round++ {
+				replicas := make([]*RGA, tt.sites)
+				delivered := make([]map[int]bool, tt.sites)
+				for i := range replicas {
+					replicas[i] = NewRGA()
+					delivered[i] = make(map[int]bool)
+				}
+				var log []CRDTOp
+				deliver := func(s, i int) bool {
+					if delivered[s][i] || !deliverable(replicas[s], log[i]) {
+						return false
+					}
+					if err := replicas[s].Integrate(log[i]); err != nil {
+						t.Fatal(err)
+					}
+					delivered[s][i] = true
+					return true
+				}
+
+				for step := 0; step < tt.steps; step++ {
+					s := r.Intn(tt.sites)
+					if r.Intn(3) == 0 && len(log) > 0 {
+						for k := 0; k < 3; k++ {
+							deliver(s, r.Intn(len(log)))
+						}
+						continue
+					}
+					content := []rune(replicas[s].Content())
+					pos := r.Intn(len(content) + 1)
+					next := string(content[:pos]) + string(rune('a'+r.Intn(26))) + string(content[pos:])
+					if len(content) > 0 && r.Intn(3) == 0 {
+						next = string(content[:pos]) + string(content[min(pos+1, len(content)):])
+					}
+					for _, op := range replicas[s].Replace(string(rune('A'+s)), next) {
+						if err := replicas[s].Integrate(op); err != nil {
+							t.Fatal(err)
+						}
+						log = append(log, op)
+						delivered[s][len(log)-1] = true
+					}
+				}
+
+				for progress := true; progress; {
+					progress = false
+					for s := range replicas {
+						for i := range log {
+							progress = deliver(s, i) || progress
+						}
+					}
+				}
+				for s := 1; s < tt.sites; s++ {
+					if got, want := replicas[s].Content(), replicas[0].Content(); got != want {
+						t.Fatalf("round %d: site %d has %q, site 0 has %q", round, s, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// deliverable reports whether g has what op depends on.
+func deliverable(g *RGA, op CRDTOp) bool {
+	switch {
+	case op.Kind == "delete":
+		_, ok := g.nodes[op.ID]
+		return ok
+	case op.Origin != nil:
+		_, ok := g.nodes[*op.Origin]
+		return ok
+	default:
+		return true
+	}
+}
+
+func TestCRDTEngineRebuildsFromLog(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(NewInMemoryRepository())
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "ab", EngineCRDT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		in   ApplyOperationInput
+		want string
+	}{
+		{ApplyOperationInput{Delta: `{"ops":[{"kind":"insert","id":{"site":"c1","seq":10},"origin":{"site":"server","seq":1},"value":"X"}]}`}, "aXb"},
+		{ApplyOperationInput{NewContent: "aXbc"}, "aXbc"},
+		// The insert was stamped with the session's site, not the one sent.
+		{ApplyOperationInput{Delta: `{"ops":[{"kind":"delete","id":{"site":"u/","seq":10}}]}`}, "abc"},
+	}
+	for _, step := range steps {
+		step.in.TenantID, step.in.DocumentID, step.in.UserID = "t", doc.ID, "u"
+		if doc, _, _, err = svc.ApplyOperation(ctx, step.in); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Content != step.want {
+			t.Fatalf("content = %q, want %q", doc.Content, step.want)
+		}
+	}
+
+	cached, err := svc.EngineState(ctx, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Release("t", doc.ID)
+	rebuilt, err := svc.EngineState(ctx, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != rebuilt {
+		t.Errorf("state rebuilt from the log differs:\n%s\n%s", cached, rebuilt)
+	}
+}
+
+func TestCRDTEngineStampsSite(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(NewInMemoryRepository())
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "ab", EngineCRDT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client claims the server's site, and reuses a seq the server
+	// already holds, for an insert, text anchored to it and its deletion.
+	delta := `{"ops":[` +
+		`{"kind":"insert","id":{"site":"server","seq":2},"origin":{"site":"server","seq":1},"value":"X"},` +
+		`{"kind":"insert","id":{"site":"server","seq":3},"origin":{"site":"server","seq":2},"value":"Y"},` +
+		`{"kind":"delete","id":{"site":"server","seq":2}}]}`
+	doc, op, _, err := svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", Session: "s", Delta: delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Content != "aYb" {
+		t.Fatalf("content = %q, want %q", doc.Content, "aYb")
+	}
+	d, err := ParseCRDTDelta(op.Delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := CRDTSite("u", "s")
+	x := CharID{Site: site, Seq: 2}
+	want := []CRDTOp{
+		{Kind: "insert", ID: x, Origin: &CharID{Site: serverSite, Seq: 1}, Value: "X"},
+		{Kind: "insert", ID: CharID{Site: site, Seq: 3}, Origin: &x, Value: "Y"},
+		{Kind: "delete", ID: x},
+	}
+	got, _ := json.Marshal(d.Ops)
+	if w, _ := json.Marshal(want); string(got) != string(w) {
+		t.Fatalf("logged ops\n%s\nwant\n%s", got, w)
+	}
+}
+
+// TestCRDTEngineUndoesUncommitted checks the cached replica against one
+// rebuilt from the log after operations that never commit.
+func TestCRDTEngineUndoesUncommitted(t *testing.T) {
+	ctx := context.Background()
+	repo := &hookedRepository{InMemoryRepository: NewInMemoryRepository()}
+	svc := NewService(repo)
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "ab", EngineCRDT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(in ApplyOperationInput) error {
+		in.TenantID, in.DocumentID, in.UserID = "t", doc.ID, "u"
+		_, _, _, err := svc.ApplyOperation(ctx, in)
+		return err
+	}
+	matchesLog := func(t *testing.T, want string) {
+		t.Helper()
+		doc, err := svc.GetDocument(ctx, "t", doc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Content != want {
+			t.Fatalf("content = %q, want %q", doc.Content, want)
+		}
+		cached, err := svc.EngineState(ctx, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc.Release("t", doc.ID)
+		rebuilt, err := svc.EngineState(ctx, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != rebuilt {
+			t.Fatalf("cached state differs from the log:\n%s\n%s", cached, rebuilt)
+		}
+	}
+	if _, err := svc.EngineState(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first op is fine, the second is not; neither may stick.
+	bad := `{"ops":[{"kind":"insert","id":{"site":"c","seq":5},"value":"X"},{"kind":"delete","id":{"site":"c","seq":99}}]}`
+	if err := apply(ApplyOperationInput{Delta: bad}); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("err = %v, want ErrInvalidDelta", err)
+	}
+	matchesLog(t, "ab")
+
+	svc.SetMaxContentBytes(3)
+	if err := apply(ApplyOperationInput{NewContent: "abcd"}); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Fatalf("err = %v, want ErrDocumentTooLarge", err)
+	}
+	matchesLog(t, "ab")
+	svc.SetMaxContentBytes(DefaultMaxContentBytes)
+
+	// Another writer commits first; the retry lands on top of it.
+	repo.beforeCommit = func() {
+		if err := apply(ApplyOperationInput{NewContent: "abc"}); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := apply(ApplyOperationInput{Delta: `{"ops":[{"kind":"insert","id":{"site":"c","seq":5},"value":"X"}]}`}); err != nil {
+		t.Fatal(err)
+	}
+	matchesLog(t, "Xabc")
+}
+
+// listingRepository records where each ListOperations call starts.
+type listingRepository struct {
+	*InMemoryRepository
+	after []int64
+}
+
+func (r *listingRepository) ListOperations(ctx context.Context, tenantID, documentID string, afterVersion int64, limit int) ([]Operation, error) {
+	r.after = append(r.after, afterVersion)
+	return r.InMemoryRepository.ListOperations(ctx, tenantID, documentID, afterVersion, limit)
+}
+
+func TestCRDTEngineReplaysOnlyWhatItMissed(t *testing.T) {
+	ctx := context.Background()
+	repo := &listingRepository{InMemoryRepository: NewInMemoryRepository()}
+	svc := NewService(repo)
+	svc.SetVersionPolicy(VersionPolicy{Every: 5})
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "", EngineCRDT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(svc *Service, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if doc, _, _, err = svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", NewContent: doc.Content + "x"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	state := func(svc *Service) string {
+		t.Helper()
+		s, err := svc.EngineState(ctx, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	edit(svc, 12)
+	want := state(svc)
+	version, err := repo.NearestVersion(ctx, "t", doc.ID, doc.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.engineState == "" || version.Sequence == doc.Version {
+		t.Fatalf("nearest snapshot at %d has state %q", version.Sequence, version.engineState)
+	}
+
+	// A cold start replays from the checkpoint, not from creation.
+	svc.Release("t", doc.ID)
+	repo.after = nil
+	if got := state(svc); got != want {
+		t.Fatalf("rebuilt from checkpoint:\n%s\nwant\n%s", got, want)
+	}
+	if len(repo.after) != 1 || repo.after[0] != version.Sequence {
+		t.Fatalf("listed operations after %v, want after %d", repo.after, version.Sequence)
+	}
+
+	// A replica another instance left behind catches up from where it is.
+	other := NewService(repo)
+	behind := doc.Version
+	state(other)
+	edit(svc, 2)
+	repo.after = nil
+	if got, want := state(other), state(svc); got != want {
+		t.Fatalf("caught up:\n%s\nwant\n%s", got, want)
+	}
+	if len(repo.after) != 1 || repo.after[0] != behind {
+		t.Fatalf("listed operations after %v, want after %d", repo.after, behind)
+	}
+}
+
+func TestRGALongInsert(t *testing.T) {
+	// Typing at the end of a long document must not reindex what precedes
+	// it; this would take minutes if every insert were linear.
+	g := NewRGA()
+	for _, op := range g.Replace("a", strings.Repeat("x", 200000)) {
+		if err := g.Integrate(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(g.Content()); n != 200000 {
+		t.Fatalf("content has %d characters", n)
+	}
+}
@@ -0,0 +1,135 @@
+package document
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Engine names accepted in Document.Engine.
+const (
+	EngineOT   = "ot"
+	EngineCRDT = "crdt"
+)
+
+// EngineResult is the outcome of merging a change into a document.
+type EngineResult struct {
+	Content string // materialized document content after the change
+	Delta   string // engine-native payload stored in Operation.Delta and broadcast
+	// Effect is the change expressed as a text operation, set when Delta is
+	// not one already. Used to shift positions such as cursors.
+	Effect string
+}
+
+// Engine merges client changes into a document. Each document picks its engine
+// at creation time; the service persists whatever Delta the engine returns.
+type Engine interface {
+	Name() string
+	// Seed returns the delta to log as the document's first operation, or ""
+	// when the engine needs no initial state.
+	Seed(ctx context.Context, doc Document) (string, error)
+	// Apply integrates a client delta built against baseVersion. site names
+	// the editing session it came from, for engines that attribute changes.
+	Apply(ctx context.Context, doc Document, delta string, baseVersion int64, site string) (EngineResult, error)
+	// Replace produces the change that turns the document into content.
+	Replace(ctx context.Context, doc Document, content string) (EngineResult, error)
+	// State returns the engine state clients need to start editing, or "".
+	State(ctx context.Context, doc Document) (string, error)
+}
+
+// forgetter is implemented by engines that cache per-document state.
+type forgetter interface {
+	Forget(tenantID, documentID string)
+}
+
+// aborter is implemented by engines whose cached state runs ahead of the
+// commit. Abort discards what Apply or Replace produced for version once it
+// is known not to have committed.
+type aborter interface {
+	Abort(tenantID, documentID string, version int64)
+}
+
+// checkpointer is implemented by engines whose state is costly to rebuild
+// from the log. Checkpoint returns the state at doc's version, if at hand, to
+// be stored with a snapshot of it.
+type checkpointer interface {
+	Checkpoint(doc Document) (string, bool)
+}
+
+// isStructuredDelta reports whether delta is an engine payload rather than a
+// legacy placeholder such as "naive-full-sync".
+func isStructuredDelta(delta string) bool {
+	trimmed := strings.TrimSpace(delta)
+	return strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{")
+}
+
+// otEngine rebases text operations onto the head with operational transformation.
+type otEngine struct {
+	repo Repository
+}
+
+func newOTEngine(repo Repository) *otEngine {
+	return &otEngine{repo: repo}
+}
+
+func (e *otEngine) Name() string { return EngineOT }
+
+func (e *otEngine) Seed(context.Context, Document) (string, error) { return "", nil }
+
+func (e *otEngine) State(context.Context, Document) (string, error) { return "", nil }
+
+func (e *otEngine) Apply(ctx context.Context, doc Document, delta string, baseVersion int64, _ string) (EngineResult, error) {
+	op, err := e.transform(ctx, doc, delta, baseVersion)
+	if err != nil {
+		return EngineResult{}, err
+	}
+	content, err := op.Apply(doc.Content)
+	if err != nil {
+		return EngineResult{}, err
+	}
+	return EngineResult{Content: content, Delta: op.String()}, nil
+}
+
+func (e *otEngine) Replace(_ context.Context, doc Document, content string) (EngineResult, error) {
+	return EngineResult{Content: content, Delta: Diff(doc.Content, content).String()}, nil
+}
+
+// transform rebases a client delta made against baseVersion onto the current
+// document version. Operations already in the log win ties, so text inserted
+// at the same position by an earlier committer stays first.
+func (e *otEngine) transform(ctx context.Context, doc Document, delta string, baseVersion int64) (TextOperation, error) {
+	op, err := ParseDelta(delta)
+	if err != nil {
+		return TextOperation{}, err
+	}
+	if baseVersion == 0 {
+		baseVersion = doc.Version
+	}
+	if baseVersion > doc.Version {
+		return TextOperation{}, fmt.Errorf("%w: base %d, head %d", ErrBaseVersionAhead, baseVersion, doc.Version)
+	}
+	if baseVersion == doc.Version {
+		return op, nil
+	}
+
+	// Later operations may have committed since doc was read; the commit
+	// will conflict, but the transform must not see them.
+	history, err := e.repo.ListOperations(ctx, doc.TenantID, doc.ID, baseVersion, int(doc.Version-baseVersion))
+	if err != nil {
+		return TextOperation{}, err
+	}
+	if int64(len(history)) != doc.Version-baseVersion {
+		return TextOperation{}, fmt.Errorf("%w: need %d operations since version %d, found %d", ErrHistoryUnavailable, doc.Version-baseVersion, baseVersion, len(history))
+	}
+
+	for _, h := range history {
+		concurrent, err := ParseDelta(h.Delta)
+		if err != nil {
+			return TextOperation{}, fmt.Errorf("operation %s: %w", h.ID, err)
+		}
+		if _, op, err = Transform(concurrent, op); err != nil {
+			return TextOperation{}, err
+		}
+	}
+	return op, nil
+}
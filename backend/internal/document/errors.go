@@ -5,4 +5,36 @@ import "errors"
 var (
 	// ErrDocumentNotFound is returned when a requested document is missing.
 	ErrDocumentNotFound = errors.New("document not found")
+	// ErrUnknownEngine is returned when a document names an engine that is not registered.
+	ErrUnknownEngine = errors.New("unknown document engine")
+	// ErrInvalidDelta is returned when an operation delta cannot be decoded or applied.
+	ErrInvalidDelta = errors.New("invalid delta")
+	// ErrVersionConflict is returned when a document changed between being read and written back.
+	ErrVersionConflict = errors.New("document changed concurrently")
+	// ErrBaseVersionAhead is returned when a client claims a version the server has not produced.
+	ErrBaseVersionAhead = errors.New("base version is ahead of document")
+	// ErrHistoryUnavailable is returned when the operation log cannot cover a transform.
+	ErrHistoryUnavailable = errors.New("operation history unavailable")
+	// ErrVersionNotFound is returned when a requested version does not exist.
+	ErrVersionNotFound = errors.New("version not found")
+	// ErrDocumentTooLarge is returned when a change would grow a document past the size limit.
+	ErrDocumentTooLarge = errors.New("document too large")
+	// ErrCausalBaseUnseen is returned when an operation depends on one the server never received.
+	ErrCausalBaseUnseen = errors.New("causal base not seen")
+	// ErrDuplicateOperation is returned when a session resends an operation that was already applied.
+	ErrDuplicateOperation = errors.New("duplicate operation")
+	// ErrNothingToUndo is returned when a user has no recent edit left to undo.
+	ErrNothingToUndo = errors.New("nothing to undo")
+	// ErrNothingToRedo is returned when a user has no undone edit to restore.
+	ErrNothingToRedo = errors.New("nothing to redo")
+	// ErrInvalidTitle is returned when a document title is empty.
+	ErrInvalidTitle = errors.New("invalid title")
+	// ErrNotOwner is returned when someone other than the owner tries to delete a document.
+	ErrNotOwner = errors.New("only the owner can delete a document")
+	// ErrInvalidPlayback is returned for a playback range, speed or cursor that makes no sense.
+	ErrInvalidPlayback = errors.New("invalid playback request")
+	// ErrInvalidBatch is returned for an operation batch that is empty, too long or has no base version.
+	ErrInvalidBatch = errors.New("invalid operation batch")
+	// ErrBatchConflict is wrapped by BatchConflict, returned when a batch cannot be merged automatically.
+	ErrBatchConflict = errors.New("batch conflicts with concurrent changes")
 )
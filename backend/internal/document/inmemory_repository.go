@@ -2,7 +2,11 @@ package document
 
 import (
 	"context"
+	"fmt"
+	"maps"
+	"slices"
 	"sync"
+	"time"
 )
 
 // InMemoryRepository is a thread-safe store for development and tests.
@@ -47,7 +51,7 @@ func (r *InMemoryRepository) CreateDocument(_ context.Context, doc Document) (Do
 	if _, ok := r.documents[doc.TenantID]; !ok {
 		r.documents[doc.TenantID] = make(map[string]Document)
 	}
-	r.documents[doc.TenantID][doc.ID] = doc
+	r.documents[doc.TenantID][doc.ID] = cloneDocument(doc)
 	return doc, nil
 }
 
@@ -63,20 +67,27 @@ func (r *InMemoryRepository) GetDocument(_ context.Context, tenantID, documentID
 	if !ok {
 		return Document{}, ErrDocumentNotFound
 	}
-	return doc, nil
+	return cloneDocument(doc), nil
 }
 
 func (r *InMemoryRepository) UpdateDocument(_ context.Context, doc Document) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, ok := r.documents[doc.TenantID]; !ok {
+	return r.storeDocument(doc, doc.Version)
+}
+
+// storeDocument replaces a stored document that is at version. Callers hold
+// r.mu.
+func (r *InMemoryRepository) storeDocument(doc Document, version int64) error {
+	stored, ok := r.documents[doc.TenantID][doc.ID]
+	if !ok {
 		return ErrDocumentNotFound
 	}
-	if _, ok := r.documents[doc.TenantID][doc.ID]; !ok {
-		return ErrDocumentNotFound
+	if stored.Version != version {
+		return fmt.Errorf("%w: stored version %d, expected %d", ErrVersionConflict, stored.Version, version)
 	}
-	r.documents[doc.TenantID][doc.ID] = doc
+	r.documents[doc.TenantID][doc.ID] = cloneDocument(doc)
 	return nil
 }
 
@@ -91,11 +102,33 @@ func (r *InMemoryRepository) ListDocuments(_ context.Context, tenantID string) (
 
 	out := make([]Document, 0, len(tenantDocs))
 	for _, doc := range tenantDocs {
-		out = append(out, doc)
+		out = append(out, cloneDocument(doc))
 	}
 	return out, nil
 }
 
+func (r *InMemoryRepository) DeleteDocument(_ context.Context, tenantID, documentID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.documents[tenantID][documentID]; !ok {
+		return ErrDocumentNotFound
+	}
+	delete(r.documents[tenantID], documentID)
+	delete(r.operations, documentID)
+	delete(r.versions, documentID)
+	return nil
+}
+
+// cloneDocument copies a document's maps and slices so callers never share
+// them with the stored copy, as they would not with a database.
+func cloneDocument(doc Document) Document {
+	doc.Permissions = maps.Clone(doc.Permissions)
+	doc.ShareLinks = slices.Clone(doc.ShareLinks)
+	doc.Clocks = maps.Clone(doc.Clocks)
+	return doc
+}
+
 func (r *InMemoryRepository) SaveOperation(_ context.Context, op Operation) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -104,6 +137,49 @@ func (r *InMemoryRepository) SaveOperation(_ context.Context, op Operation) erro
 	return nil
 }
 
+func (r *InMemoryRepository) CommitOperation(_ context.Context, doc Document, op Operation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.storeDocument(doc, doc.Version-1); err != nil {
+		return err
+	}
+	r.operations[op.DocumentID] = append(r.operations[op.DocumentID], op)
+	return nil
+}
+
+func (r *InMemoryRepository) ListOperations(_ context.Context, tenantID, documentID string, afterVersion int64, limit int) ([]Operation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := []Operation{}
+	for _, op := range r.operations[documentID] {
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		if op.TenantID == tenantID && op.Version > afterVersion {
+			out = append(out, op)
+		}
+	}
+	return out, nil
+}
+
+func (r *InMemoryRepository) ListOperationsBetween(_ context.Context, tenantID, documentID string, from, to time.Time, afterVersion int64, limit int) ([]Operation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := []Operation{}
+	for _, op := range r.operations[documentID] {
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		if op.TenantID == tenantID && op.Version > afterVersion && !op.CreatedAt.Before(from) && op.CreatedAt.Before(to) {
+			out = append(out, op)
+		}
+	}
+	return out, nil
+}
+
 func (r *InMemoryRepository) SaveVersion(_ context.Context, version DocumentVersion) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -125,3 +201,36 @@ func (r *InMemoryRepository) ListVersions(_ context.Context, tenantID, documentI
 	}
 	return append([]DocumentVersion(nil), versions...), nil
 }
+
+func (r *InMemoryRepository) NearestVersion(_ context.Context, tenantID, documentID string, sequence int64) (DocumentVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var best DocumentVersion
+	for _, v := range r.versions[documentID] {
+		if v.TenantID != tenantID || v.Sequence > sequence {
+			continue
+		}
+		// Later snapshots of the same sequence (e.g. a label) win.
+		if best.ID == "" || v.Sequence >= best.Sequence {
+			best = v
+		}
+	}
+	if best.ID == "" {
+		return DocumentVersion{}, ErrVersionNotFound
+	}
+	return best, nil
+}
+
+func (r *InMemoryRepository) LatestVersionSequence(_ context.Context, tenantID, documentID string) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var sequence int64
+	for _, v := range r.versions[documentID] {
+		if v.TenantID == tenantID {
+			sequence = max(sequence, v.Sequence)
+		}
+	}
+	return sequence, nil
+}
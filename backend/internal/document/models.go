@@ -36,9 +36,17 @@ type Operation struct {
 	DocumentID string    `json:"documentId"`
 	TenantID   string    `json:"tenantId"`
 	UserID     string    `json:"userId"`
-	Lamport    int64     `json:"lamport"`
-	Delta      string    `json:"delta"` // transport-safe serialized operation payload
+	Lamport    int64     `json:"lamport"`           // assigned by the server, see clocks.go
+	Version    int64     `json:"version"`           // document version this operation produced
+	Session    string    `json:"session,omitempty"` // editing session that sent it
+	Seq        int64     `json:"seq,omitempty"`     // its number within that session
+	Undoes     string    `json:"undoes,omitempty"`  // ID of the operation this one inverts
+	Redoes     string    `json:"redoes,omitempty"`  // ID of the undo this one inverts
+	Delta      string    `json:"delta"`             // transport-safe serialized operation payload
+	Effect     string    `json:"effect,omitempty"`  // text-level change when Delta is not a text operation
 	CreatedAt  time.Time `json:"createdAt"`
+	// Checksum is the Checksum of the content the operation produced.
+	Checksum string `json:"checksum,omitempty"`
 }
 
 // DocumentVersion stores a fully materialized version snapshot.
@@ -51,6 +59,9 @@ type DocumentVersion struct {
 	Content    string    `json:"content"`
 	Label      string    `json:"label"`
 	CreatedAt  time.Time `json:"createdAt"`
+	// engineState is the engine's state at Sequence, when the engine keeps
+	// one worth checkpointing. It is never sent to clients.
+	engineState string
 }
 
 // User represents a registered user in the system.
@@ -70,7 +81,12 @@ type Document struct {
 	OwnerID     string                 `json:"ownerId"`
 	Permissions map[string]AccessLevel `json:"permissions"`
 	ShareLinks  []ShareLink            `json:"shareLinks"`
+	Engine      string                 `json:"engine"` // ot | crdt
 	Version     int64                  `json:"version"`
+	Lamport     int64                  `json:"lamport"` // highest Lamport time assigned to an operation
 	CreatedAt   time.Time              `json:"createdAt"`
 	UpdatedAt   time.Time              `json:"updatedAt"`
+	// Clocks holds the last operation accepted from each recent editing
+	// session, by user and session ID; see sessionKey.
+	Clocks map[string]SessionClock `json:"-"`
 }
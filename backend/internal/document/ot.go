@@ -0,0 +1,386 @@
+package document
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// OpComponent is a single step of a text operation. Exactly one of the
+// fields is set: Retain skips characters, Insert adds text, Delete removes
+// characters. Offsets count Unicode code points.
+type OpComponent struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// TextOperation is an operational-transformation delta over a whole document.
+// It is serialized in the compact ot.js form: positive integers retain,
+// negative integers delete and strings insert, e.g. [5,"abc",-2].
+type TextOperation struct {
+	Ops       []OpComponent
+	BaseLen   int
+	TargetLen int
+}
+
+// Retain appends a retain step, merging it with a trailing retain.
+func (o *TextOperation) Retain(n int) *TextOperation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLen += n
+	o.TargetLen += n
+	if last := o.last(); last != nil && last.Retain > 0 {
+		last.Retain += n
+		return o
+	}
+	o.Ops = append(o.Ops, OpComponent{Retain: n})
+	return o
+}
+
+// Insert appends an insert step. Inserts are kept ahead of an adjacent
+// delete so equivalent operations share a canonical form.
+func (o *TextOperation) Insert(s string) *TextOperation {
+	if s == "" {
+		return o
+	}
+	o.TargetLen += utf8.RuneCountInString(s)
+	n := len(o.Ops)
+	switch {
+	case n > 0 && o.Ops[n-1].Insert != "":
+		o.Ops[n-1].Insert += s
+	case n > 0 && o.Ops[n-1].Delete > 0:
+		if n > 1 && o.Ops[n-2].Insert != "" {
+			o.Ops[n-2].Insert += s
+		} else {
+			o.Ops = append(o.Ops, o.Ops[n-1])
+			o.Ops[n-1] = OpComponent{Insert: s}
+		}
+	default:
+		o.Ops = append(o.Ops, OpComponent{Insert: s})
+	}
+	return o
+}
+
+// Delete appends a delete step, merging it with a trailing delete.
+func (o *TextOperation) Delete(n int) *TextOperation {
+	if n <= 0 {
+		return o
+	}
+	o.BaseLen += n
+	if last := o.last(); last != nil && last.Delete > 0 {
+		last.Delete += n
+		return o
+	}
+	o.Ops = append(o.Ops, OpComponent{Delete: n})
+	return o
+}
+
+func (o *TextOperation) last() *OpComponent {
+	if len(o.Ops) == 0 {
+		return nil
+	}
+	return &o.Ops[len(o.Ops)-1]
+}
+
+// IsNoop reports whether the operation leaves any document unchanged.
+func (o TextOperation) IsNoop() bool {
+	return len(o.Ops) == 0 || (len(o.Ops) == 1 && o.Ops[0].Retain > 0)
+}
+
+// Apply runs the operation against content.
+func (o TextOperation) Apply(content string) (string, error) {
+	runes := []rune(content)
+	if len(runes) != o.BaseLen {
+		return "", fmt.Errorf("%w: operation expects length %d, document has %d", ErrInvalidDelta, o.BaseLen, len(runes))
+	}
+
+	var b strings.Builder
+	pos := 0
+	for _, c := range o.Ops {
+		switch {
+		case c.Retain > 0:
+			b.WriteString(string(runes[pos : pos+c.Retain]))
+			pos += c.Retain
+		case c.Insert != "":
+			b.WriteString(c.Insert)
+		case c.Delete > 0:
+			pos += c.Delete
+		}
+	}
+	return b.String(), nil
+}
+
+// MarshalJSON encodes the operation in the ot.js array form.
+func (o TextOperation) MarshalJSON() ([]byte, error) {
+	out := make([]any, 0, len(o.Ops))
+	for _, c := range o.Ops {
+		switch {
+		case c.Retain > 0:
+			out = append(out, c.Retain)
+		case c.Insert != "":
+			out = append(out, c.Insert)
+		case c.Delete > 0:
+			out = append(out, -c.Delete)
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes the ot.js array form.
+func (o *TextOperation) UnmarshalJSON(data []byte) error {
+	var raw []any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+
+	*o = TextOperation{}
+	for _, item := range raw {
+		switch v := item.(type) {
+		case string:
+			o.Insert(v)
+		case float64:
+			n := int(v)
+			if float64(n) != v || n == 0 {
+				return fmt.Errorf("%w: bad component %v", ErrInvalidDelta, v)
+			}
+			if n > 0 {
+				o.Retain(n)
+			} else {
+				o.Delete(-n)
+			}
+		default:
+			return fmt.Errorf("%w: bad component %v", ErrInvalidDelta, v)
+		}
+	}
+	return nil
+}
+
+// String returns the serialized delta, suitable for Operation.Delta.
+func (o TextOperation) String() string {
+	b, _ := o.MarshalJSON()
+	return string(b)
+}
+
+// ParseDelta decodes a serialized text operation. Every failure wraps
+// ErrInvalidDelta.
+func ParseDelta(delta string) (TextOperation, error) {
+	var op TextOperation
+	if err := json.Unmarshal([]byte(delta), &op); err != nil {
+		if !errors.Is(err, ErrInvalidDelta) {
+			err = fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+		}
+		return TextOperation{}, err
+	}
+	return op, nil
+}
+
+// Diff builds the operation turning before into after by trimming their
+// common prefix and suffix. It is used for whole-content writes.
+func Diff(before, after string) TextOperation {
+	a, b := []rune(before), []rune(after)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var op TextOperation
+	op.Retain(prefix)
+	op.Delete(len(a) - prefix - suffix)
+	op.Insert(string(b[prefix : len(b)-suffix]))
+	op.Retain(suffix)
+	return op
+}
+
+// TransformIndex maps a position in the document before o to the matching
+// position after it. Text inserted exactly at the position pushes it right.
+func (o TextOperation) TransformIndex(pos int) int {
+	newPos, index := pos, pos
+	for _, c := range o.Ops {
+		if index < 0 {
+			break
+		}
+		switch {
+		case c.Retain > 0:
+			index -= c.Retain
+		case c.Insert != "":
+			newPos += utf8.RuneCountInString(c.Insert)
+		case c.Delete > 0:
+			newPos -= min(index, c.Delete)
+			index -= c.Delete
+		}
+	}
+	return newPos
+}
+
+// Transform takes two operations a and b made against the same document and
+// returns a' and b' such that applying a then b' equals applying b then a'.
+// When both insert at the same position, a's text is placed first.
+func Transform(a, b TextOperation) (TextOperation, TextOperation, error) {
+	if a.BaseLen != b.BaseLen {
+		return TextOperation{}, TextOperation{}, fmt.Errorf("%w: concurrent operations have different base lengths", ErrInvalidDelta)
+	}
+
+	var aPrime, bPrime TextOperation
+	ai, bi := 0, 0
+	var ac, bc *OpComponent
+	next := func(ops []OpComponent, i *int) *OpComponent {
+		if *i >= len(ops) {
+			return nil
+		}
+		c := ops[*i]
+		*i++
+		return &c
+	}
+	ac, bc = next(a.Ops, &ai), next(b.Ops, &bi)
+
+	for ac != nil || bc != nil {
+		if ac != nil && ac.Insert != "" {
+			aPrime.Insert(ac.Insert)
+			bPrime.Retain(utf8.RuneCountInString(ac.Insert))
+			ac = next(a.Ops, &ai)
+			continue
+		}
+		if bc != nil && bc.Insert != "" {
+			aPrime.Retain(utf8.RuneCountInString(bc.Insert))
+			bPrime.Insert(bc.Insert)
+			bc = next(b.Ops, &bi)
+			continue
+		}
+		if ac == nil || bc == nil {
+			return TextOperation{}, TextOperation{}, fmt.Errorf("%w: operations are too short to transform", ErrInvalidDelta)
+		}
+
+		switch {
+		case ac.Retain > 0 && bc.Retain > 0:
+			n := min(ac.Retain, bc.Retain)
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+			ac.Retain -= n
+			bc.Retain -= n
+		case ac.Delete > 0 && bc.Delete > 0:
+			n := min(ac.Delete, bc.Delete)
+			ac.Delete -= n
+			bc.Delete -= n
+		case ac.Delete > 0 && bc.Retain > 0:
+			n := min(ac.Delete, bc.Retain)
+			aPrime.Delete(n)
+			ac.Delete -= n
+			bc.Retain -= n
+		case ac.Retain > 0 && bc.Delete > 0:
+			n := min(ac.Retain, bc.Delete)
+			bPrime.Delete(n)
+			ac.Retain -= n
+			bc.Delete -= n
+		}
+
+		if ac.Retain == 0 && ac.Delete == 0 {
+			ac = next(a.Ops, &ai)
+		}
+		if bc.Retain == 0 && bc.Delete == 0 {
+			bc = next(b.Ops, &bi)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// Compose merges a and b, where b was made against the result of a, into a
+// single operation with the same effect as applying a then b.
+func Compose(a, b TextOperation) (TextOperation, error) {
+	if a.TargetLen != b.BaseLen {
+		return TextOperation{}, fmt.Errorf("%w: cannot compose, lengths %d and %d differ", ErrInvalidDelta, a.TargetLen, b.BaseLen)
+	}
+
+	var out TextOperation
+	ai, bi := 0, 0
+	next := func(ops []OpComponent, i *int) *OpComponent {
+		if *i >= len(ops) {
+			return nil
+		}
+		c := ops[*i]
+		*i++
+		return &c
+	}
+	ac, bc := next(a.Ops, &ai), next(b.Ops, &bi)
+
+	for ac != nil || bc != nil {
+		if ac != nil && ac.Delete > 0 {
+			out.Delete(ac.Delete)
+			ac = next(a.Ops, &ai)
+			continue
+		}
+		if bc != nil && bc.Insert != "" {
+			out.Insert(bc.Insert)
+			bc = next(b.Ops, &bi)
+			continue
+		}
+		if ac == nil || bc == nil {
+			return TextOperation{}, fmt.Errorf("%w: operations are too short to compose", ErrInvalidDelta)
+		}
+
+		switch {
+		case ac.Retain > 0 && bc.Retain > 0:
+			n := min(ac.Retain, bc.Retain)
+			out.Retain(n)
+			ac.Retain -= n
+			bc.Retain -= n
+		case ac.Insert != "" && bc.Delete > 0:
+			runes := []rune(ac.Insert)
+			n := min(len(runes), bc.Delete)
+			ac.Insert = string(runes[n:])
+			bc.Delete -= n
+		case ac.Insert != "" && bc.Retain > 0:
+			runes := []rune(ac.Insert)
+			n := min(len(runes), bc.Retain)
+			out.Insert(string(runes[:n]))
+			ac.Insert = string(runes[n:])
+			bc.Retain -= n
+		case ac.Retain > 0 && bc.Delete > 0:
+			n := min(ac.Retain, bc.Delete)
+			out.Delete(n)
+			ac.Retain -= n
+			bc.Delete -= n
+		}
+
+		if ac.Retain == 0 && ac.Insert == "" {
+			ac = next(a.Ops, &ai)
+		}
+		if bc.Retain == 0 && bc.Delete == 0 {
+			bc = next(b.Ops, &bi)
+		}
+	}
+	return out, nil
+}
+
+// Invert returns the operation that undoes o. content is the text o was
+// applied to; it supplies the characters o deleted.
+func (o TextOperation) Invert(content string) (TextOperation, error) {
+	runes := []rune(content)
+	if len(runes) != o.BaseLen {
+		return TextOperation{}, fmt.Errorf("%w: operation expects length %d, document has %d", ErrInvalidDelta, o.BaseLen, len(runes))
+	}
+
+	var out TextOperation
+	pos := 0
+	for _, c := range o.Ops {
+		switch {
+		case c.Retain > 0:
+			out.Retain(c.Retain)
+			pos += c.Retain
+		case c.Insert != "":
+			out.Delete(utf8.RuneCountInString(c.Insert))
+		case c.Delete > 0:
+			out.Insert(string(runes[pos : pos+c.Delete]))
+			pos += c.Delete
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,200 @@
+package document
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustParse(t *testing.T, delta string) TextOperation {
+	t.Helper()
+	op, err := ParseDelta(delta)
+	if err != nil {
+		t.Fatalf("ParseDelta(%s): %v", delta, err)
+	}
+	return op
+}
+
+func mustApply(t *testing.T, op TextOperation, content string) string {
+	t.Helper()
+	out, err := op.Apply(content)
+	if err != nil {
+		t.Fatalf("apply %s to %q: %v", op, content, err)
+	}
+	return out
+}
+
+func TestTransformConverges(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		a, b    string
+		want    string
+	}{
+		{"disjoint edits", "hello world", `[-1,"H",10]`, `[11,"!"]`, "Hello world!"},
+		{"inserts at one index keep a first", "ab", `[1,"X",1]`, `[1,"Y",1]`, "aXYb"},
+		{"inserts at the start", "ab", `["X",2]`, `["Y",2]`, "XYab"},
+		{"inserts at the end", "ab", `[2,"X"]`, `[2,"Y"]`, "abXY"},
+		{"same delete", "abcdef", `[1,-3,2]`, `[1,-3,2]`, "aef"},
+		{"overlapping deletes", "abcdef", `[1,-3,2]`, `[2,-3,1]`, "af"},
+		{"nested deletes", "abcdef", `[-6]`, `[2,-2,2]`, ""},
+		{"insert inside a delete", "abcdef", `[1,-4,1]`, `[3,"X",3]`, "aXf"},
+		{"replace against replace", "abc", `[-3,"one"]`, `[-3,"two"]`, "onetwo"},
+		{"multi-byte text", "héllo 😀 wörld", `[6,-1,"🎉",6]`, `[8,"ß",5]`, "héllo 🎉 ßwörld"},
+		{"astral inserts", "😀😀", `[1,"🙂",1]`, `[1,"🙃",1]`, "😀🙂🙃😀"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := mustParse(t, c.a), mustParse(t, c.b)
+			aPrime, bPrime, err := Transform(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ab := mustApply(t, bPrime, mustApply(t, a, c.content))
+			ba := mustApply(t, aPrime, mustApply(t, b, c.content))
+			if ab != ba {
+				t.Fatalf("diverged: a then b' = %q, b then a' = %q", ab, ba)
+			}
+			if ab != c.want {
+				t.Fatalf("converged on %q, want %q", ab, c.want)
+			}
+		})
+	}
+}
+
+func TestTransformRejectsMismatchedLengths(t *testing.T) {
+	if _, _, err := Transform(mustParse(t, `[3,"x"]`), mustParse(t, `[4]`)); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("err = %v, want ErrInvalidDelta", err)
+	}
+}
+
+func TestApplyRejectsLengthMismatch(t *testing.T) {
+	cases := []struct {
+		delta, content string
+	}{
+		{`[3,"x"]`, "ab"},
+		{`[3,"x"]`, "abcd"},
+		{`[-2]`, "😀"}, // one code point, though two UTF-16 units
+		{`["x"]`, "a"},
+	}
+	for _, c := range cases {
+		op := mustParse(t, c.delta)
+		if _, err := op.Apply(c.content); !errors.Is(err, ErrInvalidDelta) {
+			t.Errorf("apply %s to %q: err = %v, want ErrInvalidDelta", c.delta, c.content, err)
+		}
+		if _, err := op.Invert(c.content); !errors.Is(err, ErrInvalidDelta) {
+			t.Errorf("invert %s against %q: err = %v, want ErrInvalidDelta", c.delta, c.content, err)
+		}
+	}
+}
+
+func TestParseDeltaRejectsBadComponents(t *testing.T) {
+	for _, delta := range []string{`[0]`, `[1.5]`, `[true]`, `{"retain":1}`, `[1,`} {
+		if _, err := ParseDelta(delta); !errors.Is(err, ErrInvalidDelta) {
+			t.Errorf("ParseDelta(%s): err = %v, want ErrInvalidDelta", delta, err)
+		}
+	}
+}
+
+func TestCanonicalForm(t *testing.T) {
+	cases := []struct {
+		delta, want string
+	}{
+		{`[1,2,"a","b",-1,-2]`, `[3,"ab",-3]`},
+		{`[-2,"x",3]`, `["x",-2,3]`},
+		{`[-1,"x",-1,"y"]`, `["xy",-2]`},
+		{`[2,-1,"",1]`, `[2,-1,1]`},
+		{`["😀",1]`, `["😀",1]`},
+	}
+	for _, c := range cases {
+		if got := mustParse(t, c.delta).String(); got != c.want {
+			t.Errorf("%s normalizes to %s, want %s", c.delta, got, c.want)
+		}
+	}
+
+	op := mustParse(t, `["😀",-1,2]`)
+	if op.BaseLen != 3 || op.TargetLen != 3 {
+		t.Fatalf("lengths = %d -> %d, want 3 -> 3 in code points", op.BaseLen, op.TargetLen)
+	}
+	if !mustParse(t, `[5]`).IsNoop() || mustParse(t, `[5,"x"]`).IsNoop() {
+		t.Fatal("IsNoop disagrees on a lone retain")
+	}
+}
+
+func TestComposeInvertRoundTrip(t *testing.T) {
+	cases := []struct {
+		content, delta string
+	}{
+		{"hello world", `[-1,"H",10]`},
+		{"hello world", `[5,-6,"!"]`},
+		{"", `["new"]`},
+		{"abc", `[-3]`},
+		{"héllo 😀", `[1,-1,"e",4,-1,"🎉"]`},
+	}
+	for _, c := range cases {
+		op := mustParse(t, c.delta)
+		inverse, err := op.Invert(c.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := mustApply(t, op, c.content)
+		if got := mustApply(t, inverse, after); got != c.content {
+			t.Errorf("%s then its inverse gives %q, want %q", c.delta, got, c.content)
+		}
+		both, err := Compose(op, inverse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mustApply(t, both, c.content); got != c.content {
+			t.Errorf("%s composed with its inverse gives %q", c.delta, got)
+		}
+	}
+}
+
+func TestComposeMatchesSequentialApply(t *testing.T) {
+	content := "the quick brown fox"
+	a := mustParse(t, `[4,-5,"slow",10]`)
+	b := mustParse(t, `[8,"ish",7,-3,"cat"]`)
+	both, err := Compose(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustApply(t, b, mustApply(t, a, content))
+	if got := mustApply(t, both, content); got != want {
+		t.Fatalf("composed gives %q, sequential %q", got, want)
+	}
+	if _, err := Compose(b, a); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("compose in the wrong order: err = %v, want ErrInvalidDelta", err)
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	cases := []struct {
+		delta string
+		pos   int
+		want  int
+	}{
+		{`[2,"xy",3]`, 1, 1},    // before the insert
+		{`[2,"xy",3]`, 2, 4},    // at the insert: pushed right
+		{`[2,"xy",3]`, 4, 6},    // after the insert
+		{`[1,-2,2]`, 0, 0},      // before the delete
+		{`[1,-2,2]`, 2, 1},      // inside the delete: collapses to its start
+		{`[1,-2,2]`, 3, 1},      // at the delete's end
+		{`[1,-2,2]`, 5, 3},      // after it
+		{`["😀",2]`, 1, 2},       // one code point per emoji
+		{`[1,-1,"ab",1]`, 2, 3}, // after a replacement
+	}
+	for _, c := range cases {
+		if got := mustParse(t, c.delta).TransformIndex(c.pos); got != c.want {
+			t.Errorf("%s maps %d to %d, want %d", c.delta, c.pos, got, c.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, c := range [][2]string{{"", "abc"}, {"abc", ""}, {"hello", "help"}, {"a😀b", "a🎉b"}, {"same", "same"}} {
+		op := Diff(c[0], c[1])
+		if got := mustApply(t, op, c[0]); got != c[1] {
+			t.Errorf("Diff(%q, %q) gives %q", c[0], c[1], got)
+		}
+	}
+}
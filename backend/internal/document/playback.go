@@ -0,0 +1,111 @@
+package document
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Playback limits.
+const (
+	DefaultPlaybackLimit = 500
+	MaxPlaybackLimit     = 1000
+	// MaxPlaybackDelay caps the pause before a step, after speed-up, so a
+	// document left alone for hours does not stall its replay.
+	MaxPlaybackDelay = 2 * time.Second
+)
+
+// PlaybackQuery selects part of a document's history to replay.
+type PlaybackQuery struct {
+	// From and To bound the operations' CreatedAt, To exclusive. A zero
+	// To means now.
+	From, To time.Time
+	// After is the cursor from the previous page; zero for the first.
+	After int64
+	Limit int
+	// Speed divides the real pauses between operations; zero means 1.
+	Speed float64
+}
+
+// PlaybackStep is an operation with how long to wait before applying it.
+type PlaybackStep struct {
+	Operation
+	DelayMs int64 `json:"delayMs"`
+}
+
+// PlaybackPage is one page of a replay. Applying each step's effect, or
+// its delta when it has none, to Start reproduces every version in turn.
+type PlaybackPage struct {
+	// Start is the document just before the first step; it is only set
+	// on the first page.
+	Start *DocumentVersion `json:"start,omitempty"`
+	Steps []PlaybackStep   `json:"steps"`
+	// Next is the After cursor for the following page; zero on the last.
+	Next int64 `json:"next,omitempty"`
+}
+
+// Playback returns a page of the operations made to a document between two
+// points in time, in the order they were applied.
+func (s *Service) Playback(ctx context.Context, tenantID, documentID string, q PlaybackQuery) (PlaybackPage, error) {
+	if q.To.IsZero() {
+		q.To = time.Now().UTC()
+	}
+	if q.Speed == 0 {
+		q.Speed = 1
+	}
+	switch {
+	case q.Speed < 0:
+		return PlaybackPage{}, fmt.Errorf("%w: speed must be positive", ErrInvalidPlayback)
+	case !q.From.Before(q.To):
+		return PlaybackPage{}, fmt.Errorf("%w: from must be before to", ErrInvalidPlayback)
+	case q.After < 0:
+		return PlaybackPage{}, fmt.Errorf("%w: bad cursor", ErrInvalidPlayback)
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultPlaybackLimit
+	}
+	q.Limit = min(q.Limit, MaxPlaybackLimit)
+	if _, err := s.repo.GetDocument(ctx, tenantID, documentID); err != nil {
+		return PlaybackPage{}, err
+	}
+
+	// Version 1 is the document as created, so replays start after it. A
+	// later page re-reads the previous page's last operation to time the
+	// first pause. One more row than the page tells whether another follows.
+	after, fetch := int64(1), q.Limit+1
+	if q.After > 1 {
+		after, fetch = q.After-1, fetch+1
+	}
+	ops, err := s.repo.ListOperationsBetween(ctx, tenantID, documentID, q.From, q.To, after, fetch)
+	if err != nil {
+		return PlaybackPage{}, fmt.Errorf("list operations: %w", err)
+	}
+	var prev *Operation
+	if len(ops) > 0 && ops[0].Version == q.After {
+		prev = &ops[0]
+		ops = ops[1:]
+	}
+	page := PlaybackPage{Steps: make([]PlaybackStep, 0, min(len(ops), q.Limit))}
+	if len(ops) > q.Limit {
+		ops = ops[:q.Limit]
+		page.Next = ops[len(ops)-1].Version
+	}
+	for i, op := range ops {
+		step := PlaybackStep{Operation: op}
+		if prev != nil {
+			delay := time.Duration(float64(op.CreatedAt.Sub(prev.CreatedAt)) / q.Speed)
+			step.DelayMs = min(max(delay, 0), MaxPlaybackDelay).Milliseconds()
+		}
+		page.Steps = append(page.Steps, step)
+		prev = &ops[i]
+	}
+
+	if q.After == 0 && len(ops) > 0 {
+		start, err := s.VersionAt(ctx, tenantID, documentID, ops[0].Version-1)
+		if err != nil {
+			return PlaybackPage{}, err
+		}
+		page.Start = &start
+	}
+	return page, nil
+}
@@ -0,0 +1,196 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// playbackDoc builds a document whose version v, after the first, appends
+// one letter and was made at epoch plus v seconds.
+func playbackDoc(t *testing.T, policy VersionPolicy, edits int) (*Service, Document, time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	repo := NewInMemoryRepository()
+	svc := NewService(repo)
+	svc.SetVersionPolicy(policy)
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "", EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := ""
+	for i := 0; i < edits; i++ {
+		content += string(rune('a' + i%26))
+		if doc, _, _, err = svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", NewContent: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	epoch := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.mu.Lock()
+	for i := range repo.operations[doc.ID] {
+		op := &repo.operations[doc.ID][i]
+		op.CreatedAt = epoch.Add(time.Duration(op.Version) * time.Second)
+	}
+	repo.mu.Unlock()
+	return svc, doc, epoch
+}
+
+// replay applies a page's steps to content.
+func replay(t *testing.T, content string, steps []PlaybackStep) string {
+	t.Helper()
+	for _, step := range steps {
+		effect, err := step.TextEffect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, err = effect.Apply(content); err != nil {
+			t.Fatalf("step %d: %v", step.Version, err)
+		}
+	}
+	return content
+}
+
+func TestPlaybackPages(t *testing.T) {
+	ctx := context.Background()
+	svc, doc, epoch := playbackDoc(t, VersionPolicy{}, 10)
+	q := PlaybackQuery{From: epoch, To: epoch.Add(time.Hour), Limit: 4}
+
+	var content string
+	var steps []PlaybackStep
+	for pages := 0; ; pages++ {
+		page, err := svc.Playback(ctx, "t", doc.ID, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (pages == 0) != (page.Start != nil) {
+			t.Fatalf("page %d: start = %+v, want it on the first page only", pages, page.Start)
+		}
+		if page.Start != nil {
+			if page.Start.Sequence != 1 || page.Start.Content != "" {
+				t.Fatalf("start = %d %q, want the document as created", page.Start.Sequence, page.Start.Content)
+			}
+			content = page.Start.Content
+		}
+		if len(page.Steps) > q.Limit {
+			t.Fatalf("page %d has %d steps, limit %d", pages, len(page.Steps), q.Limit)
+		}
+		content = replay(t, content, page.Steps)
+		steps = append(steps, page.Steps...)
+		if page.Next == 0 {
+			break
+		}
+		q.After = page.Next
+	}
+
+	if content != doc.Content {
+		t.Fatalf("replayed %q, want %q", content, doc.Content)
+	}
+	for i, step := range steps {
+		if step.Version != int64(i)+2 {
+			t.Fatalf("step %d is version %d: pages skip or repeat operations", i, step.Version)
+		}
+		// Only the very first step has nothing to wait for; later pages
+		// are timed from the previous page's last step.
+		if want := int64(1000); i > 0 && step.DelayMs != want {
+			t.Fatalf("step %d waits %dms, want %d", i, step.DelayMs, want)
+		}
+	}
+	if steps[0].DelayMs != 0 {
+		t.Fatalf("first step waits %dms", steps[0].DelayMs)
+	}
+}
+
+func TestPlaybackLimits(t *testing.T) {
+	ctx := context.Background()
+	svc, doc, epoch := playbackDoc(t, VersionPolicy{Every: 100}, MaxPlaybackLimit+5)
+
+	for _, tt := range []struct {
+		limit, want int
+	}{
+		{0, DefaultPlaybackLimit},
+		{-1, DefaultPlaybackLimit},
+		{MaxPlaybackLimit * 10, MaxPlaybackLimit},
+	} {
+		page, err := svc.Playback(ctx, "t", doc.ID, PlaybackQuery{From: epoch, Limit: tt.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Steps) != tt.want || page.Next != page.Steps[len(page.Steps)-1].Version {
+			t.Fatalf("limit %d: %d steps, next %d; want %d steps", tt.limit, len(page.Steps), page.Next, tt.want)
+		}
+	}
+
+	for _, q := range []PlaybackQuery{
+		{From: epoch, Speed: -1},
+		{From: epoch, To: epoch},
+		{From: epoch.Add(time.Hour), To: epoch},
+		{From: epoch, After: -1},
+	} {
+		if _, err := svc.Playback(ctx, "t", doc.ID, q); !errors.Is(err, ErrInvalidPlayback) {
+			t.Fatalf("%+v: err = %v, want ErrInvalidPlayback", q, err)
+		}
+	}
+	if _, err := svc.Playback(ctx, "t", "missing", PlaybackQuery{From: epoch}); !errors.Is(err, ErrDocumentNotFound) {
+		t.Fatalf("missing document: err = %v", err)
+	}
+}
+
+func TestPlaybackSpeed(t *testing.T) {
+	ctx := context.Background()
+	svc, doc, epoch := playbackDoc(t, VersionPolicy{}, 4)
+	for _, tt := range []struct {
+		speed float64
+		want  int64
+	}{
+		{0, 1000},
+		{1, 1000},
+		{4, 250},
+		{0.1, MaxPlaybackDelay.Milliseconds()},
+	} {
+		page, err := svc.Playback(ctx, "t", doc.ID, PlaybackQuery{From: epoch, Speed: tt.speed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range page.Steps[1:] {
+			if step.DelayMs != tt.want {
+				t.Fatalf("speed %v: step %d waits %dms, want %d", tt.speed, step.Version, step.DelayMs, tt.want)
+			}
+		}
+	}
+}
+
+// TestPlaybackFromSnapshot starts replays partway through history, where
+// the start is rebuilt from the nearest snapshot rather than from creation.
+func TestPlaybackFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	svc, doc, epoch := playbackDoc(t, VersionPolicy{Every: 3}, 12)
+	versions, err := svc.ListVersions(ctx, "t", doc.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) < 3 {
+		t.Fatalf("only %d snapshots taken", len(versions))
+	}
+
+	for _, from := range []int64{4, 5, 8, doc.Version} {
+		page, err := svc.Playback(ctx, "t", doc.ID, PlaybackQuery{From: epoch.Add(time.Duration(from) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := svc.VersionAt(ctx, "t", doc.ID, from-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Start == nil || page.Start.Sequence != from-1 || page.Start.Content != want.Content {
+			t.Fatalf("from version %d: start = %+v, want %q", from, page.Start, want.Content)
+		}
+		if len(want.Content) != int(from)-2 {
+			t.Fatalf("version %d is %q", from-1, want.Content)
+		}
+		if got := replay(t, page.Start.Content, page.Steps); got != doc.Content {
+			t.Fatalf("from version %d: replayed %q, want %q", from, got, doc.Content)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package document
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -69,6 +73,21 @@ func (r *PostgresRepository) EnsureSchema(ctx context.Context) error {
 			delta TEXT NOT NULL,
 			created_at TIMESTAMP NOT NULL
 		);`,
+		`ALTER TABLE operations ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;`,
+		`CREATE INDEX IF NOT EXISTS operations_document_version_idx ON operations (document_id, version);`,
+		`ALTER TABLE documents ADD COLUMN IF NOT EXISTS engine TEXT NOT NULL DEFAULT 'ot';`,
+		`ALTER TABLE operations ADD COLUMN IF NOT EXISTS effect TEXT NOT NULL DEFAULT '';`,
+		`CREATE INDEX IF NOT EXISTS document_versions_document_sequence_idx ON document_versions (document_id, sequence);`,
+		`ALTER TABLE documents ADD COLUMN IF NOT EXISTS lamport BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE documents ADD COLUMN IF NOT EXISTS clocks JSONB NOT NULL DEFAULT '{}';`,
+		// Older clients stamp operations with version+1; start clocks there.
+		`UPDATE documents SET lamport = version WHERE lamport < version;`,
+		`ALTER TABLE operations ADD COLUMN IF NOT EXISTS session TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE operations ADD COLUMN IF NOT EXISTS seq BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE operations ADD COLUMN IF NOT EXISTS undoes TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE operations ADD COLUMN IF NOT EXISTS redoes TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE operations ADD COLUMN IF NOT EXISTS checksum TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE document_versions ADD COLUMN IF NOT EXISTS engine_state TEXT NOT NULL DEFAULT '';`,
 	}
 
 	for _, q := range queries {
@@ -106,9 +125,9 @@ func (r *PostgresRepository) CreateDocument(ctx context.Context, doc Document) (
 	defer tx.Rollback(ctx)
 
 	_, err = tx.Exec(ctx, `
-		INSERT INTO documents (id, tenant_id, title, content, owner_id, version, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	`, doc.ID, doc.TenantID, doc.Title, doc.Content, doc.OwnerID, doc.Version, doc.CreatedAt, doc.UpdatedAt)
+		INSERT INTO documents (id, tenant_id, title, content, owner_id, engine, version, lamport, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, doc.ID, doc.TenantID, doc.Title, doc.Content, doc.OwnerID, doc.Engine, doc.Version, doc.Lamport, doc.CreatedAt, doc.UpdatedAt)
 	if err != nil {
 		return Document{}, err
 	}
@@ -141,11 +160,14 @@ func (r *PostgresRepository) CreateDocument(ctx context.Context, doc Document) (
 func (r *PostgresRepository) GetDocument(ctx context.Context, tenantID, documentID string) (Document, error) {
 	var doc Document
 	err := r.db.QueryRow(ctx, `
-		SELECT id, tenant_id, title, content, owner_id, version, created_at, updated_at
+		SELECT id, tenant_id, title, content, owner_id, engine, version, lamport, clocks, created_at, updated_at
 		FROM documents WHERE tenant_id = $1 AND id = $2
-	`, tenantID, documentID).Scan(&doc.ID, &doc.TenantID, &doc.Title, &doc.Content, &doc.OwnerID, &doc.Version, &doc.CreatedAt, &doc.UpdatedAt)
+	`, tenantID, documentID).Scan(&doc.ID, &doc.TenantID, &doc.Title, &doc.Content, &doc.OwnerID, &doc.Engine, &doc.Version, &doc.Lamport, &doc.Clocks, &doc.CreatedAt, &doc.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Document{}, ErrDocumentNotFound
+	}
 	if err != nil {
-		return Document{}, err // Could check for pgx.ErrNoRows and return ErrDocumentNotFound
+		return Document{}, err
 	}
 
 	// Load Permissions
@@ -192,15 +214,32 @@ func (r *PostgresRepository) UpdateDocument(ctx context.Context, doc Document) e
 	}
 	defer tx.Rollback(ctx)
 
+	if err := writeDocument(ctx, tx, doc, doc.Version); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// writeDocument replaces a document row, with its permissions and share
+// links, if the stored row is at version. The row lock taken by the update
+// holds off other writers until tx ends.
+func writeDocument(ctx context.Context, tx pgx.Tx, doc Document, version int64) error {
 	ct, err := tx.Exec(ctx, `
-		UPDATE documents SET title=$1, content=$2, version=$3, updated_at=$4
-		WHERE id=$5 AND tenant_id=$6
-	`, doc.Title, doc.Content, doc.Version, doc.UpdatedAt, doc.ID, doc.TenantID)
+		UPDATE documents SET title=$1, content=$2, version=$3, lamport=$4, clocks=$5, updated_at=$6
+		WHERE id=$7 AND tenant_id=$8 AND version=$9
+	`, doc.Title, doc.Content, doc.Version, doc.Lamport, clocksJSON(doc.Clocks), doc.UpdatedAt, doc.ID, doc.TenantID, version)
 	if err != nil {
 		return err
 	}
 	if ct.RowsAffected() == 0 {
-		return fmt.Errorf("document not found or no change")
+		var exists bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM documents WHERE id=$1 AND tenant_id=$2)`, doc.ID, doc.TenantID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrDocumentNotFound
+		}
+		return fmt.Errorf("%w: expected version %d", ErrVersionConflict, version)
 	}
 
 	// Replace Permissions
@@ -228,13 +267,12 @@ func (r *PostgresRepository) UpdateDocument(ctx context.Context, doc Document) e
 			return err
 		}
 	}
-
-	return tx.Commit(ctx)
+	return nil
 }
 
 func (r *PostgresRepository) ListDocuments(ctx context.Context, tenantID string) ([]Document, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, tenant_id, title, content, owner_id, version, created_at, updated_at
+		SELECT id, tenant_id, title, content, owner_id, engine, version, created_at, updated_at
 		FROM documents WHERE tenant_id = $1 ORDER BY updated_at DESC
 	`, tenantID)
 	if err != nil {
@@ -245,7 +283,7 @@ func (r *PostgresRepository) ListDocuments(ctx context.Context, tenantID string)
 	docs := []Document{}
 	for rows.Next() {
 		var doc Document
-		if err := rows.Scan(&doc.ID, &doc.TenantID, &doc.Title, &doc.Content, &doc.OwnerID, &doc.Version, &doc.CreatedAt, &doc.UpdatedAt); err != nil {
+		if err := rows.Scan(&doc.ID, &doc.TenantID, &doc.Title, &doc.Content, &doc.OwnerID, &doc.Engine, &doc.Version, &doc.CreatedAt, &doc.UpdatedAt); err != nil {
 			return nil, err
 		}
 		// Optimization: Don't load permissions/links for list view if not needed,
@@ -255,28 +293,123 @@ func (r *PostgresRepository) ListDocuments(ctx context.Context, tenantID string)
 	return docs, nil
 }
 
+// DeleteDocument relies on ON DELETE CASCADE to remove the document's
+// permissions, share links, operations and versions.
+func (r *PostgresRepository) DeleteDocument(ctx context.Context, tenantID, documentID string) error {
+	ct, err := r.db.Exec(ctx, `DELETE FROM documents WHERE id = $1 AND tenant_id = $2`, documentID, tenantID)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrDocumentNotFound
+	}
+	return nil
+}
+
 func (r *PostgresRepository) SaveOperation(ctx context.Context, op Operation) error {
-	_, err := r.db.Exec(ctx, `
-		INSERT INTO operations (id, document_id, tenant_id, user_id, lamport, delta, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`, op.ID, op.DocumentID, op.TenantID, op.UserID, op.Lamport, op.Delta, op.CreatedAt)
+	return insertOperation(ctx, r.db, op)
+}
+
+func (r *PostgresRepository) CommitOperation(ctx context.Context, doc Document, op Operation) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := writeDocument(ctx, tx, doc, doc.Version-1); err != nil {
+		return err
+	}
+	if err := insertOperation(ctx, tx, op); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// execer is a pool or a transaction.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func insertOperation(ctx context.Context, db execer, op Operation) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO operations (id, document_id, tenant_id, user_id, lamport, version, session, seq, undoes, redoes, delta, effect, checksum, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	`, op.ID, op.DocumentID, op.TenantID, op.UserID, op.Lamport, op.Version, op.Session, op.Seq, op.Undoes, op.Redoes, op.Delta, op.Effect, op.Checksum, op.CreatedAt)
 	return err
 }
 
+func (r *PostgresRepository) ListOperations(ctx context.Context, tenantID, documentID string, afterVersion int64, limit int) ([]Operation, error) {
+	// LIMIT NULL means no limit.
+	var lim *int
+	if limit > 0 {
+		lim = &limit
+	}
+	rows, err := r.db.Query(ctx, `
+		SELECT id, document_id, tenant_id, user_id, lamport, version, session, seq, undoes, redoes, delta, effect, checksum, created_at
+		FROM operations WHERE tenant_id = $1 AND document_id = $2 AND version > $3
+		ORDER BY version ASC LIMIT $4
+	`, tenantID, documentID, afterVersion, lim)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ops := []Operation{}
+	for rows.Next() {
+		var op Operation
+		if err := rows.Scan(&op.ID, &op.DocumentID, &op.TenantID, &op.UserID, &op.Lamport, &op.Version, &op.Session, &op.Seq, &op.Undoes, &op.Redoes, &op.Delta, &op.Effect, &op.Checksum, &op.CreatedAt); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+func (r *PostgresRepository) ListOperationsBetween(ctx context.Context, tenantID, documentID string, from, to time.Time, afterVersion int64, limit int) ([]Operation, error) {
+	var lim *int
+	if limit > 0 {
+		lim = &limit
+	}
+	rows, err := r.db.Query(ctx, `
+		SELECT id, document_id, tenant_id, user_id, lamport, version, session, seq, undoes, redoes, delta, effect, checksum, created_at
+		FROM operations WHERE tenant_id = $1 AND document_id = $2 AND version > $3 AND created_at >= $4 AND created_at < $5
+		ORDER BY version ASC LIMIT $6
+	`, tenantID, documentID, afterVersion, from, to, lim)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ops := []Operation{}
+	for rows.Next() {
+		var op Operation
+		if err := rows.Scan(&op.ID, &op.DocumentID, &op.TenantID, &op.UserID, &op.Lamport, &op.Version, &op.Session, &op.Seq, &op.Undoes, &op.Redoes, &op.Delta, &op.Effect, &op.Checksum, &op.CreatedAt); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
 func (r *PostgresRepository) SaveVersion(ctx context.Context, version DocumentVersion) error {
 	_, err := r.db.Exec(ctx, `
-		INSERT INTO document_versions (id, document_id, tenant_id, author_id, sequence, content, label, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	`, version.ID, version.DocumentID, version.TenantID, version.AuthorID, version.Sequence, version.Content, version.Label, version.CreatedAt)
+		INSERT INTO document_versions (id, document_id, tenant_id, author_id, sequence, content, label, created_at, engine_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, version.ID, version.DocumentID, version.TenantID, version.AuthorID, version.Sequence, version.Content, version.Label, version.CreatedAt, version.engineState)
 	return err
 }
 
 func (r *PostgresRepository) ListVersions(ctx context.Context, tenantID, documentID string, limit int) ([]DocumentVersion, error) {
+	var lim *int
+	if limit > 0 {
+		lim = &limit
+	}
 	rows, err := r.db.Query(ctx, `
 		SELECT id, document_id, tenant_id, author_id, sequence, content, label, created_at
 		FROM document_versions WHERE tenant_id = $1 AND document_id = $2
 		ORDER BY sequence DESC LIMIT $3
-	`, tenantID, documentID, limit)
+	`, tenantID, documentID, lim)
 	if err != nil {
 		return nil, err
 	}
@@ -292,3 +425,33 @@ func (r *PostgresRepository) ListVersions(ctx context.Context, tenantID, documen
 	}
 	return versions, nil
 }
+
+func (r *PostgresRepository) NearestVersion(ctx context.Context, tenantID, documentID string, sequence int64) (DocumentVersion, error) {
+	var v DocumentVersion
+	err := r.db.QueryRow(ctx, `
+		SELECT id, document_id, tenant_id, author_id, sequence, content, label, created_at, engine_state
+		FROM document_versions WHERE tenant_id = $1 AND document_id = $2 AND sequence <= $3
+		ORDER BY sequence DESC, created_at DESC LIMIT 1
+	`, tenantID, documentID, sequence).Scan(&v.ID, &v.DocumentID, &v.TenantID, &v.AuthorID, &v.Sequence, &v.Content, &v.Label, &v.CreatedAt, &v.engineState)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return DocumentVersion{}, ErrVersionNotFound
+	}
+	return v, err
+}
+
+func (r *PostgresRepository) LatestVersionSequence(ctx context.Context, tenantID, documentID string) (int64, error) {
+	var sequence int64
+	err := r.db.QueryRow(ctx, `
+		SELECT COALESCE(MAX(sequence), 0)
+		FROM document_versions WHERE tenant_id = $1 AND document_id = $2
+	`, tenantID, documentID).Scan(&sequence)
+	return sequence, err
+}
+
+// clocksJSON keeps a nil map from being stored as JSON null.
+func clocksJSON(clocks map[string]SessionClock) map[string]SessionClock {
+	if clocks == nil {
+		return map[string]SessionClock{}
+	}
+	return clocks
+}
@@ -2,6 +2,7 @@ package document
 
 import (
 	"context"
+	"time"
 )
 
 // Repository abstracts persistence for documents, operations, and versions.
@@ -11,11 +12,29 @@ type Repository interface {
 
 	CreateDocument(ctx context.Context, doc Document) (Document, error)
 	GetDocument(ctx context.Context, tenantID, documentID string) (Document, error)
+	// UpdateDocument stores doc if the stored copy is still at doc.Version,
+	// and returns ErrVersionConflict if it has moved on.
 	UpdateDocument(ctx context.Context, doc Document) error
 	ListDocuments(ctx context.Context, tenantID string) ([]Document, error)
+	// DeleteDocument removes a document with its operations and versions.
+	DeleteDocument(ctx context.Context, tenantID, documentID string) error
 
 	SaveOperation(ctx context.Context, op Operation) error
+	// CommitOperation stores doc and the operation that produced it in one
+	// transaction. The stored copy must be at the version before doc's, or
+	// nothing is written and it returns ErrVersionConflict.
+	CommitOperation(ctx context.Context, doc Document, op Operation) error
+	ListOperations(ctx context.Context, tenantID, documentID string, afterVersion int64, limit int) ([]Operation, error)
+	// ListOperationsBetween lists operations after afterVersion created in
+	// [from, to), in version order.
+	ListOperationsBetween(ctx context.Context, tenantID, documentID string, from, to time.Time, afterVersion int64, limit int) ([]Operation, error)
 
 	SaveVersion(ctx context.Context, version DocumentVersion) error
 	ListVersions(ctx context.Context, tenantID, documentID string, limit int) ([]DocumentVersion, error)
+	// NearestVersion returns the latest snapshot with Sequence <= sequence,
+	// or ErrVersionNotFound.
+	NearestVersion(ctx context.Context, tenantID, documentID string, sequence int64) (DocumentVersion, error)
+	// LatestVersionSequence returns the Sequence of the newest snapshot, or
+	// zero when there is none.
+	LatestVersionSequence(ctx context.Context, tenantID, documentID string) (int64, error)
 }
@@ -4,17 +4,74 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Service orchestrates document workflows (creation, permissions, versioning).
 type Service struct {
-	repo Repository
+	repo     Repository
+	engines  map[string]Engine
+	policy   VersionPolicy
+	maxBytes int
+
+	mu        sync.Mutex
+	listeners []func(Change) // see OnChange
 }
 
+// DefaultMaxContentBytes caps document content at 16 MiB.
+const DefaultMaxContentBytes = 16 << 20
+
 func NewService(repo Repository) *Service {
-	return &Service{repo: repo}
+	s := &Service{
+		repo:     repo,
+		engines:  make(map[string]Engine),
+		policy:   DefaultVersionPolicy,
+		maxBytes: DefaultMaxContentBytes,
+	}
+	s.RegisterEngine(newOTEngine(repo))
+	s.RegisterEngine(newCRDTEngine(repo))
+	return s
+}
+
+// RegisterEngine makes an engine selectable by name for new documents.
+func (s *Service) RegisterEngine(engine Engine) {
+	s.engines[engine.Name()] = engine
+}
+
+// SetMaxContentBytes changes the largest document content the service
+// accepts, in UTF-8 bytes.
+func (s *Service) SetMaxContentBytes(n int) {
+	s.maxBytes = n
+}
+
+// MaxContentBytes reports the document size limit.
+func (s *Service) MaxContentBytes() int {
+	return s.maxBytes
+}
+
+// checkSize rejects content over the size limit.
+func (s *Service) checkSize(content string) error {
+	if len(content) > s.maxBytes {
+		return fmt.Errorf("%w: %d bytes exceeds the %d byte limit", ErrDocumentTooLarge, len(content), s.maxBytes)
+	}
+	return nil
+}
+
+// engineFor resolves a document's engine. Documents created before engines
+// were selectable have no name and use OT.
+func (s *Service) engineFor(name string) (Engine, error) {
+	if name == "" {
+		name = EngineOT
+	}
+	engine, ok := s.engines[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEngine, name)
+	}
+	return engine, nil
 }
 
 type ApplyOperationInput struct {
@@ -23,11 +80,36 @@ type ApplyOperationInput struct {
 	UserID     string
 	Delta      string
 	NewContent string
-	Lamport    int64
-	Label      string
+	// BaseVersion is the document version Delta was built against. Zero
+	// means the current head.
+	BaseVersion int64
+	// Lamport is the sender's clock; it may only name times the server has
+	// issued.
+	Lamport int64
+	// Session identifies the sender's editing session and Seq numbers its
+	// operations from 1. Both are optional.
+	Session string
+	Seq     int64
+
+	// Set by Undo and Redo on the operation they produce.
+	undoes, redoes string
+	// edit is a text operation against BaseVersion, for documents whose
+	// engine does not take text deltas. Each attempt rebases it onto the
+	// head it read before handing the engine the resulting content.
+	edit *TextOperation
+	// Label forces a snapshot of the resulting version under this name.
+	Label string
 }
 
-func (s *Service) CreateDocument(ctx context.Context, tenantID, ownerID, title, initialContent string) (Document, error) {
+func (s *Service) CreateDocument(ctx context.Context, tenantID, ownerID, title, initialContent, engineName string) (Document, error) {
+	engine, err := s.engineFor(engineName)
+	if err != nil {
+		return Document{}, err
+	}
+	if err := s.checkSize(initialContent); err != nil {
+		return Document{}, err
+	}
+
 	now := time.Now().UTC()
 	doc := Document{
 		ID:          NewID(),
@@ -36,15 +118,38 @@ func (s *Service) CreateDocument(ctx context.Context, tenantID, ownerID, title,
 		Content:     initialContent,
 		OwnerID:     ownerID,
 		Permissions: map[string]AccessLevel{ownerID: AccessEdit},
+		Engine:      engine.Name(),
 		Version:     1,
+		Lamport:     1,
 		CreatedAt:   now,
 		UpdatedAt:   now,
 	}
 
+	seed, err := engine.Seed(ctx, doc)
+	if err != nil {
+		return Document{}, fmt.Errorf("seed document: %w", err)
+	}
+
 	if _, err := s.repo.CreateDocument(ctx, doc); err != nil {
 		return Document{}, fmt.Errorf("create document: %w", err)
 	}
 
+	if seed != "" {
+		op := Operation{
+			ID:         NewID(),
+			DocumentID: doc.ID,
+			TenantID:   tenantID,
+			UserID:     ownerID,
+			Version:    doc.Version,
+			Delta:      seed,
+			Checksum:   Checksum(doc.Content),
+			CreatedAt:  now,
+		}
+		if err := s.repo.SaveOperation(ctx, op); err != nil {
+			return Document{}, fmt.Errorf("save operation: %w", err)
+		}
+	}
+
 	version := DocumentVersion{
 		ID:         NewID(),
 		DocumentID: doc.ID,
@@ -52,11 +157,19 @@ func (s *Service) CreateDocument(ctx context.Context, tenantID, ownerID, title,
 		AuthorID:   ownerID,
 		Sequence:   doc.Version,
 		Content:    doc.Content,
-		Label:      "initial",
+		Label:      LabelInitial,
 		CreatedAt:  now,
 	}
 
 	_ = s.repo.SaveVersion(ctx, version)
+	s.emit(Change{
+		Kind:       ChangeCreated,
+		TenantID:   doc.TenantID,
+		DocumentID: doc.ID,
+		UserID:     ownerID,
+		Version:    doc.Version,
+		Document:   &doc,
+	})
 	return doc, nil
 }
 
@@ -68,14 +181,91 @@ func (s *Service) ListDocuments(ctx context.Context, tenantID string) ([]Documen
 	return s.repo.ListDocuments(ctx, tenantID)
 }
 
+// DeleteDocument removes a document and its history. Only the owner may
+// delete it.
+func (s *Service) DeleteDocument(ctx context.Context, tenantID, documentID, userID string) error {
+	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+	if err != nil {
+		return err
+	}
+	if doc.OwnerID != userID {
+		return ErrNotOwner
+	}
+	if err := s.repo.DeleteDocument(ctx, tenantID, documentID); err != nil {
+		return fmt.Errorf("delete document: %w", err)
+	}
+	s.Release(tenantID, documentID)
+	s.emit(Change{
+		Kind:       ChangeDeleted,
+		TenantID:   doc.TenantID,
+		DocumentID: doc.ID,
+		UserID:     userID,
+		Version:    doc.Version,
+		Document:   &doc,
+	})
+	return nil
+}
+
+// maxCommitAttempts bounds how often a change is redone on top of a document
+// that another writer changed first.
+const maxCommitAttempts = 5
+
+// ApplyOperation merges the incoming delta through the document's engine and
+// logs what the engine produced. Clients that only send NewContent are treated
+// as a whole-document replacement of the current content. The returned
+// version is the snapshot taken under the version policy, or the zero value.
+// An operation that loses a race to commit is rebased onto the winner.
 func (s *Service) ApplyOperation(ctx context.Context, in ApplyOperationInput) (Document, Operation, DocumentVersion, error) {
+	for attempt := 1; ; attempt++ {
+		doc, op, version, err := s.applyOperation(ctx, &in)
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxCommitAttempts {
+			return doc, op, version, err
+		}
+	}
+}
+
+// applyOperation makes one attempt at ApplyOperation. It pins a zero
+// BaseVersion to the head it read, so a retry transforms the delta across
+// whatever committed in between.
+func (s *Service) applyOperation(ctx context.Context, in *ApplyOperationInput) (Document, Operation, DocumentVersion, error) {
 	doc, err := s.repo.GetDocument(ctx, in.TenantID, in.DocumentID)
 	if err != nil {
 		return Document{}, Operation{}, DocumentVersion{}, err
 	}
+	if in.BaseVersion == 0 {
+		in.BaseVersion = doc.Version
+	}
+	engine, err := s.engineFor(doc.Engine)
+	if err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, err
+	}
+	if err := checkCausality(doc, *in); err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, err
+	}
+
+	var result EngineResult
+	switch {
+	case in.edit != nil:
+		var content string
+		if content, err = s.applyEdit(ctx, doc, *in.edit, in.BaseVersion); err == nil {
+			result, err = engine.Replace(ctx, doc, content)
+		}
+	case isStructuredDelta(in.Delta):
+		result, err = engine.Apply(ctx, doc, in.Delta, in.BaseVersion, CRDTSite(in.UserID, in.Session))
+	default:
+		result, err = engine.Replace(ctx, doc, in.NewContent)
+	}
+	if err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("apply operation: %w", err)
+	}
+	if err := s.checkSize(result.Content); err != nil {
+		s.abort(doc.TenantID, doc.ID, doc.Version+1)
+		return Document{}, Operation{}, DocumentVersion{}, err
+	}
 
+	before := doc
 	now := time.Now().UTC()
-	doc.Content = in.NewContent
+	doc.Content = result.Content
 	doc.Version++
 	doc.UpdatedAt = now
 
@@ -84,70 +274,195 @@ func (s *Service) ApplyOperation(ctx context.Context, in ApplyOperationInput) (D
 		DocumentID: doc.ID,
 		TenantID:   doc.TenantID,
 		UserID:     in.UserID,
-		Lamport:    in.Lamport,
-		Delta:      in.Delta,
+		Version:    doc.Version,
+		Delta:      result.Delta,
+		Effect:     result.Effect,
+		Undoes:     in.undoes,
+		Redoes:     in.redoes,
+		Checksum:   Checksum(doc.Content),
 		CreatedAt:  now,
 	}
+	advanceClocks(&doc, &op, *in)
 
-	version := DocumentVersion{
-		ID:         NewID(),
-		DocumentID: doc.ID,
-		TenantID:   doc.TenantID,
-		AuthorID:   in.UserID,
-		Sequence:   doc.Version,
-		Content:    doc.Content,
-		Label:      in.Label,
-		CreatedAt:  now,
-	}
-
-	if err := s.repo.UpdateDocument(ctx, doc); err != nil {
+	if err := s.commit(ctx, doc, op); err != nil {
 		return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("apply operation: %w", err)
 	}
-	_ = s.repo.SaveOperation(ctx, op)
-	_ = s.repo.SaveVersion(ctx, version)
 
+	version := s.snapshotForOperation(ctx, before, doc, op, in.Label)
 	return doc, op, version, nil
 }
 
-func (s *Service) SetPermission(ctx context.Context, tenantID, documentID, subjectID string, level AccessLevel) (Document, error) {
-	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+// applyEdit rebases edit, made against baseVersion, over the text effects of
+// the operations since, and returns doc's content with it applied.
+func (s *Service) applyEdit(ctx context.Context, doc Document, edit TextOperation, baseVersion int64) (string, error) {
+	if baseVersion > doc.Version {
+		return "", fmt.Errorf("%w: base %d, head %d", ErrBaseVersionAhead, baseVersion, doc.Version)
+	}
+	if baseVersion == doc.Version {
+		return edit.Apply(doc.Content)
+	}
+	history, err := s.repo.ListOperations(ctx, doc.TenantID, doc.ID, baseVersion, int(doc.Version-baseVersion))
 	if err != nil {
-		return Document{}, err
+		return "", err
+	}
+	if int64(len(history)) != doc.Version-baseVersion {
+		return "", fmt.Errorf("%w: need %d operations since version %d, found %d", ErrHistoryUnavailable, doc.Version-baseVersion, baseVersion, len(history))
+	}
+	for _, h := range history {
+		concurrent, err := h.TextEffect()
+		if err != nil {
+			return "", fmt.Errorf("operation %s: %w", h.ID, err)
+		}
+		if _, edit, err = Transform(concurrent, edit); err != nil {
+			return "", err
+		}
+	}
+	return edit.Apply(doc.Content)
+}
+
+// commit stores doc with the operation that produced it. If that fails the
+// engines may hold the state the operation would have produced, so they are
+// made to discard it.
+func (s *Service) commit(ctx context.Context, doc Document, op Operation) error {
+	err := s.repo.CommitOperation(ctx, doc, op)
+	if err != nil {
+		s.abort(doc.TenantID, doc.ID, doc.Version)
+	}
+	return err
+}
+
+// abort tells engines that version of a document will not commit.
+func (s *Service) abort(tenantID, documentID string, version int64) {
+	for _, engine := range s.engines {
+		if a, ok := engine.(aborter); ok {
+			a.Abort(tenantID, documentID, version)
+		}
 	}
-	if doc.Permissions == nil {
-		doc.Permissions = make(map[string]AccessLevel)
+}
+
+// OperationsSince returns the operations committed after version, oldest
+// first, so a reconnecting client can catch up. It returns at most limit
+// operations (0 for all) and ErrHistoryUnavailable if the log has a gap.
+func (s *Service) OperationsSince(ctx context.Context, tenantID, documentID string, version int64, limit int) ([]Operation, error) {
+	ops, err := s.repo.ListOperations(ctx, tenantID, documentID, version, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if op.Version != version+int64(i)+1 {
+			return nil, fmt.Errorf("%w: missing version %d", ErrHistoryUnavailable, version+int64(i)+1)
+		}
+	}
+	return ops, nil
+}
+
+// EngineState returns the engine state a client needs alongside the content
+// to start editing doc, or "" if the engine needs none.
+func (s *Service) EngineState(ctx context.Context, doc Document) (string, error) {
+	engine, err := s.engineFor(doc.Engine)
+	if err != nil {
+		return "", err
+	}
+	return engine.State(ctx, doc)
+}
+
+// Release lets engines drop cached state for a document nobody is editing.
+func (s *Service) Release(tenantID, documentID string) {
+	for _, engine := range s.engines {
+		if f, ok := engine.(forgetter); ok {
+			f.Forget(tenantID, documentID)
+		}
 	}
-	doc.Permissions[subjectID] = level
-	doc.UpdatedAt = time.Now().UTC()
+}
 
-	if err := s.repo.UpdateDocument(ctx, doc); err != nil {
+// updateDocument applies change to the stored document and writes it back,
+// reading it again if an operation commits in between.
+func (s *Service) updateDocument(ctx context.Context, tenantID, documentID string, change func(*Document)) (Document, error) {
+	for attempt := 1; ; attempt++ {
+		doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+		if err != nil {
+			return Document{}, err
+		}
+		change(&doc)
+		doc.UpdatedAt = time.Now().UTC()
+		err = s.repo.UpdateDocument(ctx, doc)
+		if err == nil || !errors.Is(err, ErrVersionConflict) || attempt == maxCommitAttempts {
+			return doc, err
+		}
+	}
+}
+
+func (s *Service) SetPermission(ctx context.Context, tenantID, documentID, subjectID string, level AccessLevel) (Document, error) {
+	doc, err := s.updateDocument(ctx, tenantID, documentID, func(doc *Document) {
+		if doc.Permissions == nil {
+			doc.Permissions = make(map[string]AccessLevel)
+		}
+		doc.Permissions[subjectID] = level
+	})
+	if err != nil {
 		return Document{}, fmt.Errorf("update permissions: %w", err)
 	}
+	s.emit(Change{
+		Kind:       ChangePermission,
+		TenantID:   doc.TenantID,
+		DocumentID: doc.ID,
+		SubjectID:  subjectID,
+		Level:      level,
+		Version:    doc.Version,
+		Document:   &doc,
+	})
 	return doc, nil
 }
 
-func (s *Service) CreateShareLink(ctx context.Context, tenantID, documentID, creatorID string, level AccessLevel, expiresAt *time.Time) (ShareLink, error) {
-	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+// RenameDocument changes a document's title.
+func (s *Service) RenameDocument(ctx context.Context, tenantID, documentID, userID, title string) (Document, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return Document{}, fmt.Errorf("%w: title is empty", ErrInvalidTitle)
+	}
+	doc, err := s.updateDocument(ctx, tenantID, documentID, func(doc *Document) {
+		doc.Title = title
+	})
 	if err != nil {
-		return ShareLink{}, err
+		return Document{}, fmt.Errorf("rename document: %w", err)
 	}
+	s.emit(Change{
+		Kind:       ChangeTitle,
+		TenantID:   doc.TenantID,
+		DocumentID: doc.ID,
+		UserID:     userID,
+		Title:      doc.Title,
+		Version:    doc.Version,
+		Document:   &doc,
+	})
+	return doc, nil
+}
 
+func (s *Service) CreateShareLink(ctx context.Context, tenantID, documentID, creatorID string, level AccessLevel, expiresAt *time.Time) (ShareLink, error) {
 	link := ShareLink{
 		ID:         NewID(),
 		Token:      NewID(),
 		Level:      level,
 		ExpiresAt:  expiresAt,
-		DocumentID: doc.ID,
-		TenantID:   doc.TenantID,
+		DocumentID: documentID,
+		TenantID:   tenantID,
 		CreatedAt:  time.Now().UTC(),
 		CreatedBy:  creatorID,
 	}
-
-	doc.ShareLinks = append(doc.ShareLinks, link)
-	doc.UpdatedAt = link.CreatedAt
-	if err := s.repo.UpdateDocument(ctx, doc); err != nil {
+	doc, err := s.updateDocument(ctx, tenantID, documentID, func(doc *Document) {
+		doc.ShareLinks = append(doc.ShareLinks, link)
+	})
+	if err != nil {
 		return ShareLink{}, fmt.Errorf("create share link: %w", err)
 	}
+	s.emit(Change{
+		Kind:       ChangeShareLink,
+		TenantID:   doc.TenantID,
+		DocumentID: doc.ID,
+		UserID:     creatorID,
+		Level:      level,
+		Version:    doc.Version,
+	})
 	return link, nil
 }
 
@@ -169,34 +484,102 @@ func (s *Service) RevertToVersion(ctx context.Context, tenantID, documentID, ver
 		}
 	}
 	if target.ID == "" {
-		return Document{}, DocumentVersion{}, fmt.Errorf("version not found: %s", versionID)
+		return Document{}, DocumentVersion{}, fmt.Errorf("%w: %s", ErrVersionNotFound, versionID)
 	}
+	return s.revertTo(ctx, tenantID, documentID, target.Content, userID)
+}
 
-	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+// RevertToSequence restores the document as of sequence, which need not have
+// a snapshot of its own.
+func (s *Service) RevertToSequence(ctx context.Context, tenantID, documentID string, sequence int64, userID string) (Document, DocumentVersion, error) {
+	target, err := s.VersionAt(ctx, tenantID, documentID, sequence)
 	if err != nil {
 		return Document{}, DocumentVersion{}, err
 	}
+	return s.revertTo(ctx, tenantID, documentID, target.Content, userID)
+}
+
+func (s *Service) revertTo(ctx context.Context, tenantID, documentID, content, userID string) (Document, DocumentVersion, error) {
+	var doc Document
+	var op Operation
+	var err error
+	for attempt := 1; ; attempt++ {
+		doc, op, err = s.commitRevert(ctx, tenantID, documentID, content, userID)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrVersionConflict) || attempt == maxCommitAttempts {
+			return Document{}, DocumentVersion{}, err
+		}
+	}
+
+	// Open sessions must hear about the new content even if the snapshot
+	// below fails.
+	s.emit(Change{
+		Kind:       ChangeReverted,
+		TenantID:   doc.TenantID,
+		DocumentID: doc.ID,
+		UserID:     userID,
+		Version:    doc.Version,
+		Operation:  &op,
+		Document:   &doc,
+	})
+
+	restoreVersion, err := s.saveSnapshot(ctx, doc, userID, LabelRevert)
+	if err != nil {
+		return Document{}, DocumentVersion{}, err
+	}
+	return doc, restoreVersion, nil
+}
+
+// commitRevert logs content as an operation replacing the head.
+func (s *Service) commitRevert(ctx context.Context, tenantID, documentID, content, userID string) (Document, Operation, error) {
+	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+	if err != nil {
+		return Document{}, Operation{}, err
+	}
+
+	engine, err := s.engineFor(doc.Engine)
+	if err != nil {
+		return Document{}, Operation{}, err
+	}
+	result, err := engine.Replace(ctx, doc, content)
+	if err != nil {
+		return Document{}, Operation{}, fmt.Errorf("revert version: %w", err)
+	}
 
 	now := time.Now().UTC()
-	doc.Content = target.Content
+	doc.Content = result.Content
 	doc.Version++
 	doc.UpdatedAt = now
-	if err := s.repo.UpdateDocument(ctx, doc); err != nil {
-		return Document{}, DocumentVersion{}, fmt.Errorf("revert version: %w", err)
-	}
 
-	restoreVersion := DocumentVersion{
+	// Log the revert as an ordinary operation so in-flight client deltas can
+	// still be transformed across it.
+	op := Operation{
 		ID:         NewID(),
 		DocumentID: doc.ID,
 		TenantID:   tenantID,
-		AuthorID:   userID,
-		Sequence:   doc.Version,
-		Content:    target.Content,
-		Label:      "revert",
+		UserID:     userID,
+		Version:    doc.Version,
+		Delta:      result.Delta,
+		Effect:     result.Effect,
+		Checksum:   Checksum(doc.Content),
 		CreatedAt:  now,
 	}
-	_ = s.repo.SaveVersion(ctx, restoreVersion)
-	return doc, restoreVersion, nil
+	advanceClocks(&doc, &op, ApplyOperationInput{})
+	if err := s.commit(ctx, doc, op); err != nil {
+		return Document{}, Operation{}, fmt.Errorf("revert version: %w", err)
+	}
+	return doc, op, nil
+}
+
+// TextEffect returns the operation's change as a text operation, whichever
+// engine produced it.
+func (op Operation) TextEffect() (TextOperation, error) {
+	if op.Effect != "" {
+		return ParseDelta(op.Effect)
+	}
+	return ParseDelta(op.Delta)
 }
 
 func NewID() string {
@@ -206,3 +589,54 @@ func NewID() string {
 	}
 	return hex.EncodeToString(b)
 }
+
+// ComposeOperations merges consecutive operations into one spanning their
+// versions. Text deltas are composed; CRDT deltas are concatenated and their
+// text effects composed. The result has no ID or author.
+func ComposeOperations(ops []Operation) (Operation, error) {
+	if len(ops) == 0 {
+		return Operation{}, fmt.Errorf("%w: nothing to compose", ErrInvalidDelta)
+	}
+	last := ops[len(ops)-1]
+	out := Operation{
+		DocumentID: last.DocumentID,
+		TenantID:   last.TenantID,
+		Lamport:    last.Lamport,
+		Version:    last.Version,
+		Checksum:   last.Checksum,
+		CreatedAt:  last.CreatedAt,
+	}
+
+	var effect TextOperation
+	var crdt CRDTDelta
+	structured := ops[0].Effect != ""
+	for i, op := range ops {
+		if (op.Effect != "") != structured {
+			return Operation{}, fmt.Errorf("%w: cannot compose operations of different engines", ErrInvalidDelta)
+		}
+		next, err := op.TextEffect()
+		if err != nil {
+			return Operation{}, fmt.Errorf("operation %s: %w", op.ID, err)
+		}
+		if i == 0 {
+			effect = next
+		} else if effect, err = Compose(effect, next); err != nil {
+			return Operation{}, fmt.Errorf("operation %s: %w", op.ID, err)
+		}
+		if structured {
+			d, err := ParseCRDTDelta(op.Delta)
+			if err != nil {
+				return Operation{}, fmt.Errorf("operation %s: %w", op.ID, err)
+			}
+			crdt.Ops = append(crdt.Ops, d.Ops...)
+		}
+	}
+
+	if structured {
+		out.Delta = encodeCRDTDelta(crdt.Ops)
+		out.Effect = effect.String()
+	} else {
+		out.Delta = effect.String()
+	}
+	return out, nil
+}
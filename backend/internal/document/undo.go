@@ -0,0 +1,144 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// undoWindow is how many recent versions Undo and Redo search. Edits older
+// than that can no longer be undone.
+const undoWindow = 1000
+
+// Undo reverts userID's most recent edit that is not already undone,
+// leaving everyone else's changes in place. The inverse is rebased over the
+// operations that followed it and applied like any other edit.
+func (s *Service) Undo(ctx context.Context, tenantID, documentID, userID string) (Document, Operation, DocumentVersion, error) {
+	doc, ops, err := s.recentOperations(ctx, tenantID, documentID)
+	if err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, err
+	}
+
+	undone := make(map[string]bool)
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		if op.UserID != userID {
+			continue
+		}
+		if op.Undoes != "" {
+			undone[op.Undoes] = true
+			continue
+		}
+		if undone[op.ID] {
+			continue
+		}
+		return s.applyInverse(ctx, doc, ops, i, ApplyOperationInput{
+			TenantID:   tenantID,
+			DocumentID: documentID,
+			UserID:     userID,
+			undoes:     op.ID,
+		})
+	}
+	return Document{}, Operation{}, DocumentVersion{}, ErrNothingToUndo
+}
+
+// Redo restores the edit userID most recently undid. Any other edit by the
+// same user since then clears what can be redone.
+func (s *Service) Redo(ctx context.Context, tenantID, documentID, userID string) (Document, Operation, DocumentVersion, error) {
+	doc, ops, err := s.recentOperations(ctx, tenantID, documentID)
+	if err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, err
+	}
+
+	redone := make(map[string]bool)
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		if op.UserID != userID {
+			continue
+		}
+		switch {
+		case op.Redoes != "":
+			redone[op.Redoes] = true
+		case op.Undoes != "":
+			if redone[op.ID] {
+				continue
+			}
+			return s.applyInverse(ctx, doc, ops, i, ApplyOperationInput{
+				TenantID:   tenantID,
+				DocumentID: documentID,
+				UserID:     userID,
+				redoes:     op.ID,
+			})
+		default:
+			return Document{}, Operation{}, DocumentVersion{}, ErrNothingToRedo
+		}
+	}
+	return Document{}, Operation{}, DocumentVersion{}, ErrNothingToRedo
+}
+
+// recentOperations loads the document and its operations within the undo
+// window, up to the head. The creation seed is never included. Only the
+// unbroken run of logged versions ending at the head is returned: documents
+// older than the log, or whose log has gaps, have nothing older to undo.
+func (s *Service) recentOperations(ctx context.Context, tenantID, documentID string) (Document, []Operation, error) {
+	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+	if err != nil {
+		return Document{}, nil, err
+	}
+	ops, err := s.repo.ListOperations(ctx, tenantID, documentID, max(doc.Version-undoWindow, 1), 0)
+	if err != nil {
+		return Document{}, nil, err
+	}
+	start := len(ops)
+	for start > 0 && ops[start-1].Version == doc.Version-int64(len(ops)-start) {
+		start--
+	}
+	return doc, ops[start:], nil
+}
+
+// applyInverse applies the inverse of ops[i], transformed past ops[i+1:],
+// to doc. ops must run up to doc's head.
+func (s *Service) applyInverse(ctx context.Context, doc Document, ops []Operation, i int, in ApplyOperationInput) (Document, Operation, DocumentVersion, error) {
+	target := ops[i]
+	before, err := s.VersionAt(ctx, doc.TenantID, doc.ID, target.Version-1)
+	if errors.Is(err, ErrHistoryUnavailable) || errors.Is(err, ErrVersionNotFound) {
+		// The log cannot rebuild the text target changed, so it is as
+		// good as older than the log.
+		nothing := ErrNothingToUndo
+		if in.redoes != "" {
+			nothing = ErrNothingToRedo
+		}
+		return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("%w: history before version %d is unavailable", nothing, target.Version)
+	}
+	if err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("invert operation %s: %w", target.ID, err)
+	}
+	effect, err := target.TextEffect()
+	if err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("invert operation %s: %w", target.ID, err)
+	}
+	inverse, err := effect.Invert(before.Content)
+	if err != nil {
+		return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("invert operation %s: %w", target.ID, err)
+	}
+	for _, later := range ops[i+1:] {
+		next, err := later.TextEffect()
+		if err != nil {
+			return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("operation %s: %w", later.ID, err)
+		}
+		if inverse, _, err = Transform(inverse, next); err != nil {
+			return Document{}, Operation{}, DocumentVersion{}, fmt.Errorf("rebase inverse over %s: %w", later.ID, err)
+		}
+	}
+
+	// OT documents take the inverse as a delta against doc; CRDT documents
+	// take it as text and derive their own ops once it is rebased onto the
+	// head, should another edit commit first.
+	in.BaseVersion = doc.Version
+	if doc.Engine == EngineCRDT {
+		in.edit = &inverse
+	} else {
+		in.Delta = inverse.String()
+	}
+	return s.ApplyOperation(ctx, in)
+}
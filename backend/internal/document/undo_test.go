@@ -0,0 +1,69 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUndoRedo(t *testing.T) {
+	for _, engine := range []string{EngineOT, EngineCRDT} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := context.Background()
+			repo := &hookedRepository{InMemoryRepository: NewInMemoryRepository()}
+			svc := NewService(repo)
+			doc, err := svc.CreateDocument(ctx, "t", "u", "x", "hello", engine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edit := func(userID, content string) {
+				t.Helper()
+				if _, _, _, err := svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: userID, NewContent: content}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := func(content string) {
+				t.Helper()
+				got, err := svc.GetDocument(ctx, "t", doc.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Content != content {
+					t.Fatalf("content = %q, want %q", got.Content, content)
+				}
+			}
+
+			if _, _, _, err := svc.Undo(ctx, "t", doc.ID, "u"); !errors.Is(err, ErrNothingToUndo) {
+				t.Fatalf("undo before any edit: err = %v, want ErrNothingToUndo", err)
+			}
+			if _, _, _, err := svc.Redo(ctx, "t", doc.ID, "u"); !errors.Is(err, ErrNothingToRedo) {
+				t.Fatalf("redo before any undo: err = %v, want ErrNothingToRedo", err)
+			}
+
+			// The peer's edit follows u's and survives its undo.
+			edit("u", ">hello")
+			edit("peer", ">hello!")
+			if _, op, _, err := svc.Undo(ctx, "t", doc.ID, "u"); err != nil {
+				t.Fatal(err)
+			} else if op.Undoes == "" {
+				t.Fatal("undo operation does not name what it undoes")
+			}
+			want("hello!")
+			if _, _, _, err := svc.Undo(ctx, "t", doc.ID, "u"); !errors.Is(err, ErrNothingToUndo) {
+				t.Fatalf("second undo: err = %v, want ErrNothingToUndo", err)
+			}
+
+			// Another peer edit lands while the redo commits.
+			repo.beforeCommit = func() { edit("peer", "[hello!") }
+			if _, op, _, err := svc.Redo(ctx, "t", doc.ID, "u"); err != nil {
+				t.Fatal(err)
+			} else if op.Redoes == "" {
+				t.Fatal("redo operation does not name what it redoes")
+			}
+			want("[>hello!")
+			if _, _, _, err := svc.Redo(ctx, "t", doc.ID, "u"); !errors.Is(err, ErrNothingToRedo) {
+				t.Fatalf("second redo: err = %v, want ErrNothingToRedo", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Labels given to snapshots the service takes on its own.
+const (
+	LabelInitial = "initial"
+	LabelAuto    = "auto"
+	LabelIdle    = "idle"
+	LabelRevert  = "revert"
+)
+
+// VersionPolicy decides when ApplyOperation snapshots the document. The
+// operation log keeps every change; snapshots only bound how far a
+// historical version has to be replayed from.
+type VersionPolicy struct {
+	// Every snapshots once this many operations have accumulated since the
+	// last snapshot. Zero disables it.
+	Every int
+	// IdleGap snapshots the resting state when an edit arrives after the
+	// document has been untouched this long. Zero disables it.
+	IdleGap time.Duration
+}
+
+// DefaultVersionPolicy is used by NewService.
+var DefaultVersionPolicy = VersionPolicy{Every: 100, IdleGap: 2 * time.Minute}
+
+// SetVersionPolicy replaces the snapshot policy.
+func (s *Service) SetVersionPolicy(policy VersionPolicy) {
+	s.policy = policy
+}
+
+// snapshotForOperation applies the version policy once op has been committed
+// on top of before. It returns the snapshot of the new head, if one was taken.
+// Snapshots are best effort: the log alone can rebuild every version.
+func (s *Service) snapshotForOperation(ctx context.Context, before, doc Document, op Operation, label string) DocumentVersion {
+	lastSequence, err := s.repo.LatestVersionSequence(ctx, doc.TenantID, doc.ID)
+	if err != nil {
+		return DocumentVersion{}
+	}
+
+	if s.policy.IdleGap > 0 && op.CreatedAt.Sub(before.UpdatedAt) >= s.policy.IdleGap && lastSequence < before.Version {
+		author := s.lastAuthor(ctx, before)
+		if _, err := s.saveSnapshot(ctx, before, author, LabelIdle); err == nil {
+			lastSequence = before.Version
+		}
+	}
+
+	if label == "" {
+		if s.policy.Every <= 0 || doc.Version-lastSequence < int64(s.policy.Every) {
+			return DocumentVersion{}
+		}
+		label = LabelAuto
+	}
+	version, _ := s.saveSnapshot(ctx, doc, op.UserID, label)
+	return version
+}
+
+func (s *Service) saveSnapshot(ctx context.Context, doc Document, authorID, label string) (DocumentVersion, error) {
+	version := DocumentVersion{
+		ID:         NewID(),
+		DocumentID: doc.ID,
+		TenantID:   doc.TenantID,
+		AuthorID:   authorID,
+		Sequence:   doc.Version,
+		Content:    doc.Content,
+		Label:      label,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if engine, err := s.engineFor(doc.Engine); err == nil {
+		if c, ok := engine.(checkpointer); ok {
+			version.engineState, _ = c.Checkpoint(doc)
+		}
+	}
+	if err := s.repo.SaveVersion(ctx, version); err != nil {
+		return DocumentVersion{}, fmt.Errorf("save version: %w", err)
+	}
+	return version, nil
+}
+
+// lastAuthor returns who produced doc's current version, or "" if unknown.
+func (s *Service) lastAuthor(ctx context.Context, doc Document) string {
+	ops, err := s.repo.ListOperations(ctx, doc.TenantID, doc.ID, doc.Version-1, 1)
+	if err != nil || len(ops) == 0 {
+		return ""
+	}
+	return ops[0].UserID
+}
+
+// LabelVersion snapshots the current head under label.
+func (s *Service) LabelVersion(ctx context.Context, tenantID, documentID, userID, label string) (DocumentVersion, error) {
+	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+	if err != nil {
+		return DocumentVersion{}, err
+	}
+	return s.saveSnapshot(ctx, doc, userID, label)
+}
+
+// Checkpoint snapshots the head if it is not snapshotted yet. Callers use it
+// when editing pauses, e.g. once the last collaborator leaves.
+func (s *Service) Checkpoint(ctx context.Context, tenantID, documentID string) error {
+	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+	if err != nil {
+		return err
+	}
+	last, err := s.repo.NearestVersion(ctx, tenantID, documentID, doc.Version)
+	if err == nil && last.Sequence == doc.Version {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrVersionNotFound) {
+		return err
+	}
+	_, err = s.saveSnapshot(ctx, doc, s.lastAuthor(ctx, doc), LabelIdle)
+	return err
+}
+
+// VersionAt returns the document as of sequence. Versions without a snapshot
+// are rebuilt by replaying the log from the nearest earlier snapshot; the
+// result then has no ID.
+func (s *Service) VersionAt(ctx context.Context, tenantID, documentID string, sequence int64) (DocumentVersion, error) {
+	doc, err := s.repo.GetDocument(ctx, tenantID, documentID)
+	if err != nil {
+		return DocumentVersion{}, err
+	}
+	if sequence < 1 || sequence > doc.Version {
+		return DocumentVersion{}, fmt.Errorf("%w: sequence %d", ErrVersionNotFound, sequence)
+	}
+
+	base, err := s.repo.NearestVersion(ctx, tenantID, documentID, sequence)
+	if err != nil {
+		return DocumentVersion{}, fmt.Errorf("sequence %d: %w", sequence, err)
+	}
+	if base.Sequence == sequence {
+		return base, nil
+	}
+
+	ops, err := s.OperationsSince(ctx, tenantID, documentID, base.Sequence, int(sequence-base.Sequence))
+	if err != nil {
+		return DocumentVersion{}, err
+	}
+	if int64(len(ops)) != sequence-base.Sequence {
+		return DocumentVersion{}, fmt.Errorf("%w: log ends before version %d", ErrHistoryUnavailable, sequence)
+	}
+
+	content := base.Content
+	for _, op := range ops {
+		effect, err := op.TextEffect()
+		if err != nil {
+			return DocumentVersion{}, fmt.Errorf("rebuild version %d: operation %s: %w", sequence, op.ID, err)
+		}
+		if content, err = effect.Apply(content); err != nil {
+			return DocumentVersion{}, fmt.Errorf("rebuild version %d: operation %s: %w", sequence, op.ID, err)
+		}
+	}
+
+	last := ops[len(ops)-1]
+	return DocumentVersion{
+		DocumentID: documentID,
+		TenantID:   tenantID,
+		AuthorID:   last.UserID,
+		Sequence:   sequence,
+		Content:    content,
+		CreatedAt:  last.CreatedAt,
+	}, nil
+}
@@ -0,0 +1,74 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(NewInMemoryRepository())
+	svc.SetVersionPolicy(VersionPolicy{})
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "a", EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"ab", "abc", "abcd"} {
+		if doc, _, _, err = svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", NewContent: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		t.Helper()
+		versions, err := svc.ListVersions(ctx, "t", doc.ID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(versions)
+	}
+	before := count()
+
+	labelled, err := svc.LabelVersion(ctx, "t", doc.ID, "u", "draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labelled.ID == "" || labelled.Label != "draft" || labelled.Sequence != doc.Version || labelled.Content != "abcd" {
+		t.Fatalf("LabelVersion = %+v", labelled)
+	}
+	if got := count(); got != before+1 {
+		t.Fatalf("%d versions after LabelVersion, want %d", got, before+1)
+	}
+
+	// The head already has a snapshot, so a checkpoint adds nothing.
+	if err := svc.Checkpoint(ctx, "t", doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(); got != before+1 {
+		t.Fatalf("%d versions after a redundant Checkpoint, want %d", got, before+1)
+	}
+	if doc, _, _, err = svc.ApplyOperation(ctx, ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", NewContent: "abcde"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Checkpoint(ctx, "t", doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(); got != before+2 {
+		t.Fatalf("%d versions after Checkpoint, want %d", got, before+2)
+	}
+
+	for sequence, want := range map[int64]string{2: "ab", 3: "abc", doc.Version - 1: "abcd", doc.Version: "abcde"} {
+		v, err := svc.VersionAt(ctx, "t", doc.ID, sequence)
+		if err != nil {
+			t.Fatalf("VersionAt(%d): %v", sequence, err)
+		}
+		if v.Sequence != sequence || v.Content != want {
+			t.Fatalf("VersionAt(%d) = %d %q, want %q", sequence, v.Sequence, v.Content, want)
+		}
+	}
+	for _, sequence := range []int64{0, doc.Version + 1} {
+		if _, err := svc.VersionAt(ctx, "t", doc.ID, sequence); !errors.Is(err, ErrVersionNotFound) {
+			t.Fatalf("VersionAt(%d): err = %v, want ErrVersionNotFound", sequence, err)
+		}
+	}
+}
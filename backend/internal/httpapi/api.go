@@ -3,15 +3,15 @@ package httpapi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"docStream/backend/internal/auth"
 	"docStream/backend/internal/document"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 // API wires HTTP handlers to the document service.
@@ -39,21 +39,12 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Protected routes middleware
-	tokenString := extractToken(r)
-	if tokenString == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-	claims := jwt.MapClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return auth.SecretKey, nil
-	})
-	if err != nil || !token.Valid {
+	claims, err := auth.ParseToken(extractToken(r))
+	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	userID, _ := claims["sub"].(string)
-	ctx := context.WithValue(r.Context(), "userID", userID)
+	ctx := context.WithValue(r.Context(), "userID", claims.UserID)
 	r = r.WithContext(ctx)
 
 	// Path parsing for resource routes
@@ -86,6 +77,10 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			switch r.Method {
 			case http.MethodGet:
 				a.getDocument(w, r, tenantID, docID)
+			case http.MethodPatch:
+				a.renameDocument(w, r, tenantID, docID)
+			case http.MethodDelete:
+				a.deleteDocument(w, r, tenantID, docID)
 			default:
 				w.WriteHeader(http.StatusMethodNotAllowed)
 			}
@@ -100,10 +95,26 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			a.setPermission(w, r, tenantID, docID)
 			return
 		}
+		if len(parts) == 5 && parts[4] == "playback" && r.Method == http.MethodGet {
+			a.playback(w, r, tenantID, docID)
+			return
+		}
 		if len(parts) == 5 && parts[4] == "versions" && r.Method == http.MethodGet {
 			a.listVersions(w, r, tenantID, docID)
 			return
 		}
+		if len(parts) == 5 && parts[4] == "versions" && r.Method == http.MethodPost {
+			a.labelVersion(w, r, tenantID, docID)
+			return
+		}
+		if len(parts) == 6 && parts[4] == "history" && r.Method == http.MethodGet {
+			a.versionAt(w, r, tenantID, docID, parts[5])
+			return
+		}
+		if len(parts) == 7 && parts[4] == "history" && parts[6] == "revert" && r.Method == http.MethodPost {
+			a.revertSequence(w, r, tenantID, docID, parts[5])
+			return
+		}
 		if len(parts) == 7 && parts[4] == "versions" && parts[6] == "revert" && r.Method == http.MethodPost {
 			versionID := parts[5]
 			a.revertVersion(w, r, tenantID, docID, versionID)
@@ -165,6 +176,7 @@ func (a *API) createDocument(w http.ResponseWriter, r *http.Request, tenantID st
 	type request struct {
 		Title   string `json:"title"`
 		Content string `json:"content"`
+		Engine  string `json:"engine"`
 	}
 	var req request
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -174,8 +186,16 @@ func (a *API) createDocument(w http.ResponseWriter, r *http.Request, tenantID st
 
 	userID := r.Context().Value("userID").(string)
 
-	doc, err := a.docs.CreateDocument(r.Context(), tenantID, userID, req.Title, req.Content)
+	doc, err := a.docs.CreateDocument(r.Context(), tenantID, userID, req.Title, req.Content, req.Engine)
 	if err != nil {
+		if errors.Is(err, document.ErrUnknownEngine) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, document.ErrDocumentTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -196,6 +216,43 @@ func (a *API) getDocument(w http.ResponseWriter, r *http.Request, tenantID, docI
 	writeJSON(w, http.StatusOK, doc)
 }
 
+func (a *API) renameDocument(w http.ResponseWriter, r *http.Request, tenantID, docID string) {
+	userID := r.Context().Value("userID").(string)
+	var req struct {
+		Title string `json:"title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.requireAccess(w, r, tenantID, docID, document.AccessEdit) {
+		return
+	}
+	doc, err := a.docs.RenameDocument(r.Context(), tenantID, docID, userID, req.Title)
+	if err != nil {
+		status := versionErrorStatus(err)
+		if errors.Is(err, document.ErrInvalidTitle) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (a *API) deleteDocument(w http.ResponseWriter, r *http.Request, tenantID, docID string) {
+	userID := r.Context().Value("userID").(string)
+	if err := a.docs.DeleteDocument(r.Context(), tenantID, docID, userID); err != nil {
+		status := versionErrorStatus(err)
+		if errors.Is(err, document.ErrNotOwner) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (a *API) listDocuments(w http.ResponseWriter, r *http.Request, tenantID string) {
 	docs, err := a.docs.ListDocuments(r.Context(), tenantID)
 	if err != nil {
@@ -235,6 +292,9 @@ func (a *API) setPermission(w http.ResponseWriter, r *http.Request, tenantID, do
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !a.requireOwner(w, r, tenantID, docID) {
+		return
+	}
 
 	doc, err := a.docs.SetPermission(r.Context(), tenantID, docID, req.SubjectID, document.AccessLevel(req.Level))
 	if err != nil {
@@ -251,6 +311,9 @@ func (a *API) listVersions(w http.ResponseWriter, r *http.Request, tenantID, doc
 			limit = parsed
 		}
 	}
+	if !a.requireAccess(w, r, tenantID, docID, document.AccessView) {
+		return
+	}
 	versions, err := a.docs.ListVersions(r.Context(), tenantID, docID, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -261,10 +324,124 @@ func (a *API) listVersions(w http.ResponseWriter, r *http.Request, tenantID, doc
 
 func (a *API) revertVersion(w http.ResponseWriter, r *http.Request, tenantID, docID, versionID string) {
 	userID := r.Context().Value("userID").(string)
+	if !a.requireAccess(w, r, tenantID, docID, document.AccessEdit) {
+		return
+	}
 
 	doc, version, err := a.docs.RevertToVersion(r.Context(), tenantID, docID, versionID, userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), versionErrorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"document": doc,
+		"version":  version,
+	})
+}
+
+func (a *API) labelVersion(w http.ResponseWriter, r *http.Request, tenantID, docID string) {
+	userID := r.Context().Value("userID").(string)
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Label) == "" {
+		http.Error(w, "label is required", http.StatusBadRequest)
+		return
+	}
+	if !a.requireAccess(w, r, tenantID, docID, document.AccessEdit) {
+		return
+	}
+	version, err := a.docs.LabelVersion(r.Context(), tenantID, docID, userID, strings.TrimSpace(req.Label))
+	if err != nil {
+		http.Error(w, err.Error(), versionErrorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, version)
+}
+
+// versionAt returns the document as of a sequence number, rebuilt from the
+// operation log when no snapshot was taken at that point.
+func (a *API) versionAt(w http.ResponseWriter, r *http.Request, tenantID, docID, rawSequence string) {
+	sequence, err := strconv.ParseInt(rawSequence, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid sequence", http.StatusBadRequest)
+		return
+	}
+	if !a.requireAccess(w, r, tenantID, docID, document.AccessView) {
+		return
+	}
+	version, err := a.docs.VersionAt(r.Context(), tenantID, docID, sequence)
+	if err != nil {
+		http.Error(w, err.Error(), versionErrorStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, version)
+}
+
+// playback returns a page of the operations made between "from" and "to"
+// (RFC 3339; "to" defaults to now), each with the pause before it divided
+// by "speed". Pass the page's "next" as "after" to get the following page.
+func (a *API) playback(w http.ResponseWriter, r *http.Request, tenantID, docID string) {
+	query := r.URL.Query()
+	var q document.PlaybackQuery
+	var err error
+	if q.From, err = time.Parse(time.RFC3339Nano, query.Get("from")); err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("to"); value != "" {
+		if q.To, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("after"); value != "" {
+		if q.After, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if q.Limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("speed"); value != "" {
+		if q.Speed, err = strconv.ParseFloat(value, 64); err != nil {
+			http.Error(w, "invalid speed", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !a.requireAccess(w, r, tenantID, docID, document.AccessView) {
+		return
+	}
+	page, err := a.docs.Playback(r.Context(), tenantID, docID, q)
+	if err != nil {
+		status := versionErrorStatus(err)
+		if errors.Is(err, document.ErrInvalidPlayback) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (a *API) revertSequence(w http.ResponseWriter, r *http.Request, tenantID, docID, rawSequence string) {
+	userID := r.Context().Value("userID").(string)
+	sequence, err := strconv.ParseInt(rawSequence, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid sequence", http.StatusBadRequest)
+		return
+	}
+	if !a.requireAccess(w, r, tenantID, docID, document.AccessEdit) {
+		return
+	}
+	doc, version, err := a.docs.RevertToSequence(r.Context(), tenantID, docID, sequence, userID)
+	if err != nil {
+		http.Error(w, err.Error(), versionErrorStatus(err))
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]any{
@@ -273,6 +450,52 @@ func (a *API) revertVersion(w http.ResponseWriter, r *http.Request, tenantID, do
 	})
 }
 
+// requireAccess checks that the caller has at least want on the document,
+// as the websocket join does, and writes the error response if not.
+func (a *API) requireAccess(w http.ResponseWriter, r *http.Request, tenantID, docID string, want document.AccessLevel) bool {
+	userID := r.Context().Value("userID").(string)
+	doc, err := a.docs.GetDocument(r.Context(), tenantID, docID)
+	if err != nil {
+		http.Error(w, err.Error(), versionErrorStatus(err))
+		return false
+	}
+	if level, ok := doc.AccessFor(userID); !ok || !level.Allows(want) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireOwner writes a 403 unless the caller owns the document. Only the
+// owner may grant or revoke access.
+func (a *API) requireOwner(w http.ResponseWriter, r *http.Request, tenantID, docID string) bool {
+	userID := r.Context().Value("userID").(string)
+	doc, err := a.docs.GetDocument(r.Context(), tenantID, docID)
+	if err != nil {
+		http.Error(w, err.Error(), versionErrorStatus(err))
+		return false
+	}
+	if doc.OwnerID != userID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// versionErrorStatus maps history lookup failures to HTTP statuses.
+func versionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, document.ErrDocumentNotFound), errors.Is(err, document.ErrVersionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, document.ErrHistoryUnavailable), errors.Is(err, document.ErrVersionConflict):
+		return http.StatusConflict
+	case errors.Is(err, document.ErrDocumentTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -0,0 +1,146 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"docStream/backend/internal/auth"
+	"docStream/backend/internal/document"
+)
+
+// testAPI serves an API over an in-memory repository with one document,
+// owned by "owner" and shared read-only with "viewer". "stranger" has no
+// access.
+type testAPI struct {
+	api    *API
+	docs   *document.Service
+	doc    document.Document
+	tokens map[string]string
+	users  map[string]string
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	ctx := context.Background()
+	repo := document.NewInMemoryRepository()
+	docs := document.NewService(repo)
+	authSvc := auth.NewService(repo)
+	ta := &testAPI{api: New(docs, authSvc), docs: docs, tokens: map[string]string{}, users: map[string]string{}}
+	for _, name := range []string{"owner", "viewer", "stranger"} {
+		if _, err := authSvc.Register(ctx, name+"@example.com", "password"); err != nil {
+			t.Fatal(err)
+		}
+		token, userID, err := authSvc.Login(ctx, name+"@example.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ta.tokens[name], ta.users[name] = token, userID
+	}
+
+	doc, err := docs.CreateDocument(ctx, "t", ta.users["owner"], "x", "hello", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = docs.SetPermission(ctx, "t", doc.ID, ta.users["viewer"], document.AccessView); err != nil {
+		t.Fatal(err)
+	}
+	ta.doc = doc
+	return ta
+}
+
+// do sends a request as user and returns the response status.
+func (ta *testAPI) do(t *testing.T, user, method, path, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+ta.tokens[user])
+	rec := httptest.NewRecorder()
+	ta.api.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestVersionsRequireAccess(t *testing.T) {
+	ta := newTestAPI(t)
+	version, err := ta.docs.LabelVersion(context.Background(), "t", ta.doc.ID, ta.users["owner"], "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := "/tenants/t/docs/" + ta.doc.ID + "/versions"
+	revert := versions + "/" + version.ID + "/revert"
+
+	cases := []struct {
+		user, method, path string
+		want               int
+	}{
+		{"stranger", http.MethodGet, versions, http.StatusForbidden},
+		{"viewer", http.MethodGet, versions, http.StatusOK},
+		{"stranger", http.MethodPost, revert, http.StatusForbidden},
+		{"viewer", http.MethodPost, revert, http.StatusForbidden},
+		{"owner", http.MethodPost, revert, http.StatusOK},
+	}
+	for _, c := range cases {
+		if got := ta.do(t, c.user, c.method, c.path, ""); got != c.want {
+			t.Errorf("%s %s as %s: status %d, want %d", c.method, c.path, c.user, got, c.want)
+		}
+	}
+}
+
+func TestSetPermissionRequiresOwner(t *testing.T) {
+	ta := newTestAPI(t)
+	path := "/tenants/t/docs/" + ta.doc.ID + "/permissions"
+	grant := func(subject, level string) string {
+		return `{"subjectId":"` + ta.users[subject] + `","level":"` + level + `"}`
+	}
+
+	if got := ta.do(t, "viewer", http.MethodPost, path, grant("viewer", "edit")); got != http.StatusForbidden {
+		t.Errorf("viewer upgrading themselves: status %d, want 403", got)
+	}
+	if got := ta.do(t, "stranger", http.MethodPost, path, grant("stranger", "view")); got != http.StatusForbidden {
+		t.Errorf("stranger granting themselves access: status %d, want 403", got)
+	}
+	doc, err := ta.docs.GetDocument(context.Background(), "t", ta.doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level, _ := doc.AccessFor(ta.users["viewer"]); level != document.AccessView {
+		t.Fatalf("viewer's access changed to %q by a refused request", level)
+	}
+	if _, ok := doc.AccessFor(ta.users["stranger"]); ok {
+		t.Fatal("stranger was granted access by a refused request")
+	}
+
+	if got := ta.do(t, "owner", http.MethodPost, path, grant("stranger", "view")); got != http.StatusOK {
+		t.Fatalf("owner granting access: status %d, want 200", got)
+	}
+	if got := ta.do(t, "stranger", http.MethodGet, "/tenants/t/docs/"+ta.doc.ID+"/versions", ""); got != http.StatusOK {
+		t.Fatalf("stranger listing versions after the grant: status %d, want 200", got)
+	}
+}
+
+func TestPlaybackParams(t *testing.T) {
+	ta := newTestAPI(t)
+	path := "/tenants/t/docs/" + ta.doc.ID + "/playback?from=2024-01-01T00:00:00Z"
+	cases := []struct {
+		user, query string
+		want        int
+	}{
+		{"viewer", "", http.StatusOK},
+		{"viewer", "&speed=8&limit=5000&after=1", http.StatusOK},
+		{"stranger", "", http.StatusForbidden},
+		{"viewer", "&speed=fast", http.StatusBadRequest},
+		{"viewer", "&speed=-2", http.StatusBadRequest},
+		{"viewer", "&limit=ten", http.StatusBadRequest},
+		{"viewer", "&after=-1", http.StatusBadRequest},
+		{"viewer", "&to=2023-01-01T00:00:00Z", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if got := ta.do(t, c.user, http.MethodGet, path+c.query, ""); got != c.want {
+			t.Errorf("playback%s as %s: status %d, want %d", c.query, c.user, got, c.want)
+		}
+	}
+	if got := ta.do(t, "viewer", http.MethodGet, "/tenants/t/docs/"+ta.doc.ID+"/playback", ""); got != http.StatusBadRequest {
+		t.Errorf("playback without from: status %d, want 400", got)
+	}
+}
@@ -0,0 +1,152 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// awarenessTTL is how long a client's awareness state lives without a
+	// refresh. Clients resend their state periodically to keep it.
+	awarenessTTL = 30 * time.Second
+	// awarenessThrottle is the shortest gap between two broadcasts of one
+	// client's state; changes in between go out together on the next
+	// flush tick.
+	awarenessThrottle = lagFlushInterval
+	// Limits on one client's state.
+	maxAwarenessKeys  = 32
+	maxAwarenessBytes = 4 << 10
+)
+
+// AwarenessState is one client's ephemeral state as sent in snapshots.
+type AwarenessState struct {
+	ClientID string         `json:"clientId"`
+	UserID   string         `json:"userId"`
+	State    map[string]any `json:"state"`
+}
+
+// awarenessEntry is a local client's state. It is never persisted.
+type awarenessEntry struct {
+	state   map[string]any
+	updated time.Time // last message from the client
+	sent    time.Time // last broadcast
+	dirty   bool      // changed since the last broadcast
+}
+
+// remoteAwareness is state mirrored from a client on another instance.
+type remoteAwareness struct {
+	AwarenessState
+	updated time.Time
+}
+
+// handleAwareness merges the sender's keys into its state; a null value
+// removes a key. An empty message just refreshes the TTL.
+func (r *Room) handleAwareness(evt inboundEvent) {
+	now := time.Now()
+	entry := r.awareness[evt.client]
+	if entry == nil {
+		entry = &awarenessEntry{state: make(map[string]any)}
+	}
+
+	next := make(map[string]any, len(entry.state)+len(evt.message.Awareness))
+	for k, v := range entry.state {
+		next[k] = v
+	}
+	for k, v := range evt.message.Awareness {
+		if v == nil {
+			delete(next, k)
+		} else {
+			next[k] = v
+		}
+	}
+	if err := checkAwareness(next); err != nil {
+		r.sendError(evt.client, err)
+		return
+	}
+
+	entry.updated = now
+	if len(evt.message.Awareness) == 0 {
+		return
+	}
+	entry.state = next
+	r.awareness[evt.client] = entry
+	if now.Sub(entry.sent) < awarenessThrottle {
+		entry.dirty = true
+		return
+	}
+	r.broadcastAwareness(evt.client, entry, now)
+}
+
+func checkAwareness(state map[string]any) error {
+	if len(state) > maxAwarenessKeys {
+		return fmt.Errorf("%w: more than %d keys", errInvalidAwareness, maxAwarenessKeys)
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidAwareness, err)
+	}
+	if len(b) > maxAwarenessBytes {
+		return fmt.Errorf("%w: state exceeds %d bytes", errInvalidAwareness, maxAwarenessBytes)
+	}
+	return nil
+}
+
+// flushAwareness sends throttled changes and drops state that was not
+// refreshed within awarenessTTL.
+func (r *Room) flushAwareness(now time.Time) {
+	for client, entry := range r.awareness {
+		if now.Sub(entry.updated) >= awarenessTTL {
+			r.clearAwareness(client)
+			continue
+		}
+		if entry.dirty && now.Sub(entry.sent) >= awarenessThrottle {
+			r.broadcastAwareness(client, entry, now)
+		}
+	}
+	for id, remote := range r.remoteAwareness {
+		if now.Sub(remote.updated) >= awarenessTTL {
+			delete(r.remoteAwareness, id)
+		}
+	}
+}
+
+func (r *Room) broadcastAwareness(client *Client, entry *awarenessEntry, now time.Time) {
+	entry.sent, entry.dirty = now, false
+	r.broadcast(ServerMessage{
+		Type:       "awareness",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     client.userID,
+		ClientID:   client.id,
+		Awareness:  entry.state,
+	})
+}
+
+// clearAwareness forgets a client's state and tells the others to drop it.
+func (r *Room) clearAwareness(client *Client) {
+	if _, ok := r.awareness[client]; !ok {
+		return
+	}
+	delete(r.awareness, client)
+	r.broadcast(ServerMessage{
+		Type:       "awareness",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     client.userID,
+		ClientID:   client.id,
+	})
+}
+
+func (r *Room) awarenessStates() []AwarenessState {
+	out := make([]AwarenessState, 0, len(r.awareness)+len(r.remoteAwareness))
+	for client, entry := range r.awareness {
+		if len(entry.state) > 0 {
+			out = append(out, AwarenessState{ClientID: client.id, UserID: client.userID, State: entry.state})
+		}
+	}
+	for _, remote := range r.remoteAwareness {
+		out = append(out, remote.AwarenessState)
+	}
+	return out
+}
@@ -0,0 +1,133 @@
+package realtime
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// awarenessRoom is an unstarted room with two local clients; tests drive it
+// directly.
+func awarenessRoom(t *testing.T) (*Room, *Client, *Client) {
+	t.Helper()
+	r := newRoom(NewHub(document.NewService(document.NewInMemoryRepository()), Config{}), "t", "d")
+	alice := &Client{id: "a", userID: "alice", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	bob := &Client{id: "b", userID: "bob", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	r.clients[alice], r.clients[bob] = true, true
+	return r, alice, bob
+}
+
+func setAwareness(r *Room, client *Client, state map[string]any) {
+	r.handleAwareness(inboundEvent{client: client, message: ClientMessage{Type: "awareness", UserID: "mallory", Awareness: state}})
+}
+
+func TestAwarenessThrottleAndTTL(t *testing.T) {
+	r, alice, bob := awarenessRoom(t)
+
+	setAwareness(r, bob, map[string]any{"typing": true, "section": "intro"})
+	msg := expectMessage(t, alice, "awareness")
+	if msg.UserID != "bob" || msg.ClientID != bob.id {
+		t.Fatalf("bob's state sent as %s/%s", msg.UserID, msg.ClientID)
+	}
+	if want := map[string]any{"typing": true, "section": "intro"}; !reflect.DeepEqual(msg.Awareness, want) {
+		t.Fatalf("state = %v", msg.Awareness)
+	}
+
+	// Changes within awarenessThrottle wait for the flush and go out
+	// merged; null removes a key.
+	setAwareness(r, bob, map[string]any{"typing": nil})
+	setAwareness(r, bob, map[string]any{"viewport": 3.0})
+	if len(alice.send) != 0 {
+		t.Fatal("throttled change broadcast at once")
+	}
+	sent := r.awareness[bob].sent
+	r.flushAwareness(sent.Add(awarenessThrottle / 2))
+	if len(alice.send) != 0 {
+		t.Fatal("throttled change broadcast before the throttle passed")
+	}
+	r.flushAwareness(sent.Add(awarenessThrottle))
+	if msg := expectMessage(t, alice, "awareness"); !reflect.DeepEqual(msg.Awareness, map[string]any{"section": "intro", "viewport": 3.0}) {
+		t.Fatalf("flushed state = %v", msg.Awareness)
+	}
+
+	// An empty message keeps the state alive without a broadcast.
+	updated := r.awareness[bob].updated
+	r.awareness[bob].updated = updated.Add(-awarenessTTL / 2)
+	setAwareness(r, bob, nil)
+	r.flushAwareness(updated.Add(awarenessTTL / 2))
+	if len(alice.send) != 0 || r.awareness[bob] == nil {
+		t.Fatal("refresh broadcast or expired the state")
+	}
+
+	// State not refreshed within awarenessTTL is dropped, and others told.
+	r.flushAwareness(r.awareness[bob].updated.Add(awarenessTTL))
+	if msg := expectMessage(t, alice, "awareness"); msg.ClientID != bob.id || msg.Awareness != nil {
+		t.Fatalf("expiry sent %s with %v", msg.ClientID, msg.Awareness)
+	}
+	if states := r.awarenessStates(); len(states) != 0 {
+		t.Fatalf("states after expiry: %+v", states)
+	}
+}
+
+func TestAwarenessLimits(t *testing.T) {
+	r, alice, bob := awarenessRoom(t)
+	setAwareness(r, bob, map[string]any{"k": "v"})
+	expectMessage(t, alice, "awareness")
+
+	tooMany := make(map[string]any, maxAwarenessKeys)
+	for i := 0; i < maxAwarenessKeys; i++ {
+		tooMany[string(rune('A'+i))] = i
+	}
+	for name, state := range map[string]map[string]any{
+		"too many keys":  tooMany,
+		"too many bytes": {"blob": string(make([]byte, maxAwarenessBytes))},
+	} {
+		setAwareness(r, bob, state)
+		if msg := expectMessage(t, bob, "error"); msg.Code != ErrCodeInvalidAwareness {
+			t.Fatalf("%s: code %q", name, msg.Code)
+		}
+	}
+	if got := r.awareness[bob].state; !reflect.DeepEqual(got, map[string]any{"k": "v"}) {
+		t.Fatalf("rejected updates changed the state to %v", got)
+	}
+}
+
+func TestAwarenessClearedOnLeave(t *testing.T) {
+	h, doc := handshakeHub(t)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	bob := joinTestClient(t, h, "t", doc.ID, "bob")
+	if _, _, ok := bob.submit(ClientMessage{Type: "awareness", Awareness: map[string]any{"typing": true}}); !ok {
+		t.Fatal("room closed")
+	}
+	if msg := expectMessage(t, alice, "awareness"); msg.ClientID != bob.id || msg.UserID != "bob" {
+		t.Fatalf("alice got awareness from %s/%s", msg.UserID, msg.ClientID)
+	}
+	late := joinTestClient(t, h, "t", doc.ID, "alice")
+	if peers := expectMessage(t, late, "snapshot").Peers; len(peers) != 1 || peers[0].ClientID != bob.id {
+		t.Fatalf("snapshot peers = %+v", peers)
+	}
+
+	bob.leave()
+	if msg := expectMessage(t, alice, "awareness"); msg.ClientID != bob.id || msg.Awareness != nil {
+		t.Fatalf("after bob left alice got %s with %v", msg.ClientID, msg.Awareness)
+	}
+}
+
+func TestRemoteAwarenessExpires(t *testing.T) {
+	r, _, _ := awarenessRoom(t)
+	payload, err := json.Marshal(envelope{Origin: "other", Message: ServerMessage{Type: "awareness", UserID: "carol", ClientID: "c", Awareness: map[string]any{"typing": true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.handleFeed(payload)
+	if states := r.awarenessStates(); len(states) != 1 || states[0].UserID != "carol" {
+		t.Fatalf("states = %+v", states)
+	}
+	r.flushAwareness(time.Now().Add(awarenessTTL))
+	if states := r.awarenessStates(); len(states) != 0 {
+		t.Fatalf("remote state outlived its TTL: %+v", states)
+	}
+}
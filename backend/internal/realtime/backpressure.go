@@ -0,0 +1,180 @@
+package realtime
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"docStream/backend/internal/document"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sendBuffer is the number of encoded messages queued per client.
+	sendBuffer = 256
+	// A client whose queue fills past lagHighWater stops receiving updates
+	// one by one; they are held back until the queue drains to lagLowWater
+	// and then sent as a single coalesced update.
+	lagHighWater = sendBuffer * 3 / 4
+	lagLowWater  = sendBuffer / 4
+	// lagFlushInterval is how often lagging clients are checked.
+	lagFlushInterval = 200 * time.Millisecond
+	// slowConsumerTimeout is how long a client may stay behind before it
+	// is disconnected.
+	slowConsumerTimeout = 30 * time.Second
+)
+
+// Reasons given in the close frame when the server ends a connection.
+const (
+	closeReasonSlowConsumer = "slow consumer: could not keep up with updates"
+	closeReasonShutdown     = "server shutting down"
+)
+
+// backlog holds the updates a lagging client has not been sent yet.
+type backlog struct {
+	since     int64 // version the client had before the first held update
+	ops       []document.Operation
+	authors   []string
+	versioned *document.DocumentVersion
+	resync    bool // too much to coalesce; send a fresh snapshot instead
+	started   time.Time
+}
+
+// hold adds an update to the backlog, giving up on coalescing when the
+// updates are not consecutive or there are more than a replay's worth.
+func (b *backlog) hold(msg ServerMessage) {
+	if b.resync {
+		return
+	}
+	if msg.Operation == nil || len(b.ops) >= maxReplayOps ||
+		(len(b.ops) > 0 && msg.Version != b.ops[len(b.ops)-1].Version+1) {
+		b.resync = true
+		b.ops, b.authors, b.versioned = nil, nil, nil
+		return
+	}
+	if len(b.ops) == 0 {
+		b.since = msg.Version - 1
+	}
+	b.ops = append(b.ops, *msg.Operation)
+	if msg.Versioned != nil {
+		b.versioned = msg.Versioned
+	}
+	for _, author := range b.authors {
+		if author == msg.UserID {
+			return
+		}
+	}
+	b.authors = append(b.authors, msg.UserID)
+}
+
+// queue delivers an encoded broadcast to a client, holding updates back
+// while it is lagging. Cursor, presence and ack messages for a lagging
+// client are dropped; the catch-up that ends the lag restates them.
+func (r *Room) queue(client *Client, msg ServerMessage, payload []byte) {
+	b := r.lagging[client]
+	if b == nil && len(client.send) < lagHighWater {
+		select {
+		case client.send <- payload:
+			return
+		default:
+		}
+	}
+	if b == nil {
+		b = r.startLag(client)
+	}
+	if msg.Type == "update" {
+		b.hold(msg)
+	}
+}
+
+func (r *Room) startLag(client *Client) *backlog {
+	b := &backlog{started: time.Now()}
+	r.lagging[client] = b
+	return b
+}
+
+// flushLagging catches up clients whose queues have drained, and
+// disconnects those that have been behind for too long.
+func (r *Room) flushLagging(now time.Time) {
+	for client, b := range r.lagging {
+		if len(client.send) > lagLowWater {
+			if now.Sub(b.started) > slowConsumerTimeout {
+				log.Printf("room %s: dropping slow client %s", r.topic, client.id)
+				r.dropClient(client, websocket.CloseTryAgainLater, closeReasonSlowConsumer)
+			}
+			continue
+		}
+		delete(r.lagging, client)
+		r.catchUp(client, b)
+	}
+}
+
+// catchUp sends a caught-up client what it missed: one update composed from
+// the held operations followed by the current cursors and roster, or a
+// fresh snapshot when the backlog could not be coalesced.
+func (r *Room) catchUp(client *Client, b *backlog) {
+	if len(b.ops) == 0 && !b.resync {
+		r.sendResumed(client, r.version, "", 0)
+		return
+	}
+	var op document.Operation
+	var err error
+	if !b.resync {
+		if op, err = document.ComposeOperations(b.ops); err != nil {
+			log.Printf("room %s: coalesce updates: %v", r.topic, err)
+		}
+	}
+	if b.resync || err != nil {
+		r.sendSnapshotMessage(client, "resync")
+		return
+	}
+
+	msg := ServerMessage{
+		Type:        "update",
+		TenantID:    r.tenantID,
+		DocumentID:  r.documentID,
+		Version:     op.Version,
+		BaseVersion: b.since,
+		Operation:   &op,
+		Checksum:    op.Checksum,
+		Versioned:   b.versioned,
+		Authors:     b.authors,
+		Message:     "coalesced",
+	}
+	if len(b.authors) == 1 {
+		msg.UserID = b.authors[0]
+	}
+	r.sendTo(client, msg)
+	r.sendResumed(client, op.Version, r.documentEngine(), 0)
+}
+
+// documentEngine returns the document's engine, loading the document if the
+// room has not yet. It returns "" if the document cannot be loaded.
+func (r *Room) documentEngine() string {
+	if r.engine != "" {
+		return r.engine
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	doc, err := r.service.GetDocument(ctx, r.tenantID, r.documentID)
+	if err != nil {
+		log.Printf("room %s: load document: %v", r.topic, err)
+		return ""
+	}
+	r.engine = doc.Engine
+	return r.engine
+}
+
+// dropClient removes a client from the room and closes its queue. The
+// writer sends code and reason in the close frame; a zero code sends an
+// empty one.
+func (r *Room) dropClient(client *Client, code int, reason string) {
+	if !r.clients[client] {
+		return
+	}
+	delete(r.clients, client)
+	delete(r.lagging, client)
+	r.stopReplay(client)
+	client.closeCode, client.closeReason = code, reason
+	close(client.send)
+}
@@ -0,0 +1,169 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// lagRoom returns a room, not running, for a new document with the given
+// engine, and a client whose queue is already past the high-water mark.
+func lagRoom(t *testing.T, engine string) (*Room, *Client, document.Document) {
+	t.Helper()
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(context.Background(), "t", "owner", "x", "hello", engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRoom(NewHub(svc, Config{}), "t", doc.ID)
+	r.version = doc.Version
+	slow := &Client{id: "slow", userID: "s", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	r.clients[slow] = true
+	for i := 0; i < lagHighWater; i++ {
+		slow.send <- []byte("{}")
+	}
+	return r, slow, doc
+}
+
+func TestSlowReaderCatchUp(t *testing.T) {
+	tests := []struct {
+		engine  string
+		updates int
+		want    string // first message once the client drains its queue
+	}{
+		{document.EngineOT, 1, "update"},
+		{document.EngineOT, 20, "update"},
+		{document.EngineOT, maxReplayOps + 1, "snapshot"},
+		{document.EngineCRDT, 1, "update"},
+		{document.EngineCRDT, 20, "update"},
+		{document.EngineCRDT, maxReplayOps + 1, "snapshot"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.engine, tt.updates), func(t *testing.T) {
+			r, slow, doc := lagRoom(t, tt.engine)
+			fast := &Client{id: "fast", userID: "f", codec: jsonWire, send: make(chan []byte, 4*sendBuffer)}
+			r.clients[fast] = true
+
+			content := doc.Content
+			for i := 0; i < tt.updates; i++ {
+				next := content + fmt.Sprint(i%10)
+				if i%4 == 3 {
+					next = content[1:]
+				}
+				in := document.ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: fmt.Sprint("u", i%3), BaseVersion: doc.Version}
+				if tt.engine == document.EngineOT {
+					in.Delta = document.Diff(content, next).String()
+				} else {
+					in.NewContent = next
+				}
+				var op document.Operation
+				var err error
+				if doc, op, _, err = r.service.ApplyOperation(context.Background(), in); err != nil {
+					t.Fatal(err)
+				}
+				content = next
+				r.deliver(ServerMessage{Type: "update", UserID: op.UserID, Version: op.Version, Operation: &op})
+				r.deliver(ServerMessage{Type: "cursor", UserID: op.UserID})
+				for len(fast.send) > 0 {
+					<-fast.send
+				}
+			}
+			if r.lagging[fast] != nil {
+				t.Fatal("a client keeping up was marked as lagging")
+			}
+			if len(slow.send) != lagHighWater {
+				t.Fatalf("lagging client was sent %d more messages", len(slow.send)-lagHighWater)
+			}
+
+			r.flushLagging(time.Now())
+			if r.lagging[slow] == nil {
+				t.Fatal("client with a full queue caught up")
+			}
+			for len(slow.send) > 0 {
+				<-slow.send
+			}
+			r.flushLagging(time.Now())
+			if r.lagging[slow] != nil {
+				t.Fatal("client with an empty queue is still lagging")
+			}
+
+			var msg ServerMessage
+			if err := jsonWire.Unmarshal(<-slow.send, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != tt.want {
+				t.Fatalf("got %s %q, want %s", msg.Type, msg.Message, tt.want)
+			}
+			if msg.Type == "snapshot" {
+				if msg.Message != "resync" || msg.Content != content {
+					t.Fatalf("resync snapshot %q has %q, want %q", msg.Message, msg.Content, content)
+				}
+				return
+			}
+			if msg.Message != "coalesced" || msg.BaseVersion != 1 || msg.Version != doc.Version {
+				t.Fatalf("update %q spans %d..%d, want coalesced 1..%d", msg.Message, msg.BaseVersion, msg.Version, doc.Version)
+			}
+			if msg.Checksum != document.Checksum(content) {
+				t.Errorf("checksum %s, want %s", msg.Checksum, document.Checksum(content))
+			}
+			if want := min(tt.updates, 3); len(msg.Authors) != want {
+				t.Errorf("authors %v, want %d", msg.Authors, want)
+			}
+
+			if err := jsonWire.Unmarshal(<-slow.send, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != "resumed" || msg.Version != doc.Version || msg.Engine != tt.engine {
+				t.Fatalf("got %s at %d engine %q, want resumed at %d engine %q", msg.Type, msg.Version, msg.Engine, doc.Version, tt.engine)
+			}
+			if len(slow.send) != 0 {
+				t.Fatalf("%d unexpected messages after resumed", len(slow.send))
+			}
+		})
+	}
+}
+
+func TestSlowReaderDisconnected(t *testing.T) {
+	tests := []struct {
+		name     string
+		behind   time.Duration
+		wantDrop bool
+	}{
+		{"briefly behind", slowConsumerTimeout / 2, false},
+		{"behind too long", slowConsumerTimeout + time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, slow, _ := lagRoom(t, document.EngineOT)
+			for len(slow.send) < sendBuffer {
+				r.sendTo(slow, ServerMessage{Type: "cursor"})
+			}
+			r.sendTo(slow, ServerMessage{Type: "cursor"})
+			if b := r.lagging[slow]; b == nil {
+				t.Fatal("client with a full queue is not lagging")
+			}
+
+			r.flushLagging(time.Now().Add(tt.behind))
+			if dropped := !r.clients[slow]; dropped != tt.wantDrop {
+				t.Fatalf("dropped = %v, want %v", dropped, tt.wantDrop)
+			}
+			if !tt.wantDrop {
+				return
+			}
+			if slow.closeReason != closeReasonSlowConsumer {
+				t.Errorf("close reason %q", slow.closeReason)
+			}
+			n := 0
+			for range slow.send {
+				n++
+			}
+			if n != sendBuffer {
+				t.Errorf("%d messages left queued, want %d", n, sendBuffer)
+			}
+			r.dropClient(slow, 0, "") // already dropped: must not close twice
+		})
+	}
+}
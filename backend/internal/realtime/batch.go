@@ -0,0 +1,60 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// batchTimeout bounds a "batch" message, which may commit up to
+// document.MaxBatchOperations operations.
+const batchTimeout = 15 * time.Second
+
+// handleBatch merges edits a client made while disconnected. The operations
+// are broadcast as usual; the sender gets "batch_applied" once they are all
+// in, or a batch_conflict error describing why none were applied.
+func (r *Room) handleBatch(evt inboundEvent) {
+	if !evt.client.access.Allows(document.AccessEdit) {
+		r.sendError(evt.client, errForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+
+	result, err := r.service.ApplyBatch(ctx, document.ApplyBatchInput{
+		TenantID:    r.tenantID,
+		DocumentID:  r.documentID,
+		UserID:      evt.client.userID,
+		BaseVersion: evt.message.BaseVersion,
+		Operations:  evt.message.Batch,
+		Lamport:     evt.message.Lamport,
+		Session:     evt.client.session,
+		Force:       evt.message.Force,
+	})
+	// A batch that failed partway still committed its first operations.
+	doc := result.Document
+	for i, op := range result.Operations {
+		doc.Version = op.Version
+		r.broadcastApplied(doc, op, result.Versions[i])
+	}
+	if err != nil {
+		if !errors.Is(err, document.ErrBatchConflict) {
+			log.Printf("apply batch failed: %v", err)
+		}
+		r.sendError(evt.client, err)
+		return
+	}
+	r.sendTo(evt.client, ServerMessage{
+		Type:        "batch_applied",
+		TenantID:    r.tenantID,
+		DocumentID:  r.documentID,
+		UserID:      evt.client.userID,
+		Version:     result.Document.Version,
+		BaseVersion: evt.message.BaseVersion,
+		Seq:         result.Document.SessionSeq(evt.client.userID, evt.client.session),
+	})
+}
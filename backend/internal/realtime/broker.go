@@ -0,0 +1,158 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrBrokerClosed is returned when publishing to or subscribing on a closed broker.
+var ErrBrokerClosed = errors.New("broker closed")
+
+// Broker fans room messages out across backend instances. Every instance
+// with a room open for a document subscribes to the document's topic and
+// delivers what it receives, so all instances see broadcasts in the order
+// the broker assigned them.
+type Broker interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Subscribe(ctx context.Context, topic string) (Subscription, error)
+	Close() error
+}
+
+// Subscription is a live feed of payloads published to one topic.
+type Subscription interface {
+	// Messages is closed once the subscription ends.
+	Messages() <-chan []byte
+	Close() error
+}
+
+// InMemoryBroker is a single-process broker for development and tests.
+type InMemoryBroker struct {
+	mu     sync.RWMutex
+	topics map[string]map[*memorySubscription]struct{}
+	closed bool
+}
+
+func NewInMemoryBroker() *InMemoryBroker {
+	return &InMemoryBroker{topics: make(map[string]map[*memorySubscription]struct{})}
+}
+
+func (b *InMemoryBroker) Publish(_ context.Context, topic string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	for sub := range b.topics[topic] {
+		sub.push(payload)
+	}
+	return nil
+}
+
+func (b *InMemoryBroker) Subscribe(_ context.Context, topic string) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	sub := newMemorySubscription(func(s *memorySubscription) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.topics[topic], s)
+		if len(b.topics[topic]) == 0 {
+			delete(b.topics, topic)
+		}
+	})
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[*memorySubscription]struct{})
+	}
+	b.topics[topic][sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *InMemoryBroker) Close() error {
+	b.mu.Lock()
+	topics := b.topics
+	b.topics = make(map[string]map[*memorySubscription]struct{})
+	b.closed = true
+	b.mu.Unlock()
+
+	for _, subs := range topics {
+		for sub := range subs {
+			sub.stop()
+		}
+	}
+	return nil
+}
+
+// memorySubscription queues payloads without bounding them so a publisher
+// never blocks on its own subscriber, e.g. a room publishing to itself.
+type memorySubscription struct {
+	out    chan []byte
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	done   bool
+	remove func(*memorySubscription)
+	once   sync.Once
+}
+
+func newMemorySubscription(remove func(*memorySubscription)) *memorySubscription {
+	s := &memorySubscription{out: make(chan []byte), remove: remove}
+	s.cond = sync.NewCond(&s.mu)
+	go s.pump()
+	return s
+}
+
+func (s *memorySubscription) push(payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.queue = append(s.queue, payload)
+	s.cond.Signal()
+}
+
+func (s *memorySubscription) pump() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.done {
+			s.cond.Wait()
+		}
+		if s.done {
+			s.mu.Unlock()
+			return
+		}
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		s.out <- next
+	}
+}
+
+func (s *memorySubscription) Messages() <-chan []byte { return s.out }
+
+func (s *memorySubscription) Close() error {
+	s.remove(s)
+	s.stop()
+	return nil
+}
+
+func (s *memorySubscription) stop() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.done = true
+		s.queue = nil
+		s.cond.Signal()
+		s.mu.Unlock()
+		// Unblock a pump waiting to hand over a message nobody will read.
+		go func() {
+			for range s.out {
+			}
+		}()
+	})
+}
@@ -0,0 +1,153 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// Changes made through the REST API reach rooms as document.Change events.
+// The hub publishes each one on the room's topic, so every instance with
+// the room open applies it to its own clients.
+
+const (
+	// closeAccessRevoked closes the connection of a user who lost access to
+	// the document; clients should not reconnect.
+	closeAccessRevoked       = 4403
+	closeReasonAccessRevoked = "access revoked"
+)
+
+// PermissionChange is the body of a "permission" message.
+type PermissionChange struct {
+	SubjectID string               `json:"subjectId,omitempty"` // whose access changed; empty for share links
+	Level     document.AccessLevel `json:"level,omitempty"`     // empty when revoked
+	ShareLink bool                 `json:"shareLink,omitempty"` // a share link granting Level was created
+}
+
+func roomTopic(tenantID, documentID string) string {
+	return "docstream:room:" + tenantID + ":" + documentID
+}
+
+// publishChange hands a service change to the document's rooms and the
+// tenant's list watchers on every instance. It runs on the goroutine that
+// made the change.
+func (h *Hub) publishChange(change document.Change) {
+	if evt, ok := listingFor(change); ok {
+		h.publishListing(change.TenantID, evt)
+	}
+	if change.Kind == document.ChangeCreated {
+		// No room can be open yet.
+		return
+	}
+	payload, err := json.Marshal(envelope{Origin: h.instance, Change: &change})
+	if err != nil {
+		log.Printf("marshal change: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = h.broker.Publish(ctx, roomTopic(change.TenantID, change.DocumentID), payload)
+	if err == nil {
+		return
+	}
+	log.Printf("publish %s change failed, applying locally: %v", change.Kind, err)
+
+	h.mu.Lock()
+	room := h.rooms[h.roomKey(change.TenantID, change.DocumentID)]
+	h.mu.Unlock()
+	if room == nil {
+		return
+	}
+	select {
+	case room.changes <- change:
+	case <-room.done:
+	}
+}
+
+// applyChange brings this instance's clients up to date with a change made
+// outside the room.
+func (r *Room) applyChange(change document.Change) {
+	switch change.Kind {
+	case document.ChangeReverted:
+		if change.Operation != nil {
+			r.recordEffect(*change.Operation)
+		}
+		// Everyone starts over from the restored content. Lagging clients
+		// get it once they drain.
+		for client := range r.clients {
+			if b := r.lagging[client]; b != nil {
+				b.resync = true
+				continue
+			}
+			r.sendSnapshotMessage(client, "reverted")
+		}
+	case document.ChangeTitle:
+		r.deliver(ServerMessage{
+			Type:       "title",
+			TenantID:   r.tenantID,
+			DocumentID: r.documentID,
+			UserID:     change.UserID,
+			Version:    change.Version,
+			Title:      change.Title,
+		})
+	case document.ChangePermission, document.ChangeShareLink:
+		r.deliver(ServerMessage{
+			Type:       "permission",
+			TenantID:   r.tenantID,
+			DocumentID: r.documentID,
+			UserID:     change.UserID,
+			Version:    change.Version,
+			Permission: &PermissionChange{
+				SubjectID: change.SubjectID,
+				Level:     change.Level,
+				ShareLink: change.Kind == document.ChangeShareLink,
+			},
+		})
+		if change.Kind == document.ChangePermission {
+			r.recheckAccess()
+		}
+	case document.ChangeDeleted:
+		for client := range r.clients {
+			r.dropClient(client, closeDocumentDeleted, closeReasonDocumentDeleted)
+		}
+	}
+}
+
+// recheckAccess applies the document's current permissions to connected
+// clients: a changed level takes effect at once and is reported with an
+// "access" message, and clients left without access are disconnected.
+func (r *Room) recheckAccess() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	doc, err := r.service.GetDocument(ctx, r.tenantID, r.documentID)
+	if err != nil {
+		log.Printf("room %s: recheck access: %v", r.topic, err)
+		return
+	}
+	now := time.Now()
+	for client := range r.clients {
+		access, ok := doc.AccessFor(client.userID)
+		if !ok {
+			access, ok = doc.AccessForLink(client.shareToken, now)
+		}
+		if !ok {
+			r.dropClient(client, closeAccessRevoked, closeReasonAccessRevoked)
+			continue
+		}
+		if access == client.access {
+			continue
+		}
+		client.access = access
+		r.sendTo(client, ServerMessage{
+			Type:       "access",
+			TenantID:   r.tenantID,
+			DocumentID: r.documentID,
+			UserID:     client.userID,
+			ClientID:   client.id,
+			Access:     access,
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package realtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// expectClosed drains client until the room closes it and returns the close
+// code it was given.
+func expectClosed(t *testing.T, client *Client) int {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-client.send:
+			if !ok {
+				return client.closeCode
+			}
+		case <-timeout:
+			t.Fatalf("client %s still open", client.userID)
+		}
+	}
+}
+
+// changeHub opens a hub on a document owned by alice that bob may edit and
+// carol may view.
+func changeHub(t *testing.T) (*Hub, *document.Service, document.Document) {
+	t.Helper()
+	ctx := context.Background()
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(ctx, "t", "alice", "x", "hello", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, level := range map[string]document.AccessLevel{"bob": document.AccessEdit, "carol": document.AccessView} {
+		if doc, err = svc.SetPermission(ctx, "t", doc.ID, user, level); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHub(svc, Config{})
+	closeHub(t, h)
+	return h, svc, doc
+}
+
+func TestPermissionChangeReachesOpenClients(t *testing.T) {
+	ctx := context.Background()
+	h, svc, doc := changeHub(t)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	bob := joinTestClient(t, h, "t", doc.ID, "bob")
+	expectMessage(t, bob, "snapshot")
+
+	if _, err := svc.SetPermission(ctx, "t", doc.ID, "bob", document.AccessView); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectMessage(t, bob, "access"); msg.Access != document.AccessView {
+		t.Fatalf("bob's access message = %q, want view", msg.Access)
+	}
+	if msg := expectMessage(t, alice, "permission"); msg.Permission.SubjectID != "bob" || msg.Permission.Level != document.AccessView {
+		t.Fatalf("alice got %+v", msg.Permission)
+	}
+	// The downgrade applies at once: bob's edits are refused.
+	if _, _, ok := bob.submit(ClientMessage{Type: "operation", Delta: `[5,"!"]`, BaseVersion: doc.Version}); !ok {
+		t.Fatal("room closed")
+	}
+	if msg := expectMessage(t, bob, "error"); msg.Code != ErrCodeForbidden {
+		t.Fatalf("bob's edit after the downgrade: code %q, want %q", msg.Code, ErrCodeForbidden)
+	}
+
+	if _, err := svc.SetPermission(ctx, "t", doc.ID, "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if code := expectClosed(t, bob); code != closeAccessRevoked {
+		t.Fatalf("bob closed with %d, want %d", code, closeAccessRevoked)
+	}
+	if msg := expectMessage(t, alice, "permission"); msg.Permission.SubjectID != "bob" || msg.Permission.Level != "" {
+		t.Fatalf("alice got %+v, want bob's revocation", msg.Permission)
+	}
+}
+
+func TestRevertAndRenameReachOpenClients(t *testing.T) {
+	ctx := context.Background()
+	h, svc, doc := changeHub(t)
+	version, err := svc.LabelVersion(ctx, "t", doc.ID, "alice", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol := joinTestClient(t, h, "t", doc.ID, "carol")
+	expectMessage(t, carol, "snapshot")
+	if _, _, _, err := svc.ApplyOperation(ctx, document.ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "alice", NewContent: "changed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := svc.RevertToVersion(ctx, "t", doc.ID, version.ID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectMessage(t, carol, "snapshot"); msg.Content != "hello" || msg.Version != doc.Version+2 {
+		t.Fatalf("after the revert carol got %q at version %d", msg.Content, msg.Version)
+	}
+
+	if _, err := svc.RenameDocument(ctx, "t", doc.ID, "alice", "Renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectMessage(t, carol, "title"); msg.Title != "Renamed" || msg.UserID != "alice" {
+		t.Fatalf("carol got title %q from %q", msg.Title, msg.UserID)
+	}
+}
@@ -0,0 +1,41 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// handleChecksum compares the checksum a client reports for its copy of the
+// document with the server's at the same version. A mismatch means the
+// client has drifted; it is logged as a divergence and the client alone is
+// resynced with a snapshot.
+func (r *Room) handleChecksum(evt inboundEvent) {
+	client := evt.client
+	version, reported := evt.message.Version, evt.message.Checksum
+	if version <= 0 || reported == "" {
+		r.sendError(client, fmt.Errorf("%w: version and checksum are required", errInvalidChecksum))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	expected, err := r.service.ChecksumAt(ctx, r.tenantID, r.documentID, version)
+	if err != nil {
+		r.sendError(client, err)
+		return
+	}
+	if expected == "" || expected == reported {
+		return
+	}
+
+	log.Printf("room %s: divergence: client %s (user %s) has checksum %s at version %d, server has %s",
+		r.topic, client.id, client.userID, reported, version, expected)
+	if b := r.lagging[client]; b != nil {
+		b.resync = true
+		return
+	}
+	r.sendSnapshotMessage(client, "diverged")
+}
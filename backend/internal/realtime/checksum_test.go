@@ -0,0 +1,97 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+func TestChecksumMismatchResyncs(t *testing.T) {
+	h, doc := handshakeHub(t)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	expectMessage(t, alice, "snapshot")
+	bob := joinTestClient(t, h, "t", doc.ID, "bob")
+	snapshot := expectMessage(t, bob, "snapshot")
+	if snapshot.Checksum != document.Checksum("hello") {
+		t.Fatalf("snapshot checksum %s, want %s", snapshot.Checksum, document.Checksum("hello"))
+	}
+	if _, _, ok := alice.submit(ClientMessage{Type: "operation", Delta: `[5,"!"]`, BaseVersion: doc.Version}); !ok {
+		t.Fatal("room closed")
+	}
+	update := expectMessage(t, bob, "update")
+	if update.Checksum != document.Checksum("hello!") {
+		t.Fatalf("update checksum %s, want %s", update.Checksum, document.Checksum("hello!"))
+	}
+
+	report := func(version int64, checksum string) {
+		t.Helper()
+		if _, _, ok := bob.submit(ClientMessage{Type: "checksum", Version: version, Checksum: checksum}); !ok {
+			t.Fatal("room closed")
+		}
+	}
+
+	// Matching checksums, at the head or an older version, are not
+	// answered: the next reply bob gets is to his ping.
+	report(update.Version, update.Checksum)
+	report(snapshot.Version, snapshot.Checksum)
+	if _, _, ok := bob.submit(ClientMessage{Type: "ping"}); !ok {
+		t.Fatal("room closed")
+	}
+	if types, _ := messagesUntil(t, bob, "pong"); len(types) != 1 {
+		t.Fatalf("matching checksums answered with %v", types[:len(types)-1])
+	}
+
+	for _, version := range []int64{update.Version, snapshot.Version} {
+		report(version, "00000000")
+		resync := expectMessage(t, bob, "snapshot")
+		if resync.Message != "diverged" || resync.Content != "hello!" || resync.Version != update.Version {
+			t.Fatalf("mismatch at %d: snapshot %q of %q at %d", version, resync.Message, resync.Content, resync.Version)
+		}
+	}
+	// Only the drifting client is reset.
+	if _, _, ok := alice.submit(ClientMessage{Type: "ping"}); !ok {
+		t.Fatal("room closed")
+	}
+	types, _ := messagesUntil(t, alice, "pong")
+	for _, typ := range types {
+		if typ == "snapshot" {
+			t.Fatalf("alice was resynced: %v", types)
+		}
+	}
+
+	report(0, "00000000")
+	if msg := expectMessage(t, bob, "error"); msg.Code != ErrCodeInvalidChecksum {
+		t.Fatalf("checksum without a version: code %q", msg.Code)
+	}
+	report(update.Version+5, "00000000")
+	if msg := expectMessage(t, bob, "error"); msg.Code != ErrCodeBaseVersionAhead {
+		t.Fatalf("checksum ahead of the head: code %q", msg.Code)
+	}
+}
+
+// TestChecksumMismatchWhileLagging folds the resync into the catch-up of a
+// client that is behind rather than queueing a snapshot after its backlog.
+func TestChecksumMismatchWhileLagging(t *testing.T) {
+	r, slow, doc := lagRoom(t, document.EngineOT)
+	r.deliver(ServerMessage{Type: "cursor", UserID: "f"})
+	if r.lagging[slow] == nil {
+		t.Fatal("client with a full queue is not lagging")
+	}
+
+	r.handleChecksum(inboundEvent{client: slow, message: ClientMessage{Type: "checksum", Version: doc.Version, Checksum: "00000000"}})
+	if len(slow.send) != lagHighWater {
+		t.Fatal("resync sent past the backlog")
+	}
+	for len(slow.send) > 0 {
+		<-slow.send
+	}
+	r.flushLagging(time.Now())
+	var msg ServerMessage
+	if err := jsonWire.Unmarshal(<-slow.send, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "snapshot" || msg.Content != doc.Content {
+		t.Fatalf("caught up with %s %q, want a snapshot", msg.Type, msg.Message)
+	}
+}
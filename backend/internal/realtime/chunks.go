@@ -0,0 +1,138 @@
+package realtime
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"docStream/backend/internal/document"
+)
+
+const (
+	// snapshotChunkSize is the largest piece of content sent in one frame.
+	// Bigger snapshots are split into snapshot_chunk messages.
+	snapshotChunkSize = 256 << 10
+	// transferTTL is how long a chunked snapshot can be resumed after the
+	// last request for it.
+	transferTTL = 2 * time.Minute
+	// uploadOverhead allows for the envelope and escaping around content
+	// in an uploaded message.
+	uploadOverhead = 64 << 10
+)
+
+// snapshotTransfer is a chunked snapshot kept so a client that drops
+// mid-transfer can continue where it stopped instead of starting over.
+type snapshotTransfer struct {
+	version int64
+	content string
+	expires time.Time
+}
+
+// pendingUpload collects the chunks of one oversized client message.
+type pendingUpload struct {
+	id  string
+	buf []byte
+}
+
+// sendChunked sends a snapshot header without content, then the content in
+// snapshot_chunk messages.
+func (r *Room) sendChunked(client *Client, msg ServerMessage) {
+	id := document.NewID()
+	t := &snapshotTransfer{version: msg.Version, content: msg.Content, expires: time.Now().Add(transferTTL)}
+	r.transfers[id] = t
+
+	msg.Content = ""
+	msg.Transfer = &Transfer{ID: id, Size: len(t.content)}
+	r.sendTo(client, msg)
+	r.sendChunks(client, id, t, 0)
+}
+
+func (r *Room) sendChunks(client *Client, id string, t *snapshotTransfer, offset int) {
+	for offset < len(t.content) {
+		end := min(offset+snapshotChunkSize, len(t.content))
+		for end < len(t.content) && !utf8.RuneStart(t.content[end]) {
+			end--
+		}
+		r.sendTo(client, ServerMessage{
+			Type:       "snapshot_chunk",
+			TenantID:   r.tenantID,
+			DocumentID: r.documentID,
+			Version:    t.version,
+			Content:    t.content[offset:end],
+			Transfer:   &Transfer{ID: id, Offset: offset, Size: len(t.content)},
+		})
+		offset = end
+	}
+}
+
+// handleSnapshotResume continues a chunked snapshot from the requested
+// offset. Expired or unknown transfers get a fresh snapshot instead.
+func (r *Room) handleSnapshotResume(evt inboundEvent) {
+	req := evt.message.Transfer
+	var t *snapshotTransfer
+	if req != nil {
+		t = r.transfers[req.ID]
+	}
+	if t == nil || req.Offset < 0 || req.Offset > len(t.content) ||
+		(req.Offset < len(t.content) && !utf8.RuneStart(t.content[req.Offset])) {
+		r.sendSnapshotMessage(evt.client, "resync")
+		return
+	}
+	t.expires = time.Now().Add(transferTTL)
+	r.sendChunks(evt.client, req.ID, t, req.Offset)
+}
+
+func (r *Room) expireTransfers(now time.Time) {
+	for id, t := range r.transfers {
+		if now.After(t.expires) {
+			delete(r.transfers, id)
+		}
+	}
+}
+
+// handleUpload appends a chunk to the sender's pending upload and, on the
+// final chunk, decodes and handles the assembled message. A client has at
+// most one upload pending: a chunk with a new ID abandons the previous one,
+// and the limiter charges every chunk, so restarting gains nothing.
+func (r *Room) handleUpload(evt inboundEvent) {
+	chunk := evt.message.Upload
+	if chunk == nil || chunk.ID == "" {
+		r.sendError(evt.client, fmt.Errorf("%w: missing upload", errInvalidUpload))
+		return
+	}
+
+	up := r.uploads[evt.client]
+	if up == nil || up.id != chunk.ID {
+		up = &pendingUpload{id: chunk.ID}
+		r.uploads[evt.client] = up
+	}
+	if chunk.Offset != len(up.buf) {
+		delete(r.uploads, evt.client)
+		r.sendError(evt.client, fmt.Errorf("%w: expected offset %d, got %d", errInvalidUpload, len(up.buf), chunk.Offset))
+		return
+	}
+	if limit := 2*r.service.MaxContentBytes() + uploadOverhead; len(up.buf)+len(chunk.Data) > limit {
+		delete(r.uploads, evt.client)
+		r.sendError(evt.client, fmt.Errorf("%w: upload exceeds %d bytes", document.ErrDocumentTooLarge, limit))
+		return
+	}
+	up.buf = append(up.buf, chunk.Data...)
+	if !chunk.Final {
+		return
+	}
+	delete(r.uploads, evt.client)
+
+	var msg ClientMessage
+	if err := evt.client.codec.Unmarshal(up.buf, &msg); err != nil {
+		r.sendError(evt.client, fmt.Errorf("%w: %v", errInvalidUpload, err))
+		return
+	}
+	if msg.Type == "upload" {
+		r.sendError(evt.client, fmt.Errorf("%w: nested upload", errInvalidUpload))
+		return
+	}
+	msg.DocumentID = r.documentID
+	msg.TenantID = r.tenantID
+	msg.UserID = evt.client.userID
+	r.handleEvent(inboundEvent{client: evt.client, message: msg})
+}
@@ -0,0 +1,213 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"docStream/backend/internal/document"
+	"github.com/gorilla/websocket"
+)
+
+// readChunked reads a chunked snapshot: the header, then chunks until the
+// content is complete. It returns the header, the content and where each
+// chunk started.
+func readChunked(t *testing.T, client *Client, from int) (ServerMessage, string, []int) {
+	t.Helper()
+	header := expectMessage(t, client, "snapshot")
+	if header.Transfer == nil || header.Content != "" {
+		t.Fatalf("snapshot of %d bytes is not chunked", len(header.Content))
+	}
+	content, offsets := readChunks(t, client, header.Transfer.ID, from)
+	return header, content, offsets
+}
+
+func readChunks(t *testing.T, client *Client, id string, from int) (string, []int) {
+	t.Helper()
+	var b strings.Builder
+	var offsets []int
+	for offset := from; ; {
+		msg := expectMessage(t, client, "snapshot_chunk")
+		if msg.Transfer == nil || msg.Transfer.ID != id || msg.Transfer.Offset != offset {
+			t.Fatalf("chunk %+v, want offset %d of %s", msg.Transfer, offset, id)
+		}
+		if len(msg.Content) > snapshotChunkSize || !utf8.ValidString(msg.Content) {
+			t.Fatalf("chunk at %d: %d bytes, valid UTF-8 %v", offset, len(msg.Content), utf8.ValidString(msg.Content))
+		}
+		offsets = append(offsets, offset)
+		b.WriteString(msg.Content)
+		offset += len(msg.Content)
+		if offset == msg.Transfer.Size {
+			return b.String(), offsets
+		}
+	}
+}
+
+func TestChunkedSnapshot(t *testing.T) {
+	// Two ASCII bytes put every chunk boundary inside an "é".
+	content := "xy" + strings.Repeat("aé", snapshotChunkSize*5/6)
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(context.Background(), "t", "alice", "x", content, document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(svc, Config{})
+	closeHub(t, h)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+
+	header, got, offsets := readChunked(t, alice, 0)
+	if got != content || header.Version != doc.Version || header.Checksum != document.Checksum(content) {
+		t.Fatalf("reassembled %d bytes at version %d, want %d at %d", len(got), header.Version, len(content), doc.Version)
+	}
+	if len(offsets) != 3 || offsets[1] != snapshotChunkSize-1 {
+		t.Fatalf("chunks start at %v, want 3 split short of each rune cut", offsets)
+	}
+	id := header.Transfer.ID
+
+	// A dropped transfer continues from the last chunk received.
+	resume := func(id string, offset int) {
+		t.Helper()
+		if _, _, ok := alice.submit(ClientMessage{Type: "snapshot_resume", Transfer: &Transfer{ID: id, Offset: offset}}); !ok {
+			t.Fatal("room closed")
+		}
+	}
+	resume(id, offsets[1])
+	if rest, _ := readChunks(t, alice, id, offsets[1]); rest != content[offsets[1]:] {
+		t.Fatalf("resumed transfer has %d bytes, want %d", len(rest), len(content)-offsets[1])
+	}
+
+	// Offsets it cannot continue from start over.
+	for name, tr := range map[string]Transfer{
+		"unknown transfer": {ID: "nope"},
+		"inside a rune":    {ID: id, Offset: offsets[1] + 1},
+		"past the end":     {ID: id, Offset: len(content) + 1},
+		"negative":         {ID: id, Offset: -1},
+	} {
+		resume(tr.ID, tr.Offset)
+		header, got, _ := readChunked(t, alice, 0)
+		if header.Message != "resync" || got != content {
+			t.Fatalf("%s: got %q snapshot of %d bytes", name, header.Message, len(got))
+		}
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	h, doc := handshakeHub(t)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	expectMessage(t, alice, "snapshot")
+
+	paste := strings.Repeat("z", 3*maxMessageSize/2)
+	raw, err := json.Marshal(ClientMessage{Type: "operation", Delta: fmt.Sprintf(`[5,%q]`, paste), BaseVersion: doc.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(chunk UploadChunk) {
+		t.Helper()
+		if _, _, ok := alice.submit(ClientMessage{Type: "upload", Upload: &chunk}); !ok {
+			t.Fatal("room closed")
+		}
+	}
+
+	// A chunk out of order abandons the upload.
+	send(UploadChunk{ID: "u1", Data: string(raw[:100])})
+	send(UploadChunk{ID: "u1", Offset: 200, Data: string(raw[200:300])})
+	if msg := expectMessage(t, alice, "error"); msg.Code != ErrCodeInvalidUpload {
+		t.Fatalf("out-of-order chunk: code %q", msg.Code)
+	}
+	send(UploadChunk{ID: "u1", Offset: 100, Data: string(raw[100:]), Final: true})
+	if msg := expectMessage(t, alice, "error"); msg.Code != ErrCodeInvalidUpload {
+		t.Fatalf("chunk of an abandoned upload: code %q", msg.Code)
+	}
+
+	size := maxMessageSize / 2
+	for offset := 0; offset < len(raw); offset += size {
+		end := min(offset+size, len(raw))
+		send(UploadChunk{ID: "u2", Offset: offset, Data: string(raw[offset:end]), Final: end == len(raw)})
+	}
+	update := expectMessage(t, alice, "update")
+	if update.Version != doc.Version+1 || update.UserID != "alice" {
+		t.Fatalf("upload applied as %+v", update)
+	}
+	got, err := h.service.GetDocument(context.Background(), "t", doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "hello"+paste {
+		t.Fatalf("document has %d bytes, want %d", len(got.Content), len("hello"+paste))
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	svc := document.NewService(document.NewInMemoryRepository())
+	svc.SetMaxContentBytes(1 << 10)
+	r := newRoom(NewHub(svc, Config{}), "t", "d")
+	client := &Client{id: "c", userID: "u", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	r.clients[client] = true
+	limit := 2*svc.MaxContentBytes() + uploadOverhead
+
+	for _, tt := range []struct {
+		name   string
+		chunks []UploadChunk
+		code   string
+	}{
+		{"missing ID", []UploadChunk{{Data: "{}", Final: true}}, ErrCodeInvalidUpload},
+		{"over the size limit", []UploadChunk{
+			{ID: "a", Data: strings.Repeat("x", limit/2)},
+			{ID: "a", Offset: limit / 2, Data: strings.Repeat("x", limit/2+1)},
+		}, ErrCodeTooLarge},
+		{"malformed message", []UploadChunk{{ID: "b", Data: "{", Final: true}}, ErrCodeInvalidUpload},
+		{"nested upload", []UploadChunk{{ID: "c", Data: `{"type":"upload"}`, Final: true}}, ErrCodeInvalidUpload},
+	} {
+		for i := range tt.chunks {
+			r.handleUpload(inboundEvent{client: client, message: ClientMessage{Type: "upload", Upload: &tt.chunks[i]}})
+		}
+		if msg := expectMessage(t, client, "error"); msg.Code != tt.code {
+			t.Fatalf("%s: code %q, want %q", tt.name, msg.Code, tt.code)
+		}
+		if len(r.uploads) != 0 {
+			t.Fatalf("%s: upload kept after it was rejected", tt.name)
+		}
+	}
+}
+
+// TestFrameAboveMaxMessageSize checks both transports refuse a single
+// message bigger than maxMessageSize; clients must upload it in chunks.
+func TestFrameAboveMaxMessageSize(t *testing.T) {
+	s := newTransportServer(t)
+	big := strings.Repeat("x", maxMessageSize+1)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.url(t, "/ws", "alice", nil), "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectWS(t, conn, "snapshot")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(big)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Fatalf("oversized frame: %v, want close %d", err, websocket.CloseMessageTooBig)
+		}
+		break
+	}
+
+	_, first := s.poll(t, "alice", nil)
+	resp, err := http.Post(s.url(t, "/send", "alice", url.Values{"sessionId": {first.SessionID}}), "application/json", strings.NewReader(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized send: status %d, want 413", resp.StatusCode)
+	}
+}
@@ -2,10 +2,11 @@ package realtime
 
 import (
 	"context"
-	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
+	"docStream/backend/internal/document"
 	"github.com/gorilla/websocket"
 )
 
@@ -13,21 +14,50 @@ const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 1024 * 8
+	maxMessageSize = 1024 * 1024
+	// compressMinSize is the smallest frame worth deflating; below it the
+	// compression overhead outweighs the savings.
+	compressMinSize = 512
 )
 
-// Client represents a single websocket connection.
+// Client represents a single connection: a websocket, or an event stream or
+// long poll paired with POSTs (see fallback.go), for which conn is nil.
 type Client struct {
-	room   *Room
-	conn   *websocket.Conn
-	send   chan []byte
-	userID string
-	ctx    context.Context
+	id          string
+	room        *Room
+	conn        *websocket.Conn
+	codec       Codec // wire format negotiated at upgrade
+	send        chan []byte
+	userID      string
+	displayName string
+	access      document.AccessLevel
+	resuming    bool   // skip the join snapshot; the client will send "resume"
+	session     string // editing session, kept across reconnects; see document.SessionClock
+	shareToken  string // share link the client joined with, if any
+	ctx         context.Context
+	limiter     *inboundLimiter // used by submit, one call at a time
+
+	// Set by the room before it closes send; written in the close frame.
+	closeCode   int
+	closeReason string
+
+	leaveOnce sync.Once
+}
+
+// leave unregisters the client from its room. Only the first call counts.
+func (c *Client) leave() {
+	c.leaveOnce.Do(func() {
+		select {
+		case c.room.unregister <- c:
+		case <-c.room.done:
+		}
+	})
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.room.unregister <- c
+		c.leave()
+		c.room.hub.users.leave(c.userID)
 		c.conn.Close()
 	}()
 
@@ -48,27 +78,60 @@ func (c *Client) readPump() {
 		}
 
 		var clientMsg ClientMessage
-		if err := json.Unmarshal(message, &clientMsg); err != nil {
+		if err := c.codec.Unmarshal(message, &clientMsg); err != nil {
 			log.Printf("decode message: %v", err)
 			continue
 		}
 
-		// Fill missing routing fields from the connection context.
-		if clientMsg.DocumentID == "" {
-			clientMsg.DocumentID = c.room.documentID
-		}
-		if clientMsg.TenantID == "" {
-			clientMsg.TenantID = c.room.tenantID
-		}
-		if clientMsg.UserID == "" {
-			clientMsg.UserID = c.userID
+		if code, reason, ok := c.submit(clientMsg); !ok {
+			if code != 0 {
+				frame := websocket.FormatCloseMessage(code, reason)
+				_ = c.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeWait))
+			}
+			return
 		}
+	}
+}
 
-		c.room.inbound <- inboundEvent{
-			client:  c,
-			message: clientMsg,
-		}
+// submit hands a decoded message to the room once it passes the rate
+// limits, waiting while the room's queue is full. It reports false when the
+// client must be disconnected, with the code and reason to close with; a
+// zero code means the room is gone.
+func (c *Client) submit(msg ClientMessage) (code int, reason string, ok bool) {
+	evt, code, reason, deliver := c.admit(msg)
+	if !deliver {
+		return code, reason, code == 0
+	}
+	select {
+	case c.room.inbound <- evt:
+		return 0, "", true
+	case <-c.room.done:
+		return 0, "", false
+	}
+}
+
+// admit stamps msg with the connection's identity and applies the rate
+// limits. It returns the event to hand to the room, or deliver false when
+// there is none; then a non-zero code means the client must be
+// disconnected. It must be called from the client's read loop.
+func (c *Client) admit(msg ClientMessage) (evt inboundEvent, code int, reason string, deliver bool) {
+	// Routing and identity come from the authenticated connection, never
+	// from the payload.
+	msg.DocumentID = c.room.documentID
+	msg.TenantID = c.room.tenantID
+	msg.UserID = c.userID
+
+	allowed, notice, closeConn := c.limiter.allow(msg, time.Now())
+	switch {
+	case closeConn:
+		log.Printf("closing client %s of user %s: %s", c.id, c.userID, closeReasonRateLimited)
+		return inboundEvent{}, websocket.ClosePolicyViolation, closeReasonRateLimited, false
+	case notice != nil:
+		return inboundEvent{client: c, rejected: notice}, 0, "", true
+	case !allowed:
+		return inboundEvent{}, 0, "", false
 	}
+	return inboundEvent{client: c, message: msg}, 0, "", true
 }
 
 func (c *Client) writePump() {
@@ -83,11 +146,16 @@ func (c *Client) writePump() {
 		case message, ok := <-c.send:
 			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				frame := []byte{}
+				if c.closeCode != 0 {
+					frame = websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				}
+				_ = c.conn.WriteMessage(websocket.CloseMessage, frame)
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			c.conn.EnableWriteCompression(len(message) >= compressMinSize)
+			w, err := c.conn.NextWriter(c.codec.FrameType())
 			if err != nil {
 				return
 			}
@@ -0,0 +1,52 @@
+package realtime
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols a client can request in Sec-WebSocket-Protocol. Clients that
+// request none get JSON, which is what the web app speaks.
+const (
+	ProtocolJSON    = "docstream.json.v1"
+	ProtocolMsgpack = "docstream.msgpack.v1"
+)
+
+// Codec encodes ClientMessage and ServerMessage for one wire format. Every
+// codec follows the json tags on those types, so the struct definitions are
+// the single schema for all encodings.
+type Codec interface {
+	Name() string
+	// FrameType is the websocket frame type messages are written with.
+	FrameType() int
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	jsonWire    Codec = jsonCodec{}
+	msgpackWire Codec = msgpackCodec{}
+)
+
+// codecFor resolves a negotiated subprotocol, defaulting to JSON.
+func codecFor(subprotocol string) Codec {
+	if subprotocol == ProtocolMsgpack {
+		return msgpackWire
+	}
+	return jsonWire
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return ProtocolJSON }
+func (jsonCodec) FrameType() int                     { return websocket.TextMessage }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string                       { return ProtocolMsgpack }
+func (msgpackCodec) FrameType() int                     { return websocket.BinaryMessage }
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return marshalMsgpack(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return unmarshalMsgpack(data, v) }
@@ -0,0 +1,140 @@
+package realtime
+
+import (
+	"log"
+
+	"docStream/backend/internal/document"
+)
+
+// maxEffectHistory bounds how many recent operations a room remembers for
+// rebasing cursors that were reported against an older version.
+const maxEffectHistory = 128
+
+// Selection is a caret or highlighted range. Anchor is where the selection
+// started and Head is where the caret is; they are equal for a plain caret.
+// Offsets count Unicode code points.
+type Selection struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// CursorState is a collaborator's selection as sent in snapshots.
+type CursorState struct {
+	ClientID  string    `json:"clientId"`
+	UserID    string    `json:"userId"`
+	Selection Selection `json:"selection"`
+}
+
+type appliedEffect struct {
+	version int64
+	effect  document.TextOperation
+}
+
+func (s Selection) transform(op document.TextOperation) Selection {
+	return Selection{Anchor: op.TransformIndex(s.Anchor), Head: op.TransformIndex(s.Head)}
+}
+
+// clamp bounds both offsets to a document of length code points.
+func (s Selection) clamp(length int) Selection {
+	return Selection{Anchor: min(max(s.Anchor, 0), length), Head: min(max(s.Head, 0), length)}
+}
+
+// recordEffect remembers an applied operation and shifts every known cursor
+// across it.
+func (r *Room) recordEffect(op document.Operation) {
+	effect, err := op.TextEffect()
+	if err != nil {
+		log.Printf("decode operation effect: %v", err)
+		return
+	}
+
+	if r.version != 0 && op.Version != r.version+1 {
+		// The room missed a change, so older selections cannot be rebased.
+		r.history = nil
+	}
+	r.history = append(r.history, appliedEffect{version: op.Version, effect: effect})
+	if len(r.history) > maxEffectHistory {
+		r.history = r.history[len(r.history)-maxEffectHistory:]
+	}
+	r.version = op.Version
+	r.length = effect.TargetLen
+
+	for client, sel := range r.cursors {
+		r.cursors[client] = sel.transform(effect)
+	}
+	for id, cur := range r.remoteCursors {
+		cur.Selection = cur.Selection.transform(effect)
+		r.remoteCursors[id] = cur
+	}
+}
+
+// rebaseSelection brings a selection reported at version up to the room's
+// current version, clamping offsets outside the document as it stood then.
+// It reports false when the needed history is gone.
+func (r *Room) rebaseSelection(sel Selection, version int64) (Selection, bool) {
+	if version == 0 || version >= r.version {
+		return sel.clamp(r.length), true
+	}
+	if len(r.history) == 0 || r.history[0].version > version+1 {
+		return Selection{}, false
+	}
+	for _, h := range r.history {
+		switch {
+		case h.version == version+1:
+			sel = sel.clamp(h.effect.BaseLen).transform(h.effect)
+		case h.version > version:
+			sel = sel.transform(h.effect)
+		}
+	}
+	return sel, true
+}
+
+func (r *Room) handleCursor(evt inboundEvent) {
+	if evt.message.Cursor == nil {
+		r.clearCursor(evt.client)
+		return
+	}
+
+	sel, ok := r.rebaseSelection(*evt.message.Cursor, evt.message.BaseVersion)
+	if !ok {
+		return
+	}
+	r.cursors[evt.client] = sel
+	r.broadcast(ServerMessage{
+		Type:       "cursor",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     evt.client.userID,
+		ClientID:   evt.client.id,
+		Version:    r.version,
+		Cursor:     &sel,
+	})
+}
+
+// clearCursor forgets a client's selection and tells the others to stop
+// drawing it.
+func (r *Room) clearCursor(client *Client) {
+	if _, ok := r.cursors[client]; !ok {
+		return
+	}
+	delete(r.cursors, client)
+	r.broadcast(ServerMessage{
+		Type:       "cursor",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     client.userID,
+		ClientID:   client.id,
+		Version:    r.version,
+	})
+}
+
+func (r *Room) cursorStates() []CursorState {
+	out := make([]CursorState, 0, len(r.cursors)+len(r.remoteCursors))
+	for client, sel := range r.cursors {
+		out = append(out, CursorState{ClientID: client.id, UserID: client.userID, Selection: sel})
+	}
+	for _, cur := range r.remoteCursors {
+		out = append(out, cur)
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package realtime
+
+import (
+	"context"
+	"testing"
+
+	"docStream/backend/internal/document"
+)
+
+func TestCursorsFollowEdits(t *testing.T) {
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(context.Background(), "t", "alice", "x", "hello world", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.SetPermission(context.Background(), "t", doc.ID, "bob", document.AccessEdit); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(svc, Config{})
+	closeHub(t, h)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	bob := joinTestClient(t, h, "t", doc.ID, "bob")
+	expectMessage(t, bob, "snapshot")
+
+	// moveCursor reports bob's selection at version; alice sees where the
+	// room puts it.
+	moveCursor := func(sel Selection, version int64) Selection {
+		t.Helper()
+		if _, _, ok := bob.submit(ClientMessage{Type: "cursor", Cursor: &sel, BaseVersion: version}); !ok {
+			t.Fatal("room closed")
+		}
+		msg := expectMessage(t, alice, "cursor")
+		if msg.ClientID != bob.id || msg.Cursor == nil {
+			t.Fatalf("alice got cursor %+v from %s", msg.Cursor, msg.ClientID)
+		}
+		return *msg.Cursor
+	}
+	edit := func(delta string, base int64) {
+		t.Helper()
+		if _, _, ok := alice.submit(ClientMessage{Type: "operation", Delta: delta, BaseVersion: base}); !ok {
+			t.Fatal("room closed")
+		}
+		expectMessage(t, bob, "update")
+	}
+	// stored is bob's selection as a newly connected client sees it.
+	stored := func() Selection {
+		t.Helper()
+		late := joinTestClient(t, h, "t", doc.ID, "alice")
+		for _, cur := range expectMessage(t, late, "snapshot").Cursors {
+			if cur.ClientID == bob.id {
+				return cur.Selection
+			}
+		}
+		t.Fatal("snapshot has no cursor for bob")
+		return Selection{}
+	}
+	v := doc.Version
+
+	if got := moveCursor(Selection{Anchor: 6, Head: 11}, v); got != (Selection{Anchor: 6, Head: 11}) {
+		t.Fatalf("cursor at the head moved to %+v", got)
+	}
+	edit(`[">> ",11]`, v)
+	if got := stored(); got != (Selection{Anchor: 9, Head: 14}) {
+		t.Fatalf("after an insert before it, bob's selection is %+v, want 9..14", got)
+	}
+	// A selection reported against the version before the insert is
+	// rebased across it.
+	if got := moveCursor(Selection{Anchor: 0, Head: 5}, v); got != (Selection{Anchor: 3, Head: 8}) {
+		t.Fatalf("stale cursor rebased to %+v, want 3..8", got)
+	}
+	edit(`[1,-4,9]`, v+1)
+	if got := stored(); got != (Selection{Anchor: 1, Head: 4}) {
+		t.Fatalf("after a delete overlapping it, bob's selection is %+v, want 1..4", got)
+	}
+
+	// Offsets outside the document are clamped to it, at the head and at
+	// the older version they were reported against.
+	if got := moveCursor(Selection{Anchor: -4, Head: 500}, v+2); got != (Selection{Anchor: 0, Head: 10}) {
+		t.Fatalf("out-of-range cursor at the head became %+v, want 0..10", got)
+	}
+	if got := moveCursor(Selection{Anchor: 40, Head: 2}, v); got != (Selection{Anchor: 10, Head: 1}) {
+		t.Fatalf("out-of-range stale cursor became %+v, want 10..1", got)
+	}
+}
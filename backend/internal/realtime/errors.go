@@ -0,0 +1,146 @@
+package realtime
+
+import (
+	"errors"
+	"log"
+
+	"docStream/backend/internal/document"
+)
+
+// Error codes carried in ServerMessage.Code on "error" messages so clients
+// can react without parsing Message.
+const (
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInvalidDelta       = "invalid_delta"
+	ErrCodeBaseVersionAhead   = "base_version_ahead"
+	ErrCodeHistoryUnavailable = "history_unavailable"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeTooLarge           = "document_too_large"
+	ErrCodeInvalidUpload      = "invalid_upload"
+	ErrCodeCausalBaseUnseen   = "causal_base_unseen"
+	ErrCodeDuplicate          = "duplicate_operation"
+	ErrCodeNothingToUndo      = "nothing_to_undo"
+	ErrCodeNothingToRedo      = "nothing_to_redo"
+	ErrCodeInvalidAwareness   = "invalid_awareness"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeRoomBusy           = "room_busy"
+	ErrCodeBadSubscription    = "invalid_subscription"
+	ErrCodeInvalidPlayback    = "invalid_playback"
+	ErrCodeInvalidBatch       = "invalid_batch"
+	ErrCodeBatchConflict      = "batch_conflict"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidJoin        = "invalid_join"
+	ErrCodeBadProtocol        = "unsupported_protocol"
+	ErrCodeInvalidChecksum    = "invalid_checksum"
+	ErrCodeVersionConflict    = "version_conflict"
+	ErrCodeInternal           = "internal"
+)
+
+// errHubClosed is returned when a connection arrives during shutdown.
+var errHubClosed = errors.New("server shutting down")
+
+// errNoAccess is returned when a user may not open a document at all.
+var errNoAccess = errors.New("no access to document")
+
+// errForbidden is returned when a view or comment subscriber tries to edit.
+var errForbidden = errors.New("edit access required")
+
+// errInvalidUpload is returned for chunks that arrive out of order or do
+// not decode once complete.
+var errInvalidUpload = errors.New("invalid upload")
+
+// errInvalidAwareness is returned for awareness state over the size limits.
+var errInvalidAwareness = errors.New("invalid awareness state")
+
+// errRateLimited is returned for messages over a connection's or user's
+// rate limit; they are dropped unprocessed.
+var errRateLimited = errors.New("rate limited")
+
+// errRoomBusy is returned for messages dropped because their room's queue
+// stayed full; the client may send them again.
+var errRoomBusy = errors.New("room busy")
+
+// errInvalidSubscription is returned for malformed subscribe requests and
+// messages naming a subscription the connection does not have.
+var errInvalidSubscription = errors.New("invalid subscription")
+
+// errUnknownType is returned for messages of a type the server does not
+// handle.
+var errUnknownType = errors.New("unknown message type")
+
+// errInvalidJoin is returned for "join" messages with malformed display
+// metadata.
+var errInvalidJoin = errors.New("invalid join")
+
+// errUnsupportedProtocol is returned when a client joins asking for a
+// protocol version older than the server supports.
+var errUnsupportedProtocol = errors.New("unsupported protocol version")
+
+// errInvalidChecksum is returned for "checksum" reports without a version
+// or checksum.
+var errInvalidChecksum = errors.New("invalid checksum report")
+
+// errorCode maps service errors onto wire error codes.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errForbidden), errors.Is(err, errNoAccess):
+		return ErrCodeForbidden
+	case errors.Is(err, document.ErrInvalidDelta):
+		return ErrCodeInvalidDelta
+	case errors.Is(err, document.ErrBaseVersionAhead):
+		return ErrCodeBaseVersionAhead
+	case errors.Is(err, document.ErrHistoryUnavailable):
+		return ErrCodeHistoryUnavailable
+	case errors.Is(err, document.ErrDocumentNotFound):
+		return ErrCodeNotFound
+	case errors.Is(err, document.ErrDocumentTooLarge):
+		return ErrCodeTooLarge
+	case errors.Is(err, errInvalidUpload):
+		return ErrCodeInvalidUpload
+	case errors.Is(err, document.ErrCausalBaseUnseen):
+		return ErrCodeCausalBaseUnseen
+	case errors.Is(err, document.ErrDuplicateOperation):
+		return ErrCodeDuplicate
+	case errors.Is(err, document.ErrNothingToUndo):
+		return ErrCodeNothingToUndo
+	case errors.Is(err, document.ErrNothingToRedo):
+		return ErrCodeNothingToRedo
+	case errors.Is(err, errInvalidAwareness):
+		return ErrCodeInvalidAwareness
+	case errors.Is(err, errRateLimited):
+		return ErrCodeRateLimited
+	case errors.Is(err, errRoomBusy):
+		return ErrCodeRoomBusy
+	case errors.Is(err, errInvalidSubscription):
+		return ErrCodeBadSubscription
+	case errors.Is(err, document.ErrInvalidPlayback):
+		return ErrCodeInvalidPlayback
+	case errors.Is(err, document.ErrInvalidBatch):
+		return ErrCodeInvalidBatch
+	case errors.Is(err, document.ErrBatchConflict):
+		return ErrCodeBatchConflict
+	case errors.Is(err, errUnknownType):
+		return ErrCodeUnknownType
+	case errors.Is(err, errInvalidJoin):
+		return ErrCodeInvalidJoin
+	case errors.Is(err, errUnsupportedProtocol):
+		return ErrCodeBadProtocol
+	case errors.Is(err, errInvalidChecksum):
+		return ErrCodeInvalidChecksum
+	case errors.Is(err, document.ErrVersionConflict):
+		return ErrCodeVersionConflict
+	default:
+		return ErrCodeInternal
+	}
+}
+
+// errorMessage is the text sent to a client with errorCode(err). Internal
+// failures can carry storage or network details, so those are logged under
+// where and the client only learns that something went wrong.
+func errorMessage(where string, err error) string {
+	if errorCode(err) != ErrCodeInternal {
+		return err.Error()
+	}
+	log.Printf("%s: internal error: %v", where, err)
+	return "internal error"
+}
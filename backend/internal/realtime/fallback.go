@@ -0,0 +1,340 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"docStream/backend/internal/auth"
+	"docStream/backend/internal/document"
+)
+
+// HTTP fallback for networks whose proxies strip websocket upgrades. A
+// client receives from an event stream (ServeSSE) or by long polling
+// (ServePoll) and POSTs what it sends to ServeSend. Either way it joins the
+// document's room like a websocket client, always speaking JSON, and names
+// the session it was given when it sends or polls again.
+
+const (
+	// pollWait is how long a poll waits for a message before returning
+	// empty. It stays under the server's 30s write timeout.
+	pollWait = 25 * time.Second
+	// pollBatch caps the messages one poll returns.
+	pollBatch = 256
+	// pollExpiry ends a long-poll session that has gone that long without
+	// polling, like a websocket that stopped answering pings.
+	pollExpiry = pongWait
+)
+
+// httpSession is a client connected over the HTTP fallback.
+type httpSession struct {
+	id     string
+	hub    *Hub
+	client *Client
+
+	submitMu sync.Mutex  // one POST is handed to the room at a time
+	pollMu   sync.Mutex  // held by the poll in progress
+	expiry   *time.Timer // nil for event streams
+
+	// The last batch a poll returned, kept until the next poll acknowledges
+	// it. Guarded by pollMu.
+	batch   int64
+	unacked []json.RawMessage
+
+	once        sync.Once
+	done        chan struct{}
+	closeCode   int // set before done closes
+	closeReason string
+}
+
+// closeNotice tells an HTTP client the server ended its session, with the
+// code and reason a websocket would get in its close frame.
+type closeNotice struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// pollResponse is the body of a long-poll reply. Messages are in the order
+// the room sent them; once Close is set the client must reconnect. The
+// client passes Batch as "ack" on its next poll, or the same messages are
+// sent again.
+type pollResponse struct {
+	SessionID string            `json:"sessionId"`
+	ClientID  string            `json:"clientId"`
+	Messages  []json.RawMessage `json:"messages"`
+	Batch     int64             `json:"batch,omitempty"`
+	Close     *closeNotice      `json:"close,omitempty"`
+}
+
+// ServeSSE attaches the caller to a document's room and streams the room's
+// messages as server-sent events. It takes the same query parameters as
+// ServeWS. The first event, "session", carries the session ID for
+// ServeSend; a final "close" event reports why the server ended the stream.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	join, ok := h.authorizeJoin(w, r)
+	if !ok {
+		return
+	}
+	s, err := h.openSession(join, r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.end(0, "")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx and similar proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(event string, data []byte) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(writeWait))
+		var err error
+		switch {
+		case event == "":
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		case data == nil:
+			_, err = fmt.Fprintf(w, ": %s\n\n", event)
+		default:
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err == nil
+	}
+	hello, _ := json.Marshal(map[string]string{"sessionId": s.id, "clientId": s.client.id})
+	if !write("session", hello) {
+		return
+	}
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-s.client.send:
+			if !ok {
+				notice, _ := json.Marshal(closeNotice{Code: s.client.closeCode, Reason: s.client.closeReason})
+				write("close", notice)
+				return
+			}
+			if !write("", message) {
+				return
+			}
+		case <-s.done:
+			notice, _ := json.Marshal(closeNotice{Code: s.closeCode, Reason: s.closeReason})
+			write("close", notice)
+			return
+		case <-ticker.C:
+			// A comment line keeps idle proxies from timing the stream out.
+			if !write("ping", nil) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ServePoll returns the room's messages to a long-polling client, waiting
+// up to pollWait for the first. A poll whose "ack" parameter is not the
+// previous reply's batch gets that batch again first. Without a "sessionId" parameter it attaches
+// the caller to a room first, taking the same parameters as ServeWS; the
+// reply names the new session.
+func (h *Hub) ServePoll(w http.ResponseWriter, r *http.Request) {
+	var s *httpSession
+	if r.URL.Query().Get("sessionId") == "" {
+		join, ok := h.authorizeJoin(w, r)
+		if !ok {
+			return
+		}
+		var err error
+		if s, err = h.openSession(join, r, true); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		var ok bool
+		if s, ok = h.sessionFor(w, r); !ok {
+			return
+		}
+	}
+
+	if !s.pollMu.TryLock() {
+		http.Error(w, "another poll is in progress", http.StatusConflict)
+		return
+	}
+	defer s.pollMu.Unlock()
+	if s.expiry == nil {
+		http.Error(w, "session is read by an event stream", http.StatusConflict)
+		return
+	}
+	// The session only expires between polls.
+	if !s.expiry.Stop() {
+		http.Error(w, "session expired", http.StatusGone)
+		return
+	}
+	defer s.expiry.Reset(pollExpiry)
+
+	resp := pollResponse{SessionID: s.id, ClientID: s.client.id, Messages: []json.RawMessage{}}
+	closed := func(code int, reason string) {
+		resp.Close = &closeNotice{Code: code, Reason: reason}
+	}
+	receive := func(message []byte, ok bool) {
+		if !ok {
+			closed(s.client.closeCode, s.client.closeReason)
+			s.end(0, "")
+			return
+		}
+		resp.Messages = append(resp.Messages, message)
+	}
+	// A batch the client has not acknowledged may never have reached it, so
+	// it goes out again ahead of anything new.
+	if ack := r.URL.Query().Get("ack"); ack == "" || ack == strconv.FormatInt(s.batch, 10) {
+		s.unacked = nil
+	}
+	resp.Messages = append(resp.Messages, s.unacked...)
+	if len(resp.Messages) == 0 {
+		wait := time.NewTimer(pollWait)
+		defer wait.Stop()
+		select {
+		case message, ok := <-s.client.send:
+			receive(message, ok)
+		case <-s.done:
+			closed(s.closeCode, s.closeReason)
+		case <-wait.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+drain:
+	for resp.Close == nil && len(resp.Messages) < pollBatch {
+		select {
+		case message, ok := <-s.client.send:
+			receive(message, ok)
+		default:
+			break drain
+		}
+	}
+	if len(resp.Messages) > 0 {
+		s.batch++
+		s.unacked = resp.Messages
+		resp.Batch = s.batch
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("poll %s: %v", s.id, err)
+	}
+}
+
+// ServeSend hands one JSON ClientMessage, POSTed with a "sessionId"
+// parameter, to the session's room. Replies come back on the session's
+// stream or poll, not in the response.
+func (h *Hub) ServeSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s, ok := h.sessionFor(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var msg ClientMessage
+	if err := jsonWire.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.submitMu.Lock()
+	defer s.submitMu.Unlock()
+	select {
+	case <-s.done:
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	default:
+	}
+	if code, reason, ok := s.client.submit(msg); !ok {
+		if code != 0 {
+			s.end(code, reason)
+			http.Error(w, reason, http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// openSession attaches a new HTTP client to the room join asks for. A
+// polled session expires unless polls keep coming.
+func (h *Hub) openSession(join joinRequest, r *http.Request, polled bool) (*httpSession, error) {
+	room, err := h.acquire(join.tenantID, join.documentID)
+	if err != nil {
+		return nil, err
+	}
+	s := &httpSession{
+		id:     document.NewID(),
+		hub:    h,
+		client: h.newClient(room, join, r),
+		done:   make(chan struct{}),
+	}
+	if !h.attach(s.client) {
+		return nil, errHubClosed
+	}
+	s.client.limiter = h.newLimiter(s.client.userID)
+	if polled {
+		s.expiry = time.AfterFunc(pollExpiry, func() { s.end(0, "") })
+	}
+	h.mu.Lock()
+	h.sessions[s.id] = s
+	h.mu.Unlock()
+	return s, nil
+}
+
+// sessionFor finds the session a request names and checks it belongs to
+// the caller, answering the request itself when it does not.
+func (h *Hub) sessionFor(w http.ResponseWriter, r *http.Request) (*httpSession, bool) {
+	claims, err := auth.ParseToken(wsToken(r))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	h.mu.Lock()
+	s, ok := h.sessions[r.URL.Query().Get("sessionId")]
+	h.mu.Unlock()
+	// Someone else's session looks the same as one that has ended.
+	if !ok || s.client.userID != claims.UserID {
+		http.Error(w, "unknown session; connect again", http.StatusNotFound)
+		return nil, false
+	}
+	return s, true
+}
+
+// end detaches the session's client from its room. A non-zero code is
+// reported to the client as the reason.
+func (s *httpSession) end(code int, reason string) {
+	s.once.Do(func() {
+		s.closeCode, s.closeReason = code, reason
+		close(s.done)
+		s.hub.mu.Lock()
+		delete(s.hub.sessions, s.id)
+		s.hub.mu.Unlock()
+
+		s.client.leave()
+		s.hub.users.leave(s.client.userID)
+	})
+}
@@ -0,0 +1,307 @@
+package realtime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/auth"
+	"docStream/backend/internal/document"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// testToken signs a login token for userID, as auth.Service.Login would.
+func testToken(t *testing.T, userID string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   userID,
+		"email": userID + "@example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	signed, err := token.SignedString(auth.SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// transportServer serves a hub's websocket and fallback endpoints for a
+// document that alice and bob may edit.
+type transportServer struct {
+	*httptest.Server
+	hub *Hub
+	doc document.Document
+}
+
+func newTransportServer(t *testing.T) *transportServer {
+	t.Helper()
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(context.Background(), "t", "alice", "x", "hello", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = svc.SetPermission(context.Background(), "t", doc.ID, "bob", document.AccessEdit); err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(svc, Config{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", hub.ServeWS)
+	mux.HandleFunc("/sse", hub.ServeSSE)
+	mux.HandleFunc("/poll", hub.ServePoll)
+	mux.HandleFunc("/send", hub.ServeSend)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	closeHub(t, hub) // runs first, ending the streams srv.Close waits for
+	return &transportServer{Server: srv, hub: hub, doc: doc}
+}
+
+// url builds an endpoint URL joining the document as userID.
+func (s *transportServer) url(t *testing.T, path, userID string, extra url.Values) string {
+	t.Helper()
+	q := url.Values{"tenantId": {"t"}, "docId": {s.doc.ID}, "token": {testToken(t, userID)}}
+	for k, v := range extra {
+		q[k] = v
+	}
+	return s.URL + path + "?" + q.Encode()
+}
+
+func (s *transportServer) poll(t *testing.T, userID string, extra url.Values) (int, pollResponse) {
+	t.Helper()
+	resp, err := http.Get(s.url(t, "/poll", userID, extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body pollResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, body
+}
+
+func (s *transportServer) send(t *testing.T, userID, sessionID string, msg ClientMessage) int {
+	t.Helper()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(s.url(t, "/send", userID, url.Values{"sessionId": {sessionID}}), "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func decodeMessages(t *testing.T, raw []json.RawMessage) []ServerMessage {
+	t.Helper()
+	msgs := make([]ServerMessage, len(raw))
+	for i, m := range raw {
+		if err := json.Unmarshal(m, &msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return msgs
+}
+
+func TestPollResendsUnacknowledgedBatch(t *testing.T) {
+	s := newTransportServer(t)
+	status, first := s.poll(t, "alice", nil)
+	if status != http.StatusOK || first.SessionID == "" || first.Batch == 0 || len(first.Messages) == 0 {
+		t.Fatalf("first poll: status %d, %+v", status, first)
+	}
+	if msgs := decodeMessages(t, first.Messages); msgs[0].Type != "snapshot" {
+		t.Fatalf("first poll starts with %q, want the snapshot", msgs[0].Type)
+	}
+	session := url.Values{"sessionId": {first.SessionID}}
+
+	// A poll that does not acknowledge the batch, as after a lost reply,
+	// gets it again.
+	session.Set("ack", "0")
+	_, again := s.poll(t, "alice", session)
+	if len(again.Messages) < len(first.Messages) || string(again.Messages[0]) != string(first.Messages[0]) {
+		t.Fatalf("unacknowledged batch not resent: got %d messages", len(again.Messages))
+	}
+
+	if code := s.send(t, "alice", first.SessionID, ClientMessage{Type: "ping", ClientTime: 1}); code != http.StatusAccepted {
+		t.Fatalf("send: status %d", code)
+	}
+	session.Set("ack", strconv.FormatInt(again.Batch, 10))
+	_, next := s.poll(t, "alice", session)
+	// The presence echo of alice's join may still trail in; nothing from
+	// the acknowledged batches may.
+	var types []string
+	for _, msg := range decodeMessages(t, next.Messages) {
+		types = append(types, msg.Type)
+	}
+	if len(types) == 0 || types[len(types)-1] != "pong" || slices.Contains(types, "snapshot") {
+		t.Fatalf("after acknowledging, poll returned %v, want only new messages up to the pong", types)
+	}
+	if next.Batch <= again.Batch {
+		t.Fatalf("batch %d does not follow %d", next.Batch, again.Batch)
+	}
+}
+
+func TestSessionBelongsToItsUser(t *testing.T) {
+	s := newTransportServer(t)
+	_, first := s.poll(t, "alice", nil)
+	session := url.Values{"sessionId": {first.SessionID}, "ack": {strconv.FormatInt(first.Batch, 10)}}
+
+	if status, _ := s.poll(t, "bob", session); status != http.StatusNotFound {
+		t.Fatalf("bob polling alice's session: status %d, want 404", status)
+	}
+	if code := s.send(t, "bob", first.SessionID, ClientMessage{Type: "ping"}); code != http.StatusNotFound {
+		t.Fatalf("bob sending on alice's session: status %d, want 404", code)
+	}
+	if code := s.send(t, "alice", first.SessionID, ClientMessage{Type: "ping"}); code != http.StatusAccepted {
+		t.Fatalf("alice sending on her session: status %d", code)
+	}
+}
+
+func TestPollSessionExpires(t *testing.T) {
+	s := newTransportServer(t)
+	_, first := s.poll(t, "alice", nil)
+	s.hub.mu.Lock()
+	session := s.hub.sessions[first.SessionID]
+	s.hub.mu.Unlock()
+	if session == nil {
+		t.Fatal("no session after the first poll")
+	}
+
+	// Stand in for pollExpiry passing without a poll.
+	session.expiry.Reset(time.Millisecond)
+	select {
+	case <-session.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle session did not end")
+	}
+	if status, _ := s.poll(t, "alice", url.Values{"sessionId": {first.SessionID}}); status != http.StatusNotFound {
+		t.Fatalf("poll on an expired session: status %d, want 404", status)
+	}
+	if code := s.send(t, "alice", first.SessionID, ClientMessage{Type: "ping"}); code != http.StatusNotFound {
+		t.Fatalf("send on an expired session: status %d, want 404", code)
+	}
+}
+
+// sseStream reads server-sent events.
+type sseStream struct {
+	scanner *bufio.Scanner
+}
+
+// next returns the next event's name and data; unnamed events are "".
+func (s *sseStream) next(t *testing.T) (string, []byte) {
+	t.Helper()
+	var event string
+	var data []byte
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case line == "":
+			if data != nil {
+				return event, data
+			}
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = []byte(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	t.Fatalf("event stream ended: %v", s.scanner.Err())
+	return "", nil
+}
+
+// expect reads room messages from the stream until one of type typ.
+func (s *sseStream) expect(t *testing.T, typ string) ServerMessage {
+	t.Helper()
+	for {
+		event, data := s.next(t)
+		if event != "" {
+			continue
+		}
+		var msg ServerMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+func expectWS(t *testing.T, conn *websocket.Conn, typ string) ServerMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg ServerMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %q: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+// TestEventStreamAndWebsocketShareRoom connects alice over an event stream
+// and bob over a websocket; each sees the other's edits.
+func TestEventStreamAndWebsocketShareRoom(t *testing.T) {
+	s := newTransportServer(t)
+
+	resp, err := http.Get(s.url(t, "/sse", "alice", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("event stream: status %d, type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	stream := &sseStream{scanner: bufio.NewScanner(resp.Body)}
+	event, data := stream.next(t)
+	var hello struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.Unmarshal(data, &hello); event != "session" || err != nil || hello.SessionID == "" {
+		t.Fatalf("first event %q %s, want the session", event, data)
+	}
+	snapshot := stream.expect(t, "snapshot")
+
+	wsURL := "ws" + strings.TrimPrefix(s.url(t, "/ws", "bob", nil), "http")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	expectWS(t, conn, "snapshot")
+
+	if err := conn.WriteJSON(ClientMessage{Type: "operation", Delta: `[5,"!"]`, BaseVersion: snapshot.Version}); err != nil {
+		t.Fatal(err)
+	}
+	update := stream.expect(t, "update")
+	if update.UserID != "bob" || update.Version != snapshot.Version+1 {
+		t.Fatalf("alice's stream got %+v, want bob's edit", update)
+	}
+
+	if code := s.send(t, "alice", hello.SessionID, ClientMessage{Type: "operation", Delta: `["> ",6]`, BaseVersion: update.Version}); code != http.StatusAccepted {
+		t.Fatalf("send: status %d", code)
+	}
+	for {
+		update = expectWS(t, conn, "update")
+		if update.UserID == "alice" {
+			break
+		}
+	}
+	if update.Version != snapshot.Version+2 {
+		t.Fatalf("bob got alice's edit at version %d, want %d", update.Version, snapshot.Version+2)
+	}
+}
@@ -0,0 +1,145 @@
+package realtime
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A connection is usable as soon as it opens. Clients may then send "join"
+// to agree on a protocol version and optional features and to say how they
+// appear in the roster; the server answers "joined". "ping" is answered
+// with "pong" carrying the server's clock, for measuring latency and skew.
+
+// Protocol versions the server speaks. A client asking for a newer one is
+// answered with ProtocolVersion and should fall back to it.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// serverCapabilities are the optional features a client can ask for in
+// "join", sorted.
+var serverCapabilities = []string{
+	"awareness",
+	"batch",
+	"chunked_snapshots",
+	"coalesced_updates",
+	"msgpack",
+	"replay",
+	"undo",
+	"upload",
+}
+
+// Limits on the display metadata a client may set.
+const (
+	maxDisplayNameRunes = 64
+	maxAvatarURLLen     = 512
+)
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// JoinRequest is the body of a "join" message. Empty display fields leave
+// the roster entry as it is.
+type JoinRequest struct {
+	Protocol     int      `json:"protocol"` // zero: ProtocolVersion
+	Capabilities []string `json:"capabilities,omitempty"`
+	DisplayName  string   `json:"displayName,omitempty"`
+	Color        string   `json:"color,omitempty"` // #rrggbb
+	AvatarURL    string   `json:"avatarUrl,omitempty"`
+}
+
+// JoinReply is the body of a "joined" message.
+type JoinReply struct {
+	Protocol int `json:"protocol"`
+	// Capabilities are those the client asked for that the server has, or
+	// all of the server's when the client asked for none.
+	Capabilities []string `json:"capabilities"`
+}
+
+// handleJoin answers the handshake and applies the client's display
+// metadata to its roster entry.
+func (r *Room) handleJoin(evt inboundEvent) {
+	var req JoinRequest
+	if evt.message.Join != nil {
+		req = *evt.message.Join
+	}
+	reply, err := negotiate(req)
+	if err != nil {
+		r.sendError(evt.client, err)
+		return
+	}
+
+	if entry, ok := r.roster[evt.client.userID]; ok {
+		changed := false
+		if name := strings.TrimSpace(req.DisplayName); name != "" && name != entry.DisplayName {
+			entry.DisplayName, changed = name, true
+		}
+		if req.Color != "" && req.Color != entry.Color {
+			entry.Color, changed = req.Color, true
+		}
+		if req.AvatarURL != "" && req.AvatarURL != entry.AvatarURL {
+			entry.AvatarURL, changed = req.AvatarURL, true
+		}
+		if changed {
+			r.broadcastPresence(PresenceState, *entry)
+		}
+	}
+
+	r.sendTo(evt.client, ServerMessage{
+		Type:       "joined",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     evt.client.userID,
+		ClientID:   evt.client.id,
+		ServerTime: time.Now().UnixMilli(),
+		Join:       &reply,
+	})
+}
+
+// negotiate checks a join request and works out the reply.
+func negotiate(req JoinRequest) (JoinReply, error) {
+	if req.Protocol == 0 {
+		req.Protocol = ProtocolVersion
+	}
+	if req.Protocol < MinProtocolVersion {
+		return JoinReply{}, fmt.Errorf("%w: version %d, need at least %d", errUnsupportedProtocol, req.Protocol, MinProtocolVersion)
+	}
+	if utf8.RuneCountInString(req.DisplayName) > maxDisplayNameRunes {
+		return JoinReply{}, fmt.Errorf("%w: display name over %d characters", errInvalidJoin, maxDisplayNameRunes)
+	}
+	if req.Color != "" && !colorPattern.MatchString(req.Color) {
+		return JoinReply{}, fmt.Errorf("%w: color must be #rrggbb", errInvalidJoin)
+	}
+	if req.AvatarURL != "" {
+		u, err := url.Parse(req.AvatarURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" || len(req.AvatarURL) > maxAvatarURLLen {
+			return JoinReply{}, fmt.Errorf("%w: avatar must be an https URL of at most %d bytes", errInvalidJoin, maxAvatarURLLen)
+		}
+	}
+
+	reply := JoinReply{Protocol: min(req.Protocol, ProtocolVersion), Capabilities: []string{}}
+	for _, c := range serverCapabilities {
+		if len(req.Capabilities) == 0 || slices.Contains(req.Capabilities, c) {
+			reply.Capabilities = append(reply.Capabilities, c)
+		}
+	}
+	return reply, nil
+}
+
+// handlePing answers a ping with the server's clock, echoing the client's
+// so it can pair them up.
+func (r *Room) handlePing(evt inboundEvent) {
+	r.sendTo(evt.client, ServerMessage{
+		Type:       "pong",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     evt.client.userID,
+		ClientTime: evt.message.ClientTime,
+		ServerTime: time.Now().UnixMilli(),
+	})
+}
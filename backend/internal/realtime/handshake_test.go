@@ -0,0 +1,203 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// messagesUntil reads from client up to and including the first message of
+// type typ and returns the types read.
+func messagesUntil(t *testing.T, client *Client, typ string) ([]string, ServerMessage) {
+	t.Helper()
+	var types []string
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case payload, ok := <-client.send:
+			if !ok {
+				t.Fatalf("client %s closed waiting for %q", client.userID, typ)
+			}
+			var msg ServerMessage
+			if err := jsonWire.Unmarshal(payload, &msg); err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, msg.Type)
+			if msg.Type == typ {
+				return types, msg
+			}
+		case <-timeout:
+			t.Fatalf("client %s got no %q after %v", client.userID, typ, types)
+		}
+	}
+}
+
+func handshakeHub(t *testing.T) (*Hub, document.Document) {
+	t.Helper()
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(context.Background(), "t", "alice", "x", "hello", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = svc.SetPermission(context.Background(), "t", doc.ID, "bob", document.AccessEdit); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(svc, Config{})
+	closeHub(t, h)
+	return h, doc
+}
+
+func TestPingAndUnknownTypesAreUnicast(t *testing.T) {
+	h, doc := handshakeHub(t)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	bob := joinTestClient(t, h, "t", doc.ID, "bob")
+	expectMessage(t, bob, "snapshot")
+
+	if _, _, ok := bob.submit(ClientMessage{Type: "shout"}); !ok {
+		t.Fatal("room closed")
+	}
+	if msg := expectMessage(t, bob, "error"); msg.Code != ErrCodeUnknownType {
+		t.Fatalf("unknown type: code %q, want %q", msg.Code, ErrCodeUnknownType)
+	}
+
+	before := time.Now().UnixMilli()
+	if _, _, ok := bob.submit(ClientMessage{Type: "ping", ClientTime: 42}); !ok {
+		t.Fatal("room closed")
+	}
+	pong := expectMessage(t, bob, "pong")
+	if pong.ClientTime != 42 || pong.ServerTime < before || pong.ServerTime > time.Now().UnixMilli() {
+		t.Fatalf("pong = client %d, server %d", pong.ClientTime, pong.ServerTime)
+	}
+
+	// Alice's own ping is answered after everything bob caused, none of
+	// which may have reached her.
+	if _, _, ok := alice.submit(ClientMessage{Type: "ping", ClientTime: 7}); !ok {
+		t.Fatal("room closed")
+	}
+	types, mine := messagesUntil(t, alice, "pong")
+	for _, typ := range types[:len(types)-1] {
+		if typ == "error" || typ == "pong" || typ == "ack" {
+			t.Fatalf("alice was sent bob's %q: %v", typ, types)
+		}
+	}
+	if mine.ClientTime != 7 {
+		t.Fatalf("alice's pong echoes %d", mine.ClientTime)
+	}
+}
+
+func TestJoinHandshake(t *testing.T) {
+	h, doc := handshakeHub(t)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	expectMessage(t, alice, "snapshot")
+	bob := joinTestClient(t, h, "t", doc.ID, "bob")
+
+	// Messages are answered in order, after the snapshot the connection
+	// opened with.
+	join := &JoinRequest{Protocol: ProtocolVersion + 5, Capabilities: []string{"undo", "telepathy"}, DisplayName: "Bobby", Color: "#00ff00"}
+	for _, msg := range []ClientMessage{{Type: "join", Join: join}, {Type: "ping"}} {
+		if _, _, ok := bob.submit(msg); !ok {
+			t.Fatal("room closed")
+		}
+	}
+	types, joined := messagesUntil(t, bob, "joined")
+	if types[0] != "snapshot" {
+		t.Fatalf("bob got %v before joined, want the snapshot first", types)
+	}
+	if joined.Join == nil || joined.Join.Protocol != ProtocolVersion || !reflect.DeepEqual(joined.Join.Capabilities, []string{"undo"}) {
+		t.Fatalf("joined = %+v", joined.Join)
+	}
+	if joined.ClientID != bob.id {
+		t.Fatalf("joined names client %q, want %q", joined.ClientID, bob.id)
+	}
+	expectMessage(t, bob, "pong")
+
+	// Others see the new display metadata as a state change.
+	for {
+		msg := expectMessage(t, alice, "presence")
+		if msg.Presence.Event != PresenceState {
+			continue
+		}
+		if u := msg.Presence.User; u.UserID != "bob" || u.DisplayName != "Bobby" || u.Color != "#00ff00" {
+			t.Fatalf("alice saw %+v", u)
+		}
+		break
+	}
+
+	// A bare join gets every capability.
+	if _, _, ok := bob.submit(ClientMessage{Type: "join"}); !ok {
+		t.Fatal("room closed")
+	}
+	if msg := expectMessage(t, bob, "joined"); !reflect.DeepEqual(msg.Join.Capabilities, serverCapabilities) {
+		t.Fatalf("bare join got %v", msg.Join.Capabilities)
+	}
+
+	for _, tt := range []struct {
+		join JoinRequest
+		code string
+	}{
+		{JoinRequest{Protocol: -1}, ErrCodeBadProtocol},
+		{JoinRequest{Color: "green"}, ErrCodeInvalidJoin},
+		{JoinRequest{AvatarURL: "http://example.com/a.png"}, ErrCodeInvalidJoin},
+		{JoinRequest{DisplayName: strings.Repeat("é", maxDisplayNameRunes+1)}, ErrCodeInvalidJoin},
+	} {
+		if _, _, ok := bob.submit(ClientMessage{Type: "join", Join: &tt.join}); !ok {
+			t.Fatal("room closed")
+		}
+		if msg := expectMessage(t, bob, "error"); msg.Code != tt.code {
+			t.Fatalf("join %+v: code %q, want %q", tt.join, msg.Code, tt.code)
+		}
+	}
+}
+
+// brokenRepository fails document lookups the way an unreachable database
+// would.
+type brokenRepository struct {
+	*document.InMemoryRepository
+}
+
+func (brokenRepository) GetDocument(context.Context, string, string) (document.Document, error) {
+	return document.Document{}, errors.New("dial tcp 10.0.0.7:5432: password authentication failed for user docstream")
+}
+
+func TestJoinHidesInternalErrors(t *testing.T) {
+	h := NewHub(document.NewService(brokenRepository{document.NewInMemoryRepository()}), Config{})
+	closeHub(t, h)
+	q := url.Values{"tenantId": {"t"}, "docId": {"d"}, "token": {testToken(t, "alice")}}
+	rec := httptest.NewRecorder()
+	h.ServeWS(rec, httptest.NewRequest(http.MethodGet, "/ws?"+q.Encode(), nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "10.0.0.7") || strings.Contains(body, "password") {
+		t.Fatalf("error body leaks the cause: %q", body)
+	}
+}
+
+func TestSnapshotNamesCRDTSite(t *testing.T) {
+	svc := document.NewService(document.NewInMemoryRepository())
+	h := NewHub(svc, Config{})
+	closeHub(t, h)
+	for _, engine := range []string{document.EngineOT, document.EngineCRDT} {
+		doc, err := svc.CreateDocument(context.Background(), "t", "alice", "x", "hello", engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice := joinTestClient(t, h, "t", doc.ID, "alice")
+		want := ""
+		if engine == document.EngineCRDT {
+			want = document.CRDTSite("alice", alice.session)
+		}
+		if msg := expectMessage(t, alice, "snapshot"); msg.Site != want {
+			t.Fatalf("%s snapshot names site %q, want %q", engine, msg.Site, want)
+		}
+	}
+}
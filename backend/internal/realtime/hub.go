@@ -3,11 +3,16 @@ package realtime
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"docStream/backend/internal/auth"
 	"docStream/backend/internal/document"
 	"github.com/gorilla/websocket"
 )
@@ -15,6 +20,9 @@ import (
 type inboundEvent struct {
 	client  *Client
 	message ClientMessage
+	// rejected is set instead of a message when the client went over its
+	// rate limit; the room only reports it.
+	rejected error
 }
 
 // Room represents collaborators on a single document.
@@ -23,157 +31,701 @@ type Room struct {
 	documentID string
 	service    *document.Service
 
+	// Broadcasts go out through the broker and are delivered to local
+	// clients when they come back on feed, so every instance uses the
+	// broker's order. origin tags messages this instance published.
+	broker Broker
+	origin string
+	topic  string
+	feed   Subscription
+
 	register   chan *Client
 	unregister chan *Client
 	clients    map[*Client]bool
 	inbound    chan inboundEvent
+	changes    chan document.Change // used when the broker is unavailable
+
+	// Lifecycle: refs counts clients handed this room by Hub.acquire that
+	// have not unregistered yet, guarded by hub.mu. The room only shuts down
+	// while refs is zero, so a concurrent ServeWS never registers with a
+	// room that is going away.
+	hub         *Hub
+	refs        int
+	idleTimeout time.Duration
+	stop        chan struct{}
+	done        chan struct{}
+
+	version int64  // last document version the room has seen applied
+	length  int    // the content's length in code points at version
+	engine  string // the document's engine, once loaded; it never changes
+	cursors map[*Client]Selection
+	history []appliedEffect
+	roster  map[string]*PresenceUser
+
+	transfers map[string]*snapshotTransfer // chunked snapshots by transfer ID
+	uploads   map[*Client]*pendingUpload
+	lagging   map[*Client]*backlog // clients whose updates are held back
+	awareness map[*Client]*awarenessEntry
+
+	// State mirrored from clients connected to other instances.
+	remoteCursors   map[string]CursorState     // by client ID
+	remoteRoster    map[string]remotePresence  // by origin + "/" + user ID
+	remoteAwareness map[string]remoteAwareness // by client ID
+
+	// The room's entry in tenant document lists; see tenant.go. Only
+	// changes made on this instance mark it dirty.
+	listingDirty bool
+	listingSent  time.Time
+
+	replays      map[*Client]*replayRun // see replay.go
+	replayFrames chan replayFrame
 }
 
-func newRoom(service *document.Service, tenantID, documentID string) *Room {
+// envelope wraps a broadcast on the broker.
+type envelope struct {
+	Origin  string        `json:"origin"`
+	Message ServerMessage `json:"message"`
+	// Change is set instead of Message for changes made through the
+	// service; see changes.go.
+	Change *document.Change `json:"change,omitempty"`
+	// Roster is set instead of Message on heartbeats: the origin's local
+	// roster, which keeps other instances listing those users.
+	Roster []PresenceUser `json:"roster,omitempty"`
+}
+
+func newRoom(hub *Hub, tenantID, documentID string) *Room {
 	return &Room{
 		tenantID:   tenantID,
 		documentID: documentID,
-		service:    service,
+		service:    hub.service,
+		broker:     hub.broker,
+		origin:     hub.instance,
+		topic:      roomTopic(tenantID, documentID),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
 		inbound:    make(chan inboundEvent, 64),
+		changes:    make(chan document.Change, 16),
+
+		hub:         hub,
+		idleTimeout: hub.idleTimeout,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+
+		cursors: make(map[*Client]Selection),
+		roster:  make(map[string]*PresenceUser),
+
+		transfers: make(map[string]*snapshotTransfer),
+		uploads:   make(map[*Client]*pendingUpload),
+		lagging:   make(map[*Client]*backlog),
+		awareness: make(map[*Client]*awarenessEntry),
+
+		remoteCursors:   make(map[string]CursorState),
+		remoteRoster:    make(map[string]remotePresence),
+		remoteAwareness: make(map[string]remoteAwareness),
+
+		replays:      make(map[*Client]*replayRun),
+		replayFrames: make(chan replayFrame),
 	}
 }
 
 func (r *Room) run() {
+	defer close(r.done)
+
+	sweep := time.NewTicker(presenceSweepInterval)
+	defer sweep.Stop()
+	flush := time.NewTicker(lagFlushInterval)
+	defer flush.Stop()
+
+	var feed <-chan []byte
+	if r.feed != nil {
+		feed = r.feed.Messages()
+	}
+
+	// idle fires once the room has been empty for idleTimeout.
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	stopIdle := func() {
+		if idleTimer != nil {
+			idleTimer.Stop()
+			idleTimer, idle = nil, nil
+		}
+	}
+	defer stopIdle()
+
 	for {
 		select {
 		case client := <-r.register:
+			stopIdle()
+			// The snapshot roster already lists the new client; it may also
+			// see its own join come back from the broker.
+			r.joinRoster(client)
 			r.clients[client] = true
+			if !client.resuming {
+				r.sendSnapshotMessage(client, "initial")
+			}
 		case client := <-r.unregister:
-			if _, ok := r.clients[client]; ok {
-				delete(r.clients, client)
-				close(client.send)
+			r.dropClient(client, 0, "")
+			delete(r.uploads, client)
+			r.clearCursor(client)
+			r.clearAwareness(client)
+			r.leaveRoster(client)
+			if r.hub.release(r) == 0 && idleTimer == nil {
+				idleTimer = time.NewTimer(r.idleTimeout)
+				idle = idleTimer.C
+			}
+		case evt := <-r.inbound:
+			r.handleEvent(evt)
+		case change := <-r.changes:
+			r.applyChange(change)
+		case frame := <-r.replayFrames:
+			r.deliverReplay(frame)
+		case payload, ok := <-feed:
+			if !ok {
+				log.Printf("room %s lost its broker feed; broadcasting locally", r.topic)
+				feed, r.feed = nil, nil
+				continue
+			}
+			r.handleFeed(payload)
+		case now := <-sweep.C:
+			r.sweepIdle(now)
+			r.heartbeatRoster()
+			r.expireRemoteRoster(now)
+			r.expireTransfers(now)
+		case now := <-flush.C:
+			r.flushLagging(now)
+			r.flushAwareness(now)
+			r.flushListing(now)
+		case <-idle:
+			idleTimer, idle = nil, nil
+			if r.hub.evict(r) {
+				r.shutdown()
+				return
 			}
+		case <-r.stop:
+			r.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown flushes what is still queued and releases the room's resources.
+// Events left in inbound are applied so edits sent just before a disconnect
+// are not lost; remaining clients are closed.
+func (r *Room) shutdown() {
+drain:
+	for {
+		select {
 		case evt := <-r.inbound:
 			r.handleEvent(evt)
+		default:
+			break drain
 		}
 	}
+
+	for client := range r.clients {
+		r.dropClient(client, websocket.CloseGoingAway, closeReasonShutdown)
+	}
+	if r.feed != nil {
+		_ = r.feed.Close()
+		r.feed = nil
+	}
+
+	// Editing has paused; snapshot the head so history reads stay cheap.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.service.Checkpoint(ctx, r.tenantID, r.documentID); err != nil {
+		log.Printf("checkpoint %s failed: %v", r.topic, err)
+	}
+	r.service.Release(r.tenantID, r.documentID)
 }
 
 func (r *Room) handleEvent(evt inboundEvent) {
+	if evt.rejected != nil {
+		r.sendError(evt.client, evt.rejected)
+		return
+	}
 	switch evt.message.Type {
 	case "operation":
+		r.touchPresence(evt.client.userID)
 		r.handleOperation(evt)
+	case "batch":
+		r.touchPresence(evt.client.userID)
+		r.handleBatch(evt)
+	case "cursor":
+		r.touchPresence(evt.client.userID)
+		r.handleCursor(evt)
 	case "presence":
-		r.broadcast(ServerMessage{
-			Type:       "presence",
-			TenantID:   r.tenantID,
-			DocumentID: r.documentID,
-			UserID:     evt.message.UserID,
-			Message:    "presence",
-		})
+		r.handlePresence(evt)
+	case "awareness":
+		r.handleAwareness(evt)
+	case "resume":
+		r.handleResume(evt)
+	case "snapshot_resume":
+		r.handleSnapshotResume(evt)
+	case "upload":
+		r.handleUpload(evt)
+	case "undo", "redo":
+		r.touchPresence(evt.client.userID)
+		r.handleUndo(evt)
+	case "replay", "replay_stop":
+		r.handleReplay(evt)
+	case "join":
+		r.handleJoin(evt)
+	case "ping":
+		r.handlePing(evt)
+	case "checksum":
+		r.handleChecksum(evt)
 	default:
-		r.broadcast(ServerMessage{
-			Type:       "ack",
-			TenantID:   r.tenantID,
-			DocumentID: r.documentID,
-			UserID:     evt.message.UserID,
-			Message:    "noop",
-		})
+		r.sendError(evt.client, fmt.Errorf("%w: %q", errUnknownType, evt.message.Type))
 	}
 }
 
 func (r *Room) handleOperation(evt inboundEvent) {
+	if !evt.client.access.Allows(document.AccessEdit) {
+		r.sendError(evt.client, errForbidden)
+		return
+	}
+
 	// Use a short timeout for operations to prevent locking up resources
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	doc, op, version, err := r.service.ApplyOperation(ctx, document.ApplyOperationInput{
-		TenantID:   r.tenantID,
-		DocumentID: r.documentID,
-		UserID:     evt.message.UserID,
-		Delta:      evt.message.Delta,
-		NewContent: evt.message.NewContent,
-		Lamport:    evt.message.Lamport,
-		Label:      evt.message.Label,
+		TenantID:    r.tenantID,
+		DocumentID:  r.documentID,
+		UserID:      evt.message.UserID,
+		Delta:       evt.message.Delta,
+		BaseVersion: evt.message.BaseVersion,
+		NewContent:  evt.message.NewContent,
+		Lamport:     evt.message.Lamport,
+		Session:     evt.client.session,
+		Seq:         evt.message.Seq,
+		Label:       evt.message.Label,
 	})
 	if err != nil {
 		log.Printf("apply operation failed: %v", err)
-		evt.client.send <- marshal(ServerMessage{
-			Type:       "error",
-			TenantID:   r.tenantID,
-			DocumentID: r.documentID,
-			UserID:     evt.message.UserID,
-			Message:    err.Error(),
-		})
+		r.sendError(evt.client, err)
+		return
+	}
+	r.broadcastApplied(doc, op, version)
+}
+
+// handleUndo reverts or restores the sender's own most recent edit.
+func (r *Room) handleUndo(evt inboundEvent) {
+	if !evt.client.access.Allows(document.AccessEdit) {
+		r.sendError(evt.client, errForbidden)
 		return
 	}
 
-	r.broadcast(ServerMessage{
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	undo := r.service.Undo
+	if evt.message.Type == "redo" {
+		undo = r.service.Redo
+	}
+	doc, op, version, err := undo(ctx, r.tenantID, r.documentID, evt.client.userID)
+	if err != nil {
+		r.sendError(evt.client, err)
+		return
+	}
+	r.broadcastApplied(doc, op, version)
+}
+
+// broadcastApplied announces an operation the service has committed.
+func (r *Room) broadcastApplied(doc document.Document, op document.Operation, version document.DocumentVersion) {
+	r.recordEffect(op)
+	r.listingDirty = true
+	// Updates carry only the applied operation; clients at doc.Version-1
+	// reproduce the content themselves and resync on a gap.
+	msg := ServerMessage{
 		Type:       "update",
 		TenantID:   r.tenantID,
 		DocumentID: r.documentID,
-		UserID:     evt.message.UserID,
+		UserID:     op.UserID,
 		Version:    doc.Version,
-		Content:    doc.Content,
 		Operation:  &op,
-		Versioned:  &version,
-	})
+		Checksum:   op.Checksum,
+	}
+	// Most operations do not produce a snapshot. Announce the ones that do
+	// without repeating the content.
+	if version.ID != "" {
+		version.Content = ""
+		msg.Versioned = &version
+	}
+	r.broadcast(msg)
 }
 
+// sendTo queues a message for a single client. Clients that already left
+// are skipped; their events can still be draining from the inbound queue.
+// A client whose queue is full gets a fresh snapshot once it drains.
+func (r *Room) sendTo(client *Client, msg ServerMessage) {
+	if !r.clients[client] {
+		return
+	}
+	select {
+	case client.send <- marshal(client.codec, msg):
+	default:
+		b := r.lagging[client]
+		if b == nil {
+			b = r.startLag(client)
+		}
+		b.resync = true
+	}
+}
+
+// sendError reports a failure to the client that caused it.
+func (r *Room) sendError(client *Client, err error) {
+	msg := ServerMessage{
+		Type:       "error",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     client.userID,
+		Code:       errorCode(err),
+		Message:    errorMessage("room "+r.topic, err),
+		RetryAfter: retryAfter(err),
+	}
+	var conflict *document.BatchConflict
+	if errors.As(err, &conflict) {
+		msg.Conflict = conflict
+	}
+	r.sendTo(client, msg)
+}
+
+// sendSnapshotMessage gives a client the document, its engine state, every
+// collaborator's current cursor and the roster. reason is "initial" on join
+// and "resync" when the client is being reset.
+func (r *Room) sendSnapshotMessage(client *Client, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	doc, err := r.service.GetDocument(ctx, r.tenantID, r.documentID)
+	if err != nil {
+		log.Printf("load snapshot: %v", err)
+		return
+	}
+	state, err := r.service.EngineState(ctx, doc)
+	if err != nil {
+		log.Printf("load engine state: %v", err)
+	}
+	r.engine = doc.Engine
+	if doc.Version > r.version {
+		// Someone else changed the document outside this room; cursors can
+		// no longer be rebased across the gap.
+		r.version = doc.Version
+		r.history = nil
+	}
+	if doc.Version == r.version {
+		r.length = utf8.RuneCountInString(doc.Content)
+	}
+
+	msg := ServerMessage{
+		Type:       "snapshot",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     client.userID,
+		ClientID:   client.id,
+		Version:    doc.Version,
+		Content:    doc.Content,
+		Checksum:   document.Checksum(doc.Content),
+		Engine:     doc.Engine,
+		State:      state,
+		Cursors:    r.cursorStates(),
+		Roster:     r.rosterList(),
+		Peers:      r.awarenessStates(),
+		Seq:        doc.SessionSeq(client.userID, client.session),
+		Message:    reason,
+	}
+	if doc.Engine == document.EngineCRDT {
+		msg.Site = document.CRDTSite(client.userID, client.session)
+	}
+	if len(doc.Content) > snapshotChunkSize {
+		r.sendChunked(client, msg)
+		return
+	}
+	r.sendTo(client, msg)
+}
+
+// broadcast publishes msg for every instance with this room open. Without a
+// working feed it is delivered locally right away.
 func (r *Room) broadcast(msg ServerMessage) {
-	payload := marshal(msg)
+	if r.feed == nil {
+		r.deliver(msg)
+		return
+	}
+
+	payload, err := json.Marshal(envelope{Origin: r.origin, Message: msg})
+	if err != nil {
+		log.Printf("marshal envelope: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := r.broker.Publish(ctx, r.topic, payload); err != nil {
+		log.Printf("publish to %s failed, delivering locally: %v", r.topic, err)
+		r.deliver(msg)
+	}
+}
+
+// handleFeed delivers a broadcast that came back from the broker, first
+// mirroring state from messages other instances published.
+func (r *Room) handleFeed(payload []byte) {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		log.Printf("decode envelope: %v", err)
+		return
+	}
+	if env.Change != nil {
+		r.applyChange(*env.Change)
+		return
+	}
+	if env.Roster != nil {
+		if env.Origin != r.origin {
+			r.refreshRemoteRoster(env.Origin, env.Roster, time.Now())
+		}
+		return
+	}
+	if env.Origin != r.origin {
+		r.mirrorRemote(env.Origin, env.Message)
+	}
+	r.deliver(env.Message)
+}
+
+// mirrorRemote applies another instance's broadcast to this room's state.
+func (r *Room) mirrorRemote(origin string, msg ServerMessage) {
+	switch msg.Type {
+	case "update":
+		if msg.Operation != nil {
+			r.recordEffect(*msg.Operation)
+		}
+	case "cursor":
+		if msg.Cursor == nil {
+			delete(r.remoteCursors, msg.ClientID)
+			return
+		}
+		r.remoteCursors[msg.ClientID] = CursorState{ClientID: msg.ClientID, UserID: msg.UserID, Selection: *msg.Cursor}
+	case "awareness":
+		if len(msg.Awareness) == 0 {
+			delete(r.remoteAwareness, msg.ClientID)
+			return
+		}
+		r.remoteAwareness[msg.ClientID] = remoteAwareness{
+			AwarenessState: AwarenessState{ClientID: msg.ClientID, UserID: msg.UserID, State: msg.Awareness},
+			updated:        time.Now(),
+		}
+	case "presence":
+		if msg.Presence == nil {
+			return
+		}
+		key := origin + "/" + msg.Presence.User.UserID
+		if msg.Presence.Event == PresenceLeave {
+			delete(r.remoteRoster, key)
+			return
+		}
+		r.remoteRoster[key] = remotePresence{PresenceUser: msg.Presence.User, updated: time.Now()}
+	}
+}
+
+// deliver fans a message out to this instance's clients.
+func (r *Room) deliver(msg ServerMessage) {
+	// Encode once per wire format in use.
+	payloads := make(map[Codec][]byte, 2)
 	for client := range r.clients {
-		select {
-		case client.send <- payload:
-		default:
-			close(client.send)
-			delete(r.clients, client)
+		payload, ok := payloads[client.codec]
+		if !ok {
+			payload = marshal(client.codec, msg)
+			payloads[client.codec] = payload
 		}
+		r.queue(client, msg, payload)
 	}
 }
 
+// defaultRoomIdleTimeout is how long an empty room lingers before shutting down.
+const defaultRoomIdleTimeout = time.Minute
+
+// Config tunes a Hub. The zero value runs a single instance.
+type Config struct {
+	// Broker carries room broadcasts between backend instances. Defaults
+	// to an in-process broker.
+	Broker Broker
+	// RoomIdleTimeout is how long a room stays open after its last client
+	// leaves. Defaults to one minute.
+	RoomIdleTimeout time.Duration
+	// RateLimit bounds inbound messages per connection and per user.
+	RateLimit RateLimit
+}
+
 // Hub keeps track of rooms per tenant/document.
 type Hub struct {
-	service *document.Service
-	rooms   map[string]*Room
-	mu      sync.Mutex
+	service     *document.Service
+	broker      Broker
+	instance    string
+	idleTimeout time.Duration
+	rateLimit   RateLimit
+	users       *userBuckets
+	rooms       map[string]*Room
+	sessions    map[string]*httpSession // HTTP fallback clients by session ID
+	tenants     map[string]*tenantChannel
+	closed      bool
+	mu          sync.Mutex
 }
 
-func NewHub(service *document.Service) *Hub {
-	return &Hub{
-		service: service,
-		rooms:   make(map[string]*Room),
+func NewHub(service *document.Service, cfg Config) *Hub {
+	if cfg.Broker == nil {
+		cfg.Broker = NewInMemoryBroker()
 	}
+	if cfg.RoomIdleTimeout <= 0 {
+		cfg.RoomIdleTimeout = defaultRoomIdleTimeout
+	}
+	cfg.RateLimit = cfg.RateLimit.withDefaults()
+	h := &Hub{
+		service:     service,
+		broker:      cfg.Broker,
+		instance:    document.NewID(),
+		idleTimeout: cfg.RoomIdleTimeout,
+		rateLimit:   cfg.RateLimit,
+		users:       newUserBuckets(cfg.RateLimit.PerUser),
+		rooms:       make(map[string]*Room),
+		sessions:    make(map[string]*httpSession),
+		tenants:     make(map[string]*tenantChannel),
+	}
+	service.OnChange(h.publishChange)
+	return h
 }
 
 func (h *Hub) roomKey(tenantID, documentID string) string {
 	return tenantID + ":" + documentID
 }
 
-func (h *Hub) getRoom(tenantID, documentID string) *Room {
+// acquire returns the room for a document, starting it if needed, and
+// reserves it for one client. The caller must register a client or release
+// the reservation.
+func (h *Hub) acquire(tenantID, documentID string) (*Room, error) {
 	key := h.roomKey(tenantID, documentID)
+	if room, err := h.reserve(key); room != nil || err != nil {
+		return room, err
+	}
+
+	// Subscribing can wait on the network, so it happens without h.mu. If
+	// another caller opens the room meanwhile, this feed is not needed.
+	room := newRoom(h, tenantID, documentID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	feed, err := h.broker.Subscribe(ctx, room.topic)
+	cancel()
+	if err != nil {
+		log.Printf("subscribe %s failed, room is local only: %v", room.topic, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	existing, ok := h.rooms[key]
+	if h.closed || ok {
+		if feed != nil {
+			_ = feed.Close()
+		}
+		if h.closed {
+			return nil, errHubClosed
+		}
+		existing.refs++
+		return existing, nil
+	}
+	room.feed = feed
+	h.rooms[key] = room
+	go room.run()
+	room.refs++
+	return room, nil
+}
+
+// reserve takes a reference on the open room for key, if there is one.
+func (h *Hub) reserve(key string) (*Room, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	if h.closed {
+		return nil, errHubClosed
+	}
 	room, ok := h.rooms[key]
-	if !ok {
-		room = newRoom(h.service, tenantID, documentID)
-		h.rooms[key] = room
-		go room.run()
+	if ok {
+		room.refs++
+	}
+	return room, nil
+}
+
+// release drops one reservation and returns how many remain.
+func (h *Hub) release(room *Room) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if room.refs > 0 {
+		room.refs--
+	}
+	return room.refs
+}
+
+// evict removes an idle room from the hub. It refuses if a client acquired
+// the room after its idle timer started.
+func (h *Hub) evict(room *Room) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if room.refs > 0 {
+		return false
+	}
+	key := h.roomKey(room.tenantID, room.documentID)
+	if h.rooms[key] == room {
+		delete(h.rooms, key)
+	}
+	return true
+}
+
+// Close shuts every room down, disconnecting their clients, and waits for
+// the room goroutines to exit or ctx to end.
+func (h *Hub) Close(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	rooms := make([]*Room, 0, len(h.rooms))
+	for key, room := range h.rooms {
+		rooms = append(rooms, room)
+		delete(h.rooms, key)
+	}
+	channels := make([]*tenantChannel, 0, len(h.tenants))
+	for tenantID, channel := range h.tenants {
+		channels = append(channels, channel)
+		delete(h.tenants, tenantID)
 	}
-	return room
+	h.mu.Unlock()
+
+	for _, channel := range channels {
+		_ = channel.feed.Close()
+	}
+	for _, room := range rooms {
+		close(room.stop)
+	}
+	for _, room := range rooms {
+		select {
+		case <-room.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin:     func(r *http.Request) bool { return true },
+	// In order of preference; clients asking for neither get JSON.
+	Subprotocols: []string{ProtocolMsgpack, ProtocolJSON},
+	// permessage-deflate, used for frames of compressMinSize and up.
+	EnableCompression: true,
 }
 
-// ServeWS upgrades and attaches a client to a room.
+// ServeWS authenticates the caller, checks their access to the document and
+// attaches them to its room. The login token comes from the Authorization
+// header or, for browsers that cannot set headers on upgrades, the "token"
+// query parameter. A "shareToken" parameter grants the share link's level.
 func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
-	tenantID := r.URL.Query().Get("tenantId")
-	docID := r.URL.Query().Get("docId")
-	userID := r.URL.Query().Get("userId")
-	if tenantID == "" || docID == "" || userID == "" {
-		http.Error(w, "tenantId, docId, and userId are required", http.StatusBadRequest)
+	join, ok := h.authorizeJoin(w, r)
+	if !ok {
 		return
 	}
 
@@ -183,40 +735,153 @@ func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room := h.getRoom(tenantID, docID)
-	client := &Client{
-		room:   room,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		userID: userID,
-		ctx:    context.Background(), // Use background context to avoid cancellation on handler return
+	room, err := h.acquire(join.tenantID, join.documentID)
+	if err != nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, err.Error()))
+		conn.Close()
+		return
 	}
-	room.register <- client
+	client := h.newClient(room, join, r)
+	client.conn = conn
+	client.codec = codecFor(conn.Subprotocol())
+	if !h.attach(client) {
+		conn.Close()
+		return
+	}
+	client.limiter = h.newLimiter(client.userID)
 
 	go client.writePump()
 	go client.readPump()
+}
+
+// joinRequest is an authenticated request to join a document's room.
+type joinRequest struct {
+	tenantID    string
+	documentID  string
+	userID      string
+	displayName string
+	access      document.AccessLevel
+}
+
+// authorizeJoin reads the document and caller from a connection request and
+// checks the caller's access, answering the request itself when it fails.
+func (h *Hub) authorizeJoin(w http.ResponseWriter, r *http.Request) (joinRequest, bool) {
+	tenantID := r.URL.Query().Get("tenantId")
+	docID := r.URL.Query().Get("docId")
+	if tenantID == "" || docID == "" {
+		http.Error(w, "tenantId and docId are required", http.StatusBadRequest)
+		return joinRequest{}, false
+	}
 
-	// Send initial document snapshot to the new client.
-	doc, err := h.service.GetDocument(r.Context(), tenantID, docID)
-	if err == nil {
-		client.send <- marshal(ServerMessage{
-			Type:       "snapshot",
-			TenantID:   tenantID,
-			DocumentID: docID,
-			UserID:     userID,
-			Version:    doc.Version,
-			Content:    doc.Content,
-			Message:    "initial",
-		})
+	claims, err := auth.ParseToken(wsToken(r))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return joinRequest{}, false
+	}
+	userID := claims.UserID
+
+	access, err := h.authorize(r.Context(), userID, tenantID, docID, r.URL.Query().Get("shareToken"))
+	switch {
+	case errors.Is(err, document.ErrDocumentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return joinRequest{}, false
+	case errors.Is(err, errNoAccess):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return joinRequest{}, false
+	case err != nil:
+		log.Printf("authorize %s on %s/%s: %v", userID, tenantID, docID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return joinRequest{}, false
+	}
+
+	displayName := r.URL.Query().Get("displayName")
+	if displayName == "" {
+		displayName = claims.Email
+	}
+	return joinRequest{
+		tenantID:    tenantID,
+		documentID:  docID,
+		userID:      userID,
+		displayName: displayName,
+		access:      access,
+	}, true
+}
+
+// authorize resolves a user's access to a document, granted directly or by
+// the share link shareToken.
+func (h *Hub) authorize(ctx context.Context, userID, tenantID, docID, shareToken string) (document.AccessLevel, error) {
+	doc, err := h.service.GetDocument(ctx, tenantID, docID)
+	if err != nil {
+		return "", err
+	}
+	access, ok := doc.AccessFor(userID)
+	if !ok {
+		access, ok = doc.AccessForLink(shareToken, time.Now())
+	}
+	if !ok {
+		return "", errNoAccess
+	}
+	return access, nil
+}
+
+// newClient builds a JSON client for an authorized request; the transport
+// fills in the rest.
+func (h *Hub) newClient(room *Room, join joinRequest, r *http.Request) *Client {
+	return &Client{
+		id:          document.NewID(),
+		room:        room,
+		codec:       jsonWire,
+		send:        make(chan []byte, sendBuffer),
+		userID:      join.userID,
+		displayName: join.displayName,
+		access:      join.access,
+		resuming:    r.URL.Query().Get("resume") == "1",
+		session:     r.URL.Query().Get("session"),
+		shareToken:  r.URL.Query().Get("shareToken"),
+		ctx:         context.Background(), // Use background context to avoid cancellation on handler return
+	}
+}
+
+// attach registers a client with its room. It fails if the room has shut
+// down.
+func (h *Hub) attach(client *Client) bool {
+	select {
+	case client.room.register <- client:
+		return true
+	case <-client.room.done:
+		return false
+	}
+}
+
+// newLimiter starts counting a connection's messages against the rate
+// limits. The caller must release the user's share with users.leave once
+// the connection ends.
+func (h *Hub) newLimiter(userID string) *inboundLimiter {
+	return &inboundLimiter{
+		conn:  newTokenBucket(h.rateLimit.PerConnection, time.Now()),
+		user:  h.users.join(userID),
+		bytes: newTokenBucket(h.rateLimit.UploadBytes, time.Now()),
+		cfg:   h.rateLimit,
+	}
+}
+
+func wsToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return ""
+		}
+		return token
 	}
+	return r.URL.Query().Get("token")
 }
 
 // marshal keeps websocket writes lightweight.
-func marshal(msg ServerMessage) []byte {
-	b, err := json.Marshal(msg)
+func marshal(codec Codec, msg ServerMessage) []byte {
+	b, err := codec.Marshal(msg)
 	if err != nil {
-		log.Printf("marshal error: %v", err)
-		return []byte("{}")
+		log.Printf("marshal %s error: %v", codec.Name(), err)
+		b, _ = codec.Marshal(ServerMessage{Type: "error", Code: ErrCodeInternal, Message: "encode failed"})
 	}
 	return b
 }
@@ -0,0 +1,127 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// joinTestClient connects userID to the document's room on h with no
+// transport: the test reads what the room sends from client.send and
+// submits messages with client.submit.
+func joinTestClient(t *testing.T, h *Hub, tenantID, docID, userID string) *Client {
+	t.Helper()
+	access, err := h.authorize(context.Background(), userID, tenantID, docID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := h.acquire(tenantID, docID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := joinRequest{tenantID: tenantID, documentID: docID, userID: userID, displayName: userID, access: access}
+	client := h.newClient(room, join, httptest.NewRequest("GET", "/ws", nil))
+	client.limiter = h.newLimiter(userID)
+	if !h.attach(client) {
+		t.Fatal("room closed before the client joined")
+	}
+	return client
+}
+
+// expectMessage reads from client until a message of type typ arrives.
+func expectMessage(t *testing.T, client *Client, typ string) ServerMessage {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case payload, ok := <-client.send:
+			if !ok {
+				t.Fatalf("client %s closed waiting for %q", client.userID, typ)
+			}
+			var msg ServerMessage
+			if err := jsonWire.Unmarshal(payload, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == typ {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("client %s got no %q", client.userID, typ)
+		}
+	}
+}
+
+// closeHub shuts h down when the test ends.
+func closeHub(t *testing.T, h *Hub) {
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = h.Close(ctx)
+	})
+}
+
+// TestHubsShareBroker runs two instances on one broker: an edit made
+// through instance A reaches a client connected to instance B.
+func TestHubsShareBroker(t *testing.T) {
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(context.Background(), "t", "alice", "x", "hello", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.SetPermission(context.Background(), "t", doc.ID, "bob", document.AccessEdit); err != nil {
+		t.Fatal(err)
+	}
+	broker := NewInMemoryBroker()
+	a, b := NewHub(svc, Config{Broker: broker}), NewHub(svc, Config{Broker: broker})
+	closeHub(t, a)
+	closeHub(t, b)
+
+	alice := joinTestClient(t, a, "t", doc.ID, "alice")
+	expectMessage(t, alice, "snapshot")
+	bob := joinTestClient(t, b, "t", doc.ID, "bob")
+	expectMessage(t, bob, "snapshot")
+
+	if _, _, ok := alice.submit(ClientMessage{Type: "operation", Delta: `[5," world"]`, BaseVersion: doc.Version}); !ok {
+		t.Fatal("room refused the operation")
+	}
+	update := expectMessage(t, bob, "update")
+	if update.UserID != "alice" || update.Operation == nil || update.Version != doc.Version+1 {
+		t.Fatalf("bob got %+v", update)
+	}
+}
+
+func TestRemoteRosterExpires(t *testing.T) {
+	svc := document.NewService(document.NewInMemoryRepository())
+	r := newRoom(NewHub(svc, Config{}), "t", "d")
+	local := &Client{id: "c", userID: "alice", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	r.clients[local] = true
+
+	now := time.Now()
+	carol := PresenceUser{UserID: "carol", DisplayName: "carol", Connections: 1, State: PresenceActive}
+	heartbeat, err := json.Marshal(envelope{Origin: "dead", Roster: []PresenceUser{carol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.handleFeed(heartbeat)
+	r.refreshRemoteRoster("alive", []PresenceUser{{UserID: "dave", DisplayName: "dave", Connections: 1}}, now)
+	if got := len(r.rosterList()); got != 2 {
+		t.Fatalf("roster lists %d users, want 2", got)
+	}
+
+	// Only the instance still sending heartbeats keeps its users.
+	later := now.Add(remoteRosterTTL + time.Second)
+	r.refreshRemoteRoster("alive", []PresenceUser{{UserID: "dave", DisplayName: "dave", Connections: 1}}, later)
+	r.expireRemoteRoster(later)
+	roster := r.rosterList()
+	if len(roster) != 1 || roster[0].UserID != "dave" {
+		t.Fatalf("roster after expiry = %+v, want only dave", roster)
+	}
+	leave := expectMessage(t, local, "presence")
+	if leave.Presence.Event != PresenceLeave || leave.Presence.User.UserID != "carol" {
+		t.Fatalf("local client got %+v, want carol leaving", leave.Presence)
+	}
+}
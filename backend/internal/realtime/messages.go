@@ -4,25 +4,132 @@ import "docStream/backend/internal/document"
 
 // ClientMessage is the envelope received from the websocket clients.
 type ClientMessage struct {
-	Type       string `json:"type"` // join | operation | presence | ping
+	Type        string `json:"type"` // join | operation | undo | redo | cursor | presence | awareness | resume | snapshot_resume | upload | ping | checksum | subscribe | unsubscribe | replay | replay_stop | batch
+	TenantID    string `json:"tenantId"`
+	DocumentID  string `json:"documentId"`
+	UserID      string `json:"userId"`
+	Delta       string `json:"delta,omitempty"`       // ot.js style text operation, e.g. [3,"hi",-1]
+	BaseVersion int64  `json:"baseVersion,omitempty"` // document version Delta was built against
+	NewContent  string `json:"newContent,omitempty"`
+	Version     int64  `json:"version,omitempty"` // resume: last version the client acknowledged; checksum: the version checked
+	Lamport     int64  `json:"lamport,omitempty"`
+	Seq         int64  `json:"seq,omitempty"` // operation: position in the sender's session, from 1
+	Label       string `json:"label,omitempty"`
+	// Cursor is the sender's selection at BaseVersion; nil clears it.
+	Cursor *Selection `json:"cursor,omitempty"`
+	// Status is the sender's presence state for "presence" messages.
+	Status string `json:"status,omitempty"` // active | idle
+	// Transfer names the chunked snapshot and offset to continue from for
+	// "snapshot_resume".
+	Transfer *Transfer `json:"transfer,omitempty"`
+	// Upload is one piece of a message too large for a single frame.
+	Upload *UploadChunk `json:"upload,omitempty"`
+	// Awareness updates the sender's ephemeral state for "awareness"
+	// messages; a null value removes the key.
+	Awareness map[string]any `json:"awareness,omitempty"`
+	// Subscription routes a message on a multiplexed connection (see
+	// mux.go). "subscribe" also takes TenantID, DocumentID, ShareToken and
+	// Resume, which have the meaning of the ServeWS query parameters.
+	Subscription string `json:"sub,omitempty"`
+	ShareToken   string `json:"shareToken,omitempty"`
+	Resume       bool   `json:"resume,omitempty"`
+	// Replay selects the history a "replay" message plays back.
+	Replay *ReplayRequest `json:"replay,omitempty"`
+	// Batch carries edits made offline for "batch" messages, built on
+	// BaseVersion. Force merges them even where they overlap concurrent
+	// changes.
+	Batch []document.BatchOperation `json:"batch,omitempty"`
+	Force bool                      `json:"force,omitempty"`
+	// Join opens the handshake on "join" messages; see handshake.go.
+	Join *JoinRequest `json:"join,omitempty"`
+	// ClientTime is the sender's clock in Unix milliseconds on "ping"
+	// messages; the "pong" echoes it.
+	ClientTime int64 `json:"clientTime,omitempty"`
+	// Checksum is the sender's document.Checksum of its copy at Version on
+	// "checksum" messages.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ServerMessage is broadcast to connected collaborators.
+type ServerMessage struct {
+	Type       string `json:"type"` // snapshot | snapshot_chunk | update | resumed | cursor | joined | pong | presence | awareness | title | permission | access | subscribed | unsubscribed | doc_created | doc_renamed | doc_updated | doc_deleted | replay_start | replay_steps | replay_end | batch_applied | error
 	TenantID   string `json:"tenantId"`
 	DocumentID string `json:"documentId"`
 	UserID     string `json:"userId"`
-	Delta      string `json:"delta,omitempty"`
-	NewContent string `json:"newContent,omitempty"`
-	Lamport    int64  `json:"lamport,omitempty"`
-	Label      string `json:"label,omitempty"`
+	ClientID   string `json:"clientId,omitempty"`
+	Version    int64  `json:"version"`
+	// BaseVersion is set on coalesced updates, whose Operation spans every
+	// version after it up to Version.
+	BaseVersion int64                     `json:"baseVersion,omitempty"`
+	Authors     []string                  `json:"authors,omitempty"` // coalesced update: everyone whose edits it contains
+	Content     string                    `json:"content,omitempty"` // snapshot and snapshot_chunk only; updates carry Operation
+	Engine      string                    `json:"engine,omitempty"`  // snapshot: ot | crdt
+	State       string                    `json:"state,omitempty"`   // snapshot: engine state, e.g. the CRDT sequence
+	Site        string                    `json:"site,omitempty"`    // snapshot: the CRDT site the server stamps on this session's inserts
+	Operation   *document.Operation       `json:"operation,omitempty"`
+	Versioned   *document.DocumentVersion `json:"versioned,omitempty"`
+	Cursor      *Selection                `json:"cursor,omitempty"`   // cursor: nil when the client left or cleared it
+	Cursors     []CursorState             `json:"cursors,omitempty"`  // snapshot: every collaborator's selection
+	Presence    *PresenceEvent            `json:"presence,omitempty"` // presence: roster diff
+	Roster      []PresenceUser            `json:"roster,omitempty"`   // snapshot: everyone connected
+	Code        string                    `json:"code,omitempty"`     // error: machine-readable reason, see ErrCode*
+	Seq         int64                     `json:"seq,omitempty"`      // snapshot, resumed, batch_applied: last operation accepted from the session
+	Message     string                    `json:"message,omitempty"`
+	// Transfer is set on snapshots whose content follows in snapshot_chunk
+	// messages, and on each chunk.
+	Transfer *Transfer `json:"transfer,omitempty"`
+	// Awareness is a client's whole ephemeral state on "awareness"
+	// messages; it is empty once the state was dropped. Peers lists every
+	// client's state in snapshots.
+	Awareness map[string]any   `json:"awareness,omitempty"`
+	Peers     []AwarenessState `json:"peers,omitempty"`
+	// RetryAfter is set on rate_limited and room_busy errors: milliseconds
+	// until the sender's messages are accepted again.
+	RetryAfter int64 `json:"retryAfterMs,omitempty"`
+	// Title is the document's new title on "title" messages.
+	Title string `json:"title,omitempty"`
+	// Permission describes a sharing change on "permission" messages.
+	// Access is the receiving client's own new level on "access" messages.
+	Permission *PermissionChange    `json:"permission,omitempty"`
+	Access     document.AccessLevel `json:"access,omitempty"`
+	// Subscription is set on every message sent over a multiplexed
+	// connection. CloseCode is the websocket close code an "unsubscribed"
+	// subscription would have been closed with, if the server ended it.
+	Subscription string `json:"sub,omitempty"`
+	CloseCode    int    `json:"closeCode,omitempty"`
+	// Listing is the document's list entry on doc_* messages from tenant
+	// channels.
+	Listing *DocumentSummary `json:"listing,omitempty"`
+	// Steps are the operations a "replay_steps" message plays back, in
+	// order; "replay_start" carries the content they apply to.
+	Steps []document.PlaybackStep `json:"steps,omitempty"`
+	// Conflict is set on batch_conflict errors: why the sender's "batch"
+	// was not merged.
+	Conflict *document.BatchConflict `json:"conflict,omitempty"`
+	// Join answers a "join". ServerTime is the server's clock in Unix
+	// milliseconds on "joined" and "pong"; ClientTime echoes the ping's.
+	Join       *JoinReply `json:"join,omitempty"`
+	ServerTime int64      `json:"serverTime,omitempty"`
+	ClientTime int64      `json:"clientTime,omitempty"`
+	// Checksum is the document.Checksum of the content at Version on
+	// snapshots and updates, when known.
+	Checksum string `json:"checksum,omitempty"`
 }
 
-// ServerMessage is broadcast to connected collaborators.
-type ServerMessage struct {
-	Type       string                    `json:"type"` // update | ack | presence
-	TenantID   string                    `json:"tenantId"`
-	DocumentID string                    `json:"documentId"`
-	UserID     string                    `json:"userId"`
-	Version    int64                     `json:"version"`
-	Content    string                    `json:"content,omitempty"`
-	Operation  *document.Operation       `json:"operation,omitempty"`
-	Versioned  *document.DocumentVersion `json:"versioned,omitempty"`
-	Message    string                    `json:"message,omitempty"`
+// Transfer identifies a chunked snapshot. Offset and Size count bytes of the
+// UTF-8 content; chunks always end on a character boundary.
+type Transfer struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+	Size   int    `json:"size,omitempty"`
+}
+
+// UploadChunk carries part of an encoded ClientMessage. Chunks with the same
+// ID are appended in Offset order; the Final one completes the message,
+// which is then handled as if it had arrived in one frame.
+type UploadChunk struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+	Data   string `json:"data"`
+	Final  bool   `json:"final,omitempty"`
 }
@@ -0,0 +1,708 @@
+package realtime
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file holds a small MessagePack codec for the realtime wire types.
+// Structs are encoded as maps keyed by their json tag names and honour
+// omitempty, so a MessagePack message carries exactly the fields its JSON
+// form would. Times travel as RFC 3339 strings, as they do in JSON.
+
+var (
+	errMsgpackTruncated = errors.New("msgpack: unexpected end of data")
+	errMsgpackTooDeep   = errors.New("msgpack: nesting too deep")
+)
+
+// maxMsgpackDepth bounds how deeply arrays and maps may nest in decoded
+// input, so a hostile frame cannot recurse the decoder out of stack.
+const maxMsgpackDepth = 100
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func marshalMsgpack(v any) ([]byte, error) {
+	return appendMsgpack(make([]byte, 0, 256), reflect.ValueOf(v))
+}
+
+func appendMsgpack(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(buf, 0xc0), nil
+	}
+	if v.Type() == timeType {
+		return appendMsgpackString(buf, v.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		return appendMsgpack(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendMsgpackUint(buf, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendMsgpackString(buf, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendMsgpackBinary(buf, v.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		buf = appendMsgpackHeader(buf, 0x90, 0xdc, 0xdd, v.Len())
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if buf, err = appendMsgpack(buf, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		buf = appendMsgpackHeader(buf, 0x80, 0xde, 0xdf, len(keys))
+		var err error
+		for _, key := range keys {
+			buf = appendMsgpackString(buf, key.String())
+			if buf, err = appendMsgpack(buf, v.MapIndex(key)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		present := make([]reflect.Value, len(fields))
+		n := 0
+		for i, f := range fields {
+			fv := v.FieldByIndex(f.index)
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			present[i] = fv
+			n++
+		}
+		buf = appendMsgpackHeader(buf, 0x80, 0xde, 0xdf, n)
+		var err error
+		for i, f := range fields {
+			if !present[i].IsValid() {
+				continue
+			}
+			buf = appendMsgpackString(buf, f.name)
+			if buf, err = appendMsgpack(buf, present[i]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+}
+
+// appendMsgpackHeader writes an array or map header using the fix form
+// when the length fits in four bits.
+func appendMsgpackHeader(buf []byte, fix, b16, b32 byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, b16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, b32), uint32(n))
+	}
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackBinary(buf []byte, b []byte) []byte {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(n))
+	}
+	return append(buf, b...)
+}
+
+func appendMsgpackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+	}
+}
+
+func appendMsgpackUint(buf []byte, u uint64) []byte {
+	switch {
+	case u < 128:
+		return append(buf, byte(u))
+	case u <= math.MaxUint8:
+		return append(buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(u))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), u)
+	}
+}
+
+// isEmptyValue mirrors encoding/json's omitempty rules.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// msgpackField is a struct field as named by its json tag.
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type -> []msgpackField
+
+func cachedFields(t reflect.Type) []msgpackField {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]msgpackField)
+	}
+	fields := structFields(t, nil)
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+func structFields(t reflect.Type, parent []int) []msgpackField {
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		index := append(append([]int(nil), parent...), i)
+
+		// Untagged embedded structs are flattened, as in encoding/json.
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(sf.Type, index)...)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, msgpackField{
+			name:      name,
+			index:     index,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+	return fields
+}
+
+func unmarshalMsgpack(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("msgpack: unmarshal target must be a non-nil pointer")
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+type msgpackKind int
+
+const (
+	mpNil msgpackKind = iota
+	mpBool
+	mpInt
+	mpUint
+	mpFloat
+	mpString
+	mpBinary
+	mpArray
+	mpMap
+)
+
+// msgpackToken is one decoded header. Strings and binaries carry their
+// bytes; arrays and maps carry their element count in n.
+type msgpackToken struct {
+	kind msgpackKind
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	raw  []byte
+	n    int
+}
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int // arrays and maps open at pos
+}
+
+// enter opens an array or map; the caller defers leave.
+func (d *msgpackDecoder) enter() error {
+	if d.depth >= maxMsgpackDepth {
+		return errMsgpackTooDeep
+	}
+	d.depth++
+	return nil
+}
+
+func (d *msgpackDecoder) leave() { d.depth-- }
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *msgpackDecoder) next() (msgpackToken, error) {
+	head, err := d.take(1)
+	if err != nil {
+		return msgpackToken{}, err
+	}
+	c := head[0]
+
+	switch {
+	case c <= 0x7f:
+		return msgpackToken{kind: mpUint, u: uint64(c)}, nil
+	case c >= 0xe0:
+		return msgpackToken{kind: mpInt, i: int64(int8(c))}, nil
+	case c&0xf0 == 0x80:
+		return msgpackToken{kind: mpMap, n: int(c & 0x0f)}, nil
+	case c&0xf0 == 0x90:
+		return msgpackToken{kind: mpArray, n: int(c & 0x0f)}, nil
+	case c&0xe0 == 0xa0:
+		raw, err := d.take(int(c & 0x1f))
+		return msgpackToken{kind: mpString, raw: raw}, err
+	}
+
+	switch c {
+	case 0xc0:
+		return msgpackToken{kind: mpNil}, nil
+	case 0xc2, 0xc3:
+		return msgpackToken{kind: mpBool, b: c == 0xc3}, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		kind, size := mpBinary, 1<<(c-0xc4)
+		if c >= 0xd9 {
+			kind, size = mpString, 1<<(c-0xd9)
+		}
+		n, err := d.uint(size)
+		if err != nil {
+			return msgpackToken{}, err
+		}
+		raw, err := d.take(int(n))
+		return msgpackToken{kind: kind, raw: raw}, err
+	case 0xca:
+		u, err := d.uint(4)
+		return msgpackToken{kind: mpFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 0xcb:
+		u, err := d.uint(8)
+		return msgpackToken{kind: mpFloat, f: math.Float64frombits(u)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		return msgpackToken{kind: mpUint, u: u}, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.uint(size)
+		var i int64
+		switch size {
+		case 1:
+			i = int64(int8(u))
+		case 2:
+			i = int64(int16(u))
+		case 4:
+			i = int64(int32(u))
+		default:
+			i = int64(u)
+		}
+		return msgpackToken{kind: mpInt, i: i}, err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		return msgpackToken{kind: mpArray, n: int(n)}, err
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		return msgpackToken{kind: mpMap, n: int(n)}, err
+	}
+	return msgpackToken{}, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	tok, err := d.next()
+	if err != nil {
+		return err
+	}
+	return d.decodeToken(tok, v)
+}
+
+func (d *msgpackDecoder) decodeToken(tok msgpackToken, v reflect.Value) error {
+	if tok.kind == mpNil {
+		v.SetZero()
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeToken(tok, v.Elem())
+	}
+	if v.Type() == timeType {
+		if tok.kind != mpString {
+			return d.mismatch(tok, v)
+		}
+		t, err := time.Parse(time.RFC3339Nano, string(tok.raw))
+		if err != nil {
+			return fmt.Errorf("msgpack: %w", err)
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		generic, err := d.generic(tok)
+		if err != nil {
+			return err
+		}
+		if generic == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(generic))
+		}
+		return nil
+	}
+
+	switch tok.kind {
+	case mpBool:
+		if v.Kind() != reflect.Bool {
+			return d.mismatch(tok, v)
+		}
+		v.SetBool(tok.b)
+	case mpInt, mpUint:
+		return d.setNumber(tok, v)
+	case mpFloat:
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return d.mismatch(tok, v)
+		}
+		v.SetFloat(tok.f)
+	case mpString:
+		if v.Kind() != reflect.String {
+			return d.mismatch(tok, v)
+		}
+		v.SetString(string(tok.raw))
+	case mpBinary:
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Uint8 {
+			return d.mismatch(tok, v)
+		}
+		v.SetBytes(append([]byte(nil), tok.raw...))
+	case mpArray:
+		return d.decodeArray(tok, v)
+	case mpMap:
+		return d.decodeMap(tok, v)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) setNumber(tok msgpackToken, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := tok.i
+		if tok.kind == mpUint {
+			if tok.u > math.MaxInt64 {
+				return d.mismatch(tok, v)
+			}
+			i = int64(tok.u)
+		}
+		if v.OverflowInt(i) {
+			return d.mismatch(tok, v)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := tok.u
+		if tok.kind == mpInt {
+			if tok.i < 0 {
+				return d.mismatch(tok, v)
+			}
+			u = uint64(tok.i)
+		}
+		if v.OverflowUint(u) {
+			return d.mismatch(tok, v)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if tok.kind == mpUint {
+			v.SetFloat(float64(tok.u))
+		} else {
+			v.SetFloat(float64(tok.i))
+		}
+	default:
+		return d.mismatch(tok, v)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeArray(tok msgpackToken, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	switch v.Kind() {
+	case reflect.Slice:
+		// Each element takes at least one byte, which bounds hostile counts.
+		if tok.n > len(d.data)-d.pos {
+			return errMsgpackTruncated
+		}
+		v.Set(reflect.MakeSlice(v.Type(), tok.n, tok.n))
+	case reflect.Array:
+		if tok.n != v.Len() {
+			return d.mismatch(tok, v)
+		}
+	default:
+		return d.mismatch(tok, v)
+	}
+	for i := 0; i < tok.n; i++ {
+		if err := d.decode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeMap(tok msgpackToken, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		for i := 0; i < tok.n; i++ {
+			key, err := d.key()
+			if err != nil {
+				return err
+			}
+			field := findField(fields, key)
+			if field == nil {
+				// Unknown keys are skipped so newer peers can add fields.
+				if err := d.skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.FieldByIndex(field.index)); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		return nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return d.mismatch(tok, v)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i := 0; i < tok.n; i++ {
+			key, err := d.key()
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(elem); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		return nil
+	default:
+		return d.mismatch(tok, v)
+	}
+}
+
+func (d *msgpackDecoder) key() (string, error) {
+	tok, err := d.next()
+	if err != nil {
+		return "", err
+	}
+	if tok.kind != mpString {
+		return "", errors.New("msgpack: map key is not a string")
+	}
+	return string(tok.raw), nil
+}
+
+// findField matches a key to a field, exactly first and then ignoring case,
+// as encoding/json does.
+func findField(fields []msgpackField, key string) *msgpackField {
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, key) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) skip() error {
+	tok, err := d.next()
+	if err != nil {
+		return err
+	}
+	_, err = d.generic(tok)
+	return err
+}
+
+// generic decodes a value without a target type, using the same Go types
+// encoding/json produces for interface{} values.
+func (d *msgpackDecoder) generic(tok msgpackToken) (any, error) {
+	switch tok.kind {
+	case mpNil:
+		return nil, nil
+	case mpBool:
+		return tok.b, nil
+	case mpInt:
+		return float64(tok.i), nil
+	case mpUint:
+		return float64(tok.u), nil
+	case mpFloat:
+		return tok.f, nil
+	case mpString:
+		return string(tok.raw), nil
+	case mpBinary:
+		return append([]byte(nil), tok.raw...), nil
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	switch tok.kind {
+	case mpArray:
+		if tok.n > len(d.data)-d.pos {
+			return nil, errMsgpackTruncated
+		}
+		out := make([]any, tok.n)
+		for i := range out {
+			next, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			if out[i], err = d.generic(next); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default: // mpMap
+		out := make(map[string]any, min(tok.n, len(d.data)-d.pos))
+		for i := 0; i < tok.n; i++ {
+			key, err := d.key()
+			if err != nil {
+				return nil, err
+			}
+			next, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			if out[key], err = d.generic(next); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+}
+
+func (d *msgpackDecoder) mismatch(tok msgpackToken, v reflect.Value) error {
+	names := [...]string{"nil", "bool", "int", "uint", "float", "string", "binary", "array", "map"}
+	return fmt.Errorf("msgpack: cannot decode %s into %s", names[tok.kind], v.Type())
+}
@@ -0,0 +1,182 @@
+package realtime
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fill sets every field reachable from v to a distinct non-zero value, so a
+// round trip exercises each one, including fields added later.
+func fill(t *testing.T, v reflect.Value, path string) {
+	t.Helper()
+	if v.Type() == timeType {
+		v.Set(reflect.ValueOf(time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("é " + path + " 😀")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(-int64(len(path)) * 1e6)
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		v.SetInt(-int64(len(path)))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(len(path)))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(t, v.Elem(), path)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 2, 2))
+		for i := 0; i < 2; i++ {
+			fill(t, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		if v.Type() != reflect.TypeOf(map[string]any{}) {
+			t.Fatalf("%s: no filler for %s", path, v.Type())
+		}
+		v.Set(reflect.ValueOf(map[string]any{
+			"name":   path,
+			"n":      42.0,
+			"neg":    -3.25,
+			"ok":     true,
+			"none":   nil,
+			"list":   []any{"a", 1.0, map[string]any{"deep": false}},
+			"nested": map[string]any{"x": 1e20},
+		}))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fill(t, v.Field(i), path+"."+v.Type().Field(i).Name)
+			}
+		}
+	default:
+		t.Fatalf("%s: no filler for %s", path, v.Type())
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	full := func(v any) any {
+		fill(t, reflect.ValueOf(v).Elem(), "")
+		return reflect.ValueOf(v).Elem().Interface()
+	}
+	tests := []struct {
+		name string
+		msg  any
+	}{
+		{"empty client message", ClientMessage{}},
+		{"every client message field", full(&ClientMessage{})},
+		{"empty server message", ServerMessage{}},
+		{"every server message field", full(&ServerMessage{})},
+		{"integer edges", ServerMessage{Version: -1 << 63, BaseVersion: 1<<63 - 1, Seq: 127, RetryAfter: -33, CloseCode: 65536, ServerTime: -129}},
+		{"long strings", ServerMessage{Content: strings.Repeat("ab", 40000), State: strings.Repeat("x", 300)}},
+		{"many elements", ServerMessage{Authors: make([]string, 70000)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := msgpackWire.Marshal(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := reflect.New(reflect.TypeOf(tt.msg))
+			if err := msgpackWire.Unmarshal(b, got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), tt.msg) {
+				t.Fatalf("round trip changed the message\n got %+v\nwant %+v", got.Elem().Interface(), tt.msg)
+			}
+
+			// Decoding generically must give what JSON gives, so both wire
+			// formats present the same fields.
+			j, err := jsonWire.Marshal(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fromMsgpack, fromJSON any
+			if err := msgpackWire.Unmarshal(b, &fromMsgpack); err != nil {
+				t.Fatal(err)
+			}
+			if err := jsonWire.Unmarshal(j, &fromJSON); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fromMsgpack, fromJSON) {
+				t.Fatalf("msgpack and JSON disagree\nmsgpack %v\n   json %v", fromMsgpack, fromJSON)
+			}
+		})
+	}
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+	var msg ClientMessage
+	fill(t, reflect.ValueOf(&msg).Elem(), "")
+	b, err := msgpackWire.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(b); n++ {
+		var got ClientMessage
+		if err := msgpackWire.Unmarshal(b[:n], &got); err == nil {
+			t.Fatalf("decoded a %d byte prefix of %d", n, len(b))
+		}
+	}
+}
+
+func TestMsgpackMalformed(t *testing.T) {
+	// key writes a fixstr map key.
+	key := func(s string) []byte { return append([]byte{0xa0 | byte(len(s))}, s...) }
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	nested := func(depth int) []byte {
+		return join([]byte{0x81}, key("awareness"), []byte{0x81}, key("k"), bytes.Repeat([]byte{0x91}, depth), []byte{0xc0})
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error // nil: any error will do
+	}{
+		{"empty", nil, errMsgpackTruncated},
+		{"huge string length", join([]byte{0x81}, key("type"), []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, []byte("x")), errMsgpackTruncated},
+		{"huge binary length", join([]byte{0x81}, key("type"), []byte{0xc6, 0x7f, 0xff, 0xff, 0xff}), errMsgpackTruncated},
+		{"huge array into a slice", join([]byte{0x81}, key("batch"), []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}), errMsgpackTruncated},
+		{"huge generic array", join([]byte{0x81}, key("awareness"), []byte{0x81}, key("k"), []byte{0xdd, 0xff, 0xff, 0xff, 0xff}), errMsgpackTruncated},
+		{"huge map", []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa0, 0xc0}, errMsgpackTruncated},
+		{"huge generic map", join([]byte{0x81}, key("awareness"), []byte{0xdf, 0xff, 0xff, 0xff, 0xff}), errMsgpackTruncated},
+		{"nesting too deep", nested(maxMsgpackDepth), errMsgpackTooDeep},
+		{"deep hostile nesting", nested(1 << 20), errMsgpackTooDeep},
+		{"skipped field nesting too deep", join([]byte{0x81}, key("unknown"), bytes.Repeat([]byte{0x91}, maxMsgpackDepth+1), []byte{0xc0}), errMsgpackTooDeep},
+		{"trailing bytes", []byte{0x80, 0xc0}, nil},
+		{"reserved type byte", []byte{0xc1}, nil},
+		{"extension type", []byte{0xd4, 0x01, 0x00}, nil},
+		{"non-string key", []byte{0x81, 0x01, 0xc0}, nil},
+		{"top level not a map", []byte{0x93, 0x01, 0x02, 0x03}, nil},
+		{"string into int", join([]byte{0x81}, key("version"), key("1")), nil},
+		{"uint64 overflowing int64", join([]byte{0x81}, key("version"), []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}), nil},
+		{"int into string", join([]byte{0x81}, key("type"), []byte{0x05}), nil},
+		{"bool into int", join([]byte{0x81}, key("upload"), []byte{0x81}, key("offset"), []byte{0xc3}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg ClientMessage
+			err := msgpackWire.Unmarshal(tt.data, &msg)
+			if err == nil {
+				t.Fatalf("decoded %x as %+v", tt.data, msg)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	var msg ClientMessage
+	if err := msgpackWire.Unmarshal(nested(maxMsgpackDepth-3), &msg); err != nil {
+		t.Fatalf("nesting within the limit: %v", err)
+	}
+}
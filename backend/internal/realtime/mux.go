@@ -0,0 +1,405 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"docStream/backend/internal/auth"
+	"docStream/backend/internal/document"
+	"github.com/gorilla/websocket"
+)
+
+// Multiplexed connections carry any number of documents over one websocket.
+// The client sends "subscribe" with an ID of its choosing in "sub" and the
+// document to open; each subscription is a Client of that document's room,
+// checked for access like a connection of its own. Every other message in
+// either direction carries the subscription's ID. "unsubscribe" leaves a
+// room; the server confirms with "unsubscribed", which it also sends when
+// the room drops the subscription, and only then may the ID be reused.
+
+// maxSubscriptions caps the rooms one multiplexed connection can join.
+const maxSubscriptions = 64
+
+// subscriptionQueue is how many messages one subscription can have waiting
+// for its room before more are refused.
+const subscriptionQueue = 64
+
+// roomBusyRetry is the retry time given for a message refused because its
+// subscription's queue was full.
+const roomBusyRetry = 250 * time.Millisecond
+
+// muxConn is a multiplexed websocket. Subscriptions share its rate limits.
+type muxConn struct {
+	hub         *Hub
+	conn        *websocket.Conn
+	codec       Codec
+	userID      string
+	displayName string
+	session     string
+	limiter     *inboundLimiter // used by the read loop only
+
+	// out carries encoded messages to the writer, from the read loop and
+	// from one forwarder per subscription.
+	out  chan []byte
+	once sync.Once
+	done chan struct{} // closed when either pump exits
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+}
+
+// subscription is one room joined over a multiplexed connection. Messages
+// for the room wait in queue, so a room that falls behind holds up only its
+// own subscription, never the shared read loop.
+type subscription struct {
+	client *Client
+	queue  chan inboundEvent
+	gone   chan struct{} // closed once the room has let go of client
+}
+
+// subscriptionCodec tags every message a room sends to a subscription
+// with the subscription's ID.
+type subscriptionCodec struct {
+	Codec
+	sub string
+}
+
+func (c subscriptionCodec) Marshal(v any) ([]byte, error) {
+	if msg, ok := v.(ServerMessage); ok {
+		msg.Subscription = c.sub
+		v = msg
+	}
+	return c.Codec.Marshal(v)
+}
+
+// ServeMultiplexed authenticates the caller and upgrades to a multiplexed
+// connection, which starts with no subscriptions. It takes the login token
+// the way ServeWS does, and optionally "session" and "displayName".
+func (h *Hub) ServeMultiplexed(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.ParseToken(wsToken(r))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	displayName := r.URL.Query().Get("displayName")
+	if displayName == "" {
+		displayName = claims.Email
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("websocket upgrade failed: %v", err)
+		return
+	}
+	m := &muxConn{
+		hub:         h,
+		conn:        conn,
+		codec:       codecFor(conn.Subprotocol()),
+		userID:      claims.UserID,
+		displayName: displayName,
+		session:     r.URL.Query().Get("session"),
+		limiter:     h.newLimiter(claims.UserID),
+		out:         make(chan []byte, sendBuffer),
+		done:        make(chan struct{}),
+		subs:        make(map[string]*subscription),
+	}
+	go m.writePump()
+	go m.readPump()
+}
+
+func (m *muxConn) stop() {
+	m.once.Do(func() { close(m.done) })
+}
+
+func (m *muxConn) readPump() {
+	defer func() {
+		m.stop()
+		m.mu.Lock()
+		clients := make([]*Client, 0, len(m.subs))
+		for _, s := range m.subs {
+			clients = append(clients, s.client)
+		}
+		m.mu.Unlock()
+		for _, client := range clients {
+			client.leave()
+		}
+		m.hub.users.leave(m.userID)
+		m.conn.Close()
+	}()
+
+	m.conn.SetReadLimit(maxMessageSize)
+	_ = m.conn.SetReadDeadline(time.Now().Add(pongWait))
+	m.conn.SetPongHandler(func(string) error {
+		_ = m.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, message, err := m.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			return
+		}
+
+		var msg ClientMessage
+		if err := m.codec.Unmarshal(message, &msg); err != nil {
+			log.Printf("decode message: %v", err)
+			continue
+		}
+
+		if code, reason := m.handle(msg); code != 0 {
+			frame := websocket.FormatCloseMessage(code, reason)
+			_ = m.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// handle acts on one message from the client. A non-zero code closes the
+// connection.
+func (m *muxConn) handle(msg ClientMessage) (code int, reason string) {
+	switch msg.Type {
+	case "subscribe", "unsubscribe":
+		allowed, notice, closeConn := m.limiter.allow(msg, time.Now())
+		switch {
+		case closeConn:
+			log.Printf("closing multiplexed connection of user %s: %s", m.userID, closeReasonRateLimited)
+			return websocket.ClosePolicyViolation, closeReasonRateLimited
+		case notice != nil:
+			m.replyError(msg.Subscription, notice)
+			return 0, ""
+		case !allowed:
+			return 0, ""
+		}
+		if msg.Type == "subscribe" {
+			m.subscribe(msg)
+		} else {
+			m.unsubscribe(msg.Subscription)
+		}
+		return 0, ""
+	}
+
+	m.mu.Lock()
+	s, ok := m.subs[msg.Subscription]
+	m.mu.Unlock()
+	if !ok {
+		m.replyError(msg.Subscription, fmt.Errorf("%w: %q is not subscribed", errInvalidSubscription, msg.Subscription))
+		return 0, ""
+	}
+	evt, code, reason, deliver := s.client.admit(msg)
+	if !deliver {
+		return code, reason
+	}
+	// Every subscription shares this loop, so it never waits on a room. If
+	// the subscription's queue is full the message is refused, and the
+	// sender told to retry whenever it waits for an answer.
+	select {
+	case s.queue <- evt:
+	case <-s.gone:
+	default:
+		switch {
+		case evt.rejected != nil:
+			m.replyError(msg.Subscription, evt.rejected)
+		case expectsReply(msg):
+			m.replyError(msg.Subscription, &roomBusyError{retryAfter: roomBusyRetry})
+		}
+	}
+	return 0, ""
+}
+
+// subscribe checks the caller's access to a document and joins its room.
+// "subscribed" reaches the client ahead of anything from the room.
+func (m *muxConn) subscribe(msg ClientMessage) {
+	sub := msg.Subscription
+	if sub == "" || msg.TenantID == "" || msg.DocumentID == "" {
+		m.replyError(sub, fmt.Errorf("%w: sub, tenantId and documentId are required", errInvalidSubscription))
+		return
+	}
+	m.mu.Lock()
+	_, taken := m.subs[sub]
+	count := len(m.subs)
+	m.mu.Unlock()
+	switch {
+	case taken:
+		m.replyError(sub, fmt.Errorf("%w: %q is already subscribed", errInvalidSubscription, sub))
+		return
+	case count >= maxSubscriptions:
+		m.replyError(sub, fmt.Errorf("%w: at most %d subscriptions per connection", errInvalidSubscription, maxSubscriptions))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	access, err := m.hub.authorize(ctx, m.userID, msg.TenantID, msg.DocumentID, msg.ShareToken)
+	cancel()
+	if err != nil {
+		m.replyError(sub, err)
+		return
+	}
+	room, err := m.hub.acquire(msg.TenantID, msg.DocumentID)
+	if err != nil {
+		m.replyError(sub, err)
+		return
+	}
+	client := &Client{
+		id:          document.NewID(),
+		room:        room,
+		codec:       subscriptionCodec{Codec: m.codec, sub: sub},
+		send:        make(chan []byte, sendBuffer),
+		userID:      m.userID,
+		displayName: m.displayName,
+		access:      access,
+		resuming:    msg.Resume,
+		session:     m.session,
+		shareToken:  msg.ShareToken,
+		ctx:         context.Background(),
+		limiter:     m.limiter,
+	}
+	if !m.hub.attach(client) {
+		m.replyError(sub, errHubClosed)
+		return
+	}
+	s := &subscription{
+		client: client,
+		queue:  make(chan inboundEvent, subscriptionQueue),
+		gone:   make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.subs[sub] = s
+	m.mu.Unlock()
+
+	// The room's first messages wait in client.send until the forwarder
+	// starts, so they follow this reply.
+	m.reply(ServerMessage{
+		Type:         "subscribed",
+		TenantID:     msg.TenantID,
+		DocumentID:   msg.DocumentID,
+		UserID:       m.userID,
+		ClientID:     client.id,
+		Access:       access,
+		Subscription: sub,
+	})
+	go m.forward(sub, s)
+	go s.relay()
+}
+
+func (m *muxConn) unsubscribe(sub string) {
+	m.mu.Lock()
+	s, ok := m.subs[sub]
+	m.mu.Unlock()
+	if !ok {
+		m.replyError(sub, fmt.Errorf("%w: %q is not subscribed", errInvalidSubscription, sub))
+		return
+	}
+	s.client.leave()
+}
+
+// relay hands the subscription's queued messages to its room, waiting while
+// the room's own queue is full, until the room lets go of the client.
+func (s *subscription) relay() {
+	for {
+		select {
+		case evt := <-s.queue:
+			select {
+			case s.client.room.inbound <- evt:
+			case <-s.client.room.done:
+				return
+			case <-s.gone:
+				return
+			}
+		case <-s.gone:
+			return
+		}
+	}
+}
+
+// forward relays what the room sends the subscription to the writer until
+// the room closes it, then frees the subscription ID.
+func (m *muxConn) forward(sub string, s *subscription) {
+	client := s.client
+	for message := range client.send {
+		select {
+		case m.out <- message:
+		case <-m.done:
+			// Keep draining until the room lets go of the client.
+		}
+	}
+	client.leave()
+	close(s.gone)
+
+	m.mu.Lock()
+	if m.subs[sub] == s {
+		delete(m.subs, sub)
+	}
+	m.mu.Unlock()
+	m.reply(ServerMessage{
+		Type:         "unsubscribed",
+		TenantID:     client.room.tenantID,
+		DocumentID:   client.room.documentID,
+		UserID:       m.userID,
+		ClientID:     client.id,
+		CloseCode:    client.closeCode,
+		Message:      client.closeReason,
+		Subscription: sub,
+	})
+}
+
+// reply queues a message for the writer, unless the connection is closing.
+func (m *muxConn) reply(msg ServerMessage) {
+	select {
+	case m.out <- marshal(m.codec, msg):
+	case <-m.done:
+	}
+}
+
+// replyError reports a failure that did not reach a room.
+func (m *muxConn) replyError(sub string, err error) {
+	msg := ServerMessage{
+		Type:         "error",
+		UserID:       m.userID,
+		Code:         errorCode(err),
+		Message:      errorMessage("multiplexed connection of user "+m.userID, err),
+		RetryAfter:   retryAfter(err),
+		Subscription: sub,
+	}
+	m.reply(msg)
+}
+
+func (m *muxConn) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		m.stop()
+		m.conn.Close()
+	}()
+
+	for {
+		select {
+		case message := <-m.out:
+			_ = m.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			m.conn.EnableWriteCompression(len(message) >= compressMinSize)
+			w, err := m.conn.NextWriter(m.codec.FrameType())
+			if err != nil {
+				return
+			}
+			if _, err := w.Write(message); err != nil {
+				return
+			}
+			if err := w.Close(); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = m.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := m.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package realtime
+
+import (
+	"testing"
+
+	"docStream/backend/internal/document"
+)
+
+func TestMuxRefusesWhenSubscriptionQueueFull(t *testing.T) {
+	svc := document.NewService(document.NewInMemoryRepository())
+	room := newRoom(NewHub(svc, Config{}), "t", "d") // not running: nothing drains it
+	m := &muxConn{
+		codec:   jsonWire,
+		userID:  "u",
+		limiter: testLimiter(RateLimit{PerConnection: Limit{Rate: 1, Burst: 1000}, PerUser: Limit{Rate: 1, Burst: 1000}}),
+		out:     make(chan []byte, 2*subscriptionQueue),
+		done:    make(chan struct{}),
+	}
+	s := &subscription{
+		client: &Client{id: "c", room: room, userID: "u", limiter: m.limiter},
+		queue:  make(chan inboundEvent, subscriptionQueue),
+		gone:   make(chan struct{}),
+	}
+	m.subs = map[string]*subscription{"s": s}
+
+	for i := 0; i < subscriptionQueue; i++ {
+		m.handle(ClientMessage{Type: "operation", Subscription: "s"})
+	}
+	if len(s.queue) != subscriptionQueue || len(m.out) != 0 {
+		t.Fatalf("queued %d, replied %d; want the queue filled without replies", len(s.queue), len(m.out))
+	}
+
+	tests := []struct {
+		msg       ClientMessage
+		wantReply bool
+	}{
+		{ClientMessage{Type: "operation", Subscription: "s"}, true},
+		{ClientMessage{Type: "cursor", Subscription: "s"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg.Type, func(t *testing.T) {
+			if code, _ := m.handle(tt.msg); code != 0 {
+				t.Fatalf("connection closed with %d", code)
+			}
+			if !tt.wantReply {
+				if len(m.out) != 0 {
+					t.Fatal("dropped cursor was answered")
+				}
+				return
+			}
+			var reply ServerMessage
+			if err := jsonWire.Unmarshal(<-m.out, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Code != ErrCodeRoomBusy || reply.RetryAfter != roomBusyRetry.Milliseconds() || reply.Subscription != "s" {
+				t.Fatalf("reply %+v, want room_busy for s retrying after %s", reply, roomBusyRetry)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// idleAfter is how long a user may go without sending anything before
+	// the roster marks them idle.
+	idleAfter = 2 * time.Minute
+	// presenceSweepInterval is how often the room checks for idle users
+	// and sends other instances its roster.
+	presenceSweepInterval = 15 * time.Second
+	// remoteRosterTTL is how long a user connected through another
+	// instance stays listed without a heartbeat from it.
+	remoteRosterTTL = 3 * presenceSweepInterval
+)
+
+// Presence states and roster events.
+const (
+	PresenceActive = "active"
+	PresenceIdle   = "idle"
+
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+	PresenceState = "state"
+)
+
+// palette gives each user a stable caret/avatar color.
+var palette = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4",
+	"#42d4f4", "#f032e6", "#469990", "#9a6324", "#800000",
+}
+
+// PresenceUser is one roster entry. A user with several tabs open is listed
+// once with a connection count.
+type PresenceUser struct {
+	UserID      string    `json:"userId"`
+	DisplayName string    `json:"displayName"`
+	Color       string    `json:"color"`
+	Connections int       `json:"connections"`
+	State       string    `json:"state"` // active | idle
+	LastActive  time.Time `json:"lastActive"`
+	AvatarURL   string    `json:"avatarUrl,omitempty"` // set with "join"
+}
+
+// PresenceEvent is a roster diff broadcast when someone joins, leaves or
+// changes state.
+type PresenceEvent struct {
+	Event string       `json:"event"` // join | leave | state
+	User  PresenceUser `json:"user"`
+}
+
+// remotePresence is a roster entry mirrored from another instance.
+type remotePresence struct {
+	PresenceUser
+	updated time.Time // last roster message or heartbeat from its instance
+}
+
+func colorFor(userID string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return palette[h.Sum32()%uint32(len(palette))]
+}
+
+// joinRoster adds a connection to the roster. Only a user's first
+// connection is announced.
+func (r *Room) joinRoster(client *Client) {
+	now := time.Now().UTC()
+	entry, ok := r.roster[client.userID]
+	if ok {
+		entry.Connections++
+		entry.LastActive = now
+		if entry.State != PresenceActive {
+			entry.State = PresenceActive
+			r.broadcastPresence(PresenceState, *entry)
+		}
+		return
+	}
+
+	name := client.displayName
+	if name == "" {
+		name = client.userID
+	}
+	entry = &PresenceUser{
+		UserID:      client.userID,
+		DisplayName: name,
+		Color:       colorFor(client.userID),
+		Connections: 1,
+		State:       PresenceActive,
+		LastActive:  now,
+	}
+	r.roster[client.userID] = entry
+	r.listingDirty = true
+	r.broadcastPresence(PresenceJoin, *entry)
+}
+
+// leaveRoster drops a connection and announces the user's departure once
+// their last connection is gone.
+func (r *Room) leaveRoster(client *Client) {
+	entry, ok := r.roster[client.userID]
+	if !ok {
+		return
+	}
+	entry.Connections--
+	if entry.Connections > 0 {
+		return
+	}
+	delete(r.roster, client.userID)
+	r.listingDirty = true
+	r.broadcastPresence(PresenceLeave, *entry)
+}
+
+// touchPresence records activity from a user, waking them if idle.
+func (r *Room) touchPresence(userID string) {
+	entry, ok := r.roster[userID]
+	if !ok {
+		return
+	}
+	entry.LastActive = time.Now().UTC()
+	if entry.State != PresenceActive {
+		entry.State = PresenceActive
+		r.broadcastPresence(PresenceState, *entry)
+	}
+}
+
+// handlePresence applies an explicit state report from a client, e.g. when
+// the tab loses focus.
+func (r *Room) handlePresence(evt inboundEvent) {
+	entry, ok := r.roster[evt.client.userID]
+	if !ok {
+		return
+	}
+	switch evt.message.Status {
+	case PresenceIdle:
+		if entry.State != PresenceIdle {
+			entry.State = PresenceIdle
+			r.broadcastPresence(PresenceState, *entry)
+		}
+	default:
+		r.touchPresence(evt.client.userID)
+	}
+}
+
+// sweepIdle marks users idle once they have been quiet for idleAfter.
+func (r *Room) sweepIdle(now time.Time) {
+	for _, entry := range r.roster {
+		if entry.State == PresenceActive && now.Sub(entry.LastActive) >= idleAfter {
+			entry.State = PresenceIdle
+			r.broadcastPresence(PresenceState, *entry)
+		}
+	}
+}
+
+func (r *Room) broadcastPresence(event string, user PresenceUser) {
+	r.broadcast(ServerMessage{
+		Type:       "presence",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     user.UserID,
+		Presence:   &PresenceEvent{Event: event, User: user},
+	})
+}
+
+// rosterList merges local users with those connected through other
+// instances; a user on several instances is listed once.
+func (r *Room) rosterList() []PresenceUser {
+	merged := make(map[string]PresenceUser, len(r.roster)+len(r.remoteRoster))
+	add := func(u PresenceUser) {
+		prev, ok := merged[u.UserID]
+		if !ok {
+			merged[u.UserID] = u
+			return
+		}
+		prev.Connections += u.Connections
+		if u.State == PresenceActive {
+			prev.State = PresenceActive
+		}
+		if u.LastActive.After(prev.LastActive) {
+			prev.LastActive = u.LastActive
+		}
+		merged[u.UserID] = prev
+	}
+	for _, entry := range r.roster {
+		add(*entry)
+	}
+	for _, u := range r.remoteRoster {
+		add(u.PresenceUser)
+	}
+
+	out := make([]PresenceUser, 0, len(merged))
+	for _, u := range merged {
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DisplayName < out[j].DisplayName })
+	return out
+}
+
+// heartbeatRoster publishes the local roster to other instances, which
+// expire users whose instance goes quiet. Clients are not sent anything.
+func (r *Room) heartbeatRoster() {
+	if r.feed == nil || len(r.roster) == 0 {
+		return
+	}
+	users := make([]PresenceUser, 0, len(r.roster))
+	for _, entry := range r.roster {
+		users = append(users, *entry)
+	}
+	payload, err := json.Marshal(envelope{Origin: r.origin, Roster: users})
+	if err != nil {
+		log.Printf("marshal roster heartbeat: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := r.broker.Publish(ctx, r.topic, payload); err != nil {
+		log.Printf("publish roster heartbeat to %s: %v", r.topic, err)
+	}
+}
+
+// refreshRemoteRoster records a heartbeat from origin. It also lists users
+// whose join this room missed, say while its broker feed was down.
+func (r *Room) refreshRemoteRoster(origin string, users []PresenceUser, now time.Time) {
+	for _, u := range users {
+		r.remoteRoster[origin+"/"+u.UserID] = remotePresence{PresenceUser: u, updated: now}
+	}
+}
+
+// expireRemoteRoster drops users whose instance has not sent a heartbeat
+// within remoteRosterTTL, as when it died without announcing their
+// departure. Local clients are told they left unless they are still
+// connected some other way.
+func (r *Room) expireRemoteRoster(now time.Time) {
+	var expired []PresenceUser
+	for key, remote := range r.remoteRoster {
+		if now.Sub(remote.updated) >= remoteRosterTTL {
+			delete(r.remoteRoster, key)
+			expired = append(expired, remote.PresenceUser)
+		}
+	}
+	for _, u := range expired {
+		if r.listed(u.UserID) {
+			continue
+		}
+		r.deliver(ServerMessage{
+			Type:       "presence",
+			TenantID:   r.tenantID,
+			DocumentID: r.documentID,
+			UserID:     u.UserID,
+			Presence:   &PresenceEvent{Event: PresenceLeave, User: u},
+		})
+	}
+}
+
+// listed reports whether userID is connected here or through an instance
+// that is still heard from.
+func (r *Room) listed(userID string) bool {
+	if _, ok := r.roster[userID]; ok {
+		return true
+	}
+	for _, remote := range r.remoteRoster {
+		if remote.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
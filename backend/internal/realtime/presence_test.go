@@ -0,0 +1,104 @@
+package realtime
+
+import (
+	"testing"
+	"time"
+)
+
+// expectPresence reads the next roster diff about userID sent to client
+// and checks it is event.
+func expectPresence(t *testing.T, client *Client, userID, event string) PresenceUser {
+	t.Helper()
+	for {
+		msg := expectMessage(t, client, "presence")
+		if msg.Presence.User.UserID != userID {
+			continue
+		}
+		if msg.UserID != userID {
+			t.Fatalf("presence for %s sent as %s", userID, msg.UserID)
+		}
+		if msg.Presence.Event != event {
+			t.Fatalf("next diff for %s is %s, want %s", userID, msg.Presence.Event, event)
+		}
+		return msg.Presence.User
+	}
+}
+
+func TestPresenceRoster(t *testing.T) {
+	h, doc := handshakeHub(t)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	if roster := expectMessage(t, alice, "snapshot").Roster; len(roster) != 1 || roster[0].UserID != "alice" {
+		t.Fatalf("alice's snapshot roster = %+v", roster)
+	}
+
+	bob := joinTestClient(t, h, "t", doc.ID, "bob")
+	if u := expectPresence(t, alice, "bob", PresenceJoin); u.UserID != "bob" || u.Connections != 1 || u.State != PresenceActive || u.Color != colorFor("bob") {
+		t.Fatalf("bob joined as %+v", u)
+	}
+	if roster := expectMessage(t, bob, "snapshot").Roster; len(roster) != 2 {
+		t.Fatalf("bob's snapshot roster = %+v, want both users", roster)
+	}
+
+	// A second tab is counted, not announced, and its departure leaves
+	// the user listed: the next diff about bob is the idle state below.
+	bobTab := joinTestClient(t, h, "t", doc.ID, "bob")
+	roster := expectMessage(t, bobTab, "snapshot").Roster
+	if len(roster) != 2 || roster[1].UserID != "bob" || roster[1].Connections != 2 {
+		t.Fatalf("roster with bob's second tab = %+v", roster)
+	}
+	bobTab.leave()
+
+	// Bob goes idle and comes back; the status he reports is stamped with
+	// his own identity, whatever the message claims.
+	if _, _, ok := bob.submit(ClientMessage{Type: "presence", UserID: "alice", Status: PresenceIdle}); !ok {
+		t.Fatal("room closed")
+	}
+	if u := expectPresence(t, alice, "bob", PresenceState); u.State != PresenceIdle {
+		t.Fatalf("idle report became %+v", u)
+	}
+	if _, _, ok := bob.submit(ClientMessage{Type: "presence", Status: PresenceActive}); !ok {
+		t.Fatal("room closed")
+	}
+	if u := expectPresence(t, alice, "bob", PresenceState); u.State != PresenceActive {
+		t.Fatalf("return became %+v", u)
+	}
+
+	bob.leave()
+	if u := expectPresence(t, alice, "bob", PresenceLeave); u.Connections != 0 {
+		t.Fatalf("leave for %+v", u)
+	}
+}
+
+func TestPresenceIdleSweep(t *testing.T) {
+	h, doc := handshakeHub(t)
+	r := newRoom(h, "t", doc.ID)
+	watcher := &Client{id: "w", userID: "alice", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	quiet := &Client{id: "q", userID: "bob", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	for _, c := range []*Client{watcher, quiet} {
+		r.clients[c] = true
+		r.joinRoster(c)
+	}
+	for len(watcher.send) > 0 {
+		<-watcher.send
+	}
+
+	now := time.Now()
+	r.roster["bob"].LastActive = now.Add(-idleAfter)
+	r.sweepIdle(now)
+	if u := expectPresence(t, watcher, "bob", PresenceState); u.State != PresenceIdle {
+		t.Fatalf("sweep sent %+v", u)
+	}
+	if r.roster["alice"].State != PresenceActive {
+		t.Fatal("an active user was swept")
+	}
+	r.sweepIdle(now)
+	if len(watcher.send) != 0 {
+		t.Fatal("an idle user was announced again")
+	}
+
+	// Any message wakes them.
+	r.touchPresence("bob")
+	if u := expectPresence(t, watcher, "bob", PresenceState); u.State != PresenceActive {
+		t.Fatalf("wake sent %+v", u)
+	}
+}
@@ -0,0 +1,246 @@
+package realtime
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: Rate messages per second on average, with bursts
+// of up to Burst.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimit bounds the messages a client can push into its room. Zero
+// fields take the defaults in DefaultRateLimit.
+type RateLimit struct {
+	PerConnection Limit
+	// PerUser is shared by all of a user's connections on this instance.
+	PerUser Limit
+	// UploadBytes bounds the bytes of upload chunk data a connection sends,
+	// Rate per second with bursts of Burst. Every chunk also counts as a
+	// message. Burst must cover the largest frame.
+	UploadBytes Limit
+	// MaxViolations is how many rejected messages within ViolationWindow
+	// get a connection closed.
+	MaxViolations   int
+	ViolationWindow time.Duration
+}
+
+// DefaultRateLimit comfortably covers a fast typist who also moves the
+// caret and sends awareness updates.
+var DefaultRateLimit = RateLimit{
+	PerConnection:   Limit{Rate: 30, Burst: 60},
+	PerUser:         Limit{Rate: 60, Burst: 120},
+	UploadBytes:     Limit{Rate: 4 << 20, Burst: 8 << 20},
+	MaxViolations:   100,
+	ViolationWindow: 10 * time.Second,
+}
+
+func (l RateLimit) withDefaults() RateLimit {
+	if l.PerConnection.Rate <= 0 || l.PerConnection.Burst <= 0 {
+		l.PerConnection = DefaultRateLimit.PerConnection
+	}
+	if l.PerUser.Rate <= 0 || l.PerUser.Burst <= 0 {
+		l.PerUser = DefaultRateLimit.PerUser
+	}
+	if l.UploadBytes.Rate <= 0 || l.UploadBytes.Burst < maxMessageSize {
+		l.UploadBytes = DefaultRateLimit.UploadBytes
+	}
+	if l.MaxViolations <= 0 {
+		l.MaxViolations = DefaultRateLimit.MaxViolations
+	}
+	if l.ViolationWindow <= 0 {
+		l.ViolationWindow = DefaultRateLimit.ViolationWindow
+	}
+	return l
+}
+
+// rateLimitNoticeInterval spaces out rate_limited replies to a flooding
+// client so the replies do not become a flood of their own. Dropped edits
+// are always reported, since the sender waits for an answer to each.
+const rateLimitNoticeInterval = time.Second
+
+const closeReasonRateLimited = "rate limit exceeded"
+
+// tokenBucket is safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l Limit, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: l.Rate, burst: float64(l.Burst), tokens: float64(l.Burst), last: now}
+}
+
+// take spends a token. When none is left it reports how long until one is.
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	return b.takeN(now, 1)
+}
+
+// takeN spends n tokens at once, or none if fewer are left.
+func (b *tokenBucket) takeN(now time.Time, n float64) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	wait := (n - b.tokens) / b.rate
+	return time.Duration(wait * float64(time.Second)), false
+}
+
+// userBuckets hands out one bucket per user, dropped when the user's last
+// connection closes.
+type userBuckets struct {
+	mu      sync.Mutex
+	limit   Limit
+	buckets map[string]*userBucket
+}
+
+type userBucket struct {
+	*tokenBucket
+	conns int
+}
+
+func newUserBuckets(limit Limit) *userBuckets {
+	return &userBuckets{limit: limit, buckets: make(map[string]*userBucket)}
+}
+
+func (u *userBuckets) join(userID string) *tokenBucket {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b, ok := u.buckets[userID]
+	if !ok {
+		b = &userBucket{tokenBucket: newTokenBucket(u.limit, time.Now())}
+		u.buckets[userID] = b
+	}
+	b.conns++
+	return b.tokenBucket
+}
+
+func (u *userBuckets) leave(userID string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b, ok := u.buckets[userID]
+	if !ok {
+		return
+	}
+	if b.conns--; b.conns <= 0 {
+		delete(u.buckets, userID)
+	}
+}
+
+// inboundLimiter applies a connection's limits in its read loop, before a
+// message reaches the room.
+type inboundLimiter struct {
+	conn, user *tokenBucket
+	bytes      *tokenBucket // upload chunk data
+	cfg        RateLimit
+
+	// droppedUpload is the upload a chunk of which was rejected. Its later
+	// chunks are dropped too: the room could not assemble it anyway, and
+	// the sender starts over under a new ID.
+	droppedUpload string
+
+	violations  int
+	windowStart time.Time
+	lastNotice  time.Time
+}
+
+// allow reports whether a message may go to the room. When it may not,
+// notice is non-nil if the client should be told, and closeConn is set once
+// the client has broken the limit too often.
+func (l *inboundLimiter) allow(msg ClientMessage, now time.Time) (ok bool, notice error, closeConn bool) {
+	upload := msg.Type == "upload" && msg.Upload != nil
+	if upload && msg.Upload.ID != "" && msg.Upload.ID == l.droppedUpload {
+		return false, nil, false
+	}
+	// Every chunk of an upload counts as a message, and its data against
+	// the byte budget, so splitting a message buys nothing.
+	wait, ok := l.conn.take(now)
+	if ok {
+		wait, ok = l.user.take(now)
+	}
+	if ok && upload {
+		wait, ok = l.bytes.takeN(now, float64(len(msg.Upload.Data)))
+	}
+	if ok {
+		return true, nil, false
+	}
+	if upload && !msg.Upload.Final {
+		l.droppedUpload = msg.Upload.ID
+	}
+
+	if now.Sub(l.windowStart) > l.cfg.ViolationWindow {
+		l.windowStart, l.violations = now, 0
+	}
+	l.violations++
+	if l.violations > l.cfg.MaxViolations {
+		return false, nil, true
+	}
+	if now.Sub(l.lastNotice) < rateLimitNoticeInterval && !expectsReply(msg) {
+		return false, nil, false
+	}
+	l.lastNotice = now
+	return false, &rateLimitError{retryAfter: wait}, false
+}
+
+// expectsReply reports whether the sender of msg waits for an answer to it,
+// so must hear when it is dropped.
+func expectsReply(msg ClientMessage) bool {
+	switch msg.Type {
+	case "operation", "batch", "undo", "redo", "upload",
+		"resume", "snapshot_resume", "replay", "replay_stop", "join", "ping":
+		return true
+	}
+	return false
+}
+
+// rateLimitError tells a client its message was dropped and when to retry.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%v: retry after %s", errRateLimited, e.retryAfter.Round(time.Millisecond))
+}
+
+func (e *rateLimitError) Unwrap() error { return errRateLimited }
+
+// roomBusyError tells a client its message was dropped because the room
+// was not keeping up, and when to retry.
+type roomBusyError struct {
+	retryAfter time.Duration
+}
+
+func (e *roomBusyError) Error() string {
+	return fmt.Sprintf("%v: retry after %s", errRoomBusy, e.retryAfter.Round(time.Millisecond))
+}
+
+func (e *roomBusyError) Unwrap() error { return errRoomBusy }
+
+// retryAfter reports when a client may resend a message that err rejected,
+// in milliseconds, or zero if err does not say.
+func retryAfter(err error) int64 {
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		return limited.retryAfter.Milliseconds()
+	}
+	var busy *roomBusyError
+	if errors.As(err, &busy) {
+		return busy.retryAfter.Milliseconds()
+	}
+	return 0
+}
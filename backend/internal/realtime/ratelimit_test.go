@@ -0,0 +1,224 @@
+package realtime
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		after    time.Duration // since the bucket was drained
+		n        float64
+		want     bool
+		wantWait time.Duration
+	}{
+		{"drained", 0, 1, false, 100 * time.Millisecond},
+		{"refilled one", 100 * time.Millisecond, 1, true, 0},
+		{"not yet refilled", 50 * time.Millisecond, 1, false, 50 * time.Millisecond},
+		{"several at once", 500 * time.Millisecond, 5, true, 0},
+		{"more than refilled", 500 * time.Millisecond, 6, false, 100 * time.Millisecond},
+		{"capped at burst", time.Hour, 10, true, 0},
+		{"over burst", time.Hour, 11, false, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(Limit{Rate: 10, Burst: 10}, start)
+			if _, ok := b.takeN(start, 10); !ok {
+				t.Fatal("full bucket refused its burst")
+			}
+			wait, ok := b.takeN(start.Add(tt.after), tt.n)
+			if ok != tt.want {
+				t.Fatalf("ok = %v, want %v", ok, tt.want)
+			}
+			if diff := wait - tt.wantWait; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("wait = %s, want %s", wait, tt.wantWait)
+			}
+		})
+	}
+}
+
+func testLimiter(cfg RateLimit) *inboundLimiter {
+	cfg = cfg.withDefaults()
+	now := time.Now()
+	return &inboundLimiter{
+		conn:  newTokenBucket(cfg.PerConnection, now),
+		user:  newTokenBucket(cfg.PerUser, now),
+		bytes: newTokenBucket(cfg.UploadBytes, now),
+		cfg:   cfg,
+	}
+}
+
+func chunk(id string, size int, final bool) ClientMessage {
+	return ClientMessage{Type: "upload", Upload: &UploadChunk{ID: id, Data: strings.Repeat("x", size), Final: final}}
+}
+
+func TestInboundLimiterFlood(t *testing.T) {
+	cfg := RateLimit{
+		PerConnection:   Limit{Rate: 1, Burst: 5},
+		PerUser:         Limit{Rate: 1, Burst: 100},
+		UploadBytes:     Limit{Rate: 1, Burst: 2 * maxMessageSize},
+		MaxViolations:   20,
+		ViolationWindow: time.Minute,
+	}
+	tests := []struct {
+		name        string
+		msgs        []ClientMessage
+		wantAllowed int
+		wantNotices int
+		wantClose   bool
+	}{
+		{
+			name:        "cursor flood is noticed once",
+			msgs:        repeat(ClientMessage{Type: "cursor"}, 15),
+			wantAllowed: 5,
+			wantNotices: 1,
+		},
+		{
+			name:        "every dropped edit is noticed",
+			msgs:        repeat(ClientMessage{Type: "operation"}, 15),
+			wantAllowed: 5,
+			wantNotices: 10,
+		},
+		{
+			name:        "persistent flood closes the connection",
+			msgs:        repeat(ClientMessage{Type: "cursor"}, 5+cfg.MaxViolations+1),
+			wantAllowed: 5,
+			wantNotices: 1,
+			wantClose:   true,
+		},
+		{
+			name:        "every dropped batch is noticed",
+			msgs:        repeat(ClientMessage{Type: "batch", BaseVersion: 1, Batch: []document.BatchOperation{{Delta: `["x"]`}}}, 8),
+			wantAllowed: 5,
+			wantNotices: 3,
+		},
+		{
+			name:        "every dropped ping and join is noticed",
+			msgs:        append(repeat(ClientMessage{Type: "cursor"}, 5), ClientMessage{Type: "ping"}, ClientMessage{Type: "join"}, ClientMessage{Type: "ping"}),
+			wantAllowed: 5,
+			wantNotices: 3,
+		},
+		{
+			name:        "upload chunks count as messages",
+			msgs:        append(repeat(chunk("a", 10, false), 7), chunk("a", 10, true)),
+			wantAllowed: 5,
+			wantNotices: 1,
+		},
+		{
+			name:        "chunks of a dropped upload are dropped quietly",
+			msgs:        append(append(repeat(ClientMessage{Type: "cursor"}, 5), repeat(chunk("a", 10, false), 7)...), chunk("a", 10, true)),
+			wantAllowed: 5,
+			wantNotices: 1,
+		},
+		{
+			name:        "upload bytes are budgeted",
+			msgs:        []ClientMessage{chunk("a", maxMessageSize, false), chunk("a", maxMessageSize, false), chunk("a", 1, true)},
+			wantAllowed: 2,
+			wantNotices: 1,
+		},
+		{
+			name:        "a new upload after a dropped one is charged again",
+			msgs:        []ClientMessage{chunk("a", maxMessageSize, false), chunk("a", maxMessageSize, false), chunk("a", 1, false), chunk("b", 1, true)},
+			wantAllowed: 2,
+			wantNotices: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := testLimiter(cfg)
+			now := time.Now()
+			allowed, notices, closed := 0, 0, false
+			for _, msg := range tt.msgs {
+				ok, notice, closeConn := l.allow(msg, now)
+				if ok {
+					allowed++
+				}
+				if notice != nil {
+					notices++
+					var rl *rateLimitError
+					if !errors.As(notice, &rl) || rl.retryAfter <= 0 || errorCode(notice) != ErrCodeRateLimited {
+						t.Fatalf("notice %v is not a rate_limited error with a retry time", notice)
+					}
+				}
+				closed = closed || closeConn
+			}
+			if allowed != tt.wantAllowed || notices != tt.wantNotices || closed != tt.wantClose {
+				t.Fatalf("allowed %d, notices %d, closed %v; want %d, %d, %v", allowed, notices, closed, tt.wantAllowed, tt.wantNotices, tt.wantClose)
+			}
+		})
+	}
+}
+
+func TestInboundLimiterSharesUserBucket(t *testing.T) {
+	users := newUserBuckets(Limit{Rate: 1, Burst: 4})
+	cfg := RateLimit{PerConnection: Limit{Rate: 1, Burst: 100}}.withDefaults()
+	a := &inboundLimiter{conn: newTokenBucket(cfg.PerConnection, time.Now()), user: users.join("u"), cfg: cfg}
+	b := &inboundLimiter{conn: newTokenBucket(cfg.PerConnection, time.Now()), user: users.join("u"), cfg: cfg}
+
+	now := time.Now()
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		for _, l := range []*inboundLimiter{a, b} {
+			if ok, _, _ := l.allow(ClientMessage{Type: "cursor"}, now); ok {
+				allowed++
+			}
+		}
+	}
+	if allowed != 4 {
+		t.Fatalf("two connections got %d messages through, want the user's burst of 4", allowed)
+	}
+
+	users.leave("u")
+	users.leave("u")
+	if len(users.buckets) != 0 {
+		t.Fatal("bucket kept after the user's last connection left")
+	}
+}
+
+func repeat(msg ClientMessage, n int) []ClientMessage {
+	msgs := make([]ClientMessage, n)
+	for i := range msgs {
+		msgs[i] = msg
+	}
+	return msgs
+}
+
+func TestThrottledBatchGetsRetryError(t *testing.T) {
+	svc := document.NewService(document.NewInMemoryRepository())
+	r := newRoom(NewHub(svc, Config{}), "t", "d")
+	c := &Client{
+		id:      "c",
+		room:    r,
+		userID:  "u",
+		codec:   jsonWire,
+		send:    make(chan []byte, 4),
+		limiter: testLimiter(RateLimit{PerConnection: Limit{Rate: 1, Burst: 1}}),
+	}
+	r.clients[c] = true
+
+	// A cursor uses the only token and the next one takes the notice, so a
+	// batch right after falls inside the notice interval.
+	c.admit(ClientMessage{Type: "cursor"})
+	if evt, _, _, _ := c.admit(ClientMessage{Type: "cursor"}); evt.rejected == nil {
+		t.Fatal("second cursor was not noticed")
+	}
+	evt, code, _, deliver := c.admit(ClientMessage{Type: "batch", BaseVersion: 1, Batch: []document.BatchOperation{{Delta: `["x"]`}}})
+	if code != 0 || !deliver || evt.rejected == nil {
+		t.Fatalf("throttled batch: code %d, deliver %v, rejected %v", code, deliver, evt.rejected)
+	}
+	r.handleEvent(evt)
+
+	var reply ServerMessage
+	if err := jsonWire.Unmarshal(<-c.send, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.Code != ErrCodeRateLimited || reply.RetryAfter <= 0 {
+		t.Fatalf("reply %+v, want a rate_limited error with a retry time", reply)
+	}
+}
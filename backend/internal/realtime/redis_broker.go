@@ -0,0 +1,427 @@
+package realtime
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout  = 5 * time.Second
+	redisWriteTimeout = 5 * time.Second
+	redisMaxBackoff   = 10 * time.Second
+	// redisPublishBatch caps the PUBLISH commands pipelined in one write.
+	redisPublishBatch = 64
+)
+
+// RedisBroker implements Broker with Redis pub/sub. Redis delivers the
+// messages of one channel to every subscriber in publish order, which gives
+// rooms a single per-document order across instances.
+//
+// It speaks the small subset of RESP it needs directly, over two
+// connections each owned by one goroutine: publishLoop pipelines PUBLISH
+// commands, and subscribeLoop issues SUBSCRIBE and UNSUBSCRIBE for every
+// topic and hands pushed messages to the topic's subscriptions. Callers
+// only wait on channels, never on each other's network I/O.
+type RedisBroker struct {
+	addr      string
+	ctx       context.Context // canceled by Close
+	cancel    context.CancelFunc
+	publishes chan redisPublish
+
+	mu      sync.Mutex
+	topics  map[string]*redisTopic
+	pending []byte        // SUBSCRIBE and UNSUBSCRIBE commands not yet written
+	wake    chan struct{} // signals subscribeLoop that pending has commands
+	subErr  error         // why the subscription connection is down, if it is
+}
+
+// redisPublish is a PUBLISH waiting for publishLoop.
+type redisPublish struct {
+	topic   string
+	payload []byte
+	err     chan error // buffered, so the loop never waits for the caller
+}
+
+// redisTopic is a channel this broker is subscribed to.
+type redisTopic struct {
+	subs      map[*memorySubscription]struct{}
+	confirmed chan struct{} // closed once Redis confirms the subscription
+}
+
+func NewRedisBroker(addr string) *RedisBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &RedisBroker{
+		addr:      addr,
+		ctx:       ctx,
+		cancel:    cancel,
+		publishes: make(chan redisPublish, redisPublishBatch),
+		topics:    make(map[string]*redisTopic),
+		wake:      make(chan struct{}, 1),
+	}
+	go b.publishLoop()
+	go b.subscribeLoop()
+	return b
+}
+
+// Publish queues payload for publishLoop and waits for Redis to accept it.
+// A publish the caller stops waiting for may still go out.
+func (b *RedisBroker) Publish(ctx context.Context, topic string, payload []byte) error {
+	req := redisPublish{topic: topic, payload: payload, err: make(chan error, 1)}
+	select {
+	case b.publishes <- req:
+	case <-b.ctx.Done():
+		return ErrBrokerClosed
+	case <-ctx.Done():
+		return fmt.Errorf("redis publish: %w", ctx.Err())
+	}
+	select {
+	case err := <-req.err:
+		return err
+	case <-b.ctx.Done():
+		return ErrBrokerClosed
+	case <-ctx.Done():
+		return fmt.Errorf("redis publish: %w", ctx.Err())
+	}
+}
+
+// publishLoop owns the publish connection. It writes whatever PUBLISH
+// commands have queued in one go and then reads their replies, dialing
+// again after any failure.
+func (b *RedisBroker) publishLoop() {
+	var conn net.Conn
+	var rd *bufio.Reader
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var batch []redisPublish
+		select {
+		case req := <-b.publishes:
+			batch = append(batch, req)
+		case <-b.ctx.Done():
+			return
+		}
+	more:
+		for len(batch) < redisPublishBatch {
+			select {
+			case req := <-b.publishes:
+				batch = append(batch, req)
+			default:
+				break more
+			}
+		}
+
+		if conn == nil {
+			var err error
+			if conn, err = dialRedis(b.ctx, b.addr); err != nil {
+				for _, req := range batch {
+					req.err <- err
+				}
+				continue
+			}
+			rd = bufio.NewReader(conn)
+		}
+
+		var buf []byte
+		for _, req := range batch {
+			buf = appendRedisCommand(buf, "PUBLISH", []byte(req.topic), req.payload)
+		}
+		_ = conn.SetDeadline(time.Now().Add(redisWriteTimeout))
+		_, err := conn.Write(buf)
+		for _, req := range batch {
+			if err == nil {
+				_, err = readRedisReply(rd)
+			}
+			if err != nil {
+				req.err <- fmt.Errorf("redis publish: %w", err)
+				continue
+			}
+			req.err <- nil
+		}
+		if err != nil {
+			// Drop the connection so the next publish redials.
+			conn.Close()
+			conn, rd = nil, nil
+		}
+	}
+}
+
+// Subscribe registers a subscription for topic and waits until Redis has
+// confirmed the broker is subscribed to it, so nothing published after
+// Subscribe returns is missed.
+func (b *RedisBroker) Subscribe(ctx context.Context, topic string) (Subscription, error) {
+	b.mu.Lock()
+	if b.ctx.Err() != nil {
+		b.mu.Unlock()
+		return nil, ErrBrokerClosed
+	}
+	t, ok := b.topics[topic]
+	if !ok {
+		t = &redisTopic{subs: make(map[*memorySubscription]struct{}), confirmed: make(chan struct{})}
+		b.topics[topic] = t
+		b.command("SUBSCRIBE", topic)
+	}
+	sub := newMemorySubscription(func(s *memorySubscription) { b.unsubscribe(topic, s) })
+	t.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	select {
+	case <-t.confirmed:
+		return sub, nil
+	case <-b.ctx.Done():
+		sub.Close()
+		return nil, ErrBrokerClosed
+	case <-ctx.Done():
+		sub.Close()
+		b.mu.Lock()
+		err := b.subErr
+		b.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("redis subscribe %s: %w", topic, err)
+		}
+		return nil, fmt.Errorf("redis subscribe %s: %w", topic, ctx.Err())
+	}
+}
+
+// unsubscribe removes a closed subscription, leaving the Redis channel
+// once the topic has no subscriptions left.
+func (b *RedisBroker) unsubscribe(topic string, sub *memorySubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return
+	}
+	delete(t.subs, sub)
+	if len(t.subs) == 0 {
+		delete(b.topics, topic)
+		b.command("UNSUBSCRIBE", topic)
+	}
+}
+
+// command queues a command for the subscription connection. Callers hold
+// b.mu, so commands are written in the order the topic map changed.
+func (b *RedisBroker) command(name, topic string) {
+	b.pending = appendRedisCommand(b.pending, name, []byte(topic))
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	b.cancel()
+	topics := b.topics
+	b.topics = make(map[string]*redisTopic)
+	b.mu.Unlock()
+
+	for _, t := range topics {
+		for sub := range t.subs {
+			sub.stop()
+		}
+	}
+	return nil
+}
+
+// subscribeLoop keeps the subscription connection up, redialing with
+// backoff when it drops. Messages published while disconnected are lost;
+// rooms recover through resume and resync.
+func (b *RedisBroker) subscribeLoop() {
+	backoff := 100 * time.Millisecond
+	for {
+		ctx, cancel := context.WithTimeout(b.ctx, redisDialTimeout)
+		conn, err := dialRedis(ctx, b.addr)
+		cancel()
+		if err == nil {
+			backoff = 100 * time.Millisecond
+			err = b.serveSubscriptions(conn)
+			if b.ctx.Err() != nil {
+				return
+			}
+			log.Printf("redis subscriptions: %v", err)
+		}
+		b.mu.Lock()
+		b.subErr = err
+		b.mu.Unlock()
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, redisMaxBackoff)
+	}
+}
+
+// serveSubscriptions subscribes conn to every topic and then writes queued
+// commands while dispatch reads, until either fails or the broker closes.
+func (b *RedisBroker) serveSubscriptions(conn net.Conn) error {
+	defer conn.Close()
+	write := func(buf []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(redisWriteTimeout))
+		_, err := conn.Write(buf)
+		return err
+	}
+
+	// Commands queued until now are covered by subscribing to the current
+	// topics afresh.
+	b.mu.Lock()
+	b.pending, b.subErr = nil, nil
+	var subscribe []byte
+	if len(b.topics) > 0 {
+		topics := make([][]byte, 0, len(b.topics))
+		for topic := range b.topics {
+			topics = append(topics, []byte(topic))
+		}
+		subscribe = appendRedisCommand(nil, "SUBSCRIBE", topics...)
+	}
+	b.mu.Unlock()
+
+	dispatched := make(chan error, 1)
+	go func() { dispatched <- b.dispatch(bufio.NewReader(conn)) }()
+	if subscribe != nil {
+		if err := write(subscribe); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-b.wake:
+			b.mu.Lock()
+			buf := b.pending
+			b.pending = nil
+			b.mu.Unlock()
+			if err := write(buf); err != nil {
+				return err
+			}
+		case err := <-dispatched:
+			return err
+		case <-b.ctx.Done():
+			return ErrBrokerClosed
+		}
+	}
+}
+
+// dispatch reads pushed messages and confirmations from the subscription
+// connection. Each subscription queues what it is handed, so one slow room
+// does not hold up the others.
+func (b *RedisBroker) dispatch(rd *bufio.Reader) error {
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		channel, _ := parts[1].([]byte)
+
+		b.mu.Lock()
+		t := b.topics[string(channel)]
+		switch {
+		case t == nil:
+		case string(kind) == "message":
+			payload, _ := parts[2].([]byte)
+			for sub := range t.subs {
+				sub.push(payload)
+			}
+		case string(kind) == "subscribe":
+			select {
+			case <-t.confirmed:
+			default:
+				close(t.confirmed)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func dialRedis(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: redisDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis dial %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// appendRedisCommand appends a command as a RESP array of bulk strings.
+func appendRedisCommand(buf []byte, name string, args ...[]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)+1), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range append([][]byte{[]byte(name)}, args...) {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// readRedisReply decodes one RESP value: simple strings and bulk strings as
+// []byte, integers as int64, arrays as []any and error replies as errors.
+func readRedisReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return []byte(body), nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+	}
+}
@@ -0,0 +1,303 @@
+package realtime
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    any
+		wantErr string
+	}{
+		{"simple string", "+OK\r\n", []byte("OK"), ""},
+		{"integer", ":42\r\n", int64(42), ""},
+		{"bulk string", "$5\r\nhe\r\no\r\n", []byte("he\r\no"), ""},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, ""},
+		{"null bulk string", "$-1\r\n", nil, ""},
+		{"pushed message", "*3\r\n$7\r\nmessage\r\n$1\r\nc\r\n$2\r\nhi\r\n", []any{[]byte("message"), []byte("c"), []byte("hi")}, ""},
+		{"nested array", "*2\r\n:1\r\n*1\r\n+x\r\n", []any{int64(1), []any{[]byte("x")}}, ""},
+		{"null array", "*-1\r\n", nil, ""},
+		{"error reply", "-ERR wrong type\r\n", nil, "redis: ERR wrong type"},
+		{"bare newline", "+OK\n", nil, "malformed reply"},
+		{"unknown type", "!3\r\n", nil, "unexpected reply type"},
+		{"bad length", "$x\r\n", nil, "invalid syntax"},
+		{"truncated bulk string", "$5\r\nab", nil, "EOF"},
+		{"truncated array", "*2\r\n:1\r\n", nil, "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(tt.in)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendRedisCommand(t *testing.T) {
+	got := string(appendRedisCommand(nil, "PUBLISH", []byte("doc:1"), []byte("a\r\nb")))
+	want := "*3\r\n$7\r\nPUBLISH\r\n$5\r\ndoc:1\r\n$4\r\na\r\nb\r\n"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// What the broker writes, the reader parses back.
+	reply, err := readRedisReply(bufio.NewReader(strings.NewReader(got)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []any{[]byte("PUBLISH"), []byte("doc:1"), []byte("a\r\nb")}; !reflect.DeepEqual(reply, want) {
+		t.Fatalf("parsed %#v", reply)
+	}
+}
+
+// fakeRedis serves the pub/sub commands RedisBroker uses.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu    sync.Mutex // guards the maps and every write
+	conns map[net.Conn]struct{}
+	subs  map[string]map[net.Conn]struct{}
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, conns: make(map[net.Conn]struct{}), subs: make(map[string]map[net.Conn]struct{})}
+	go f.accept()
+	t.Cleanup(func() {
+		ln.Close()
+		f.drop()
+	})
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) accept() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = struct{}{}
+		f.mu.Unlock()
+		go f.serve(conn)
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+	for {
+		cmd, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		args, _ := cmd.([]any)
+		if len(args) == 0 {
+			return
+		}
+		name, _ := args[0].([]byte)
+
+		f.mu.Lock()
+		switch strings.ToUpper(string(name)) {
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			kind := strings.ToLower(string(name))
+			for _, arg := range args[1:] {
+				channel := string(arg.([]byte))
+				if kind == "subscribe" {
+					if f.subs[channel] == nil {
+						f.subs[channel] = make(map[net.Conn]struct{})
+					}
+					f.subs[channel][conn] = struct{}{}
+				} else {
+					delete(f.subs[channel], conn)
+				}
+				conn.Write(appendRedisCommand(nil, kind, []byte(channel), []byte("1")))
+			}
+		case "PUBLISH":
+			channel, payload := args[1].([]byte), args[2].([]byte)
+			for sub := range f.subs[string(channel)] {
+				sub.Write(appendRedisCommand(nil, "message", channel, payload))
+			}
+			fmt.Fprintf(conn, ":%d\r\n", len(f.subs[string(channel)]))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command %s\r\n", name)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// drop closes every connection, as a Redis restart would.
+func (f *fakeRedis) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = make(map[net.Conn]struct{})
+	f.subs = make(map[string]map[net.Conn]struct{})
+}
+
+func (f *fakeRedis) subscribers(channel string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs[channel])
+}
+
+// receive waits for the next payload on sub.
+func receive(t *testing.T, sub Subscription) string {
+	t.Helper()
+	select {
+	case payload, ok := <-sub.Messages():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return string(payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message")
+		return ""
+	}
+}
+
+func TestRedisBrokerPubSub(t *testing.T) {
+	f := newFakeRedis(t)
+	b := NewRedisBroker(f.addr())
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	first, err := b.Subscribe(ctx, "doc:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Subscribe(ctx, "doc:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := b.Subscribe(ctx, "doc:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.subscribers("doc:1"); n != 1 {
+		t.Fatalf("broker holds %d Redis subscriptions to doc:1, want one shared", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := b.Publish(ctx, "doc:1", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []Subscription{first, second} {
+		for i := 0; i < 3; i++ {
+			if got := receive(t, sub); got != fmt.Sprint(i) {
+				t.Fatalf("got %q, want %d: messages out of order", got, i)
+			}
+		}
+	}
+	select {
+	case payload := <-other.Messages():
+		t.Fatalf("doc:2 got %q published to doc:1", payload)
+	default:
+	}
+
+	// The Redis channel is left once its last subscription closes.
+	first.Close()
+	second.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for f.subscribers("doc:1") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("broker did not unsubscribe from doc:1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBrokerReconnects(t *testing.T) {
+	f := newFakeRedis(t)
+	b := NewRedisBroker(f.addr())
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub, err := b.Subscribe(ctx, "doc:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(ctx, "doc:1", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, sub); got != "before" {
+		t.Fatalf("got %q", got)
+	}
+
+	f.drop()
+	// Messages published while the subscription is down are lost, so keep
+	// publishing until the broker has resubscribed and one comes through.
+	for {
+		err := b.Publish(ctx, "doc:1", []byte("after"))
+		if ctx.Err() != nil {
+			t.Fatalf("no message after the connections dropped; last publish: %v", err)
+		}
+		select {
+		case payload := <-sub.Messages():
+			if string(payload) != "after" {
+				t.Fatalf("got %q", payload)
+			}
+			if f.subscribers("doc:1") != 1 {
+				t.Fatal("broker did not resubscribe")
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestRedisBrokerClose(t *testing.T) {
+	f := newFakeRedis(t)
+	b := NewRedisBroker(f.addr())
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := b.Subscribe(ctx, "doc:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Close()
+	select {
+	case _, ok := <-sub.Messages():
+		if ok {
+			t.Fatal("message after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription not closed with the broker")
+	}
+	if err := b.Publish(ctx, "doc:1", []byte("x")); err != ErrBrokerClosed {
+		t.Fatalf("Publish after Close: err = %v, want ErrBrokerClosed", err)
+	}
+	if _, err := b.Subscribe(ctx, "doc:1"); err != ErrBrokerClosed {
+		t.Fatalf("Subscribe after Close: err = %v, want ErrBrokerClosed", err)
+	}
+}
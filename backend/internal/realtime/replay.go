@@ -0,0 +1,150 @@
+package realtime
+
+import (
+	"context"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// Replay mode plays a document's history back to one client over its
+// connection. "replay" starts it: the client gets "replay_start" with the
+// content to start from, then "replay_steps" with operations as they come
+// due, sped up as asked, and finally "replay_end". The live document keeps
+// updating meanwhile; "replay_stop" ends a replay early.
+
+// replayTick is how far ahead steps are batched into one message, so a fast
+// replay does not send one message per keystroke.
+const replayTick = 50 * time.Millisecond
+
+// ReplayRequest selects what a "replay" message plays back.
+type ReplayRequest struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to,omitempty"`    // zero: until now
+	Speed float64   `json:"speed,omitempty"` // zero: real time
+}
+
+// replayRun is a replay in progress. Its goroutine reads the log and hands
+// frames to the room, which delivers them while the run is current.
+type replayRun struct {
+	cancel context.CancelFunc
+}
+
+type replayFrame struct {
+	client *Client
+	run    *replayRun
+	msg    ServerMessage
+}
+
+func (r *Room) handleReplay(evt inboundEvent) {
+	client := evt.client
+	r.stopReplay(client)
+	if evt.message.Type == "replay_stop" {
+		r.sendTo(client, ServerMessage{
+			Type:       "replay_end",
+			TenantID:   r.tenantID,
+			DocumentID: r.documentID,
+			UserID:     client.userID,
+			Message:    "stopped",
+		})
+		return
+	}
+
+	var req ReplayRequest
+	if evt.message.Replay != nil {
+		req = *evt.message.Replay
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &replayRun{cancel: cancel}
+	r.replays[client] = run
+	go r.replay(ctx, client, run, document.PlaybackQuery{From: req.From, To: req.To, Speed: req.Speed})
+}
+
+// stopReplay cancels the client's replay, if it has one.
+func (r *Room) stopReplay(client *Client) {
+	if run, ok := r.replays[client]; ok {
+		run.cancel()
+		delete(r.replays, client)
+	}
+}
+
+// deliverReplay hands a replay frame to its client. A client that falls
+// behind loses its replay; it gets a resync of the live document instead.
+func (r *Room) deliverReplay(frame replayFrame) {
+	if r.replays[frame.client] != frame.run {
+		return
+	}
+	if r.lagging[frame.client] != nil {
+		r.stopReplay(frame.client)
+		return
+	}
+	if frame.msg.Type == "replay_end" || frame.msg.Type == "error" {
+		r.stopReplay(frame.client)
+	}
+	r.sendTo(frame.client, frame.msg)
+}
+
+// replay runs on its own goroutine, reading the log a page at a time and
+// pacing the steps.
+func (r *Room) replay(ctx context.Context, client *Client, run *replayRun, q document.PlaybackQuery) {
+	emit := func(msg ServerMessage) bool {
+		msg.TenantID, msg.DocumentID, msg.UserID = r.tenantID, r.documentID, client.userID
+		select {
+		case r.replayFrames <- replayFrame{client: client, run: run, msg: msg}:
+			return true
+		case <-ctx.Done():
+		case <-r.done:
+		}
+		return false
+	}
+	fail := func(err error) {
+		emit(ServerMessage{Type: "error", Code: errorCode(err), Message: errorMessage("room "+r.topic+": replay", err)})
+	}
+
+	due := time.Now()
+	var batch []document.PlaybackStep
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		ok := emit(ServerMessage{Type: "replay_steps", Version: batch[len(batch)-1].Version, Steps: batch})
+		batch = nil
+		return ok
+	}
+	for {
+		page, err := r.service.Playback(ctx, r.tenantID, r.documentID, q)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if page.Start != nil {
+			if !emit(ServerMessage{Type: "replay_start", Version: page.Start.Sequence, Content: page.Start.Content}) {
+				return
+			}
+		}
+		for _, step := range page.Steps {
+			due = due.Add(time.Duration(step.DelayMs) * time.Millisecond)
+			if wait := time.Until(due); wait > replayTick {
+				if !flush() {
+					return
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+			batch = append(batch, step)
+		}
+		if !flush() {
+			return
+		}
+		if page.Next == 0 {
+			emit(ServerMessage{Type: "replay_end"})
+			return
+		}
+		q.After = page.Next
+	}
+}
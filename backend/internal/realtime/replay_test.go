@@ -0,0 +1,72 @@
+package realtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+func TestReplayOverSocket(t *testing.T) {
+	ctx := context.Background()
+	svc := document.NewService(document.NewInMemoryRepository())
+	svc.SetVersionPolicy(document.VersionPolicy{Every: 2})
+	doc, err := svc.CreateDocument(ctx, "t", "alice", "x", "", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"a", "ab", "abc", "abcd", "abcde"} {
+		if doc, _, _, err = svc.ApplyOperation(ctx, document.ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "alice", NewContent: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHub(svc, Config{})
+	closeHub(t, h)
+	alice := joinTestClient(t, h, "t", doc.ID, "alice")
+	expectMessage(t, alice, "snapshot")
+	from := doc.CreatedAt.Add(-time.Minute)
+
+	if _, _, ok := alice.submit(ClientMessage{Type: "replay", Replay: &ReplayRequest{From: from, Speed: -1}}); !ok {
+		t.Fatal("room closed")
+	}
+	if msg := expectMessage(t, alice, "error"); msg.Code != ErrCodeInvalidPlayback {
+		t.Fatalf("replay at a negative speed: code %q, want %q", msg.Code, ErrCodeInvalidPlayback)
+	}
+
+	if _, _, ok := alice.submit(ClientMessage{Type: "replay", Replay: &ReplayRequest{From: from, Speed: 1000}}); !ok {
+		t.Fatal("room closed")
+	}
+	start := expectMessage(t, alice, "replay_start")
+	if start.Version != 1 || start.Content != "" {
+		t.Fatalf("replay starts at %d %q, want the document as created", start.Version, start.Content)
+	}
+	content, next := start.Content, start.Version+1
+	for next <= doc.Version {
+		msg := expectMessage(t, alice, "replay_steps")
+		for _, step := range msg.Steps {
+			if step.Version != next {
+				t.Fatalf("step is version %d, want %d", step.Version, next)
+			}
+			effect, err := step.TextEffect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content, err = effect.Apply(content); err != nil {
+				t.Fatal(err)
+			}
+			next++
+		}
+	}
+	expectMessage(t, alice, "replay_end")
+	if content != doc.Content {
+		t.Fatalf("replayed %q, want %q", content, doc.Content)
+	}
+
+	if _, _, ok := alice.submit(ClientMessage{Type: "replay_stop"}); !ok {
+		t.Fatal("room closed")
+	}
+	if msg := expectMessage(t, alice, "replay_end"); msg.Message != "stopped" {
+		t.Fatalf("replay_stop answered with %q", msg.Message)
+	}
+}
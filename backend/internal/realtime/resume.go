@@ -0,0 +1,82 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"docStream/backend/internal/document"
+)
+
+// maxReplayOps is the largest gap a reconnecting client may close by replay.
+// Anything bigger is cheaper to resend as a snapshot.
+const maxReplayOps = 500
+
+// handleResume catches a reconnecting client up from the last version it
+// acknowledged, replaying the missed operations in order. If the gap is too
+// big for the replay limit or the client's send queue, the history is
+// incomplete or the version is unknown, it falls back to a full snapshot.
+func (r *Room) handleResume(evt inboundEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	since := evt.message.Version
+	doc, err := r.service.GetDocument(ctx, r.tenantID, r.documentID)
+	if err != nil {
+		log.Printf("resume: load document: %v", err)
+		r.sendError(evt.client, err)
+		return
+	}
+	r.engine = doc.Engine
+	if since <= 0 || since > doc.Version {
+		r.sendSnapshotMessage(evt.client, "resync")
+		return
+	}
+
+	ops, err := r.service.OperationsSince(ctx, r.tenantID, r.documentID, since, maxReplayOps+1)
+	if err != nil && !errors.Is(err, document.ErrHistoryUnavailable) {
+		log.Printf("resume: list operations: %v", err)
+	}
+	// The replay and "resumed" must fit in the client's queue; one that
+	// overflowed would be cut short and resynced anyway.
+	room := cap(evt.client.send) - len(evt.client.send) - 1
+	if err != nil || len(ops) > maxReplayOps || len(ops) > room {
+		r.sendSnapshotMessage(evt.client, "resync")
+		return
+	}
+
+	for i := range ops {
+		r.sendTo(evt.client, ServerMessage{
+			Type:       "update",
+			TenantID:   r.tenantID,
+			DocumentID: r.documentID,
+			UserID:     ops[i].UserID,
+			Version:    ops[i].Version,
+			Operation:  &ops[i],
+			Checksum:   ops[i].Checksum,
+			Message:    "replay",
+		})
+	}
+
+	r.sendResumed(evt.client, doc.Version, doc.Engine, doc.SessionSeq(evt.client.userID, evt.client.session))
+}
+
+// sendResumed tells a client it is caught up to version and restates the
+// cursors and roster it may have missed. seq is the session's last accepted
+// operation, or 0 when unchanged.
+func (r *Room) sendResumed(client *Client, version int64, engine string, seq int64) {
+	r.sendTo(client, ServerMessage{
+		Type:       "resumed",
+		TenantID:   r.tenantID,
+		DocumentID: r.documentID,
+		UserID:     client.userID,
+		ClientID:   client.id,
+		Version:    version,
+		Engine:     engine,
+		Cursors:    r.cursorStates(),
+		Roster:     r.rosterList(),
+		Peers:      r.awarenessStates(),
+		Seq:        seq,
+	})
+}
@@ -0,0 +1,104 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"docStream/backend/internal/document"
+)
+
+func TestResume(t *testing.T) {
+	ctx := context.Background()
+	svc := document.NewService(document.NewInMemoryRepository())
+	doc, err := svc.CreateDocument(ctx, "t", "u", "x", "", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRoom(NewHub(svc, Config{}), "t", doc.ID)
+	client := &Client{id: "c", userID: "u", codec: jsonWire, send: make(chan []byte, sendBuffer)}
+	r.clients[client] = true
+
+	// edit appends n characters, one operation each.
+	edit := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			next := doc.Content + fmt.Sprint(i%10)
+			if doc, _, _, err = svc.ApplyOperation(ctx, document.ApplyOperationInput{TenantID: "t", DocumentID: doc.ID, UserID: "u", NewContent: next}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// resume asks to catch up from since and returns what the client got.
+	resume := func(since int64) []ServerMessage {
+		t.Helper()
+		r.handleResume(inboundEvent{client: client, message: ClientMessage{Type: "resume", Version: since}})
+		var msgs []ServerMessage
+		for len(client.send) > 0 {
+			var msg ServerMessage
+			if err := jsonWire.Unmarshal(<-client.send, &msg); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+		if r.lagging[client] != nil {
+			t.Fatal("resume overflowed the client's queue")
+		}
+		return msgs
+	}
+
+	edit(5)
+	since := doc.Version - 3
+	msgs := resume(since)
+	if len(msgs) != 4 {
+		t.Fatalf("resume from %d sent %d messages, want 3 updates and resumed", since, len(msgs))
+	}
+	for i, msg := range msgs[:3] {
+		if msg.Type != "update" || msg.Message != "replay" || msg.Version != since+int64(i)+1 || msg.Operation == nil {
+			t.Fatalf("message %d is %s %q at %d", i, msg.Type, msg.Message, msg.Version)
+		}
+	}
+	if last := msgs[3]; last.Type != "resumed" || last.Version != doc.Version {
+		t.Fatalf("last message is %s at %d, want resumed at %d", last.Type, last.Version, doc.Version)
+	}
+	if msgs := resume(doc.Version); len(msgs) != 1 || msgs[0].Type != "resumed" {
+		t.Fatalf("resume at the head sent %d messages", len(msgs))
+	}
+
+	// Unknown versions and gaps too big to replay get a snapshot instead.
+	snapshot := func(name string, since int64) {
+		t.Helper()
+		msgs := resume(since)
+		if len(msgs) != 1 || msgs[0].Type != "snapshot" || msgs[0].Message != "resync" || msgs[0].Content != doc.Content {
+			t.Fatalf("%s: got %d messages, first %s %q; want only a resync snapshot", name, len(msgs), msgs[0].Type, msgs[0].Message)
+		}
+	}
+	snapshot("version zero", 0)
+	snapshot("version ahead", doc.Version+1)
+
+	start := doc.Version
+	edit(sendBuffer)
+	snapshot("gap larger than the send queue", start)
+	edit(maxReplayOps)
+	snapshot("gap larger than maxReplayOps", start+sendBuffer)
+
+	// What is already queued counts against the queue.
+	queued := sendBuffer - 10
+	for i := 0; i < queued; i++ {
+		client.send <- []byte("{}")
+	}
+	r.handleResume(inboundEvent{client: client, message: ClientMessage{Type: "resume", Version: doc.Version - 20}})
+	if len(client.send) != queued+1 || r.lagging[client] != nil {
+		t.Fatalf("resume behind %d queued messages queued %d more", queued, len(client.send)-queued)
+	}
+	for i := 0; i < queued; i++ {
+		<-client.send
+	}
+	var msg ServerMessage
+	if err := jsonWire.Unmarshal(<-client.send, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "snapshot" || msg.Message != "resync" {
+		t.Fatalf("resume behind a full queue sent %s %q, want a resync snapshot", msg.Type, msg.Message)
+	}
+}
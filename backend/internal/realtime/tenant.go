@@ -0,0 +1,424 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"docStream/backend/internal/auth"
+	"docStream/backend/internal/document"
+	"github.com/gorilla/websocket"
+)
+
+// Tenant channels keep workspace document lists current. A watcher
+// connected to ServeTenant hears when documents it can open are created,
+// renamed, updated or deleted. Events travel on the tenant's broker topic;
+// service changes are published by the hub and edits and roster changes by
+// the document's room, at most once per listingInterval.
+
+const (
+	// listingInterval spaces out the doc_updated events a busy room sends.
+	listingInterval = time.Second
+	// watcherBuffer is how many events a watcher may fall behind by before
+	// it is disconnected to reload the list.
+	watcherBuffer = 64
+
+	closeReasonWatcherLagging = "fell behind; reload the document list"
+
+	// closeDocumentDeleted closes connections to a document that was
+	// deleted; clients should not reconnect.
+	closeDocumentDeleted       = 4410
+	closeReasonDocumentDeleted = "document deleted"
+)
+
+// DocumentSummary is a document list entry on doc_created, doc_renamed,
+// doc_updated and doc_deleted messages.
+type DocumentSummary struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	OwnerID   string    `json:"ownerId"`
+	Version   int64     `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Editors counts the users with the document open. It is only known
+	// to rooms; events from elsewhere leave it out.
+	Editors *int `json:"editors,omitempty"`
+	// Access is the receiving user's level.
+	Access document.AccessLevel `json:"access,omitempty"`
+}
+
+// listingEvent is a document list change on a tenant topic. It carries the
+// document's permissions so each instance can filter it for its watchers.
+type listingEvent struct {
+	Type        string                          `json:"type"` // doc_created | doc_renamed | doc_updated | doc_deleted
+	UserID      string                          `json:"userId,omitempty"`
+	Document    DocumentSummary                 `json:"document"`
+	Permissions map[string]document.AccessLevel `json:"permissions,omitempty"`
+	// Revoked lists users who lost access; they are sent doc_deleted.
+	Revoked []string `json:"revoked,omitempty"`
+}
+
+func tenantTopic(tenantID string) string {
+	return "docstream:tenant:" + tenantID
+}
+
+func summarize(doc document.Document) DocumentSummary {
+	return DocumentSummary{
+		ID:        doc.ID,
+		Title:     doc.Title,
+		OwnerID:   doc.OwnerID,
+		Version:   doc.Version,
+		UpdatedAt: doc.UpdatedAt,
+	}
+}
+
+// listingFor turns a service change into the list event watchers should
+// see, if any.
+func listingFor(change document.Change) (listingEvent, bool) {
+	if change.Document == nil {
+		return listingEvent{}, false
+	}
+	evt := listingEvent{
+		UserID:      change.UserID,
+		Document:    summarize(*change.Document),
+		Permissions: change.Document.Permissions,
+	}
+	switch change.Kind {
+	case document.ChangeCreated:
+		evt.Type = "doc_created"
+		editors := 0
+		evt.Document.Editors = &editors
+	case document.ChangeTitle:
+		evt.Type = "doc_renamed"
+	case document.ChangeReverted:
+		evt.Type = "doc_updated"
+	case document.ChangePermission:
+		evt.Type = "doc_updated"
+		if _, ok := change.Document.AccessFor(change.SubjectID); !ok {
+			evt.Revoked = []string{change.SubjectID}
+		}
+	case document.ChangeDeleted:
+		evt.Type = "doc_deleted"
+	default:
+		return listingEvent{}, false
+	}
+	return evt, true
+}
+
+// publishListing sends a list event to the tenant's watchers on every
+// instance, delivering it locally if the broker is unavailable.
+func (h *Hub) publishListing(tenantID string, evt listingEvent) {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		log.Printf("marshal %s: %v", evt.Type, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = h.broker.Publish(ctx, tenantTopic(tenantID), payload)
+	if err == nil {
+		return
+	}
+	log.Printf("publish %s failed, delivering locally: %v", evt.Type, err)
+
+	h.mu.Lock()
+	channel := h.tenants[tenantID]
+	h.mu.Unlock()
+	if channel != nil {
+		channel.deliver(evt)
+	}
+}
+
+// tenantChannel fans a tenant's list events out to this instance's
+// watchers. It exists while the tenant has watchers here.
+type tenantChannel struct {
+	hub      *Hub
+	tenantID string
+	feed     Subscription
+	watchers map[*tenantWatcher]bool // guarded by hub.mu
+}
+
+func (c *tenantChannel) run() {
+	for payload := range c.feed.Messages() {
+		var evt listingEvent
+		if err := json.Unmarshal(payload, &evt); err != nil {
+			log.Printf("tenant %s: decode event: %v", c.tenantID, err)
+			continue
+		}
+		c.deliver(evt)
+	}
+
+	// The feed ends when the last watcher leaves, the hub closes or the
+	// broker drops it. In the latter cases watchers must reconnect.
+	h := c.hub
+	h.mu.Lock()
+	if h.tenants[c.tenantID] == c {
+		delete(h.tenants, c.tenantID)
+	}
+	watchers := c.watcherList()
+	h.mu.Unlock()
+	for _, w := range watchers {
+		w.close(websocket.CloseGoingAway, "")
+	}
+}
+
+func (c *tenantChannel) watcherList() []*tenantWatcher {
+	out := make([]*tenantWatcher, 0, len(c.watchers))
+	for w := range c.watchers {
+		out = append(out, w)
+	}
+	return out
+}
+
+// deliver sends an event to the watchers allowed to see the document.
+func (c *tenantChannel) deliver(evt listingEvent) {
+	c.hub.mu.Lock()
+	watchers := c.watcherList()
+	c.hub.mu.Unlock()
+
+	doc := document.Document{OwnerID: evt.Document.OwnerID, Permissions: evt.Permissions}
+	// Encode once per wire format and access level.
+	type key struct {
+		codec  Codec
+		access document.AccessLevel
+	}
+	payloads := make(map[key][]byte, 2)
+	for _, w := range watchers {
+		msg := ServerMessage{
+			Type:     evt.Type,
+			TenantID: c.tenantID,
+			UserID:   evt.UserID,
+			Version:  evt.Document.Version,
+		}
+		access, ok := doc.AccessFor(w.userID)
+		switch {
+		case ok:
+			msg.DocumentID = evt.Document.ID
+		case slices.Contains(evt.Revoked, w.userID):
+			msg.Type, access = "doc_deleted", ""
+			msg.DocumentID = evt.Document.ID
+		default:
+			continue
+		}
+		k := key{w.codec, access}
+		payload, ok := payloads[k]
+		if !ok {
+			summary := evt.Document
+			summary.Access = access
+			msg.Listing = &summary
+			payload = marshal(w.codec, msg)
+			payloads[k] = payload
+		}
+		select {
+		case w.send <- payload:
+		default:
+			w.close(websocket.CloseTryAgainLater, closeReasonWatcherLagging)
+		}
+	}
+}
+
+// tenantWatcher is a websocket following a tenant's document list. It
+// only receives; anything the client sends is ignored.
+type tenantWatcher struct {
+	userID string
+	conn   *websocket.Conn
+	codec  Codec
+	send   chan []byte
+
+	once        sync.Once
+	done        chan struct{}
+	closeCode   int // set before done closes
+	closeReason string
+}
+
+func (w *tenantWatcher) close(code int, reason string) {
+	w.once.Do(func() {
+		w.closeCode, w.closeReason = code, reason
+		close(w.done)
+	})
+}
+
+// ServeTenant authenticates the caller and streams list events for the
+// "tenantId" parameter's documents they have access to. It takes the login
+// token the way ServeWS does. Clients should load the list after the
+// connection opens so no change falls in between.
+func (h *Hub) ServeTenant(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.URL.Query().Get("tenantId")
+	if tenantID == "" {
+		http.Error(w, "tenantId is required", http.StatusBadRequest)
+		return
+	}
+	claims, err := auth.ParseToken(wsToken(r))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("websocket upgrade failed: %v", err)
+		return
+	}
+	watcher := &tenantWatcher{
+		userID: claims.UserID,
+		conn:   conn,
+		codec:  codecFor(conn.Subprotocol()),
+		send:   make(chan []byte, watcherBuffer),
+		done:   make(chan struct{}),
+	}
+	if err := h.watch(tenantID, watcher); err != nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, err.Error()))
+		conn.Close()
+		return
+	}
+	go watcher.writePump()
+	go h.watcherReadPump(tenantID, watcher)
+}
+
+// watch adds a watcher to the tenant's channel, opening the channel first
+// if this is the tenant's first watcher here.
+func (h *Hub) watch(tenantID string, w *tenantWatcher) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return errHubClosed
+	}
+	if channel, ok := h.tenants[tenantID]; ok {
+		channel.watchers[w] = true
+		h.mu.Unlock()
+		return nil
+	}
+	h.mu.Unlock()
+
+	// Subscribe without h.mu, as acquire does for rooms.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	feed, err := h.broker.Subscribe(ctx, tenantTopic(tenantID))
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	channel, ok := h.tenants[tenantID]
+	if h.closed || ok {
+		_ = feed.Close()
+		if h.closed {
+			return errHubClosed
+		}
+		channel.watchers[w] = true
+		return nil
+	}
+	channel = &tenantChannel{
+		hub:      h,
+		tenantID: tenantID,
+		feed:     feed,
+		watchers: map[*tenantWatcher]bool{w: true},
+	}
+	h.tenants[tenantID] = channel
+	go channel.run()
+	return nil
+}
+
+// unwatch removes a watcher, closing the tenant's channel after its last.
+func (h *Hub) unwatch(tenantID string, w *tenantWatcher) {
+	h.mu.Lock()
+	channel, ok := h.tenants[tenantID]
+	if !ok || !channel.watchers[w] {
+		h.mu.Unlock()
+		return
+	}
+	delete(channel.watchers, w)
+	last := len(channel.watchers) == 0
+	if last {
+		delete(h.tenants, tenantID)
+	}
+	h.mu.Unlock()
+	if last {
+		_ = channel.feed.Close()
+	}
+}
+
+func (h *Hub) watcherReadPump(tenantID string, w *tenantWatcher) {
+	defer func() {
+		h.unwatch(tenantID, w)
+		w.close(0, "")
+	}()
+
+	w.conn.SetReadLimit(maxMessageSize)
+	_ = w.conn.SetReadDeadline(time.Now().Add(pongWait))
+	w.conn.SetPongHandler(func(string) error {
+		_ = w.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		if _, _, err := w.conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (w *tenantWatcher) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		w.conn.Close()
+	}()
+
+	for {
+		select {
+		case message := <-w.send:
+			_ = w.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := w.conn.WriteMessage(w.codec.FrameType(), message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = w.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := w.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-w.done:
+			_ = w.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			frame := []byte{}
+			if w.closeCode != 0 {
+				frame = websocket.FormatCloseMessage(w.closeCode, w.closeReason)
+			}
+			_ = w.conn.WriteMessage(websocket.CloseMessage, frame)
+			return
+		}
+	}
+}
+
+// flushListing publishes the room's list entry once it changed and
+// listingInterval has passed since the last time.
+func (r *Room) flushListing(now time.Time) {
+	if !r.listingDirty || now.Sub(r.listingSent) < listingInterval {
+		return
+	}
+	r.listingDirty, r.listingSent = false, now
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	doc, err := r.service.GetDocument(ctx, r.tenantID, r.documentID)
+	cancel()
+	if errors.Is(err, document.ErrDocumentNotFound) {
+		return // deleted; watchers were told
+	}
+	if err != nil {
+		log.Printf("room %s: listing: %v", r.topic, err)
+		return
+	}
+	editors := len(r.rosterList())
+	summary := summarize(doc)
+	summary.Editors = &editors
+	r.hub.publishListing(r.tenantID, listingEvent{
+		Type:        "doc_updated",
+		Document:    summary,
+		Permissions: doc.Permissions,
+	})
+}
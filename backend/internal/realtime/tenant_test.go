@@ -0,0 +1,166 @@
+package realtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"docStream/backend/internal/document"
+	"github.com/gorilla/websocket"
+)
+
+// newTestWatcher builds a watcher with no connection; tests read what it
+// is sent from w.send.
+func newTestWatcher(userID string, codec Codec) *tenantWatcher {
+	return &tenantWatcher{
+		userID: userID,
+		codec:  codec,
+		send:   make(chan []byte, watcherBuffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// expectListing reads the next event sent to w.
+func expectListing(t *testing.T, w *tenantWatcher) ServerMessage {
+	t.Helper()
+	select {
+	case payload := <-w.send:
+		var msg ServerMessage
+		if err := w.codec.Unmarshal(payload, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Listing == nil {
+			t.Fatalf("%s got %q without a listing", w.userID, msg.Type)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s got no event", w.userID)
+		return ServerMessage{}
+	}
+}
+
+// testChannel opens a tenant channel on h for watchers without starting
+// its feed; tests call deliver directly.
+func testChannel(h *Hub, watchers ...*tenantWatcher) *tenantChannel {
+	c := &tenantChannel{hub: h, tenantID: "t", watchers: make(map[*tenantWatcher]bool)}
+	for _, w := range watchers {
+		c.watchers[w] = true
+	}
+	return c
+}
+
+func TestTenantEventsFollowAccess(t *testing.T) {
+	h := NewHub(document.NewService(document.NewInMemoryRepository()), Config{})
+	closeHub(t, h)
+	bob := newTestWatcher("bob", jsonWire)
+	carol := newTestWatcher("carol", jsonWire)
+	carolPacked := newTestWatcher("carol", msgpackWire)
+	dave := newTestWatcher("dave", jsonWire)
+	c := testChannel(h, bob, carol, carolPacked, dave)
+
+	c.deliver(listingEvent{
+		Type:        "doc_renamed",
+		UserID:      "alice",
+		Document:    DocumentSummary{ID: "d", Title: "Plans", OwnerID: "alice", Version: 3},
+		Permissions: map[string]document.AccessLevel{"bob": document.AccessEdit, "carol": document.AccessView},
+	})
+
+	// Payloads are shared per wire format and level; nobody may be sent
+	// another user's level.
+	want := map[*tenantWatcher]document.AccessLevel{bob: document.AccessEdit, carol: document.AccessView, carolPacked: document.AccessView}
+	for w, access := range want {
+		msg := expectListing(t, w)
+		if msg.Type != "doc_renamed" || msg.DocumentID != "d" || msg.Listing.Title != "Plans" {
+			t.Fatalf("%s (%s) got %+v", w.userID, w.codec.Name(), msg)
+		}
+		if msg.Listing.Access != access {
+			t.Fatalf("%s (%s) was told its access is %q, want %q", w.userID, w.codec.Name(), msg.Listing.Access, access)
+		}
+	}
+	select {
+	case <-dave.send:
+		t.Fatal("a watcher without access was sent the event")
+	default:
+	}
+}
+
+func TestTenantRevokedWatcherGetsDeleted(t *testing.T) {
+	h := NewHub(document.NewService(document.NewInMemoryRepository()), Config{})
+	closeHub(t, h)
+	alice := newTestWatcher("alice", jsonWire)
+	bob := newTestWatcher("bob", jsonWire)
+	c := testChannel(h, alice, bob)
+
+	doc := document.Document{ID: "d", TenantID: "t", OwnerID: "alice", Version: 2}
+	evt, ok := listingFor(document.Change{Kind: document.ChangePermission, TenantID: "t", DocumentID: "d", UserID: "alice", SubjectID: "bob", Document: &doc})
+	if !ok {
+		t.Fatal("permission change has no list event")
+	}
+	c.deliver(evt)
+
+	if msg := expectListing(t, bob); msg.Type != "doc_deleted" || msg.DocumentID != "d" || msg.Listing.Access != "" {
+		t.Fatalf("bob got %q with access %q, want doc_deleted", msg.Type, msg.Listing.Access)
+	}
+	if msg := expectListing(t, alice); msg.Type != "doc_updated" || msg.Listing.Access != document.AccessEdit {
+		t.Fatalf("alice got %q with access %q", msg.Type, msg.Listing.Access)
+	}
+}
+
+func TestTenantSlowWatcherClosed(t *testing.T) {
+	h := NewHub(document.NewService(document.NewInMemoryRepository()), Config{})
+	closeHub(t, h)
+	slow := newTestWatcher("alice", jsonWire)
+	slow.send = make(chan []byte, 1)
+	slow.send <- nil
+	other := newTestWatcher("alice", jsonWire)
+	c := testChannel(h, slow, other)
+
+	c.deliver(listingEvent{Type: "doc_updated", Document: DocumentSummary{ID: "d", OwnerID: "alice"}})
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("watcher with a full buffer left open")
+	}
+	if slow.closeCode != websocket.CloseTryAgainLater || slow.closeReason != closeReasonWatcherLagging {
+		t.Fatalf("closed with %d %q, want %d", slow.closeCode, slow.closeReason, websocket.CloseTryAgainLater)
+	}
+	if msg := expectListing(t, other); msg.Type != "doc_updated" {
+		t.Fatalf("other watcher got %q", msg.Type)
+	}
+}
+
+// TestTenantWatcherHearsServiceChanges follows changes made through the
+// service to a watcher on the hub.
+func TestTenantWatcherHearsServiceChanges(t *testing.T) {
+	ctx := context.Background()
+	svc := document.NewService(document.NewInMemoryRepository())
+	h := NewHub(svc, Config{})
+	closeHub(t, h)
+	carol := newTestWatcher("carol", jsonWire)
+	if err := h.watch("t", carol); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := svc.CreateDocument(ctx, "t", "alice", "x", "", document.EngineOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.SetPermission(ctx, "t", doc.ID, "carol", document.AccessView); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectListing(t, carol); msg.Type != "doc_updated" || msg.Listing.Access != document.AccessView {
+		t.Fatalf("carol got %q with access %q after the grant", msg.Type, msg.Listing.Access)
+	}
+	if _, err := svc.RenameDocument(ctx, "t", doc.ID, "alice", "Plans"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectListing(t, carol); msg.Type != "doc_renamed" || msg.Listing.Title != "Plans" {
+		t.Fatalf("carol got %q titled %q", msg.Type, msg.Listing.Title)
+	}
+	if _, err := svc.SetPermission(ctx, "t", doc.ID, "carol", ""); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectListing(t, carol); msg.Type != "doc_deleted" || msg.DocumentID != doc.ID {
+		t.Fatalf("carol got %q after losing access, want doc_deleted", msg.Type)
+	}
+}
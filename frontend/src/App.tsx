@@ -8,9 +8,11 @@ import { PresenceBar } from "./components/PresenceBar";
 import { Login } from "./components/Login";
 import { Signup } from "./components/Signup";
 import { useRealtimeCollaboration } from "./hooks/useRealtimeCollaboration";
+import { useDocumentFeed } from "./hooks/useDocumentFeed";
 import {
   createDocument,
   createShareLink,
+  deleteDocument,
   getDocument,
   listDocuments,
   listVersions,
@@ -18,9 +20,11 @@ import {
   setPermission,
   setAuthToken,
 } from "./api/client";
-import type { AccessLevel, Doc, DocumentVersion } from "./types";
+import type { AccessLevel, Doc, DocumentVersion, ListingMessage } from "./types";
 
 const tenantId = "demo-tenant";
+// History replays run this many times faster than the edits were made.
+const REPLAY_SPEED = 10;
 
 function App() {
   const [token, setToken] = useState<string | null>(localStorage.getItem("token"));
@@ -83,24 +87,90 @@ function App() {
     [documents, selectedDocId],
   );
 
-  const { status, lastMessage, sendOperation } = useRealtimeCollaboration({
+  const {
+    status,
+    lastMessage,
+    roster,
+    peers,
+    access,
+    latency,
+    replay,
+    conflict,
+    offlineEdits,
+    mergeOffline,
+    keepOffline,
+    discardOffline,
+    startReplay,
+    stopReplay,
+    closeReplay,
+    sendOperation,
+    undo,
+    redo,
+  } = useRealtimeCollaboration({
     tenantId,
     docId: selectedDocId,
     userId, 
     onRemoteContent: setContent,
   });
 
-  // Load documents when token changes (and is present)
+  // Renames made elsewhere arrive over the collaboration connection.
   useEffect(() => {
-    if (!token) return;
+    if (lastMessage?.type !== "title") return;
+    const { documentId, title } = lastMessage;
+    setDocuments((prev) => prev.map((doc) => (doc.id === documentId ? { ...doc, title } : doc)));
+  }, [lastMessage]);
+
+  const loadDocuments = () => {
     listDocuments(tenantId)
       .then((docs) => setDocuments(docs || []))
       .catch((err) => {
         console.error(err);
         if (err.message.includes("Unauthorized")) handleLogout();
       });
+  };
+
+  // Load documents when token changes (and is present)
+  useEffect(() => {
+    if (!token) return;
+    loadDocuments();
   }, [token]);
 
+  // Keep the list live. Reloading whenever the feed (re)connects covers
+  // anything missed while it was down.
+  const handleListing = (msg: ListingMessage) => {
+    const { listing } = msg;
+    if (msg.type === "doc_deleted") {
+      setDocuments((prev) => prev.filter((doc) => doc.id !== listing.id));
+      if (listing.id === selectedDocId) handleBack();
+      return;
+    }
+    const fields = {
+      title: listing.title,
+      ownerId: listing.ownerId,
+      version: listing.version,
+      updatedAt: listing.updatedAt,
+      ...(listing.editors === undefined ? {} : { editors: listing.editors }),
+    };
+    setDocuments((prev) => {
+      if (prev.some((doc) => doc.id === listing.id)) {
+        return prev.map((doc) => (doc.id === listing.id ? { ...doc, ...fields } : doc));
+      }
+      const added: Doc = {
+        id: listing.id,
+        tenantId: msg.tenantId,
+        content: "",
+        permissions: {},
+        shareLinks: [],
+        engine: "ot",
+        createdAt: listing.updatedAt,
+        ...fields,
+      };
+      return [...prev, added];
+    });
+  };
+
+  useDocumentFeed({ tenantId, enabled: !!token, onOpen: loadDocuments, onMessage: handleListing });
+
   useEffect(() => {
     if (!selectedDocId || !token) return;
     setContent(""); // Clear content while loading
@@ -119,13 +189,24 @@ function App() {
         title,
         content: "",
       });
-      setDocuments((prev) => [...prev, doc]);
+      // The document list feed may have added it already.
+      setDocuments((prev) => [...prev.filter((d) => d.id !== doc.id), doc]);
       handleSelectDocument(doc.id);
     } catch (err) {
       console.error(err);
     }
   };
 
+  const handleDeleteDocument = async (id: string) => {
+    if (!window.confirm("Delete this document and its history?")) return;
+    try {
+      await deleteDocument(tenantId, id);
+      setDocuments((prev) => prev.filter((doc) => doc.id !== id));
+    } catch (err) {
+      console.error(err);
+    }
+  };
+
   const handleSelectDocument = (id: string) => {
     setSelectedDocId(id);
     setView("editor");
@@ -181,6 +262,11 @@ function App() {
     [selectedDocId],
   );
 
+  const handleReplay = (from: string) => {
+    startReplay(from, REPLAY_SPEED);
+    setIsMenuOpen(false);
+  };
+
   if (!token) {
     return authMode === "login" ? (
       <Login onLogin={handleLogin} onSwitchToSignup={() => setAuthMode("signup")} />
@@ -200,7 +286,7 @@ function App() {
           </p>
         </div>
         <div style={{ display: "flex", gap: "12px", alignItems: "center" }}>
-          <PresenceBar status={status} lastMessage={lastMessage} />
+          <PresenceBar status={status} lastMessage={lastMessage} roster={roster} peers={peers} rtt={latency?.rtt} />
           <button onClick={handleLogout}>Sign Out</button>
         </div>
       </header>
@@ -210,8 +296,10 @@ function App() {
           <DocumentList
             documents={documents}
             selectedId={selectedDocId}
+            userId={userId}
             onSelect={handleSelectDocument}
             onCreate={handleCreateDocument}
+            onDelete={handleDeleteDocument}
           />
         </div>
       ) : (
@@ -219,12 +307,45 @@ function App() {
           <button className="back-button" onClick={handleBack}>
             ← Back to documents
           </button>
+          {offlineEdits > 0 && status !== "connected" && (
+            <div className="conflict-bar">
+              <span>
+                Offline — {offlineEdits} {offlineEdits === 1 ? "edit" : "edits"} will be merged when the connection
+                returns
+              </span>
+            </div>
+          )}
+          {conflict && (
+            <div className="conflict-bar">
+              <span>
+                {conflict.conflict.reason === "overlap"
+                  ? "Your offline edits change text others changed meanwhile."
+                  : "Your offline edits are too old to merge."}
+              </span>
+              {conflict.conflict.reason === "overlap" && <button onClick={mergeOffline}>Merge anyway</button>}
+              <button onClick={keepOffline}>Keep mine</button>
+              <button onClick={discardOffline}>Discard mine</button>
+            </div>
+          )}
+          {replay && (
+            <div className="replay-bar">
+              <span>
+                Replaying history — version {replay.version}
+                {replay.playing ? "" : " (finished)"}
+              </span>
+              {replay.playing && <button onClick={stopReplay}>Stop</button>}
+              <button onClick={closeReplay}>Back to live</button>
+            </div>
+          )}
           <div className="grid" style={{ gridTemplateColumns: "1fr" }}>
             <DocumentEditor
               key={selectedDocId}
               title={selectedDoc?.title}
-              content={content}
+              content={replay ? replay.content : content}
               onChange={handleContentChange}
+              onUndo={undo}
+              onRedo={redo}
+              readOnly={replay !== null || (access !== null && access !== "edit")}
               connectionStatus={status}
               onOpenMenu={() => setIsMenuOpen(true)}
             />
@@ -247,7 +368,7 @@ function App() {
                 onCreateLink={handleShareLink}
                 onSetPermission={handlePermission}
               />
-              <VersionTimeline versions={versions} onRevert={handleRevert} />
+              <VersionTimeline versions={versions} onRevert={handleRevert} onReplay={handleReplay} />
             </div>
           </div>
         </div>
@@ -1,4 +1,4 @@
-import type { AccessLevel, CollabMessage, Doc, DocumentVersion, ShareLink } from "../types";
+import type { AccessLevel, CollabMessage, Doc, DocumentVersion, ListingMessage, PlaybackPage, ShareLink } from "../types";
 
 // Use relative path so Nginx can proxy to backend
 const API_BASE = import.meta.env.VITE_API_BASE ?? "";
@@ -68,6 +68,17 @@ export async function getDocument(tenantId: string, docId: string) {
   return request<Doc>(`/api/tenants/${tenantId}/docs/${docId}`);
 }
 
+export async function renameDocument(tenantId: string, docId: string, title: string) {
+  return request<Doc>(`/api/tenants/${tenantId}/docs/${docId}`, {
+    method: "PATCH",
+    body: JSON.stringify({ title }),
+  });
+}
+
+export async function deleteDocument(tenantId: string, docId: string) {
+  await request(`/api/tenants/${tenantId}/docs/${docId}`, { method: "DELETE" });
+}
+
 export async function createShareLink(
   tenantId: string,
   docId: string,
@@ -106,21 +117,213 @@ export async function revertVersion(tenantId: string, docId: string, versionId:
   );
 }
 
+// getPlayback pages through the operations made between two times (RFC 3339;
+// `to` defaults to now). Pass the previous page's `next` as `after`.
+export async function getPlayback(
+  tenantId: string,
+  docId: string,
+  params: { from: string; to?: string; after?: number; limit?: number; speed?: number },
+) {
+  const query = new URLSearchParams({ from: params.from });
+  if (params.to) query.set("to", params.to);
+  if (params.after) query.set("after", String(params.after));
+  if (params.limit) query.set("limit", String(params.limit));
+  if (params.speed) query.set("speed", String(params.speed));
+  return request<PlaybackPage>(`/api/tenants/${tenantId}/docs/${docId}/playback?${query}`);
+}
+
+// CollabTransport picks how the collaboration connection reaches the
+// server. "sse" and "poll" are HTTP fallbacks for networks whose proxies
+// strip websocket upgrades.
+export type CollabTransport = "websocket" | "sse" | "poll";
+
+// CollabSocket is the part of WebSocket the collaboration hook uses, so the
+// HTTP fallbacks can stand in for it.
+export interface CollabSocket {
+  readonly readyState: number;
+  onopen: ((event: Event) => void) | null;
+  onclose: ((event: CloseEvent) => void) | null;
+  send(data: string): void;
+  close(): void;
+}
+
 export function openCollabSocket(params: {
   tenantId: string;
   docId: string;
   userId: string;
+  session: string;
+  resume?: boolean;
+  transport?: CollabTransport;
   onMessage: (msg: CollabMessage) => void;
-}): WebSocket {
-  const { tenantId, docId, userId, onMessage } = params;
-  const socket = new WebSocket(`${WS_BASE}/ws?tenantId=${tenantId}&docId=${docId}&userId=${userId}`);
+}): CollabSocket {
+  const { tenantId, docId, userId, session, resume, transport = "websocket", onMessage } = params;
+  // Browsers cannot set an Authorization header on websocket upgrades, so
+  // the login token travels as a query parameter.
+  const token = authToken ? `&token=${encodeURIComponent(authToken)}` : "";
+  const query = `tenantId=${tenantId}&docId=${docId}&userId=${userId}&session=${session}${token}${resume ? "&resume=1" : ""}`;
+  if (transport !== "websocket") {
+    return new HttpCollabSocket(transport, query, onMessage);
+  }
+  const socket = new WebSocket(`${WS_BASE}/ws?${query}`);
+  socket.onmessage = (event) => deliverMessage(event.data, onMessage);
+  return socket;
+}
+
+// openTenantSocket follows the tenant's document list. It only receives:
+// created, renamed, updated and deleted events for documents the user can
+// open.
+export function openTenantSocket(tenantId: string, onMessage: (msg: ListingMessage) => void): WebSocket {
+  const token = authToken ? `&token=${encodeURIComponent(authToken)}` : "";
+  const socket = new WebSocket(`${WS_BASE}/ws/tenant?tenantId=${tenantId}${token}`);
   socket.onmessage = (event) => {
     try {
-      const parsed: CollabMessage = JSON.parse(event.data);
-      onMessage(parsed);
+      onMessage(JSON.parse(event.data));
     } catch (err) {
       console.warn("failed to parse message", err);
     }
   };
   return socket;
 }
+
+function deliverMessage(data: string, onMessage: (msg: CollabMessage) => void) {
+  try {
+    const parsed: CollabMessage = JSON.parse(data);
+    onMessage(parsed);
+  } catch (err) {
+    console.warn("failed to parse message", err);
+  }
+}
+
+interface PollResponse {
+  sessionId: string;
+  messages: CollabMessage[];
+  // Acknowledged on the next poll; until then the server resends the batch.
+  batch?: number;
+  close?: { code: number; reason?: string };
+}
+
+// A poll that fails on the way back is retried this many times, acknowledging
+// the same batch, before the socket gives up and the hook reconnects.
+const POLL_RETRIES = 2;
+const POLL_RETRY_DELAY_MS = 500;
+
+// HttpCollabSocket receives from the server's event stream or by long
+// polling, and POSTs each message it sends. The server names the session
+// when the stream opens or the first poll returns.
+class HttpCollabSocket implements CollabSocket {
+  readyState: number = WebSocket.CONNECTING;
+  onopen: ((event: Event) => void) | null = null;
+  onclose: ((event: CloseEvent) => void) | null = null;
+  private sessionId = "";
+  private events: EventSource | null = null;
+  private aborter = new AbortController();
+  // POSTs are chained so the server receives messages in the order sent.
+  private outbox: Promise<void> = Promise.resolve();
+  private onMessage: (msg: CollabMessage) => void;
+
+  constructor(mode: "sse" | "poll", query: string, onMessage: (msg: CollabMessage) => void) {
+    this.onMessage = onMessage;
+    if (mode === "sse") {
+      this.stream(query);
+    } else {
+      void this.poll(query);
+    }
+  }
+
+  send(data: string) {
+    if (this.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    const url = `${API_BASE}/send?sessionId=${this.sessionId}`;
+    this.outbox = this.outbox
+      .then(async () => {
+        if (this.readyState !== WebSocket.OPEN) {
+          return;
+        }
+        const res = await fetch(url, { method: "POST", headers: this.headers(), body: data });
+        // A rate-limited session is closed through the stream or poll,
+        // with the reason.
+        if (!res.ok && res.status !== 429) {
+          this.finish(1006, "");
+        }
+      })
+      .catch(() => this.finish(1006, ""));
+  }
+
+  close() {
+    this.finish(1000, "");
+  }
+
+  private headers(): HeadersInit {
+    return authToken ? { Authorization: `Bearer ${authToken}` } : {};
+  }
+
+  private opened(sessionId: string) {
+    this.sessionId = sessionId;
+    this.readyState = WebSocket.OPEN;
+    this.onopen?.(new Event("open"));
+  }
+
+  private stream(query: string) {
+    const events = new EventSource(`${API_BASE}/sse?${query}`);
+    this.events = events;
+    events.addEventListener("session", (event) => this.opened(JSON.parse((event as MessageEvent).data).sessionId));
+    events.onmessage = (event) => deliverMessage(event.data, this.onMessage);
+    events.addEventListener("close", (event) => {
+      const { code, reason } = JSON.parse((event as MessageEvent).data);
+      this.finish(code, reason ?? "");
+    });
+    // EventSource would reconnect into a fresh session on its own; the hook
+    // reconnects instead, resuming where it left off.
+    events.onerror = () => this.finish(1006, "");
+  }
+
+  private async poll(query: string) {
+    let url = `${API_BASE}/poll?${query}`;
+    let failures = 0;
+    while (this.readyState !== WebSocket.CLOSED) {
+      let body: PollResponse;
+      try {
+        const res = await fetch(url, { headers: this.headers(), signal: this.aborter.signal });
+        if (!res.ok) {
+          this.finish(1006, "");
+          return;
+        }
+        body = await res.json();
+      } catch {
+        // The reply may have been lost in transit; the session still holds
+        // it until it is acknowledged, so poll again with the same cursor.
+        if (this.readyState !== WebSocket.OPEN || ++failures > POLL_RETRIES) {
+          this.finish(1006, "");
+          return;
+        }
+        await new Promise((resolve) => setTimeout(resolve, POLL_RETRY_DELAY_MS));
+        continue;
+      }
+      failures = 0;
+      if (this.readyState === WebSocket.CONNECTING) {
+        this.opened(body.sessionId);
+      }
+      for (const msg of body.messages) {
+        if (this.readyState === WebSocket.OPEN) {
+          this.onMessage(msg);
+        }
+      }
+      if (body.close) {
+        this.finish(body.close.code, body.close.reason ?? "");
+        return;
+      }
+      url = `${API_BASE}/poll?sessionId=${body.sessionId}&ack=${body.batch ?? 0}`;
+    }
+  }
+
+  private finish(code: number, reason: string) {
+    if (this.readyState === WebSocket.CLOSED) {
+      return;
+    }
+    this.readyState = WebSocket.CLOSED;
+    this.events?.close();
+    this.aborter.abort();
+    this.onclose?.(new CloseEvent("close", { code, reason }));
+  }
+}
@@ -2,11 +2,40 @@ interface Props {
   title?: string;
   content: string;
   onChange: (next: string) => void;
+  onUndo: () => void;
+  onRedo: () => void;
+  // Set when the user's access was lowered or revoked while editing.
+  readOnly?: boolean;
   connectionStatus: string;
   onOpenMenu: () => void;
 }
 
-export function DocumentEditor({ title, content, onChange, connectionStatus, onOpenMenu }: Props) {
+export function DocumentEditor({
+  title,
+  content,
+  onChange,
+  onUndo,
+  onRedo,
+  readOnly,
+  connectionStatus,
+  onOpenMenu,
+}: Props) {
+  // The browser's own undo would revert collaborators' edits too, so undo
+  // and redo go through the server, which only touches this user's changes.
+  const handleKeyDown = (e: React.KeyboardEvent<HTMLTextAreaElement>) => {
+    if (!(e.ctrlKey || e.metaKey)) {
+      return;
+    }
+    const key = e.key.toLowerCase();
+    if (key === "z" && !e.shiftKey) {
+      e.preventDefault();
+      onUndo();
+    } else if ((key === "z" && e.shiftKey) || key === "y") {
+      e.preventDefault();
+      onRedo();
+    }
+  };
+
   return (
     <div className="panel editor">
       <div className="panel-header">
@@ -26,6 +55,8 @@ export function DocumentEditor({ title, content, onChange, connectionStatus, onO
         <textarea
           value={content}
           onChange={(e) => onChange(e.target.value)}
+          onKeyDown={handleKeyDown}
+          readOnly={readOnly}
           placeholder="Start typing... changes stream to collaborators in real time."
         />
       </div>
@@ -4,11 +4,13 @@ import type { Doc } from "../types";
 interface Props {
   documents: Doc[];
   selectedId?: string;
+  userId: string;
   onSelect: (id: string) => void;
   onCreate: (title: string) => void;
+  onDelete: (id: string) => void;
 }
 
-export function DocumentList({ documents, selectedId, onSelect, onCreate }: Props) {
+export function DocumentList({ documents, selectedId, userId, onSelect, onCreate, onDelete }: Props) {
   const [title, setTitle] = useState("");
 
   const handleCreate = () => {
@@ -33,6 +35,20 @@ export function DocumentList({ documents, selectedId, onSelect, onCreate }: Prop
             onClick={() => onSelect(doc.id)}
           >
             <div className="doc-title">{doc.title || "Untitled"}</div>
+            {!!doc.editors && <div className="doc-meta">{doc.editors} editing</div>}
+            {doc.ownerId === userId && (
+              <span
+                className="doc-delete"
+                role="button"
+                title="Delete document"
+                onClick={(e) => {
+                  e.stopPropagation();
+                  onDelete(doc.id);
+                }}
+              >
+                ×
+              </span>
+            )}
           </button>
         ))}
         {documents.length === 0 && <div className="empty">No docs yet — create the first one.</div>}
@@ -1,11 +1,20 @@
-import type { CollabMessage } from "../types";
+import type { AwarenessState, CollabMessage, PresenceUser } from "../types";
 
 interface Props {
   status: string;
   lastMessage: CollabMessage | null;
+  roster: PresenceUser[];
+  peers: Record<string, AwarenessState>;
+  // Round trip to the server in milliseconds, once measured.
+  rtt?: number;
 }
 
-export function PresenceBar({ status, lastMessage }: Props) {
+export function PresenceBar({ status, lastMessage, roster, peers, rtt }: Props) {
+  const typing = new Set(
+    Object.values(peers)
+      .filter((peer) => peer.state.typing)
+      .map((peer) => peer.userId),
+  );
   return (
     <div className="panel presence">
       <div className="panel-header">
@@ -15,8 +24,25 @@ export function PresenceBar({ status, lastMessage }: Props) {
       <div className="panel-body">
         <div className="status-dot">
           <span className={`dot ${status}`} />
-          <span className="status-label">{status}</span>
+          <span className="status-label">
+            {status}
+            {status === "connected" && rtt !== undefined && ` · ${rtt} ms`}
+          </span>
         </div>
+        <ul className="roster">
+          {roster.map((user) => (
+            <li key={user.userId} className={`roster-user ${user.state}`}>
+              {user.avatarUrl ? (
+                <img className="avatar" src={user.avatarUrl} alt="" style={{ borderColor: user.color }} />
+              ) : (
+                <span className="dot" style={{ background: user.color }} />
+              )}
+              <span className="roster-name">{user.displayName}</span>
+              {user.connections > 1 && <span className="roster-count">×{user.connections}</span>}
+              <span className="roster-state">{typing.has(user.userId) ? "typing…" : user.state}</span>
+            </li>
+          ))}
+        </ul>
         {lastMessage ? (
           <div className="mini-log">
             <div className="eyebrow">Last event</div>
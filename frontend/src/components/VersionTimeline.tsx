@@ -3,9 +3,11 @@ import type { DocumentVersion } from "../types";
 interface Props {
   versions: DocumentVersion[];
   onRevert: (versionId: string) => void;
+  // Plays the history back from a version's time.
+  onReplay: (from: string) => void;
 }
 
-export function VersionTimeline({ versions, onRevert }: Props) {
+export function VersionTimeline({ versions, onRevert, onReplay }: Props) {
   return (
     <div className="panel">
       <div className="panel-header">
@@ -28,7 +30,10 @@ export function VersionTimeline({ versions, onRevert }: Props) {
                   by {v.authorId} • {new Date(v.createdAt).toLocaleTimeString()}
                 </div>
               </div>
-              <button onClick={() => onRevert(v.id)}>Revert</button>
+              <div style={{ display: "flex", gap: "8px" }}>
+                <button onClick={() => onReplay(v.createdAt)}>Replay</button>
+                <button onClick={() => onRevert(v.id)}>Revert</button>
+              </div>
             </div>
           ))}
         {versions.length === 0 && <div className="empty">No versions yet.</div>}
@@ -0,0 +1,54 @@
+import { useEffect, useRef } from "react";
+import { openTenantSocket } from "../api/client";
+import type { ListingMessage } from "../types";
+
+const RECONNECT_DELAY_MS = 1000;
+const MAX_RECONNECT_DELAY_MS = 15000;
+
+// useDocumentFeed follows the tenant's document list while enabled. onOpen
+// runs whenever the connection (re)opens: that is when the list should be
+// loaded, so no change falls between the load and the first event.
+export function useDocumentFeed(params: {
+  tenantId: string;
+  enabled: boolean;
+  onOpen: () => void;
+  onMessage: (msg: ListingMessage) => void;
+}) {
+  const { tenantId, enabled } = params;
+  const onOpenRef = useRef(params.onOpen);
+  const onMessageRef = useRef(params.onMessage);
+
+  useEffect(() => {
+    onOpenRef.current = params.onOpen;
+    onMessageRef.current = params.onMessage;
+  });
+
+  useEffect(() => {
+    if (!enabled) return;
+    let closed = false;
+    let attempts = 0;
+    let retryTimer: ReturnType<typeof setTimeout> | undefined;
+    let socket: WebSocket | null = null;
+
+    const connect = () => {
+      socket = openTenantSocket(tenantId, (msg) => onMessageRef.current(msg));
+      socket.onopen = () => {
+        attempts = 0;
+        onOpenRef.current();
+      };
+      socket.onclose = () => {
+        if (closed) return;
+        const delay = Math.min(RECONNECT_DELAY_MS * 2 ** attempts, MAX_RECONNECT_DELAY_MS);
+        attempts += 1;
+        retryTimer = setTimeout(connect, delay);
+      };
+    };
+
+    connect();
+    return () => {
+      closed = true;
+      clearTimeout(retryTimer);
+      socket?.close();
+    };
+  }, [tenantId, enabled]);
+}
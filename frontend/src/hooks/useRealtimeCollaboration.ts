@@ -1,9 +1,36 @@
 import { useEffect, useRef, useState } from "react";
-import type { CollabMessage } from "../types";
-import { openCollabSocket } from "../api/client";
+import type { AccessLevel, AwarenessState, BatchConflict, CollabMessage, PresenceUser, Transfer } from "../types";
+import { openCollabSocket, type CollabSocket, type CollabTransport } from "../api/client";
 
 type Status = "idle" | "connecting" | "connected" | "disconnected";
 
+// diffDelta builds an ot.js style delta ([retain, "insert", -delete]) turning
+// `before` into `after`. Offsets are code points to match the server.
+function diffDelta(before: string, after: string): (number | string)[] {
+  const a = Array.from(before);
+  const b = Array.from(after);
+  let prefix = 0;
+  while (prefix < a.length && prefix < b.length && a[prefix] === b[prefix]) {
+    prefix++;
+  }
+  let suffix = 0;
+  while (
+    suffix < a.length - prefix &&
+    suffix < b.length - prefix &&
+    a[a.length - 1 - suffix] === b[b.length - 1 - suffix]
+  ) {
+    suffix++;
+  }
+  const delta: (number | string)[] = [];
+  if (prefix > 0) delta.push(prefix);
+  const inserted = b.slice(prefix, b.length - suffix).join("");
+  if (inserted) delta.push(inserted);
+  const deleted = a.length - prefix - suffix;
+  if (deleted > 0) delta.push(-deleted);
+  if (suffix > 0) delta.push(suffix);
+  return delta;
+}
+
 interface Params {
   tenantId: string;
   docId?: string;
@@ -11,55 +38,703 @@ interface Params {
   onRemoteContent?: (content: string) => void;
 }
 
+// applyDelta runs an ot.js style delta against content.
+function applyDelta(content: string, delta: (number | string)[]): string {
+  const chars = Array.from(content);
+  let pos = 0;
+  let out = "";
+  for (const part of delta) {
+    if (typeof part === "string") {
+      out += part;
+    } else if (part > 0) {
+      out += chars.slice(pos, pos + part).join("");
+      pos += part;
+    } else {
+      pos -= part;
+    }
+  }
+  return out;
+}
+
+// contentChecksum matches the server's document.Checksum: FNV-1a (32-bit)
+// over the UTF-8 bytes, as eight hex digits.
+function contentChecksum(content: string): string {
+  let hash = 0x811c9dc5;
+  for (const byte of utf8.encode(content)) {
+    hash ^= byte;
+    hash = Math.imul(hash, 0x01000193);
+  }
+  return (hash >>> 0).toString(16).padStart(8, "0");
+}
+
+const RECONNECT_DELAY_MS = 1000;
+const MAX_RECONNECT_DELAY_MS = 15000;
+// Messages longer than this are sent as "upload" chunks so each frame stays
+// well under the server's read limit.
+const UPLOAD_CHUNK_CHARS = 128 * 1024;
+// Each chunk counts against the server's rate limits, so chunks go out at
+// most this often rather than all at once.
+const UPLOAD_CHUNK_INTERVAL_MS = 100;
+// Awareness state expires on the server after 30s without a refresh.
+const AWARENESS_REFRESH_MS = 15000;
+const TYPING_IDLE_MS = 3000;
+// Connections that fail to open this many times in a row switch to the next
+// fallback transport.
+const TRANSPORT_FAILURES = 2;
+// The server closes with these codes when the user loses access or the
+// document is deleted; neither is worth reconnecting for.
+const CLOSE_ACCESS_REVOKED = 4403;
+const CLOSE_DOCUMENT_DELETED = 4410;
+// Edits made offline past this many are folded into the last one, keeping
+// the batch sent on reconnect well under the server's limit.
+const MAX_OFFLINE_EDITS = 200;
+// Protocol version and optional features announced in the join handshake.
+const PROTOCOL_VERSION = 1;
+const CAPABILITIES = ["awareness", "batch", "chunked_snapshots", "coalesced_updates", "replay", "undo", "upload"];
+const PING_INTERVAL_MS = 20000;
+
+const utf8 = new TextEncoder();
+
+// sendMessage serializes payload, splitting it into upload chunks when it is
+// too large for one frame. Chunks never split a surrogate pair, and stop if
+// the socket closes partway.
+function sendMessage(socket: CollabSocket, payload: object) {
+  const encoded = JSON.stringify(payload);
+  if (encoded.length <= UPLOAD_CHUNK_CHARS) {
+    socket.send(encoded);
+    return;
+  }
+  const id = crypto.randomUUID();
+  let start = 0;
+  let offset = 0;
+  const sendChunk = () => {
+    if (socket.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    let end = Math.min(start + UPLOAD_CHUNK_CHARS, encoded.length);
+    const last = encoded.charCodeAt(end - 1);
+    if (end < encoded.length && last >= 0xd800 && last <= 0xdbff) {
+      end--;
+    }
+    const data = encoded.slice(start, end);
+    socket.send(JSON.stringify({ type: "upload", upload: { id, offset, data, final: end === encoded.length } }));
+    offset += utf8.encode(data).length;
+    start = end;
+    if (start < encoded.length) {
+      setTimeout(sendChunk, UPLOAD_CHUNK_INTERVAL_MS);
+    }
+  };
+  sendChunk();
+}
+
+// OfflineBatch holds the edits made while disconnected, each a delta on the
+// content the previous one left, starting from base at baseVersion.
+interface OfflineBatch {
+  baseVersion: number;
+  base: string;
+  edits: { delta: string; seq: number; content: string }[];
+}
+
+// PendingSnapshot collects the chunks of a snapshot sent in pieces.
+interface PendingSnapshot {
+  snapshot: Extract<CollabMessage, { type: "snapshot" }>;
+  transfer: Transfer;
+  parts: string[];
+  received: number;
+  resumed: boolean;
+}
+
 export function useRealtimeCollaboration({ tenantId, docId, userId, onRemoteContent }: Params) {
   const [status, setStatus] = useState<Status>("idle");
   const [lastMessage, setLastMessage] = useState<CollabMessage | null>(null);
-  const socketRef = useRef<WebSocket | null>(null);
+  const [roster, setRoster] = useState<PresenceUser[]>([]);
+  const [peers, setPeers] = useState<Record<string, AwarenessState>>({});
+  // Set once the server reports a change to this user's access.
+  const [access, setAccess] = useState<AccessLevel | "none" | null>(null);
+  // Replay mode: history played back alongside the live document.
+  const [replay, setReplay] = useState<{ content: string; version: number; playing: boolean } | null>(null);
+  const replayRef = useRef<string>("");
+  // Set when edits made offline could not be merged; content is what this
+  // user had written.
+  const [conflict, setConflict] = useState<{ conflict: BatchConflict; content: string } | null>(null);
+  const [offlineEdits, setOfflineEdits] = useState<number>(0);
+  // Round trip to the server and how far its clock is ahead of ours, both
+  // in milliseconds, from the latest pong.
+  const [latency, setLatency] = useState<{ rtt: number; skew: number } | null>(null);
+  const awarenessRef = useRef<Record<string, unknown>>({});
+  const typingTimerRef = useRef<ReturnType<typeof setTimeout> | undefined>(undefined);
+  const socketRef = useRef<CollabSocket | null>(null);
+  const transportRef = useRef<CollabTransport>("websocket");
   const lamportRef = useRef<number>(0);
+  const versionRef = useRef<number>(0);
+  // Operations are numbered within an editing session so the server can
+  // drop resends and spot lost ones; the session outlives reconnects.
+  const sessionRef = useRef<string>(crypto.randomUUID());
+  const seqRef = useRef<number>(0);
+  const shadowRef = useRef<string>("");
+  const engineRef = useRef<string>("ot");
+  // Only one delta is in flight at a time; edits made meanwhile are queued
+  // and diffed against the acknowledged server content once it arrives.
+  const inFlightRef = useRef<boolean>(false);
+  const queuedRef = useRef<string | null>(null);
+  const pendingSnapshotRef = useRef<PendingSnapshot | null>(null);
+  // The content of the in-flight delta, resent if the server rate-limited it.
+  const sentRef = useRef<string | null>(null);
+  const rateLimitTimerRef = useRef<ReturnType<typeof setTimeout> | undefined>(undefined);
+  const retryingRef = useRef<boolean>(false);
+  // The in-flight delta and what it was built on, so it can join the
+  // offline batch if the connection drops before it is acknowledged.
+  const sentOpRef = useRef<{ delta: string; seq: number; baseVersion: number; base: string } | null>(null);
+  const offlineRef = useRef<OfflineBatch | null>(null);
+  // Set while an offline batch awaits the server's answer.
+  const batchSentRef = useRef<boolean>(false);
+  const conflictBatchRef = useRef<OfflineBatch | null>(null);
+  // Set after reporting a checksum mismatch, until the server's snapshot
+  // brings this copy back in line.
+  const divergedRef = useRef<boolean>(false);
 
-  useEffect(() => {
-    if (!docId) {
+  // recordOffline adds an edit made while disconnected to the offline batch.
+  const recordOffline = (content: string) => {
+    if (versionRef.current === 0) {
+      return;
+    }
+    const offline: OfflineBatch = offlineRef.current ?? { baseVersion: versionRef.current, base: shadowRef.current, edits: [] };
+    const edits = offline.edits;
+    const previous = edits.length > 0 ? edits[edits.length - 1].content : offline.base;
+    if (content === previous) {
       return;
     }
-    setStatus("connecting");
-    const socket = openCollabSocket({
+    if (edits.length >= MAX_OFFLINE_EDITS) {
+      const before = edits[edits.length - 2].content;
+      edits[edits.length - 1] = { ...edits[edits.length - 1], delta: JSON.stringify(diffDelta(before, content)), content };
+    } else {
+      seqRef.current += 1;
+      edits.push({ delta: JSON.stringify(diffDelta(previous, content)), seq: seqRef.current, content });
+    }
+    offlineRef.current = offline;
+    setOfflineEdits(edits.length);
+  };
+
+  // sendBatch sends the offline edits to be rebased onto the head. Updates
+  // are ignored until the answer arrives; a resume then catches up on
+  // everything, these edits included.
+  const sendBatch = (socket: CollabSocket, offline: OfflineBatch, force: boolean) => {
+    lamportRef.current += 1;
+    batchSentRef.current = true;
+    inFlightRef.current = true;
+    sendMessage(socket, {
+      type: "batch",
       tenantId,
-      docId,
+      documentId: docId,
       userId,
-      onMessage: (msg) => {
-        setLastMessage(msg);
-        if (msg.type === "snapshot" || msg.type === "update") {
-          onRemoteContent?.(msg.content);
-          lamportRef.current = msg.version;
-        }
-      },
+      baseVersion: offline.baseVersion,
+      lamport: lamportRef.current,
+      force,
+      batch: offline.edits.map(({ delta, seq }) => ({ delta, seq })),
     });
-    socketRef.current = socket;
-    socket.onopen = () => setStatus("connected");
-    socket.onclose = () => setStatus("disconnected");
-    return () => socket.close();
-  }, [tenantId, docId, userId, onRemoteContent]);
+  };
 
-  const sendOperation = (content: string) => {
-    if (!socketRef.current || socketRef.current.readyState !== WebSocket.OPEN || !docId) {
+  const flush = (content: string) => {
+    const socket = socketRef.current;
+    if (!docId) {
+      return;
+    }
+    if (!socket || socket.readyState !== WebSocket.OPEN) {
+      recordOffline(content);
+      return;
+    }
+    if (inFlightRef.current) {
+      queuedRef.current = content;
+      return;
+    }
+    if (content === shadowRef.current) {
       return;
     }
     lamportRef.current += 1;
+    seqRef.current += 1;
+    const delta = JSON.stringify(diffDelta(shadowRef.current, content));
     const payload = {
       type: "operation",
       tenantId,
       documentId: docId,
       userId,
-      newContent: content,
-      delta: "naive-full-sync",
+      // CRDT documents take whole-content writes until the editor tracks
+      // character IDs itself; the server turns them into CRDT ops. OT
+      // documents only send the delta.
+      ...(engineRef.current === "crdt"
+        ? { newContent: content, delta: "" }
+        : { delta }),
+      baseVersion: versionRef.current,
       lamport: lamportRef.current,
+      seq: seqRef.current,
     };
-    socketRef.current.send(JSON.stringify(payload));
+    inFlightRef.current = true;
+    sentRef.current = content;
+    sentOpRef.current = { delta, seq: seqRef.current, baseVersion: versionRef.current, base: shadowRef.current };
+    sendMessage(socket, payload);
+  };
+  const flushRef = useRef(flush);
+  flushRef.current = flush;
+
+  useEffect(() => {
+    if (!docId) {
+      return;
+    }
+    let closed = false;
+    let attempts = 0;
+    let failedOpens = 0;
+    let retryTimer: ReturnType<typeof setTimeout> | undefined;
+
+    const connect = (resume: boolean) => {
+      setStatus("connecting");
+      const socket = openCollabSocket({
+        tenantId,
+        docId,
+        userId,
+        session: sessionRef.current,
+        resume,
+        transport: transportRef.current,
+        onMessage: (incoming) => {
+          let msg: CollabMessage = incoming;
+          if (msg.type === "snapshot" && msg.transfer) {
+            pendingSnapshotRef.current = { snapshot: msg, transfer: msg.transfer, parts: [], received: 0, resumed: false };
+            return;
+          }
+          if (msg.type === "snapshot_chunk") {
+            const pending = pendingSnapshotRef.current;
+            if (!pending || pending.transfer.id !== msg.transfer.id || pending.received !== msg.transfer.offset) {
+              return;
+            }
+            pending.parts.push(msg.content);
+            pending.received += utf8.encode(msg.content).length;
+            if (pending.received < (pending.transfer.size ?? 0)) {
+              return;
+            }
+            pendingSnapshotRef.current = null;
+            msg = { ...pending.snapshot, content: pending.parts.join(""), transfer: undefined };
+            if (pending.resumed) {
+              // The transfer picked up after a reconnect; catch up on edits
+              // made since its version once the content is in place.
+              const version = pending.snapshot.version;
+              queueMicrotask(() =>
+                socketRef.current?.send(JSON.stringify({ type: "resume", tenantId, documentId: docId, userId, version })),
+              );
+            }
+          }
+          if (msg.type === "update" && batchSentRef.current) {
+            return;
+          }
+          setLastMessage(msg);
+          if (msg.type === "snapshot") {
+            engineRef.current = msg.engine ?? "ot";
+            setRoster(msg.roster ?? []);
+          }
+          if (msg.type === "resumed") {
+            setRoster(msg.roster ?? []);
+          }
+          if (msg.type === "snapshot" || msg.type === "resumed") {
+            setPeers(Object.fromEntries((msg.peers ?? []).map((p) => [p.clientId, p])));
+          }
+          if (msg.type === "awareness") {
+            const { clientId, userId: peerUserId, awareness } = msg;
+            setPeers((prev) => {
+              const next = { ...prev };
+              if (awareness) {
+                next[clientId] = { clientId, userId: peerUserId, state: awareness };
+              } else {
+                delete next[clientId];
+              }
+              return next;
+            });
+          }
+          if ((msg.type === "snapshot" || msg.type === "resumed") && msg.seq !== undefined) {
+            seqRef.current = msg.seq;
+          }
+          if (msg.type === "error" && msg.code === "rate_limited") {
+            // The server dropped a message, perhaps our delta. Back off, then
+            // resume to learn which of our operations it kept and resend
+            // the rest once the resumed reply arrives.
+            console.warn(`rate limited, retrying in ${msg.retryAfterMs ?? 0}ms`);
+            clearTimeout(rateLimitTimerRef.current);
+            rateLimitTimerRef.current = setTimeout(() => {
+              const socket = socketRef.current;
+              if (batchSentRef.current && offlineRef.current && socket) {
+                sendBatch(socket, offlineRef.current, false);
+                return;
+              }
+              retryingRef.current = true;
+              socketRef.current?.send(
+                JSON.stringify({ type: "resume", tenantId, documentId: docId, userId, version: versionRef.current }),
+              );
+            }, msg.retryAfterMs ?? 1000);
+          }
+          if (msg.type === "resumed" && retryingRef.current) {
+            retryingRef.current = false;
+            if (inFlightRef.current && sentRef.current !== null) {
+              inFlightRef.current = false;
+              const retry = queuedRef.current ?? sentRef.current;
+              queuedRef.current = null;
+              flushRef.current(retry);
+            }
+          }
+          if (msg.type === "error" && msg.code === "causal_base_unseen") {
+            // An earlier edit of ours never arrived; pick up the server's
+            // view of this session before sending more.
+            socketRef.current?.send(
+              JSON.stringify({ type: "resume", tenantId, documentId: docId, userId, version: versionRef.current }),
+            );
+          }
+          if (msg.type === "access") {
+            setAccess(msg.access);
+          }
+          if (msg.type === "pong") {
+            const rtt = Date.now() - msg.clientTime;
+            setLatency({ rtt, skew: msg.serverTime - (msg.clientTime + rtt / 2) });
+          }
+          if (msg.type === "joined" && msg.join.protocol !== PROTOCOL_VERSION) {
+            console.warn(`server speaks collaboration protocol ${msg.join.protocol}`);
+          }
+          if (batchSentRef.current && (msg.type === "batch_applied" || (msg.type === "error" && msg.code !== "rate_limited"))) {
+            const offline = offlineRef.current;
+            batchSentRef.current = false;
+            inFlightRef.current = false;
+            offlineRef.current = null;
+            queuedRef.current = null;
+            setOfflineEdits(0);
+            if (msg.type === "error" && msg.conflict && offline) {
+              conflictBatchRef.current = offline;
+              setConflict({ conflict: msg.conflict, content: offline.edits[offline.edits.length - 1].content });
+            } else if (msg.type === "error") {
+              console.warn(`offline edits rejected: ${msg.message}`);
+            }
+            socketRef.current?.send(
+              JSON.stringify({ type: "resume", tenantId, documentId: docId, userId, version: versionRef.current }),
+            );
+          }
+          if (msg.type === "replay_start") {
+            replayRef.current = msg.content ?? "";
+            setReplay({ content: replayRef.current, version: msg.version, playing: true });
+          }
+          if (msg.type === "replay_steps") {
+            for (const step of msg.steps) {
+              replayRef.current = applyDelta(replayRef.current, JSON.parse(step.effect || step.delta));
+            }
+            setReplay({ content: replayRef.current, version: msg.version, playing: true });
+          }
+          if (msg.type === "replay_end") {
+            setReplay((prev) => prev && { ...prev, playing: false });
+          }
+          if (msg.type === "presence") {
+            const { event, user } = msg.presence;
+            setRoster((prev) => {
+              const others = prev.filter((u) => u.userId !== user.userId);
+              return event === "leave" ? others : [...others, user];
+            });
+          }
+          // Updates only carry the operation, so a gap means our copy is
+          // stale. Ask for the missing operations (or a fresh snapshot).
+          // Coalesced updates span several versions from baseVersion.
+          const gap = msg.type === "update" && (msg.baseVersion ?? msg.version - 1) !== versionRef.current;
+          if (gap && msg.version > versionRef.current) {
+            socketRef.current?.send(
+              JSON.stringify({ type: "resume", tenantId, documentId: docId, userId, version: versionRef.current }),
+            );
+          }
+          if (!gap && (msg.type === "snapshot" || msg.type === "update")) {
+            let next: string;
+            if (msg.type === "snapshot") {
+              // Content is omitted when empty.
+              next = msg.content ?? "";
+            } else {
+              const effect = msg.operation.effect || msg.operation.delta;
+              next = applyDelta(shadowRef.current, JSON.parse(effect));
+            }
+            const checksum = msg.type === "update" && msg.checksum && !divergedRef.current ? contentChecksum(next) : "";
+            if (msg.type === "snapshot") {
+              divergedRef.current = false;
+            } else if (checksum && checksum !== msg.checksum) {
+              // Our copy drifted from the server's. Report it; the server
+              // logs the divergence and answers with a fresh snapshot.
+              divergedRef.current = true;
+              socketRef.current?.send(
+                JSON.stringify({ type: "checksum", tenantId, documentId: docId, userId, version: msg.version, checksum }),
+              );
+            }
+            onRemoteContent?.(next);
+            shadowRef.current = next;
+            // The server assigns Lamport times; snapshot versions never
+            // exceed the document's clock.
+            lamportRef.current = msg.type === "update" ? msg.operation.lamport || msg.version : msg.version;
+            versionRef.current = msg.version;
+          }
+          // Undo and redo results are ours too but answer no in-flight edit.
+          const ours =
+            msg.type === "update" &&
+            msg.message !== "replay" &&
+            !msg.operation.undoes &&
+            !msg.operation.redoes &&
+            (msg.userId === userId || (msg.authors?.includes(userId) ?? false));
+          if (ours || (msg.type === "error" && msg.code !== "rate_limited")) {
+            inFlightRef.current = false;
+            const queued = queuedRef.current;
+            queuedRef.current = null;
+            if (queued !== null) {
+              flushRef.current(queued);
+            }
+          }
+        },
+      });
+      socketRef.current = socket;
+      let opened = false;
+      socket.onopen = () => {
+        attempts = 0;
+        failedOpens = 0;
+        opened = true;
+        setStatus("connected");
+        socket.send(
+          JSON.stringify({
+            type: "join",
+            tenantId,
+            documentId: docId,
+            userId,
+            join: { protocol: PROTOCOL_VERSION, capabilities: CAPABILITIES },
+          }),
+        );
+        socket.send(JSON.stringify({ type: "ping", tenantId, documentId: docId, userId, clientTime: Date.now() }));
+        // The server dropped our awareness state with the old connection.
+        if (Object.keys(awarenessRef.current).length > 0) {
+          socket.send(
+            JSON.stringify({ type: "awareness", tenantId, documentId: docId, userId, awareness: awarenessRef.current }),
+          );
+        }
+        const pending = pendingSnapshotRef.current;
+        if (offlineRef.current) {
+          // Edits made offline are merged first; the resume follows once
+          // the server has answered.
+          sendBatch(socket, offlineRef.current, false);
+        } else if (resume && pending) {
+          // Continue the interrupted snapshot where it stopped.
+          pending.resumed = true;
+          socket.send(
+            JSON.stringify({
+              type: "snapshot_resume",
+              tenantId,
+              documentId: docId,
+              userId,
+              transfer: { id: pending.transfer.id, offset: pending.received },
+            }),
+          );
+        } else if (resume) {
+          socket.send(JSON.stringify({ type: "resume", tenantId, documentId: docId, userId, version: versionRef.current }));
+        }
+      };
+      socket.onclose = (event) => {
+        if (event.reason) {
+          console.warn(`collaboration socket closed (${event.code}): ${event.reason}`);
+        }
+        const sent = sentOpRef.current;
+        const unacknowledged = inFlightRef.current && !batchSentRef.current;
+        inFlightRef.current = false;
+        batchSentRef.current = false;
+        setRoster([]);
+        setPeers({});
+        setStatus("disconnected");
+        if (closed) {
+          return;
+        }
+        // Unacknowledged edits go out with the offline batch; the server
+        // skips any it already applied, knowing them by seq.
+        if (unacknowledged && sent && !offlineRef.current) {
+          offlineRef.current = {
+            baseVersion: sent.baseVersion,
+            base: sent.base,
+            edits: [{ delta: sent.delta, seq: sent.seq, content: sentRef.current ?? sent.base }],
+          };
+          setOfflineEdits(1);
+        }
+        if (queuedRef.current !== null) {
+          recordOffline(queuedRef.current);
+          queuedRef.current = null;
+        }
+        if (event.code === CLOSE_ACCESS_REVOKED || event.code === CLOSE_DOCUMENT_DELETED) {
+          setAccess("none");
+          return;
+        }
+        // A network that never lets the socket open probably strips
+        // websocket upgrades; fall back to an event stream, then polling.
+        if (!opened && ++failedOpens >= TRANSPORT_FAILURES && transportRef.current !== "poll") {
+          transportRef.current = transportRef.current === "websocket" ? "sse" : "poll";
+          failedOpens = 0;
+          console.warn(`collaboration falling back to ${transportRef.current}`);
+        }
+        // Reconnect and ask the server to replay what we missed.
+        const delay = Math.min(RECONNECT_DELAY_MS * 2 ** attempts, MAX_RECONNECT_DELAY_MS);
+        attempts += 1;
+        retryTimer = setTimeout(() => connect(versionRef.current > 0 || pendingSnapshotRef.current !== null), delay);
+      };
+    };
+
+    versionRef.current = 0;
+    pendingSnapshotRef.current = null;
+    offlineRef.current = null;
+    batchSentRef.current = false;
+    conflictBatchRef.current = null;
+    divergedRef.current = false;
+    setAccess(null);
+    setLatency(null);
+    setReplay(null);
+    setConflict(null);
+    setOfflineEdits(0);
+    connect(false);
+    return () => {
+      closed = true;
+      clearTimeout(retryTimer);
+      clearTimeout(rateLimitTimerRef.current);
+      socketRef.current?.close();
+    };
+  }, [tenantId, docId, userId, onRemoteContent]);
+
+  const sendOperation = (content: string) => {
+    flush(content);
+    if (!awarenessRef.current.typing) {
+      setAwareness({ typing: true });
+    }
+    clearTimeout(typingTimerRef.current);
+    typingTimerRef.current = setTimeout(() => setAwarenessRef.current({ typing: null }), TYPING_IDLE_MS);
+  };
+
+  // undo and redo ask the server to revert or restore this user's own most
+  // recent edit; the result arrives as an ordinary update.
+  const sendHistory = (type: "undo" | "redo") => {
+    const socket = socketRef.current;
+    if (!socket || socket.readyState !== WebSocket.OPEN || !docId) {
+      return;
+    }
+    socket.send(JSON.stringify({ type, tenantId, documentId: docId, userId }));
+  };
+  const undo = () => sendHistory("undo");
+
+  // setAwareness merges keys into this client's ephemeral state; null
+  // removes a key. The state is resent periodically so it outlives the
+  // server's TTL while the tab is open.
+  const setAwareness = (patch: Record<string, unknown>) => {
+    const next = { ...awarenessRef.current, ...patch };
+    for (const [key, value] of Object.entries(patch)) {
+      if (value === null) {
+        delete next[key];
+      }
+    }
+    awarenessRef.current = next;
+    const socket = socketRef.current;
+    if (socket && socket.readyState === WebSocket.OPEN && docId) {
+      socket.send(JSON.stringify({ type: "awareness", tenantId, documentId: docId, userId, awareness: patch }));
+    }
+  };
+  const setAwarenessRef = useRef(setAwareness);
+  setAwarenessRef.current = setAwareness;
+
+  useEffect(() => {
+    const timer = setInterval(() => {
+      if (Object.keys(awarenessRef.current).length > 0) {
+        setAwarenessRef.current(awarenessRef.current);
+      }
+    }, AWARENESS_REFRESH_MS);
+    return () => clearInterval(timer);
+  }, []);
+
+  useEffect(() => {
+    const timer = setInterval(() => {
+      const socket = socketRef.current;
+      if (socket && socket.readyState === WebSocket.OPEN && docId) {
+        socket.send(JSON.stringify({ type: "ping", tenantId, documentId: docId, userId, clientTime: Date.now() }));
+      }
+    }, PING_INTERVAL_MS);
+    return () => clearInterval(timer);
+  }, [tenantId, docId, userId]);
+  const redo = () => sendHistory("redo");
+
+  // startReplay plays the document's history from `from` (RFC 3339) up to
+  // now, `speed` times faster than it happened.
+  const startReplay = (from: string, speed = 1) => {
+    const socket = socketRef.current;
+    if (!socket || socket.readyState !== WebSocket.OPEN || !docId) {
+      return;
+    }
+    socket.send(JSON.stringify({ type: "replay", tenantId, documentId: docId, userId, replay: { from, speed } }));
+  };
+  // stopReplay ends playback; closeReplay also leaves replay mode.
+  const stopReplay = () => {
+    socketRef.current?.send(JSON.stringify({ type: "replay_stop", tenantId, documentId: docId, userId }));
+  };
+  const closeReplay = () => {
+    if (replay?.playing) stopReplay();
+    setReplay(null);
+  };
+
+  // Answers to a conflict over offline edits: merge them anyway where they
+  // overlap, overwrite the document with this user's version, or drop them.
+  const mergeOffline = () => {
+    const socket = socketRef.current;
+    const offline = conflictBatchRef.current;
+    if (!socket || socket.readyState !== WebSocket.OPEN || !offline) {
+      return;
+    }
+    offlineRef.current = offline;
+    conflictBatchRef.current = null;
+    setConflict(null);
+    sendBatch(socket, offline, true);
+  };
+  const keepOffline = () => {
+    if (!conflict) {
+      return;
+    }
+    conflictBatchRef.current = null;
+    setConflict(null);
+    onRemoteContent?.(conflict.content);
+    flush(conflict.content);
+  };
+  const discardOffline = () => {
+    conflictBatchRef.current = null;
+    setConflict(null);
+  };
+
+  const sendCursor = (anchor: number, head: number) => {
+    const socket = socketRef.current;
+    if (!socket || socket.readyState !== WebSocket.OPEN || !docId) {
+      return;
+    }
+    socket.send(
+      JSON.stringify({
+        type: "cursor",
+        tenantId,
+        documentId: docId,
+        userId,
+        baseVersion: versionRef.current,
+        cursor: { anchor, head },
+      }),
+    );
   };
 
   return {
     status,
     lastMessage,
+    roster,
+    peers,
+    access,
+    latency,
+    replay,
+    conflict,
+    offlineEdits,
+    mergeOffline,
+    keepOffline,
+    discardOffline,
+    startReplay,
+    stopReplay,
+    closeReplay,
+    setAwareness,
     sendOperation,
+    sendCursor,
+    undo,
+    redo,
   };
 }
@@ -35,24 +35,239 @@ export interface Doc {
   ownerId: string;
   permissions: Record<string, AccessLevel>;
   shareLinks: ShareLink[];
+  engine: "ot" | "crdt";
   version: number;
   createdAt: string;
   updatedAt: string;
+  // Users with the document open, from the tenant's live list channel.
+  editors?: number;
 }
 
+// DocumentSummary is a document list entry pushed by the tenant channel.
+export interface DocumentSummary {
+  id: string;
+  title: string;
+  ownerId: string;
+  version: number;
+  updatedAt: string;
+  // Only known to the document's room; left out otherwise.
+  editors?: number;
+  // The receiving user's level; omitted on doc_deleted.
+  access?: AccessLevel;
+}
+
+export type ListingMessage = {
+  type: "doc_created" | "doc_renamed" | "doc_updated" | "doc_deleted";
+  tenantId: string;
+  documentId: string;
+  userId?: string;
+  version: number;
+  listing: DocumentSummary;
+};
+
 export interface Operation {
   id: string;
   documentId: string;
   tenantId: string;
   userId: string;
   lamport: number;
+  version: number;
+  session?: string;
+  seq?: number;
+  undoes?: string;
+  redoes?: string;
   delta: string;
+  effect?: string;
   createdAt: string;
+  // Checksum of the content this operation produced.
+  checksum?: string;
+}
+
+// PlaybackStep is a logged operation with the pause before it, already
+// divided by the requested speed.
+export interface PlaybackStep extends Operation {
+  delayMs: number;
+}
+
+export interface PlaybackPage {
+  // The document just before the first step; first page only.
+  start?: DocumentVersion;
+  steps: PlaybackStep[];
+  // Pass as `after` for the next page; omitted on the last.
+  next?: number;
+}
+
+export interface Selection {
+  anchor: number;
+  head: number;
+}
+
+export interface CursorState {
+  clientId: string;
+  userId: string;
+  selection: Selection;
+}
+
+// AwarenessState is a client's ephemeral state (typing, viewport, ...).
+// The server forgets it when the client leaves or stops refreshing it.
+export interface AwarenessState {
+  clientId: string;
+  userId: string;
+  state: Record<string, unknown>;
+}
+
+export interface PresenceUser {
+  userId: string;
+  displayName: string;
+  color: string;
+  connections: number;
+  state: "active" | "idle";
+  lastActive: string;
+  avatarUrl?: string;
+}
+
+export interface PresenceEvent {
+  event: "join" | "leave" | "state";
+  user: PresenceUser;
+}
+
+// Transfer identifies a chunked snapshot; offset and size count UTF-8 bytes.
+export interface Transfer {
+  id: string;
+  offset: number;
+  size?: number;
+}
+
+// BatchConflict explains why edits made offline were not merged: the log no
+// longer reaches their base, or they change text others changed meanwhile.
+export interface BatchConflict {
+  reason: "history_unavailable" | "overlap";
+  baseVersion: number;
+  headVersion: number;
+  // index is the position of the offline edit in the batch.
+  overlaps?: { index: number; version: number; userId: string }[];
 }
 
 export type CollabMessage =
-  | { type: "snapshot"; tenantId: string; documentId: string; version: number; content: string }
-  | { type: "update"; tenantId: string; documentId: string; userId: string; version: number; content: string }
-  | { type: "presence"; tenantId: string; documentId: string; userId: string; message: string }
-  | { type: "ack"; tenantId: string; documentId: string; userId: string; message: string }
-  | { type: "error"; tenantId: string; documentId: string; userId: string; message: string };
+  | {
+      type: "snapshot";
+      tenantId: string;
+      documentId: string;
+      version: number;
+      content: string;
+      engine?: "ot" | "crdt";
+      state?: string;
+      clientId: string;
+      cursors?: CursorState[];
+      roster?: PresenceUser[];
+      // Last operation the server accepted from this editing session.
+      seq?: number;
+      peers?: AwarenessState[];
+      // Set when the content is too large for one frame and follows in
+      // snapshot_chunk messages.
+      transfer?: Transfer;
+      // FNV-1a (32-bit) hash of the UTF-8 content, as eight hex digits.
+      checksum?: string;
+    }
+  | {
+      type: "snapshot_chunk";
+      tenantId: string;
+      documentId: string;
+      version: number;
+      content: string;
+      transfer: Transfer;
+    }
+  | {
+      type: "cursor";
+      tenantId: string;
+      documentId: string;
+      userId: string;
+      clientId: string;
+      version: number;
+      cursor?: Selection;
+    }
+  | {
+      type: "update";
+      tenantId: string;
+      documentId: string;
+      userId: string;
+      version: number;
+      // Set on coalesced updates, whose operation spans baseVersion+1..version.
+      baseVersion?: number;
+      authors?: string[];
+      operation: Operation;
+      versioned?: DocumentVersion;
+      message?: string;
+      // Checksum of the content at version, when known.
+      checksum?: string;
+    }
+  | {
+      type: "resumed";
+      tenantId: string;
+      documentId: string;
+      version: number;
+      cursors?: CursorState[];
+      roster?: PresenceUser[];
+      seq?: number;
+      peers?: AwarenessState[];
+    }
+  | { type: "presence"; tenantId: string; documentId: string; userId: string; presence: PresenceEvent }
+  | {
+      type: "awareness";
+      tenantId: string;
+      documentId: string;
+      userId: string;
+      clientId: string;
+      // Omitted once the client's state was dropped.
+      awareness?: Record<string, unknown>;
+    }
+  // Answer to "join": the protocol version and optional features agreed on.
+  | {
+      type: "joined";
+      tenantId: string;
+      documentId: string;
+      userId: string;
+      clientId: string;
+      serverTime: number;
+      join: { protocol: number; capabilities: string[] };
+    }
+  // Answer to "ping"; clientTime echoes the ping's, both in Unix milliseconds.
+  | { type: "pong"; tenantId: string; documentId: string; userId: string; clientTime: number; serverTime: number }
+  | { type: "title"; tenantId: string; documentId: string; userId: string; version: number; title: string }
+  | {
+      type: "permission";
+      tenantId: string;
+      documentId: string;
+      userId: string;
+      version: number;
+      // level is omitted when subjectId's access was revoked.
+      permission: { subjectId?: string; level?: AccessLevel; shareLink?: boolean };
+    }
+  // Replay mode: the content to start from, then batches of steps to apply
+  // to it in order, then the end (message is "stopped" when cut short).
+  | { type: "replay_start"; tenantId: string; documentId: string; userId: string; version: number; content?: string }
+  | { type: "replay_steps"; tenantId: string; documentId: string; userId: string; version: number; steps: PlaybackStep[] }
+  | { type: "replay_end"; tenantId: string; documentId: string; userId: string; message?: string }
+  // Every edit of a "batch" this client sent is in; seq is the last one.
+  | {
+      type: "batch_applied";
+      tenantId: string;
+      documentId: string;
+      userId: string;
+      version: number;
+      baseVersion: number;
+      seq?: number;
+    }
+  // This client's own access level changed.
+  | { type: "access"; tenantId: string; documentId: string; userId: string; clientId: string; access: AccessLevel }
+  | {
+      type: "error";
+      tenantId: string;
+      documentId: string;
+      userId: string;
+      code?: string;
+      message: string;
+      retryAfterMs?: number;
+      // Set on batch_conflict errors.
+      conflict?: BatchConflict;
+    };